@@ -0,0 +1,118 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	crdclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	crdinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	componentbaseconfig "k8s.io/component-base/config"
+
+	"github.com/jijiechen/external-crd/pkg/controllers/envoy"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// envoyXDSOptions holds the flags of the envoy xds generator
+type envoyXDSOptions struct {
+	kubeconfig         string
+	systemNamespace    string
+	outputDir          string
+	exposurePolicyFile string
+	baseHost           string
+
+	hostAPIServer envoy.Upstream
+	overlay       envoy.Upstream
+}
+
+// NewEnvoyXDSCmd creates the command to generate the dynamic configuration of the Envoy apiserver proxy
+func NewEnvoyXDSCmd(ctx context.Context) *cobra.Command {
+	opts := &envoyXDSOptions{
+		systemNamespace: utils.KcrdSystemNamespace,
+		outputDir:       "/etc/envoy/dynamic",
+		baseHost:        utils.DefaultProxyBaseHost,
+		hostAPIServer:   envoy.Upstream{Host: os.Getenv("KUBERNETES_SERVICE_HOST"), Port: 443},
+		overlay:         envoy.Upstream{Host: fmt.Sprintf("%s.%s.svc", utils.ExternalCrdAppName, utils.KcrdSystemNamespace), Port: 443},
+	}
+	if host := os.Getenv("PROXY_APISERVER_BASE_HOST"); len(host) > 0 {
+		opts.baseHost = host
+	}
+	if port, err := strconv.Atoi(os.Getenv("KUBERNETES_SERVICE_PORT")); err == nil {
+		opts.hostAPIServer.Port = port
+	}
+
+	cmd := &cobra.Command{
+		Use:   "envoy-xds",
+		Short: "Generate the dynamic CDS, RDS and LDS files of the Envoy apiserver proxy on changes of tenants, CRDs and serving certificates",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(opts.hostAPIServer.Host) == 0 {
+				return fmt.Errorf("please specify the apiserver where external-crd runs with --host-apiserver-host")
+			}
+			if info, err := os.Stat(opts.outputDir); err != nil || !info.IsDir() {
+				return fmt.Errorf("output directory %q is not found", opts.outputDir)
+			}
+
+			config, err := utils.LoadsKubeConfig(&componentbaseconfig.ClientConnectionConfiguration{Kubeconfig: opts.kubeconfig})
+			if err != nil {
+				return err
+			}
+			kubeClient, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				return err
+			}
+			crdClient, err := crdclientset.NewForConfig(config)
+			if err != nil {
+				return err
+			}
+
+			informerFactory := informers.NewSharedInformerFactoryWithOptions(kubeClient, utils.DefaultResync,
+				informers.WithNamespace(opts.systemNamespace))
+			crdInformerFactory := crdinformers.NewSharedInformerFactory(crdClient, utils.DefaultResync)
+			generator, err := envoy.NewXDSGenerator(informerFactory.Core().V1().ConfigMaps(), informerFactory.Core().V1().Secrets(),
+				crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions(), opts.systemNamespace, opts.outputDir,
+				opts.exposurePolicyFile, opts.baseHost, opts.hostAPIServer, opts.overlay)
+			if err != nil {
+				return err
+			}
+
+			informerFactory.Start(ctx.Done())
+			crdInformerFactory.Start(ctx.Done())
+			generator.Run(ctx.Done())
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&opts.kubeconfig, "kubeconfig", opts.kubeconfig, "Path to a kubeconfig file pointing at the cluster where external-crd runs. Only required if out-of-cluster.")
+	flags.StringVar(&opts.systemNamespace, "system-namespace", opts.systemNamespace, "The namespace holding the tenant registrations and tokens")
+	flags.StringVar(&opts.outputDir, "output-dir", opts.outputDir, "The directory of the dynamic CDS, RDS and LDS files read by Envoy")
+	flags.StringVar(&opts.baseHost, "proxy-base-host", opts.baseHost, "The base domain of the apiserver proxy, tenants are served at <namespace>-<cluster>.<base>")
+	flags.StringVar(&opts.exposurePolicyFile, "crd-exposure-policy-file", opts.exposurePolicyFile, "The YAML file of the policy deciding which CRDs are exposed to tenants, the same one as external-crd uses. All CRDs are exposed if empty")
+	flags.StringVar(&opts.hostAPIServer.Host, "host-apiserver-host", opts.hostAPIServer.Host, "The host of the apiserver where external-crd runs, which serves the root discovery documents")
+	flags.IntVar(&opts.hostAPIServer.Port, "host-apiserver-port", opts.hostAPIServer.Port, "The port of the apiserver where external-crd runs")
+	flags.StringVar(&opts.overlay.Host, "overlay-host", opts.overlay.Host, "The host of external-crd")
+	flags.IntVar(&opts.overlay.Port, "overlay-port", opts.overlay.Port, "The port of external-crd")
+	return cmd
+}
@@ -97,5 +97,9 @@ func NewExternalCrdServerCmd(ctx context.Context) *cobra.Command {
 	opts.AddFlags(flags)
 	utilfeature.DefaultMutableFeatureGate.AddFlag(flags)
 
+	cmd.AddCommand(NewTenantCmd(ctx))
+	cmd.AddCommand(NewStorageCmd(ctx))
+	cmd.AddCommand(NewProxyCmd(ctx))
+	cmd.AddCommand(NewEnvoyXDSCmd(ctx))
 	return cmd
 }
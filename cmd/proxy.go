@@ -0,0 +1,59 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/proxy"
+)
+
+// NewProxyCmd creates the command to run the front proxy of tenants
+func NewProxyCmd(ctx context.Context) *cobra.Command {
+	opts := proxy.NewOptions()
+	if host := os.Getenv("PROXY_APISERVER_BASE_HOST"); len(host) > 0 {
+		opts.BaseHost = host
+	}
+
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Run the front proxy of tenants, routing their requests to external-crd or their business clusters",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := opts.Validate(); err != nil {
+				return err
+			}
+			cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+				klog.V(1).Infof("FLAG: --%s=%q", flag.Name, flag.Value)
+			})
+
+			p, err := proxy.NewProxy(opts)
+			if err != nil {
+				return err
+			}
+			return p.Run(ctx)
+		},
+	}
+	opts.AddFlags(cmd.Flags())
+	return cmd
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	componentbaseconfig "k8s.io/component-base/config"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/controllers/tenant"
+	kcrdclientset "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// storageOptions holds the flags shared by all storage subcommands
+type storageOptions struct {
+	kubeconfig        string
+	reservedNamespace string
+}
+
+func (o *storageOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.kubeconfig, "kubeconfig", o.kubeconfig, "Path to a kubeconfig file pointing at the cluster where external-crd stores Manifests. Only required if out-of-cluster.")
+	fs.StringVar(&o.reservedNamespace, "reserved-namespace", o.reservedNamespace, "The namespace external-crd creates Manifests in, as given to its --reserved-namespace")
+}
+
+func (o *storageOptions) restConfig() (*rest.Config, error) {
+	return utils.LoadsKubeConfig(&componentbaseconfig.ClientConnectionConfiguration{Kubeconfig: o.kubeconfig})
+}
+
+// NewStorageCmd creates the command to maintain the Manifests stored by external-crd
+func NewStorageCmd(ctx context.Context) *cobra.Command {
+	opts := &storageOptions{
+		reservedNamespace: utils.KcrdReservedNamespace,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "storage",
+		Short: "Maintain the Manifests where overlay objects of tenants are stored",
+	}
+	opts.addFlags(cmd.PersistentFlags())
+
+	cmd.AddCommand(newStorageMigrateCmd(ctx, opts))
+	return cmd
+}
+
+func newStorageMigrateCmd(ctx context.Context, opts *storageOptions) *cobra.Command {
+	var fromShards, shards int
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Move Manifests across reserved namespaces after --reserved-namespace-shards is changed",
+		Long: "Move Manifests across reserved namespaces after --reserved-namespace-shards is changed. " +
+			"Please stop external-crd before migrating, and start it with the new --reserved-namespace-shards afterwards. " +
+			"Overlay objects get new uids and resource versions once their Manifests are moved. " +
+			"Manifests with owner references cannot be moved, and copies conflicting with the Manifests to move fail the migration.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if fromShards < 0 || shards < 0 {
+				return fmt.Errorf("--from-shards and --shards must not be negative")
+			}
+			config, err := opts.restConfig()
+			if err != nil {
+				return err
+			}
+			kubeClient, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				return err
+			}
+			kcrdClient, err := kcrdclientset.NewForConfig(config)
+			if err != nil {
+				return err
+			}
+
+			from := utils.NewReservedNamespaces(opts.reservedNamespace, fromShards)
+			to := utils.NewReservedNamespaces(opts.reservedNamespace, shards)
+			if !dryRun {
+				if err := tenant.EnsureReservedNamespaces(ctx, kubeClient, to); err != nil {
+					return err
+				}
+			}
+			moved, err := tenant.MigrateManifests(ctx, kcrdClient, from, to, dryRun)
+			if err != nil {
+				return err
+			}
+			if dryRun {
+				klog.Infof("%d Manifests would be moved", moved)
+				return nil
+			}
+			klog.Infof("%d Manifests are moved", moved)
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&fromShards, "from-shards", fromShards, "The --reserved-namespace-shards Manifests are currently stored with, 0 for the single --reserved-namespace")
+	cmd.Flags().IntVar(&shards, "shards", shards, "The --reserved-namespace-shards to store Manifests with, 0 for the single --reserved-namespace")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", dryRun, "Only report the Manifests to be moved")
+	return cmd
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	componentbaseconfig "k8s.io/component-base/config"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// tenantOptions holds the flags shared by all tenant subcommands
+type tenantOptions struct {
+	kubeconfig      string
+	systemNamespace string
+
+	proxyBaseHost         string
+	proxyCAFile           string
+	insecureSkipTLSVerify bool
+	output                string
+}
+
+func (o *tenantOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.kubeconfig, "kubeconfig", o.kubeconfig, "Path to a kubeconfig file pointing at the cluster where external-crd runs. Only required if out-of-cluster.")
+	fs.StringVar(&o.systemNamespace, "system-namespace", o.systemNamespace, "The namespace where external-crd and the apiserver proxy run")
+}
+
+func (o *tenantOptions) addKubeConfigFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.proxyBaseHost, "proxy-base-host", o.proxyBaseHost, "The base domain of the apiserver proxy, tenants are served at <namespace>-<cluster>.<base>")
+	fs.StringVar(&o.proxyCAFile, "proxy-ca-file", o.proxyCAFile, "Path to the CA bundle of the apiserver proxy to embed in the generated kubeconfig, defaults to the CA managed by external-crd")
+	fs.BoolVar(&o.insecureSkipTLSVerify, "insecure-skip-tls-verify", o.insecureSkipTLSVerify, "Generate a kubeconfig that does not verify the apiserver proxy, if no CA bundle is given or managed by external-crd")
+	fs.StringVarP(&o.output, "output", "o", o.output, "Path to write the generated kubeconfig to, defaults to <cluster>-<namespace>.kubeconfig")
+}
+
+func (o *tenantOptions) onboarder() (*business.Onboarder, error) {
+	config, err := utils.LoadsKubeConfig(&componentbaseconfig.ClientConnectionConfiguration{Kubeconfig: o.kubeconfig})
+	if err != nil {
+		return nil, err
+	}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return business.NewOnboarder(kubeClient, o.systemNamespace), nil
+}
+
+// proxyCA returns the CA bundle of the apiserver proxy, read from --proxy-ca-file or the CA managed by external-crd
+func (o *tenantOptions) proxyCA(ctx context.Context, onboarder *business.Onboarder) ([]byte, error) {
+	if len(o.proxyCAFile) > 0 {
+		return ioutil.ReadFile(o.proxyCAFile)
+	}
+	ca, err := onboarder.ProxyCA(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(ca) == 0 && !o.insecureSkipTLSVerify {
+		return nil, fmt.Errorf("the CA of the apiserver proxy is not generated by external-crd yet, " +
+			"please specify one with --proxy-ca-file, or use --insecure-skip-tls-verify")
+	}
+	return ca, nil
+}
+
+func (o *tenantOptions) writeKubeConfig(ctx context.Context, onboarder *business.Onboarder, registration *business.Registration) error {
+	proxyCA, err := o.proxyCA(ctx, onboarder)
+	if err != nil {
+		return err
+	}
+
+	output := o.output
+	if len(output) == 0 {
+		output = fmt.Sprintf("./%s-%s.kubeconfig", registration.ClusterID, registration.Namespace)
+	}
+	config := business.KubeConfigFor(registration, o.proxyBaseHost, proxyCA)
+	if output == "-" {
+		data, err := clientcmd.Write(*config)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := clientcmd.WriteToFile(*config, output); err != nil {
+		return err
+	}
+	fmt.Printf("Please get your kubeconfig from:\n%s\n", output)
+	return nil
+}
+
+// NewTenantCmd creates the command to manage tenants
+func NewTenantCmd(ctx context.Context) *cobra.Command {
+	opts := &tenantOptions{
+		systemNamespace: utils.KcrdSystemNamespace,
+		proxyBaseHost:   utils.DefaultProxyBaseHost,
+	}
+	if host := os.Getenv("PROXY_APISERVER_BASE_HOST"); len(host) > 0 {
+		opts.proxyBaseHost = host
+	}
+
+	cmd := &cobra.Command{
+		Use:   "tenant",
+		Short: "Manage tenants, each of which is a namespace in a business cluster",
+	}
+	opts.addFlags(cmd.PersistentFlags())
+
+	cmd.AddCommand(newTenantCreateCmd(ctx, opts))
+	cmd.AddCommand(newTenantDeleteCmd(ctx, opts))
+	cmd.AddCommand(newTenantListCmd(ctx, opts))
+	cmd.AddCommand(newTenantKubeConfigCmd(ctx, opts))
+	return cmd
+}
+
+func newTenantCreateCmd(ctx context.Context, opts *tenantOptions) *cobra.Command {
+	var businessKubeconfig string
+	var businessInsecureSkipTLSVerify bool
+	cmd := &cobra.Command{
+		Use:   "create <cluster-id> <namespace>",
+		Short: "Onboard a tenant and generate its kubeconfig",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(businessKubeconfig) == 0 {
+				return fmt.Errorf("please specify the kubeconfig of the business cluster with --business-kubeconfig")
+			}
+			businessConfig, err := business.LoadBusinessKubeConfig(businessKubeconfig)
+			if err != nil {
+				return err
+			}
+
+			onboarder, err := opts.onboarder()
+			if err != nil {
+				return err
+			}
+			registration, err := onboarder.Create(ctx, args[0], args[1], businessConfig, businessInsecureSkipTLSVerify)
+			if err != nil {
+				return err
+			}
+			klog.Infof("tenant %s is onboarded", utils.TenantKey(args[0], args[1]))
+			return opts.writeKubeConfig(ctx, onboarder, registration)
+		},
+	}
+	cmd.Flags().StringVar(&businessKubeconfig, "business-kubeconfig", businessKubeconfig, "Path to the kubeconfig of the business cluster, using either a token or a client certificate")
+	cmd.Flags().BoolVar(&businessInsecureSkipTLSVerify, "business-insecure-skip-tls-verify", businessInsecureSkipTLSVerify, "Register the business cluster without verifying its apiserver, if no CA bundle is found in --business-kubeconfig")
+	opts.addKubeConfigFlags(cmd.Flags())
+	return cmd
+}
+
+func newTenantDeleteCmd(ctx context.Context, opts *tenantOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete <cluster-id> <namespace>",
+		Short: "Offboard a tenant",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			onboarder, err := opts.onboarder()
+			if err != nil {
+				return err
+			}
+			if err := onboarder.Delete(ctx, args[0], args[1]); err != nil {
+				return err
+			}
+			klog.Infof("tenant %s is offboarded", utils.TenantKey(args[0], args[1]))
+			return nil
+		},
+	}
+}
+
+func newTenantListCmd(ctx context.Context, opts *tenantOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List tenants",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			onboarder, err := opts.onboarder()
+			if err != nil {
+				return err
+			}
+			tenants, err := onboarder.List(ctx)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "CLUSTER\tNAMESPACE\tSERVICEACCOUNT\tREGISTERED")
+			for _, tenant := range tenants {
+				sa := tenant.ServiceAccount
+				if len(sa) == 0 {
+					sa = "<none>"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", tenant.ClusterID, tenant.Namespace, sa, tenant.Registered)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newTenantKubeConfigCmd(ctx context.Context, opts *tenantOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "kubeconfig <cluster-id> <namespace>",
+		Short: "Generate the kubeconfig of an onboarded tenant",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			onboarder, err := opts.onboarder()
+			if err != nil {
+				return err
+			}
+			registration, err := onboarder.Get(ctx, args[0], args[1])
+			if err != nil {
+				return err
+			}
+			return opts.writeKubeConfig(ctx, onboarder, registration)
+		},
+	}
+	opts.addKubeConfigFlags(cmd.Flags())
+	return cmd
+}
@@ -10,6 +10,7 @@ PROXY_APISERVER_HOST=${PROXY_APISERVER_BASE_HOST:-kube-api-server.external-crd.c
 mkdir -p /tmp/working
 trap "rm -rf /tmp/working" EXIT TERM
 
+# the fallback serving certificate, tenants are served with the certificates issued by external-crd once they are listed in lds.yaml
 echo "Generating server certificate..."
 SCRIPT_PATH="$( cd "$(dirname "$0")" >/dev/null 2>&1 ; pwd -P )"
 (cd /tmp/working && $SCRIPT_PATH/certs/gen-server.sh $PROXY_APISERVER_HOST)
@@ -27,13 +28,32 @@ export BUSINESS_APISERVER_PORT="${KUBERNETES_SERVICE_PORT}"
 DELIMITER
 (source /tmp/working/env && cat ./etc-envoy/dynamic/cds-tmpl.yaml | envsubst >> /etc/envoy/dynamic/cds.yaml)
 
+# external-crd serves overlay resources under their original group paths, route to it directly
+rm -f /tmp/working/env
+cat << DELIMITER > /tmp/working/env
+export BUSINESS_CLUSTER="external-crd"
+export BUSINESS_NAMESPACE="builtin.crdserver"
+export BUSINESS_APISERVER_HOST="${EXTERNAL_CRD_SERVICE_HOST:-external-crd.external-crd-system.svc}"
+export BUSINESS_APISERVER_PORT="${EXTERNAL_CRD_SERVICE_PORT:-443}"
+DELIMITER
+(source /tmp/working/env && cat ./etc-envoy/dynamic/cds-tmpl.yaml | envsubst >> /etc/envoy/dynamic/cds.yaml)
+
 for FILE in $(ls -1 /etc/business/*.json); do
   BUSINESS_CLUSTER=$(cat $FILE | ./jq -r '.clusterId')
   BUSINESS_NAMESPACE=$(cat $FILE | ./jq -r '.namespace')
   BUSINESS_APISERVER_HOST=$(cat $FILE | ./jq -r '.apiserver.host')
   BUSINESS_APISERVER_PORT=$(cat $FILE | ./jq -r '.apiserver.httpsPort')
   BUSINESS_APISERVER_TOKEN=$(cat $FILE | ./jq -r '.apiserver.token')
-  BUSINESS_CRDSERVER_TOKEN=$(cat $FILE | ./jq -r '.externalCrdSAToken')
+  BUSINESS_CRDSERVER_TOKEN=$(cat $FILE | ./jq -r '.externalCrdSAToken // empty')
+  # tokens minted and rotated by external-crd
+  TOKEN_FILE="/etc/business-tokens/${BUSINESS_NAMESPACE}-${BUSINESS_CLUSTER}.token"
+  if [ -f "$TOKEN_FILE" ]; then
+    BUSINESS_CRDSERVER_TOKEN=$(cat $TOKEN_FILE)
+  fi
+  if [ -z "$BUSINESS_CRDSERVER_TOKEN" ]; then
+    echo "No token found for ${BUSINESS_NAMESPACE}-${BUSINESS_CLUSTER}, skipping."
+    continue
+  fi
 
   rm -f /tmp/working/env
 cat << DELIMITER > /tmp/working/env
@@ -49,5 +69,5 @@ DELIMITER
   (source /tmp/working/env && cat ./etc-envoy/dynamic/rds-tmpl.yaml | envsubst >> /etc/envoy/dynamic/rds.yaml)
 done
 echo "Done."
-# todo: watch configmap & generate cds.yaml & rds.yaml
+# cds.yaml & rds.yaml are regenerated on changes by "external-crd envoy-xds", see manifests/install/apiserver-proxy-envoy.yaml
 
@@ -66,6 +66,52 @@ type OverlayServerOptions struct {
 	// default namespace to create Manifest in
 	// default to be "clusternet-reserved"
 	ReservedNamespace string
+	// number of the namespaces "<ReservedNamespace>-<shard>" to shard Manifests across by tenant,
+	// 0 to keep them all in ReservedNamespace
+	ReservedNamespaceShards int
+
+	// how long the manifests of an offboarded tenant are kept before being deleted
+	TenantGCGracePeriod time.Duration
+	// directory to archive the manifests of an offboarded tenant to before deletion, empty to disable archiving.
+	// Archives are written by the elected leader to its local filesystem, so the directory should be a mount of a
+	// PersistentVolume shared by all the replicas, or archives are lost with the pod.
+	TenantArchiveDir string
+
+	// interval to mirror tenant namespaces from business clusters, 0 (the default) to disable
+	NamespaceSyncPeriod time.Duration
+
+	// audiences of the tokens minted for tenant identities, empty for the audiences of the 'core' kubernetes server
+	TenantTokenAudiences []string
+	// lifetime of the tokens minted for tenant identities
+	TenantTokenExpiration time.Duration
+	// name of the apiserver proxy Deployment to restart after tokens are rotated, only needed for the Envoy proxy
+	// configured once by its init container
+	ProxyDeployment string
+
+	// base domain of the apiserver proxy to issue serving certificates for, empty to disable issuing
+	ProxyBaseHost string
+	// whether to issue a wildcard serving certificate for the apiserver proxy, instead of one for each tenant
+	ProxyWildcardServingCert bool
+	// lifetime of the serving certificates issued for the apiserver proxy
+	ProxyServingCertValidity time.Duration
+
+	// file of the policy deciding which CRDs are exposed to tenants, empty to expose all
+	CRDExposurePolicyFile string
+
+	// where CRDs are read from, either utils.CRDSourceHost or utils.CRDSourceTenant
+	CRDSource string
+	// directory of the CRD bundles of tenants, named "<namespace>-<cluster>.yaml", used when CRDs come from tenants
+	TenantCRDBundleDir string
+	// interval to reload the CRDs of tenants
+	TenantCRDSyncPeriod time.Duration
+	// whether tenants can register their own CRDs in their overlay views
+	EnableVirtualCRDs bool
+	// built-in resources served to tenants under overlay group besides namespaces, in the form of "<resource>.<group>".
+	// They are stored as plain Manifests like custom resources, so none is served by default.
+	OverlayBuiltinResources []string
+	// number of the recent Manifest events kept for tenant watches to resume from, 0 to watch the host cluster for
+	// each tenant watch
+	WatchCacheSize int
 
 	RecommendedOptions *genericoptions.RecommendedOptions
 
@@ -84,10 +130,17 @@ func NewOverlayServerOptions() (*OverlayServerOptions, error) {
 	//controllerOpts.ClientConnection.Burst = int32(rest.DefaultBurst * 10)
 
 	return &OverlayServerOptions{
-		RecommendedOptions:     genericoptions.NewRecommendedOptions("fake", nil),
-		AnonymousAuthSupported: true,
-		ReservedNamespace:      utils.KcrdReservedNamespace,
-		ControllerOptions:      controllerOpts,
+		RecommendedOptions:       genericoptions.NewRecommendedOptions("fake", nil),
+		AnonymousAuthSupported:   true,
+		ReservedNamespace:        utils.KcrdReservedNamespace,
+		TenantGCGracePeriod:      utils.DefaultTenantGCGracePeriod,
+		TenantTokenExpiration:    utils.DefaultTenantTokenExpiration,
+		ProxyBaseHost:            utils.DefaultProxyBaseHost,
+		ProxyServingCertValidity: utils.DefaultProxyServingCertValidity,
+		CRDSource:                utils.CRDSourceHost,
+		TenantCRDSyncPeriod:      utils.DefaultTenantCRDSyncPeriod,
+		WatchCacheSize:           utils.DefaultWatchCacheSize,
+		ControllerOptions:        controllerOpts,
 	}, nil
 }
 
@@ -95,6 +148,30 @@ func NewOverlayServerOptions() (*OverlayServerOptions, error) {
 func (o *OverlayServerOptions) Validate() error {
 	errors := []error{}
 	errors = append(errors, o.validateRecommendedOptions()...)
+	if o.TenantGCGracePeriod < 0 {
+		errors = append(errors, fmt.Errorf("--tenant-gc-grace-period must not be negative"))
+	}
+	if o.NamespaceSyncPeriod < 0 {
+		errors = append(errors, fmt.Errorf("--namespace-sync-period must not be negative"))
+	}
+	if o.TenantTokenExpiration < 10*time.Minute {
+		errors = append(errors, fmt.Errorf("--tenant-token-expiration must be at least 10m"))
+	}
+	if o.ProxyServingCertValidity < time.Hour {
+		errors = append(errors, fmt.Errorf("--proxy-serving-cert-validity must be at least 1h"))
+	}
+	if o.CRDSource != utils.CRDSourceHost && o.CRDSource != utils.CRDSourceTenant {
+		errors = append(errors, fmt.Errorf("--crd-source must be either %q or %q", utils.CRDSourceHost, utils.CRDSourceTenant))
+	}
+	if o.TenantCRDSyncPeriod <= 0 {
+		errors = append(errors, fmt.Errorf("--tenant-crd-sync-period must be positive"))
+	}
+	if o.WatchCacheSize < 0 {
+		errors = append(errors, fmt.Errorf("--watch-cache-size must not be negative"))
+	}
+	if o.ReservedNamespaceShards < 0 {
+		errors = append(errors, fmt.Errorf("--reserved-namespace-shards must not be negative"))
+	}
 	return utilerrors.NewAggregate(errors)
 }
 
@@ -144,7 +221,12 @@ func (o *OverlayServerOptions) Config() (*Config, error) {
 
 	config := &Config{
 		GenericConfig: serverConfig,
-		ExtraConfig:   ExtraConfig{},
+		ExtraConfig: ExtraConfig{
+			CRDExposurePolicyFile: o.CRDExposurePolicyFile,
+			EnableVirtualCRDs:     o.EnableVirtualCRDs,
+			BuiltinResources:      o.OverlayBuiltinResources,
+			WatchCacheSize:        o.WatchCacheSize,
+		},
 	}
 	return config, nil
 }
@@ -156,6 +238,27 @@ func (o *OverlayServerOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.BoolVar(&o.TunnelLogging, "enable-tunnel-logging", o.TunnelLogging, "Enable tunnel logging")
 	fs.BoolVar(&o.AnonymousAuthSupported, "anonymous-auth-supported", o.AnonymousAuthSupported, "Whether the anonymous access is allowed by the 'core' kubernetes server")
 	fs.StringVar(&o.ReservedNamespace, "reserved-namespace", o.ReservedNamespace, "The default namespace to create Manifest in")
+	fs.IntVar(&o.ReservedNamespaceShards, "reserved-namespace-shards", o.ReservedNamespaceShards, "Number of the namespaces \"<reserved-namespace>-<shard>\" to shard Manifests across by tenant, which are created if missing. All Manifests are kept in --reserved-namespace if 0. Existing Manifests are moved with \"external-crd storage migrate\" after this is changed")
+	fs.DurationVar(&o.TenantGCGracePeriod, "tenant-gc-grace-period", o.TenantGCGracePeriod, "How long the manifests of an offboarded tenant are kept before being deleted")
+	fs.DurationVar(&o.NamespaceSyncPeriod, "namespace-sync-period", o.NamespaceSyncPeriod, "Interval to mirror tenant namespaces from business clusters, such as 1m. "+
+		"Syncing is disabled if 0, the default, as the objects of tenants are deleted along with their namespaces in business clusters")
+	fs.StringSliceVar(&o.TenantTokenAudiences, "tenant-token-audiences", o.TenantTokenAudiences, "Audiences of the tokens minted for tenant identities. Defaults to the audiences of the 'core' kubernetes server")
+	fs.DurationVar(&o.TenantTokenExpiration, "tenant-token-expiration", o.TenantTokenExpiration, "Lifetime of the tokens minted for tenant identities, which are refreshed before expiry")
+	fs.StringVar(&o.ProxyDeployment, "proxy-deployment", o.ProxyDeployment, "Name of the apiserver proxy Deployment in the system namespace to restart after tokens are rotated, which restarts all the proxy pods and drops the watches of tenants. Only needed for the Envoy proxy configured once by its init container, as the Go proxy and the Envoy proxy fed by \"external-crd envoy-xds\" reload tokens on the fly. Restarting is disabled if empty")
+	fs.StringVar(&o.ProxyBaseHost, "proxy-base-host", o.ProxyBaseHost, "The base domain of the apiserver proxy, tenants are served at <namespace>-<cluster>.<base>. Serving certificates are issued for the proxy unless empty")
+	fs.BoolVar(&o.ProxyWildcardServingCert, "proxy-wildcard-serving-cert", o.ProxyWildcardServingCert, "Issue one wildcard serving certificate for *.<base> instead of one for each tenant")
+	fs.DurationVar(&o.ProxyServingCertValidity, "proxy-serving-cert-validity", o.ProxyServingCertValidity, "Lifetime of the serving certificates issued for the apiserver proxy, which are reissued before expiry")
+	fs.StringVar(&o.CRDExposurePolicyFile, "crd-exposure-policy-file", o.CRDExposurePolicyFile, "The YAML file of the policy deciding which CRDs are exposed to tenants by group, kind, labels and annotations. It is reloaded on changes. All CRDs are exposed if empty")
+	fs.StringVar(&o.CRDSource, "crd-source", o.CRDSource, "Where CRDs are read from. With \"host\", CRDs installed in the 'core' kubernetes server are served to all the tenants. With \"tenant\", each tenant is served with its own CRDs, read from its bundle in --tenant-crd-bundle-dir or from its business cluster")
+	fs.StringVar(&o.TenantCRDBundleDir, "tenant-crd-bundle-dir", o.TenantCRDBundleDir, "The directory of the CRD bundles of tenants, named \"<namespace>-<cluster>.yaml\". Tenants without a bundle get CRDs from their business clusters")
+	fs.DurationVar(&o.TenantCRDSyncPeriod, "tenant-crd-sync-period", o.TenantCRDSyncPeriod, "Interval to reload the CRDs of tenants when --crd-source is \"tenant\"")
+	fs.BoolVar(&o.EnableVirtualCRDs, "enable-virtual-crds", o.EnableVirtualCRDs, "Let tenants create CustomResourceDefinitions in their overlay views, which are served only to them and never installed in any cluster")
+	fs.StringSliceVar(&o.OverlayBuiltinResources, "overlay-builtin-resources", o.OverlayBuiltinResources, "Built-in resources served to tenants under overlay group besides namespaces, in the form of \"<resource>\" for the core group or \"<resource>.<group>\", such as \"leases.coordination.k8s.io\". "+
+		"Objects of them are stored as plain Manifests in the reserved namespaces like custom resources, which are readable to whoever can read Manifests, "+
+		"and are not encrypted at rest even if the host cluster encrypts the resources themselves. Serving \"secrets\" is therefore not recommended")
+	fs.IntVar(&o.WatchCacheSize, "watch-cache-size", o.WatchCacheSize, "Number of the recent Manifest events kept for tenant watches to resume from. Tenant watches are served from one watch on the 'core' kubernetes server shared by all of them, unless it is 0")
+	fs.StringVar(&o.TenantArchiveDir, "tenant-archive-dir", o.TenantArchiveDir, "The directory to archive the manifests of an offboarded tenant to before deletion. Archiving is disabled if empty. "+
+		"Archives are written to the local filesystem of the elected leader, so mount a PersistentVolume shared by all the replicas here to keep them")
 }
 
 func (o *OverlayServerOptions) addRecommendedOptionsFlags(fs *pflag.FlagSet) {
@@ -218,6 +321,21 @@ func (o *OverlayServerOptions) recommendedOptionsApplyTo(config *genericapiserve
 // ExtraConfig holds custom apiserver config
 type ExtraConfig struct {
 	// Place you custom config here.
+
+	// file of the CRD exposure policy
+	CRDExposurePolicyFile string
+
+	// CRDs of each tenant, nil to serve the CRDs of the host cluster
+	TenantCRDs overlayapiserver.TenantCRDs
+
+	// whether tenants can register their own CRDs
+	EnableVirtualCRDs bool
+
+	// built-in resources served under overlay group besides namespaces
+	BuiltinResources []string
+
+	// number of the recent events kept by the watch cache, 0 to disable it
+	WatchCacheSize int
 }
 
 // Config defines the config for the apiserver
@@ -261,7 +379,7 @@ func (c completedConfig) New(kubeclient *kubernetes.Clientset, kcrdclient *kcrd.
 	kcrdInformerFactory informers.SharedInformerFactory,
 	aggregatorInformerFactory aggregatorinformers.SharedInformerFactory,
 	clientBuilder clientbuilder.ControllerClientBuilder,
-	reservedNamespace string) (*ExternalCrdAPIServer, error) {
+	reservedNamespaces utils.ReservedNamespaces) (*ExternalCrdAPIServer, error) {
 	genericServer, err := c.GenericConfig.New("kcrd-server", genericapiserver.NewEmptyDelegate())
 	if err != nil {
 		return nil, err
@@ -271,7 +389,11 @@ func (c completedConfig) New(kubeclient *kubernetes.Clientset, kcrdclient *kcrd.
 		GenericAPIServer: genericServer,
 	}
 
-	kcrdInformerFactory.Kcrd().V1alpha1().KubernetesCrds().Informer()
+	// indexers can only be added before the informer is started
+	if err := overlayapiserver.AddManifestIndexers(kcrdInformerFactory.Kcrd().V1alpha1().KubernetesCrds().Informer(),
+		reservedNamespaces); err != nil {
+		return nil, err
+	}
 	aggregatorInformerFactory.Apiregistration().V1().APIServices().Informer()
 
 	s.GenericAPIServer.AddPostStartHookOrDie("start-external-crd-overlay-apis", func(context genericapiserver.PostStartHookContext) error {
@@ -284,10 +406,21 @@ func (c completedConfig) New(kubeclient *kubernetes.Clientset, kcrdclient *kcrd.
 			ss := overlayapiserver.NewOverlayAPIServer(s.GenericAPIServer, c.GenericConfig.MaxRequestBodyBytes,
 				c.GenericConfig.MinRequestTimeout, c.GenericConfig.AdmissionControl, kubeclient.RESTClient(),
 				kcrdclient,
-				kcrdInformerFactory.Kcrd().V1alpha1().KubernetesCrds().Lister(),
+				kcrdInformerFactory.Kcrd().V1alpha1().KubernetesCrds(),
 				aggregatorInformerFactory.Apiregistration().V1().APIServices().Lister(),
 				crdInformerFactory,
-				reservedNamespace)
+				c.ExtraConfig.CRDExposurePolicyFile,
+				reservedNamespaces)
+			if c.ExtraConfig.TenantCRDs != nil {
+				ss.SetTenantCRDs(c.ExtraConfig.TenantCRDs)
+			}
+			ss.SetBuiltinResources(c.ExtraConfig.BuiltinResources)
+			if c.ExtraConfig.EnableVirtualCRDs {
+				ss.EnableVirtualCRDs(kcrdInformerFactory.Kcrd().V1alpha1().KubernetesCrds())
+			}
+			if c.ExtraConfig.WatchCacheSize > 0 {
+				ss.EnableWatchCache(kcrdInformerFactory.Kcrd().V1alpha1().KubernetesCrds(), c.ExtraConfig.WatchCacheSize)
+			}
 
 			crdInformerFactory.Start(context.StopCh)
 			return ss.InstallOverlayAPIGroups(context.StopCh, kubeclient.DiscoveryClient)
@@ -0,0 +1,279 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/klog/v2"
+
+	overlayapi "github.com/jijiechen/external-crd/pkg/apis/overlay/v1alpha1"
+)
+
+const (
+	aggregatedDiscoveryGroup = "apidiscovery.k8s.io"
+	aggregatedDiscoveryKind  = "APIGroupDiscoveryList"
+
+	discoveryFreshnessCurrent = "Current"
+)
+
+// aggregatedDiscoveryVersions are the versions of the aggregated discovery format being served.
+// They share the same schema.
+var aggregatedDiscoveryVersions = []string{"v2", "v2beta1"}
+
+// The types below mirror those of apidiscovery.k8s.io/v2beta1, which are not available in the k8s.io/api we depend on.
+
+type apiGroupDiscoveryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []apiGroupDiscovery `json:"items"`
+}
+
+type apiGroupDiscovery struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	// versions are ordered by preference, the preferred version comes first
+	Versions []apiVersionDiscovery `json:"versions,omitempty"`
+}
+
+type apiVersionDiscovery struct {
+	Version   string                 `json:"version"`
+	Resources []apiResourceDiscovery `json:"resources,omitempty"`
+	Freshness string                 `json:"freshness,omitempty"`
+}
+
+type apiResourceDiscovery struct {
+	Resource         string                    `json:"resource"`
+	ResponseKind     *metav1.GroupVersionKind  `json:"responseKind"`
+	Scope            string                    `json:"scope"`
+	SingularResource string                    `json:"singularResource"`
+	Verbs            []string                  `json:"verbs"`
+	ShortNames       []string                  `json:"shortNames,omitempty"`
+	Categories       []string                  `json:"categories,omitempty"`
+	Subresources     []apiSubresourceDiscovery `json:"subresources,omitempty"`
+}
+
+type apiSubresourceDiscovery struct {
+	Subresource  string                   `json:"subresource"`
+	ResponseKind *metav1.GroupVersionKind `json:"responseKind,omitempty"`
+	Verbs        []string                 `json:"verbs"`
+}
+
+// installAggregatedDiscovery takes over the route of /apis, so that the aggregated discovery document is served
+// when it is accepted by the client. The legacy APIGroupList is served otherwise.
+func (r *crdHandler) installAggregatedDiscovery() {
+	if r.container == nil {
+		return
+	}
+
+	for _, ws := range r.container.RegisteredWebServices() {
+		if ws.RootPath() != genericapiserver.APIGroupPrefix {
+			continue
+		}
+		for _, route := range ws.Routes() {
+			if route.Method != http.MethodGet {
+				continue
+			}
+
+			legacy := route.Function
+			ws.SetDynamicRoutes(true)
+			if err := ws.RemoveRoute(route.Path, route.Method); err != nil {
+				ws.SetDynamicRoutes(false)
+				klog.Errorf("failed to remove route for %s", route.Path)
+				return
+			}
+			ws.Route(ws.GET("/").To(r.aggregatedDiscoveryHandler(legacy)).
+				Doc(route.Doc).
+				Operation(route.Operation).
+				Produces(route.Produces...).
+				Consumes(route.Consumes...).
+				Writes(metav1.APIGroupList{}))
+			ws.SetDynamicRoutes(false)
+			return
+		}
+	}
+	klog.Warningf("failed to find the route of %s, aggregated discovery is not served", genericapiserver.APIGroupPrefix)
+}
+
+// aggregatedDiscoveryHandler serves the aggregated discovery document, and falls back to legacy
+func (r *crdHandler) aggregatedDiscoveryHandler(legacy restful.RouteFunction) restful.RouteFunction {
+	return func(req *restful.Request, resp *restful.Response) {
+		version, ok := acceptedAggregatedDiscoveryVersion(req.Request.Header.Get("Accept"))
+		if !ok {
+			legacy(req, resp)
+			return
+		}
+
+		list := &apiGroupDiscoveryList{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       aggregatedDiscoveryKind,
+				APIVersion: schema.GroupVersion{Group: aggregatedDiscoveryGroup, Version: version}.String(),
+			},
+			Items: r.aggregatedDiscovery(req.Request),
+		}
+		data, err := json.Marshal(list)
+		if err != nil {
+			responsewriters.InternalError(resp.ResponseWriter, req.Request, err)
+			return
+		}
+
+		etag := fmt.Sprintf("%q", fmt.Sprintf("%X", sha256.Sum256(data)))
+		w := resp.ResponseWriter
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Vary", "Accept")
+		if req.Request.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", fmt.Sprintf("application/json;g=%s;v=%s;as=%s",
+			aggregatedDiscoveryGroup, version, aggregatedDiscoveryKind))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(data)
+	}
+}
+
+// aggregatedDiscovery returns the discovery documents of overlay group and the original groups,
+// with only the resources visible to the requester of req
+func (r *crdHandler) aggregatedDiscovery(req *http.Request) []apiGroupDiscovery {
+	groups := []apiGroupDiscovery{
+		newAPIGroupDiscovery(overlayapi.GroupName, apiVersionDiscovery{
+			Version:   overlayapi.SchemeGroupVersion.Version,
+			Resources: toAPIResourceDiscovery(overlayapi.SchemeGroupVersion, r.versionDiscoveryHandler.visibleAPIResources(req)),
+			Freshness: discoveryFreshnessCurrent,
+		}),
+	}
+
+	r.groupLock.Lock()
+	defer r.groupLock.Unlock()
+
+	var groupNames []string
+	for group := range r.groupDiscoveryHandlers {
+		groupNames = append(groupNames, group)
+	}
+	sort.Strings(groupNames)
+	for _, group := range groupNames {
+		var versions []apiVersionDiscovery
+		for _, version := range r.groupDiscoveryHandlers[group].visibleAPIGroup(req).Versions {
+			gv := schema.GroupVersion{Group: group, Version: version.Version}
+			service, ok := r.groupVersionServices[gv]
+			if !ok {
+				continue
+			}
+			resources := toAPIResourceDiscovery(gv, service.discovery.visibleAPIResources(req))
+			if len(resources) == 0 {
+				continue
+			}
+			versions = append(versions, apiVersionDiscovery{
+				Version:   gv.Version,
+				Resources: resources,
+				Freshness: discoveryFreshnessCurrent,
+			})
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		groups = append(groups, newAPIGroupDiscovery(group, versions...))
+	}
+	return groups
+}
+
+func newAPIGroupDiscovery(group string, versions ...apiVersionDiscovery) apiGroupDiscovery {
+	return apiGroupDiscovery{
+		ObjectMeta: metav1.ObjectMeta{Name: group},
+		Versions:   versions,
+	}
+}
+
+// toAPIResourceDiscovery converts legacy APIResources, where subresources are named as "<resource>/<subresource>"
+func toAPIResourceDiscovery(gv schema.GroupVersion, apiResources []metav1.APIResource) []apiResourceDiscovery {
+	responseKind := func(apiResource metav1.APIResource) *metav1.GroupVersionKind {
+		gvk := &metav1.GroupVersionKind{Group: gv.Group, Version: gv.Version, Kind: apiResource.Kind}
+		if len(apiResource.Group) > 0 || len(apiResource.Version) > 0 {
+			gvk.Group, gvk.Version = apiResource.Group, apiResource.Version
+		}
+		return gvk
+	}
+
+	var resources []apiResourceDiscovery
+	index := map[string]int{}
+	for _, apiResource := range apiResources {
+		if strings.Contains(apiResource.Name, "/") {
+			continue
+		}
+		scope := "Cluster"
+		if apiResource.Namespaced {
+			scope = "Namespaced"
+		}
+		index[apiResource.Name] = len(resources)
+		resources = append(resources, apiResourceDiscovery{
+			Resource:         apiResource.Name,
+			ResponseKind:     responseKind(apiResource),
+			Scope:            scope,
+			SingularResource: apiResource.SingularName,
+			Verbs:            apiResource.Verbs,
+			ShortNames:       apiResource.ShortNames,
+			Categories:       apiResource.Categories,
+		})
+	}
+	for _, apiResource := range apiResources {
+		parts := strings.SplitN(apiResource.Name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		i, ok := index[parts[0]]
+		if !ok {
+			continue
+		}
+		resources[i].Subresources = append(resources[i].Subresources, apiSubresourceDiscovery{
+			Subresource:  parts[1],
+			ResponseKind: responseKind(apiResource),
+			Verbs:        apiResource.Verbs,
+		})
+	}
+	return resources
+}
+
+// acceptedAggregatedDiscoveryVersion returns the first version of the aggregated discovery format in accept header
+func acceptedAggregatedDiscoveryVersion(accept string) (string, bool) {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil || mediaType != "application/json" {
+			continue
+		}
+		if params["g"] != aggregatedDiscoveryGroup || params["as"] != aggregatedDiscoveryKind {
+			continue
+		}
+		for _, version := range aggregatedDiscoveryVersions {
+			if params["v"] == version {
+				return version, true
+			}
+		}
+	}
+	return "", false
+}
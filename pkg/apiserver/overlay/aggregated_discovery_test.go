@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/endpoints/discovery"
+	"k8s.io/client-go/tools/cache"
+	apiservicelisters "k8s.io/kube-aggregator/pkg/client/listers/apiregistration/v1"
+)
+
+func TestAggregatedDiscovery(t *testing.T) {
+	container := restful.NewContainer()
+	groupManager := discovery.NewRootAPIsHandler(discovery.DefaultAddresses{DefaultAddress: "127.0.0.1"}, Codecs)
+	container.Add(groupManager.WebService())
+
+	r := newTestCRDHandler(apiservicelisters.NewAPIServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		container, groupManager)
+	r.installAggregatedDiscovery()
+	for _, crd := range []interface{}{
+		newTestCRD("networking.istio.io", "v1beta1", "gateways", "Gateway"),
+		newTestCRD("networking.istio.io", "v1alpha3", "envoyfilters", "EnvoyFilter"),
+	} {
+		r.addCustomResourceDefinition(crd)
+	}
+
+	get := func(accept, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/apis", nil)
+		req.Header.Set("Accept", accept)
+		if len(etag) > 0 {
+			req.Header.Set("If-None-Match", etag)
+		}
+		recorder := httptest.NewRecorder()
+		container.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	accept := "application/json;g=apidiscovery.k8s.io;v=v2beta1;as=APIGroupDiscoveryList,application/json"
+	resp := get(accept, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", resp.Code, resp.Body.String())
+	}
+	if contentType := resp.Header().Get("Content-Type"); !strings.Contains(contentType, "as=APIGroupDiscoveryList") {
+		t.Errorf("unexpected Content-Type %q", contentType)
+	}
+	list := &apiGroupDiscoveryList{}
+	if err := json.Unmarshal(resp.Body.Bytes(), list); err != nil {
+		t.Fatal(err)
+	}
+	if list.APIVersion != "apidiscovery.k8s.io/v2beta1" || len(list.Items) != 2 {
+		t.Fatalf("unexpected discovery document %s", resp.Body.String())
+	}
+	istio := list.Items[1]
+	if istio.Name != "networking.istio.io" || len(istio.Versions) != 2 || istio.Versions[0].Version != "v1beta1" {
+		t.Errorf("unexpected versions of networking.istio.io: %+v", istio.Versions)
+	}
+	if resources := list.Items[0].Versions[0].Resources; len(resources) != 2 {
+		t.Errorf("expect 2 resources in overlay group, got %+v", resources)
+	}
+
+	etag := resp.Header().Get("ETag")
+	if len(etag) == 0 {
+		t.Fatalf("expect an ETag")
+	}
+	if resp := get(accept, etag); resp.Code != http.StatusNotModified {
+		t.Errorf("expect status %d with a matching ETag, got %d", http.StatusNotModified, resp.Code)
+	}
+
+	resp = get("application/json", "")
+	groupList := &metav1.APIGroupList{}
+	if err := json.Unmarshal(resp.Body.Bytes(), groupList); err != nil || groupList.Kind != "APIGroupList" {
+		t.Errorf("expect legacy APIGroupList, got %s", resp.Body.String())
+	}
+}
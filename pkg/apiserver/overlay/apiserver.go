@@ -25,20 +25,25 @@ import (
 	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/cache"
 	"path"
+	"reflect"
 	"strings"
 	"time"
 
 	overlayinstall "github.com/jijiechen/external-crd/pkg/apis/overlay/install"
 	overlayapi "github.com/jijiechen/external-crd/pkg/apis/overlay/v1alpha1"
 	kcrd "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned"
+	kcrdinformers "github.com/jijiechen/external-crd/pkg/generated/informers/externalversions/kcrd/v1alpha1"
 	kcrdlisters "github.com/jijiechen/external-crd/pkg/generated/listers/kcrd/v1alpha1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	crdinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions/apiextensions/v1"
 	apiextensionsv1lister "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/wait"
 	genericapi "k8s.io/apiserver/pkg/endpoints"
 	genericdiscovery "k8s.io/apiserver/pkg/endpoints/discovery"
 	"k8s.io/apiserver/pkg/registry/rest"
@@ -62,6 +67,8 @@ var (
 
 const (
 	kcrdGroupSuffix = ".jijiechen.com"
+
+	exposurePolicyReloadPeriod = 30 * time.Second
 )
 
 func init() {
@@ -98,22 +105,40 @@ type OverlayAPIServer struct {
 	kcrdClient     *kcrd.Clientset
 
 	kcrdLister       kcrdlisters.KubernetesCrdLister
+	manifestCache    *manifestCache
+	crdInformer      apiextensionsinformers.CustomResourceDefinitionInformer
 	crdLister        apiextensionsv1lister.CustomResourceDefinitionLister
 	crdSynced        cache.InformerSynced
 	crdHandler       *crdHandler
+	tenantCRDs       TenantCRDs
+	virtualCRDs      *virtualCRDs
+	watchCache       *watchCache
 	apiserviceLister apiservicelisters.APIServiceLister
 
-	// namespace where Manifests are created
-	reservedNamespace string
+	// built-in resources served under overlay group besides namespaces, such as "leases.coordination.k8s.io"
+	builtinResources []string
+
+	// file of the CRD exposure policy, empty to expose all CRDs
+	exposurePolicyFile string
+
+	// namespaces where Manifests are created
+	reservedNamespaces utils.ReservedNamespaces
 }
 
 func NewOverlayAPIServer(apiserver *genericapiserver.GenericAPIServer, maxRequestBodyBytes int64, minRequestTimeout int,
 	admissionControl admission.Interface,
-	kubeRESTClient restclient.Interface, kcrdClient *kcrd.Clientset, manifestLister kcrdlisters.KubernetesCrdLister,
+	kubeRESTClient restclient.Interface, kcrdClient *kcrd.Clientset, manifestInformer kcrdinformers.KubernetesCrdInformer,
 	apiserviceLister apiservicelisters.APIServiceLister, crdInformerFactory crdinformers.SharedInformerFactory,
-	reservedNamespace string) *OverlayAPIServer {
+	exposurePolicyFile string, reservedNamespaces utils.ReservedNamespaces) *OverlayAPIServer {
 
-	return &OverlayAPIServer{
+	// the generic apiserver publishes no OpenAPI specs, since there is no OpenAPIConfig
+	openAPI, err := newOpenAPIPublisher(apiserver.Handler.NonGoRestfulMux)
+	if err != nil {
+		klog.Errorf("failed to publish OpenAPI specs for overlay resources: %v", err)
+	}
+
+	manifestLister := manifestInformer.Lister()
+	ols := &OverlayAPIServer{
 		GenericAPIServer:    apiserver,
 		maxRequestBodyBytes: maxRequestBodyBytes,
 		minRequestTimeout:   minRequestTimeout,
@@ -121,15 +146,53 @@ func NewOverlayAPIServer(apiserver *genericapiserver.GenericAPIServer, maxReques
 		kubeRESTClient:      kubeRESTClient,
 		kcrdClient:          kcrdClient,
 		kcrdLister:          manifestLister,
+		manifestCache:       newManifestCache(manifestInformer.Informer()),
+		crdInformer:         crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions(),
 		crdLister:           crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions().Lister(),
 		crdSynced:           crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions().Informer().HasSynced,
 		crdHandler: NewCRDHandler(
 			kubeRESTClient, kcrdClient, manifestLister, apiserviceLister,
 			crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions(),
-			minRequestTimeout, maxRequestBodyBytes, admissionControl, apiserver.Authorizer, apiserver.Serializer, reservedNamespace),
-		apiserviceLister:  apiserviceLister,
-		reservedNamespace: reservedNamespace,
+			apiserver.Handler.GoRestfulContainer, apiserver.DiscoveryGroupManager, openAPI,
+			minRequestTimeout, maxRequestBodyBytes, admissionControl, apiserver.Authorizer, apiserver.Serializer, reservedNamespaces),
+		apiserviceLister:   apiserviceLister,
+		exposurePolicyFile: exposurePolicyFile,
+		reservedNamespaces: reservedNamespaces,
+	}
+	ols.crdHandler.SetManifestCache(ols.manifestCache)
+	return ols
+}
+
+// SetTenantCRDs serves the CRDs of each tenant instead of those of the host cluster.
+// It should be called before InstallOverlayAPIGroups.
+func (ols *OverlayAPIServer) SetTenantCRDs(tenantCRDs TenantCRDs) {
+	ols.tenantCRDs = tenantCRDs
+	ols.crdHandler.SetTenantCRDs(tenantCRDs)
+}
+
+// SetBuiltinResources serves built-in resources, such as "configmaps" or "leases.coordination.k8s.io", under overlay
+// group besides namespaces. It should be called before InstallOverlayAPIGroups.
+func (ols *OverlayAPIServer) SetBuiltinResources(builtinResources []string) {
+	ols.builtinResources = builtinResources
+}
+
+// EnableVirtualCRDs lets tenants register CRDs in their overlay views, which are only served to them.
+// It should be called after SetTenantCRDs and before InstallOverlayAPIGroups.
+func (ols *OverlayAPIServer) EnableVirtualCRDs(manifestInformer kcrdinformers.KubernetesCrdInformer) {
+	ols.virtualCRDs = newVirtualCRDs(manifestInformer, ols.reservedNamespaces)
+	base := ols.tenantCRDs
+	if base == nil {
+		base = &hostCRDs{informer: ols.crdInformer}
+		ols.crdHandler.SetHostCRDs(true)
 	}
+	ols.SetTenantCRDs(newMergedTenantCRDs(base, ols.virtualCRDs))
+}
+
+// EnableWatchCache serves the watches of tenants from one watch on Manifests shared by all of them, keeping the
+// latest capacity events for watches to resume from. It should be called before InstallOverlayAPIGroups.
+func (ols *OverlayAPIServer) EnableWatchCache(manifestInformer kcrdinformers.KubernetesCrdInformer, capacity int) {
+	ols.watchCache = newWatchCache(manifestInformer.Informer(), ols.reservedNamespaces, capacity)
+	ols.crdHandler.SetWatchCache(ols.watchCache)
 }
 
 func (ols *OverlayAPIServer) InstallOverlayAPIGroups(stopCh <-chan struct{}, cl discovery.DiscoveryInterface) error {
@@ -137,37 +200,76 @@ func (ols *OverlayAPIServer) InstallOverlayAPIGroups(stopCh <-chan struct{}, cl
 	klog.V(5).Info("overlay apiserver is waiting for informer caches to sync")
 
 	cache.WaitForCacheSync(stopCh, ols.crdSynced)
+	if ols.virtualCRDs != nil {
+		go ols.virtualCRDs.Run(stopCh)
+	}
+	if ols.watchCache != nil {
+		go ols.watchCache.Run(stopCh)
+	}
+	if ols.tenantCRDs != nil {
+		cache.WaitForCacheSync(stopCh, ols.tenantCRDs.HasSynced)
+	}
+
+	if len(ols.exposurePolicyFile) > 0 {
+		policy, err := LoadExposurePolicy(ols.exposurePolicyFile)
+		if err != nil {
+			return err
+		}
+		ols.crdHandler.SetExposurePolicy(policy)
+		go wait.Until(func() {
+			policy = ols.reloadExposurePolicy(policy)
+		}, exposurePolicyReloadPeriod, stopCh)
+	}
 
 	apiGroupResources, err := restmapper.GetAPIGroupResources(cl)
 	if err != nil {
 		return err
 	}
 
+	// namespaces are always served, so that tenants can see their own namespaces
+	builtinResources, missing := utils.SelectAPIResources(apiGroupResources, append([]string{"namespaces"}, ols.builtinResources...))
+	if len(missing) > 0 {
+		klog.Warningf("built-in resources %v are not found in the 'core' kubernetes server, skip serving them", missing)
+	}
+
 	overlayv1alpha1storage := map[string]rest.Storage{}
-	nsRESTSet := false
-	for _, apiGroupResource := range apiGroupResources {
-		for _, apiresource := range utils.NormalizeAPIGroupResources(apiGroupResource) {
-			if apiGroupResource.Group.Name == "" && apiresource.Name == "namespaces" {
-				nsRESTSet = true
-
-				Scheme.AddKnownTypeWithName(schema.GroupVersion{Group: apiGroupResource.Group.Name,
-					Version: apiresource.Version}.WithKind(apiresource.Kind), &unstructured.Unstructured{})
-
-				resourceRest := NewREST(ols.kubeRESTClient, ols.kcrdClient, ParameterCodec, ols.kcrdLister, ols.reservedNamespace)
-				resourceRest.SetNamespaceScoped(apiresource.Namespaced)
-				resourceRest.SetName(apiresource.Name)
-				resourceRest.SetShortNames(apiresource.ShortNames)
-				resourceRest.SetKind(apiresource.Kind)
-				resourceRest.SetGroup(apiresource.Group)
-				resourceRest.SetVersion(apiresource.Version)
-				overlayv1alpha1storage[apiresource.Name] = resourceRest
-				break
-			}
+	for _, apiresource := range builtinResources {
+		if _, ok := overlayv1alpha1storage[apiresource.Name]; ok {
+			klog.Warningf("skip built-in resource %s in group %q, since %s are already served under overlay group",
+				apiresource.Name, apiresource.Group, apiresource.Name)
+			continue
 		}
 
-		if nsRESTSet {
-			break
-		}
+		Scheme.AddKnownTypeWithName(schema.GroupVersion{Group: apiresource.Group,
+			Version: apiresource.Version}.WithKind(apiresource.Kind), &unstructured.Unstructured{})
+
+		resourceRest := NewREST(ols.kubeRESTClient, ols.kcrdClient, ParameterCodec, ols.kcrdLister, ols.GenericAPIServer.Authorizer, ols.reservedNamespaces)
+		resourceRest.SetNamespaceScoped(apiresource.Namespaced)
+		resourceRest.SetName(apiresource.Name)
+		resourceRest.SetShortNames(apiresource.ShortNames)
+		resourceRest.SetCategories(apiresource.Categories)
+		resourceRest.SetKind(apiresource.Kind)
+		resourceRest.SetGroup(apiresource.Group)
+		resourceRest.SetVersion(apiresource.Version)
+		resourceRest.SetWatchCache(ols.watchCache)
+		resourceRest.SetManifestCache(ols.manifestCache)
+		overlayv1alpha1storage[apiresource.Name] = resourceRest
+		ols.crdHandler.AddNonCRDAPIResource(apiresource)
+	}
+
+	if ols.virtualCRDs != nil {
+		Scheme.AddKnownTypeWithName(apiextensionsv1.SchemeGroupVersion.WithKind(customResourceDefinitionKind), &unstructured.Unstructured{})
+		resourceRest := ols.newVirtualCRDREST()
+		overlayv1alpha1storage[customResourceDefinitionResource] = resourceRest
+		ols.crdHandler.AddNonCRDAPIResource(metav1.APIResource{
+			Name:       customResourceDefinitionResource,
+			Namespaced: true,
+			Group:      apiextensionsv1.GroupName,
+			Version:    apiextensionsv1.SchemeGroupVersion.Version,
+			Kind:       customResourceDefinitionKind,
+			Verbs:      metav1.Verbs{"create", "delete", "deletecollection", "get", "list", "patch", "update", "watch"},
+			ShortNames: resourceRest.ShortNames(),
+		})
 	}
 
 	overlayAPIGroupInfo := genericapiserver.NewDefaultAPIGroupInfo(overlayapi.GroupName, Scheme, ParameterCodec, Codecs)
@@ -181,6 +283,23 @@ func (ols *OverlayAPIServer) InstallOverlayAPIGroups(stopCh <-chan struct{}, cl
 	return ols.installAPIGroups(&overlayAPIGroupInfo)
 }
 
+// reloadExposurePolicy re-reads the exposure policy file, so that changes, such as those of a mounted ConfigMap,
+// take effect without restarting. It returns the policy in effect.
+func (ols *OverlayAPIServer) reloadExposurePolicy(current *ExposurePolicy) *ExposurePolicy {
+	policy, err := LoadExposurePolicy(ols.exposurePolicyFile)
+	if err != nil {
+		klog.Errorf("failed to reload CRD exposure policy, keep using the current one: %v", err)
+		return current
+	}
+	if reflect.DeepEqual(policy, current) {
+		return current
+	}
+
+	klog.Infof("CRD exposure policy in %s has changed, re-syncing CustomResourceDefinitions", ols.exposurePolicyFile)
+	ols.crdHandler.SetExposurePolicy(policy)
+	return policy
+}
+
 // Exposes given api groups in the API.
 // copied from k8s.io/apiserver/pkg/server/genericapiserver.go and modified
 func (ols *OverlayAPIServer) installAPIGroups(apiGroupInfos ...*genericapiserver.APIGroupInfo) error {
@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"path"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -33,6 +34,7 @@ import (
 	apiextensionshelpers "k8s.io/apiextensions-apiserver/pkg/apihelpers"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/registry/customresource/tableconvertor"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -40,6 +42,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/version"
 	"k8s.io/apiserver/pkg/admission"
 	"k8s.io/apiserver/pkg/authorization/authorizer"
 	"k8s.io/apiserver/pkg/endpoints"
@@ -78,24 +81,53 @@ type crdHandler struct {
 
 	rootPrefix string
 
+	// syncLock serializes syncing CRDs to storages
+	syncLock sync.Mutex
+	// exposurePolicy decides which CRDs are served, nil to expose all
+	exposurePolicy *ExposurePolicy
+	// tenantCRDs provides the CRDs of each tenant, nil to serve the CRDs of the host cluster to all the tenants
+	tenantCRDs TenantCRDs
+	// hostCRDs tells that tenantCRDs includes the CRDs of the host cluster, whose objects are still dry-run there
+	hostCRDs bool
+	// watchCache serves the watches of all the storages, nil to watch the host cluster for each of them
+	watchCache *watchCache
+	// manifestCache serves the lists accepting cached data of all the storages
+	manifestCache *manifestCache
+
 	ws *restful.WebService
-	// Storage per CRD
-	storages map[string]*REST
-	// Request scope per CRD
-	requestScopes           map[string]*handlers.RequestScope
+	// Storage per CRD, keyed by the group, the storage version and the plural
+	storages map[schema.GroupVersionResource]*REST
+	// Request scope per CRD, keyed by the group, the storage version and the plural
+	requestScopes map[schema.GroupVersionResource]*handlers.RequestScope
+	// CRDs which could be served under overlay group, keyed by plural
+	overlayCandidates map[string][]*overlayCandidate
+	// CRDs being served under overlay group, keyed by plural
+	overlayResources map[string]*overlayCandidate
+
 	versionDiscoveryHandler *versionDiscoveryHandler
 	nonCRDAPIResources      []metav1.APIResource
 
-	// namespace where Manifests are created
-	reservedNamespace string
+	// container and groupManager are used to serve CRDs under their original groups
+	container    *restful.Container
+	groupManager discovery.GroupManager
+	// openAPI publishes the OpenAPI specs of served CRDs
+	openAPI *openAPIPublisher
+	// groupLock protects groupVersionServices and groupDiscoveryHandlers
+	groupLock              sync.Mutex
+	groupVersionServices   map[schema.GroupVersion]*groupVersionService
+	groupDiscoveryHandlers map[string]*groupDiscoveryHandler
+
+	// namespaces where Manifests are created
+	reservedNamespaces utils.ReservedNamespaces
 }
 
 func NewCRDHandler(kubeRESTClient restclient.Interface, kcrdclient *kcrd.Clientset,
 	kcrdLister applisters.KubernetesCrdLister, apiserviceLister apiservicelisters.APIServiceLister,
 	crdInformer apiextensionsinformers.CustomResourceDefinitionInformer,
+	container *restful.Container, groupManager discovery.GroupManager, openAPI *openAPIPublisher,
 	minRequestTimeout int, maxRequestBodyBytes int64,
 	admissionControl admission.Interface, authorizer authorizer.Authorizer, serializer runtime.NegotiatedSerializer,
-	reservedNamespace string) *crdHandler {
+	reservedNamespaces utils.ReservedNamespaces) *crdHandler {
 	r := &crdHandler{
 		rootPrefix:          path.Join(genericapiserver.APIGroupPrefix, overlayapi.SchemeGroupVersion.String()),
 		kubeRESTClient:      kubeRESTClient,
@@ -108,9 +140,17 @@ func NewCRDHandler(kubeRESTClient restclient.Interface, kcrdclient *kcrd.Clients
 		admissionControl:    admissionControl,
 		authorizer:          authorizer,
 		serializer:          serializer,
-		storages:            map[string]*REST{},
-		requestScopes:       map[string]*handlers.RequestScope{},
-		reservedNamespace:   reservedNamespace,
+		storages:            map[schema.GroupVersionResource]*REST{},
+		requestScopes:       map[schema.GroupVersionResource]*handlers.RequestScope{},
+		overlayCandidates:   map[string][]*overlayCandidate{},
+		overlayResources:    map[string]*overlayCandidate{},
+		container:           container,
+		groupManager:        groupManager,
+		openAPI:             openAPI,
+		reservedNamespaces:  reservedNamespaces,
+
+		groupVersionServices:   map[schema.GroupVersion]*groupVersionService{},
+		groupDiscoveryHandlers: map[string]*groupDiscoveryHandler{},
 	}
 	return r
 }
@@ -118,10 +158,66 @@ func NewCRDHandler(kubeRESTClient restclient.Interface, kcrdclient *kcrd.Clients
 func (r *crdHandler) AddNonCRDAPIResource(apiResource metav1.APIResource) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	apiResource.Categories = []string{utils.Category}
+	apiResource.Categories = withOverlayCategory(apiResource.Categories)
 	r.nonCRDAPIResources = append(r.nonCRDAPIResources, apiResource)
 }
 
+// withOverlayCategory returns utils.Category followed by categories, so that all the overlay resources can be listed
+// at once, while those of CRDs can still be listed by their own categories, such as "istio-io"
+func withOverlayCategory(categories []string) []string {
+	merged := []string{utils.Category}
+	for _, category := range categories {
+		if category != utils.Category {
+			merged = append(merged, category)
+		}
+	}
+	return merged
+}
+
+// printerColumnsForVersion returns the additionalPrinterColumns of a version of crd. Like native clusters,
+// a column of the age is printed if there is none.
+func printerColumnsForVersion(crd *apiextensionsv1.CustomResourceDefinition, version string) []apiextensionsv1.CustomResourceColumnDefinition {
+	for _, v := range crd.Spec.Versions {
+		if v.Name == version && len(v.AdditionalPrinterColumns) > 0 {
+			return v.AdditionalPrinterColumns
+		}
+	}
+	return []apiextensionsv1.CustomResourceColumnDefinition{
+		{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+	}
+}
+
+// SetTenantCRDs sources CRDs from tenants instead of the host cluster. It should be called before SetRootWebService.
+// The CRDs of all the tenants are served, while each tenant can only access and discover its own ones.
+func (r *crdHandler) SetTenantCRDs(tenantCRDs TenantCRDs) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.tenantCRDs = tenantCRDs
+}
+
+// SetHostCRDs tells that the CRDs set with SetTenantCRDs include those of the host cluster, which are served to
+// all the tenants along with the virtual CRDs of each tenant.
+func (r *crdHandler) SetHostCRDs(hostCRDs bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.hostCRDs = hostCRDs
+}
+
+// SetManifestCache serves the lists of all the storages accepting cached data from manifestCache.
+// It should be called before SetRootWebService.
+func (r *crdHandler) SetManifestCache(manifestCache *manifestCache) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.manifestCache = manifestCache
+}
+
+// SetWatchCache serves the watches of all the storages from watchCache. It should be called before SetRootWebService.
+func (r *crdHandler) SetWatchCache(watchCache *watchCache) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.watchCache = watchCache
+}
+
 // SetRootWebService should only called once
 func (r *crdHandler) SetRootWebService(ws *restful.WebService) {
 	r.lock.Lock()
@@ -137,6 +233,9 @@ func (r *crdHandler) SetRootWebService(ws *restful.WebService) {
 		overlayapi.SchemeGroupVersion,
 		r.nonCRDAPIResources,
 	)
+	r.versionDiscoveryHandler.filter = func(req *http.Request) func(metav1.APIResource) bool {
+		return r.tenantResourceFilter(req, overlayapi.SchemeGroupVersion)
+	}
 
 	// update version discovery route
 	versionDiscoveryPath := fmt.Sprintf("%s/%s/", genericapiserver.APIGroupPrefix, overlayapi.SchemeGroupVersion.String())
@@ -155,21 +254,85 @@ func (r *crdHandler) SetRootWebService(ws *restful.WebService) {
 		Consumes(mediaTypes...).
 		Writes(metav1.APIResourceList{}))
 
+	r.installAggregatedDiscovery()
+
 	// start event handler after ws is set
-	r.crdInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+	handler := cache.ResourceEventHandlerFuncs{
 		AddFunc:    r.addCustomResourceDefinition,
 		UpdateFunc: r.updateCustomResourceDefinition,
 		DeleteFunc: r.deleteCustomResourceDefinition,
-	})
+	}
+	if r.tenantCRDs != nil {
+		r.tenantCRDs.AddEventHandler(handler)
+		return
+	}
+	r.crdInformer.Informer().AddEventHandler(handler)
+}
+
+// SetExposurePolicy replaces the CRD exposure policy, and re-syncs all the CRDs against it
+func (r *crdHandler) SetExposurePolicy(policy *ExposurePolicy) {
+	r.lock.Lock()
+	r.exposurePolicy = policy
+	started := r.ws != nil
+	r.lock.Unlock()
+
+	if !started {
+		// CRDs will be checked against the policy once event handlers start
+		return
+	}
+
+	crds, err := r.listCRDs()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to list CustomResourceDefinitions: %v", err))
+		return
+	}
+
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+	for _, crd := range crds {
+		exposed, serving := r.exposes(crd), r.isServing(crd)
+		switch {
+		case exposed && !serving:
+			klog.V(4).Infof("exposing CustomResourceDefinition %q", klog.KObj(crd))
+			if err := r.addStorage(crd); err != nil {
+				klog.ErrorDepth(2, err)
+			}
+		case !exposed && serving:
+			klog.V(4).Infof("CustomResourceDefinition %q is no longer exposed", klog.KObj(crd))
+			r.removeStorage(crd)
+		}
+	}
+}
+
+// exposes tells whether crd is allowed to be exposed by current policy
+func (r *crdHandler) exposes(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.exposurePolicy.Exposes(crd)
+}
+
+// isServing tells whether crd is being served now
+func (r *crdHandler) isServing(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	gvr, err := storageGroupVersionResource(crd)
+	if err != nil {
+		return false
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	_, ok := r.storages[gvr]
+	return ok
 }
 
 func (r *crdHandler) addCustomResourceDefinition(obj interface{}) {
 	crd := obj.(*apiextensionsv1.CustomResourceDefinition)
-	if strings.HasSuffix(crd.Spec.Group, kcrdGroupSuffix) {
-		klog.V(4).Infof("skip syncing external-crd related CustomResourceDefinition %q", klog.KObj(crd))
+	if !r.exposes(crd) {
+		klog.V(4).Infof("skip syncing CustomResourceDefinition %q that is not exposed", klog.KObj(crd))
 		return
 	}
 
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
 	klog.V(4).Infof("adding CustomResourceDefinition %q", klog.KObj(crd))
 	err := r.addStorage(crd)
 	if err != nil {
@@ -184,17 +347,29 @@ func (r *crdHandler) updateCustomResourceDefinition(old, cur interface{}) {
 	if newCRD.DeletionTimestamp != nil {
 		return
 	}
-	if reflect.DeepEqual(oldCRD.Spec, newCRD.Spec) {
+
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+	// labels and annotations may change the exposure as well
+	exposed, serving := r.exposes(newCRD), r.isServing(oldCRD)
+	if reflect.DeepEqual(oldCRD.Spec, newCRD.Spec) && exposed == serving {
 		klog.V(4).Infof("no updates on the spec of CustomResourceDefinition %s, skipping syncing", klog.KObj(oldCRD))
 		return
 	}
-	if strings.HasSuffix(newCRD.Spec.Group, kcrdGroupSuffix) {
-		klog.V(4).Infof("skip syncing external-crd related CustomResourceDefinition %s", klog.KObj(newCRD))
+	if !exposed {
+		if serving {
+			klog.V(4).Infof("CustomResourceDefinition %q is no longer exposed", klog.KObj(newCRD))
+			r.removeStorage(oldCRD)
+		}
 		return
 	}
 	klog.V(4).Infof("updating CustomResourceDefinition %q", klog.KObj(newCRD))
-	r.removeStorage(oldCRD)
-	err := r.addStorage(newCRD)
+	var err error
+	if serving {
+		err = r.replaceStorage(oldCRD, newCRD)
+	} else {
+		err = r.addStorage(newCRD)
+	}
 	if err != nil {
 		klog.ErrorDepth(2, err)
 	}
@@ -214,6 +389,11 @@ func (r *crdHandler) deleteCustomResourceDefinition(obj interface{}) {
 			return
 		}
 	}
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+	if !r.isServing(crd) {
+		return
+	}
 	klog.V(5).Infof("deleting CustomResourceDefinition %q", klog.KObj(crd))
 	r.removeStorage(crd)
 
@@ -223,11 +403,38 @@ func (r *crdHandler) deleteCustomResourceDefinition(obj interface{}) {
 }
 
 func (r *crdHandler) removeStorage(crd *apiextensionsv1.CustomResourceDefinition) {
-	r.versionDiscoveryHandler.removeCRD(crd)
+	r.removeStorageWithError(crd, apierrors.NewGone(fmt.Sprintf("CustomResourceDefinition %s is no longer served", crd.Name)))
+}
+
+// removeStorageWithError stops serving crd, and closes open watches with err
+func (r *crdHandler) removeStorageWithError(crd *apiextensionsv1.CustomResourceDefinition, err *apierrors.StatusError) {
+	gvr, gvrErr := storageGroupVersionResource(crd)
+	if gvrErr != nil {
+		klog.ErrorDepth(2, gvrErr)
+		return
+	}
 
 	r.lock.Lock()
-	delete(r.storages, crd.Spec.Names.Plural)
-	delete(r.requestScopes, crd.Spec.Names.Plural)
+	// all served versions of crd are removed, which share the group and the plural
+	for servedGVR, storage := range r.storages {
+		if servedGVR.GroupResource() != gvr.GroupResource() {
+			continue
+		}
+		defer storage.watches.closeAll(err)
+		delete(r.storages, servedGVR)
+		delete(r.requestScopes, servedGVR)
+	}
+	var candidates []*overlayCandidate
+	for _, candidate := range r.overlayCandidates[gvr.Resource] {
+		if candidate.gvr != gvr {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		delete(r.overlayCandidates, gvr.Resource)
+	} else {
+		r.overlayCandidates[gvr.Resource] = candidates
+	}
 	r.lock.Unlock()
 
 	if r.ws == nil {
@@ -235,53 +442,288 @@ func (r *crdHandler) removeStorage(crd *apiextensionsv1.CustomResourceDefinition
 		return
 	}
 
-	itemPath := path.Join(r.rootPrefix, crd.Spec.Names.Plural)
+	r.openAPI.removeCRD(gvr)
+	r.syncOverlayResource(gvr.Resource)
+	r.removeGroupVersionServices(crd)
+}
+
+// syncOverlayResource serves the candidate with the highest group priority under overlay group for given plural,
+// since resources in overlay group are only identified by their plurals.
+func (r *crdHandler) syncOverlayResource(plural string) {
+	r.lock.Lock()
+	var winner *overlayCandidate
+	for _, candidate := range r.overlayCandidates[plural] {
+		if winner == nil || candidate.priority > winner.priority ||
+			(candidate.priority == winner.priority && candidate.gvr.Group < winner.gvr.Group) {
+			winner = candidate
+		}
+	}
+	current := r.overlayResources[plural]
+	if winner == nil {
+		delete(r.overlayResources, plural)
+	} else {
+		r.overlayResources[plural] = winner
+	}
+	r.lock.Unlock()
+
+	if current == winner {
+		return
+	}
+	overlayGVR := overlayapi.SchemeGroupVersion.WithResource(plural)
+	if current != nil {
+		r.versionDiscoveryHandler.removeCRD(current.crd)
+		r.removeResourceRoutes(r.ws, current.crd)
+		r.openAPI.removeCRD(overlayGVR)
+	}
+	if winner != nil {
+		if current != nil && current.gvr.Group != winner.gvr.Group {
+			klog.Infof("resource %s in overlay group is now served by %s", plural, winner.gvr.GroupResource())
+		}
+		r.versionDiscoveryHandler.updateCRD(winner.crd, winner.gvr.Version)
+		r.installResourceRoutes(r.ws, winner.crd, winner.subResources)
+		r.openAPI.updateCRD(overlayGVR, winner.crd)
+	}
+}
+
+// removeResourceRoutes removes the routes serving given CRD from ws.
+func (r *crdHandler) removeResourceRoutes(ws *restful.WebService, crd *apiextensionsv1.CustomResourceDefinition) {
+	// namespace-scoped resources are listed for all namespaces with the cluster-scoped path as well
+	itemPaths := []string{path.Join(ws.RootPath(), crd.Spec.Names.Plural)}
 	if crd.Spec.Scope == apiextensionsv1.NamespaceScoped {
-		itemPath = path.Join(r.rootPrefix, "namespaces/{namespace}", crd.Spec.Names.Plural)
+		itemPaths = append(itemPaths, path.Join(ws.RootPath(), "namespaces/{namespace}", crd.Spec.Names.Plural))
 	}
 
 	var routesToBeRemoved []restful.Route
-	for _, route := range r.ws.Routes() {
-		if strings.HasPrefix(route.Path, itemPath) {
-			routesToBeRemoved = append(routesToBeRemoved, route)
+	for _, route := range ws.Routes() {
+		for _, itemPath := range itemPaths {
+			if route.Path == itemPath || strings.HasPrefix(route.Path, itemPath+"/") {
+				routesToBeRemoved = append(routesToBeRemoved, route)
+				break
+			}
 		}
 	}
 
 	// before we remove routes, always set dynamicRoutes as true
-	r.ws.SetDynamicRoutes(true)
-	defer r.ws.SetDynamicRoutes(false)
+	ws.SetDynamicRoutes(true)
+	defer ws.SetDynamicRoutes(false)
 	for _, route := range routesToBeRemoved {
-		if err := r.ws.RemoveRoute(route.Path, route.Method); err != nil {
+		if err := ws.RemoveRoute(route.Path, route.Method); err != nil {
 			klog.ErrorDepth(5, fmt.Sprintf("failed to remove route %s", route.Path), err)
 			continue
 		}
 	}
 }
 
+// crdStorage is everything prebuilt to serve a CRD, so that it can be swapped in at once
+type crdStorage struct {
+	// gvr is the group, the storage version and the plural of the CRD
+	gvr schema.GroupVersionResource
+	// versions are keyed by the names of served versions
+	versions  map[string]*versionStorage
+	candidate *overlayCandidate
+}
+
+// versionStorage serves a version of a CRD
+type versionStorage struct {
+	storage      *REST
+	requestScope *handlers.RequestScope
+	subResources *apiextensionsv1.CustomResourceSubresources
+}
+
 func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) error {
-	if crd.DeletionTimestamp != nil {
+	built, err := r.newCRDStorage(crd)
+	if err != nil || built == nil {
+		return err
+	}
+
+	r.lock.Lock()
+	for version, served := range built.versions {
+		gvr := built.gvr.GroupResource().WithVersion(version)
+		r.storages[gvr] = served.storage
+		r.requestScopes[gvr] = served.requestScope
+	}
+	// CRDs sharing the same plural are all stored, but only one of them could be served under overlay group
+	candidates := []*overlayCandidate{built.candidate}
+	for _, candidate := range r.overlayCandidates[built.gvr.Resource] {
+		if candidate.gvr != built.gvr {
+			candidates = append(candidates, candidate)
+		}
+	}
+	r.overlayCandidates[built.gvr.Resource] = candidates
+	r.lock.Unlock()
+
+	r.openAPI.updateCRD(built.gvr, crd)
+
+	r.syncOverlayResource(built.gvr.Resource)
+
+	// serve the resource under its original group and every served version as well, such as
+	// /apis/networking.istio.io/v1beta1, so that the proxy can route requests to us without rewriting paths
+	for version, served := range built.versions {
+		gvService := r.ensureGroupVersionService(built.gvr.GroupResource().WithVersion(version).GroupVersion())
+		if gvService != nil {
+			gvService.discovery.updateCRD(crd, version)
+			r.installResourceRoutes(gvService.ws, crd, served.subResources)
+		}
+	}
+
+	return nil
+}
+
+// replaceStorage applies the changes from oldCRD to newCRD. Storages and request scopes are swapped at once for
+// compatible changes, while routes are kept, so that neither in-flight requests nor open watches are interrupted.
+// Breaking changes, such as those of the scope, the kind, the storage version or the served versions, stop serving
+// oldCRD before newCRD is served, where open watches are closed with an error for watchers to re-list.
+func (r *crdHandler) replaceStorage(oldCRD, newCRD *apiextensionsv1.CustomResourceDefinition) error {
+	built, err := r.newCRDStorage(newCRD)
+	if err != nil {
+		return err
+	}
+	if built == nil {
+		r.removeStorage(oldCRD)
 		return nil
 	}
+	if reason := incompatibleChange(oldCRD, newCRD); len(reason) > 0 {
+		klog.Infof("CustomResourceDefinition %s has changed incompatibly: %s", klog.KObj(newCRD), reason)
+		r.removeStorageWithError(oldCRD, apierrors.NewGone(fmt.Sprintf("CustomResourceDefinition %s has changed incompatibly: %s", newCRD.Name, reason)))
+		return r.addStorage(newCRD)
+	}
+
+	gvr := built.gvr
+	r.lock.Lock()
+	for version := range built.versions {
+		if _, ok := r.storages[gvr.GroupResource().WithVersion(version)]; !ok {
+			r.lock.Unlock()
+			return r.addStorage(newCRD)
+		}
+	}
+	for version, served := range built.versions {
+		servedGVR := gvr.GroupResource().WithVersion(version)
+		served.storage.inheritWatches(r.storages[servedGVR])
+		r.storages[servedGVR] = served.storage
+		r.requestScopes[servedGVR] = served.requestScope
+	}
+	candidates := r.overlayCandidates[gvr.Resource]
+	for i, candidate := range candidates {
+		if candidate.gvr == gvr {
+			candidates[i] = built.candidate
+		}
+	}
+	servedInOverlay := false
+	if served, ok := r.overlayResources[gvr.Resource]; ok && served.gvr == gvr {
+		r.overlayResources[gvr.Resource] = built.candidate
+		servedInOverlay = true
+	}
+	r.lock.Unlock()
+
+	r.openAPI.updateCRD(gvr, newCRD)
+	if servedInOverlay {
+		r.versionDiscoveryHandler.updateCRD(newCRD, gvr.Version)
+		r.openAPI.updateCRD(overlayapi.SchemeGroupVersion.WithResource(gvr.Resource), newCRD)
+		if !reflect.DeepEqual(servedSubResources(oldCRD, gvr.Version), built.candidate.subResources) {
+			r.removeResourceRoutes(r.ws, oldCRD)
+			r.installResourceRoutes(r.ws, newCRD, built.candidate.subResources)
+		}
+	}
+	for version, served := range built.versions {
+		if gvService := r.ensureGroupVersionService(gvr.GroupResource().WithVersion(version).GroupVersion()); gvService != nil {
+			gvService.discovery.updateCRD(newCRD, version)
+			if !reflect.DeepEqual(servedSubResources(oldCRD, version), served.subResources) {
+				r.removeResourceRoutes(gvService.ws, oldCRD)
+				r.installResourceRoutes(gvService.ws, newCRD, served.subResources)
+			}
+		}
+	}
+
+	// the group priority may have changed as well
+	r.syncOverlayResource(gvr.Resource)
+	return nil
+}
+
+// incompatibleChange tells why the change from oldCRD to newCRD breaks the objects being served or watched,
+// an empty string if it does not
+func incompatibleChange(oldCRD, newCRD *apiextensionsv1.CustomResourceDefinition) string {
+	oldGVR, err := storageGroupVersionResource(oldCRD)
+	if err != nil {
+		return err.Error()
+	}
+	newGVR, err := storageGroupVersionResource(newCRD)
+	if err != nil {
+		return err.Error()
+	}
+	oldVersions, newVersions := servedVersions(oldCRD), servedVersions(newCRD)
+	switch {
+	case oldGVR != newGVR:
+		return fmt.Sprintf("served as %s instead of %s", newGVR, oldGVR)
+	case oldCRD.Spec.Scope != newCRD.Spec.Scope:
+		return fmt.Sprintf("scope changed from %s to %s", oldCRD.Spec.Scope, newCRD.Spec.Scope)
+	case oldCRD.Spec.Names.Kind != newCRD.Spec.Names.Kind:
+		return fmt.Sprintf("kind changed from %s to %s", oldCRD.Spec.Names.Kind, newCRD.Spec.Names.Kind)
+	case !reflect.DeepEqual(oldVersions, newVersions):
+		return fmt.Sprintf("served versions changed from %v to %v", oldVersions, newVersions)
+	}
+	return ""
+}
+
+// servedVersions returns the names of the served versions of crd
+func servedVersions(crd *apiextensionsv1.CustomResourceDefinition) []string {
+	var versions []string
+	for _, version := range crd.Spec.Versions {
+		if version.Served {
+			versions = append(versions, version.Name)
+		}
+	}
+	return versions
+}
+
+// servedSubResources returns the subresources of given version of crd
+func servedSubResources(crd *apiextensionsv1.CustomResourceDefinition, version string) *apiextensionsv1.CustomResourceSubresources {
+	subResources, _ := apiextensionshelpers.GetSubresourcesForVersion(crd, version)
+	return subResources
+}
+
+// newCRDStorage builds the storages and the request scopes serving every served version of crd, nil if crd cannot
+// be served
+func (r *crdHandler) newCRDStorage(crd *apiextensionsv1.CustomResourceDefinition) (*crdStorage, error) {
+	if crd.DeletionTimestamp != nil {
+		return nil, nil
+	}
 	if r.ws == nil {
-		return errors.New("nil root WebService for crdHandler")
+		return nil, errors.New("nil root WebService for crdHandler")
 	}
 
 	storageVersion, err := apiextensionshelpers.GetCRDStorageVersion(crd)
 	if err != nil {
-		return nil
+		return nil, nil
 	}
 	if !apiextensionshelpers.HasServedCRDVersion(crd, storageVersion) {
 		klog.WarningDepth(4, fmt.Sprintf("no served version found for CustomResourceDefinition %s. skip adding serving info.", klog.KObj(crd)))
-		return nil
+		return nil, nil
 	}
 
-	// register this resource to storage if the priority is the highest
-	if !canBeAddedToStorage(crd.Spec.Group, storageVersion, crd.Spec.Names.Plural, r.apiserviceLister) {
-		return nil
+	built := &crdStorage{
+		gvr:      schema.GroupVersionResource{Group: crd.Spec.Group, Version: storageVersion, Resource: crd.Spec.Names.Plural},
+		versions: map[string]*versionStorage{},
 	}
+	for _, version := range crd.Spec.Versions {
+		if !version.Served {
+			continue
+		}
+		if built.versions[version.Name], err = r.newVersionStorage(crd, version.Name); err != nil {
+			return nil, err
+		}
+	}
+	built.candidate = &overlayCandidate{
+		gvr:          built.gvr,
+		crd:          crd,
+		subResources: built.versions[storageVersion].subResources,
+		priority:     getGroupPriorityMinimum(crd.Spec.Group, storageVersion, r.apiserviceLister),
+	}
+	return built, nil
+}
 
-	r.versionDiscoveryHandler.updateCRD(crd)
-
+// newVersionStorage builds the storage and the request scope serving given version of crd. All versions share the
+// Manifests of the storage version, where objects are converted into the version requested.
+func (r *crdHandler) newVersionStorage(crd *apiextensionsv1.CustomResourceDefinition, version string) (*versionStorage, error) {
 	crdGroupInfo := genericapiserver.NewDefaultAPIGroupInfo(overlayapi.GroupName, Scheme, ParameterCodec, Codecs)
 	var standardSerializers []runtime.SerializerInfo
 	for _, s := range crdGroupInfo.NegotiatedSerializer.SupportedMediaTypes() {
@@ -301,21 +743,31 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		selfLinkPrefix = genericapiserver.APIGroupPrefix + "/" + path.Join(overlayapi.GroupName, overlayapi.SchemeGroupVersion.Version, "namespaces") + "/"
 	}
 
-	restStorage := NewREST(r.kubeRESTClient, r.kcrdClient, ParameterCodec, r.manifestLister, r.reservedNamespace)
+	restStorage := NewREST(r.kubeRESTClient, r.kcrdClient, ParameterCodec, r.manifestLister, r.authorizer, r.reservedNamespaces)
 	restStorage.SetNamespaceScoped(crd.Spec.Scope == apiextensionsv1.NamespaceScoped)
 	restStorage.SetName(resource)
 	restStorage.SetShortNames(crd.Spec.Names.ShortNames)
+	restStorage.SetCategories(crd.Spec.Names.Categories)
 	restStorage.SetKind(crd.Spec.Names.Kind)
 	restStorage.SetGroup(crd.Spec.Group)
-	restStorage.SetVersion(storageVersion)
+	restStorage.SetVersion(version)
+	restStorage.SetTenantCRDs(r.tenantCRDs)
+	restStorage.SetHostCRDs(r.hostCRDs)
+	restStorage.SetWatchCache(r.watchCache)
+	restStorage.SetManifestCache(r.manifestCache)
+	tableConvertor, err := tableconvertor.New(printerColumnsForVersion(crd, version))
+	if err != nil {
+		klog.Warningf("invalid printer columns of CustomResourceDefinition %s, fall back to the default ones: %v", crd.Name, err)
+	}
+	restStorage.SetTableConvertor(tableConvertor)
 
 	groupVersionKind := restStorage.GroupVersionKind(schema.GroupVersion{})
 	groupVersionResource := groupVersionKind.GroupVersion().WithResource(resource)
 	equivalentResourceRegistry := runtime.NewEquivalentResourceRegistry()
 	equivalentResourceRegistry.RegisterKindFor(groupVersionResource, "", groupVersionKind)
-	subResources, err := apiextensionshelpers.GetSubresourcesForVersion(crd, storageVersion)
+	subResources, err := apiextensionshelpers.GetSubresourcesForVersion(crd, version)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if subResources != nil {
 		if subResources.Status != nil {
@@ -326,9 +778,7 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		}
 	}
 
-	r.lock.Lock()
-	r.storages[resource] = restStorage
-	r.requestScopes[resource] = &handlers.RequestScope{
+	requestScope := &handlers.RequestScope{
 		Namer: handlers.ContextBasedNaming{
 			SelfLinker:         meta.NewAccessor(),
 			ClusterScoped:      crd.Spec.Scope == apiextensionsv1.ClusterScoped,
@@ -351,7 +801,114 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		Authorizer:               r.authorizer,
 		MaxRequestBodyBytes:      r.maxRequestBodyBytes,
 	}
-	r.lock.Unlock()
+
+	return &versionStorage{
+		storage:      restStorage,
+		requestScope: requestScope,
+		subResources: subResources,
+	}, nil
+}
+
+// ensureGroupVersionService returns the WebService serving resources under the original group version gv,
+// and creates one when it does not exist yet. A nil value will be returned if the path has been occupied.
+func (r *crdHandler) ensureGroupVersionService(gv schema.GroupVersion) *groupVersionService {
+	r.groupLock.Lock()
+	defer r.groupLock.Unlock()
+
+	if service, ok := r.groupVersionServices[gv]; ok {
+		return service
+	}
+	if r.container == nil || r.groupManager == nil {
+		return nil
+	}
+
+	groupPrefix := path.Join(genericapiserver.APIGroupPrefix, gv.Group)
+	versionPrefix := path.Join(genericapiserver.APIGroupPrefix, gv.String())
+	groupHandler, groupServed := r.groupDiscoveryHandlers[gv.Group]
+	for _, ws := range r.container.RegisteredWebServices() {
+		if ws.RootPath() == versionPrefix || (!groupServed && ws.RootPath() == groupPrefix) {
+			klog.Warningf("path %s has already been registered, skip serving %s under its original group", ws.RootPath(), gv)
+			return nil
+		}
+	}
+
+	mediaTypes, _ := negotiation.MediaTypesForSerializer(r.serializer)
+	if !groupServed {
+		groupHandler = newGroupDiscoveryHandler(r.serializer, gv.Group)
+		groupHandler.filter = func(req *http.Request) func(string) bool {
+			return r.tenantVersionFilter(req, gv.Group)
+		}
+		groupHandler.ws = r.newWebService(groupPrefix)
+		groupHandler.ws.Route(groupHandler.ws.GET("/").To(groupHandler.handle).
+			Doc("get information of a group").
+			Operation("getAPIGroup").
+			Produces(mediaTypes...).
+			Consumes(mediaTypes...).
+			Writes(metav1.APIGroup{}))
+		r.container.Add(groupHandler.ws)
+		r.groupDiscoveryHandlers[gv.Group] = groupHandler
+	}
+
+	service := &groupVersionService{
+		ws:        r.newWebService(versionPrefix),
+		discovery: newVersionDiscoveryHandler(r.serializer, gv, nil),
+	}
+	service.discovery.filter = func(req *http.Request) func(metav1.APIResource) bool {
+		return r.tenantResourceFilter(req, gv)
+	}
+	service.ws.Route(service.ws.GET("/").To(service.discovery.handle).
+		Doc("get available resources").
+		Operation("getAPIResources").
+		Produces(mediaTypes...).
+		Consumes(mediaTypes...).
+		Writes(metav1.APIResourceList{}))
+	r.container.Add(service.ws)
+	r.groupVersionServices[gv] = service
+
+	r.groupManager.AddGroup(groupHandler.addVersion(gv))
+	return service
+}
+
+// removeGroupVersionServices stops serving given CRD under its original group,
+// and unregisters the group version (and the group) once no resources are left.
+func (r *crdHandler) removeGroupVersionServices(crd *apiextensionsv1.CustomResourceDefinition) {
+	r.groupLock.Lock()
+	defer r.groupLock.Unlock()
+
+	for gv, service := range r.groupVersionServices {
+		if gv.Group != crd.Spec.Group {
+			continue
+		}
+
+		service.discovery.removeCRD(crd)
+		r.removeResourceRoutes(service.ws, crd)
+		if !service.discovery.isEmpty() {
+			continue
+		}
+
+		if err := r.container.Remove(service.ws); err != nil {
+			klog.ErrorDepth(5, fmt.Sprintf("failed to remove WebService %s", service.ws.RootPath()), err)
+		}
+		delete(r.groupVersionServices, gv)
+
+		groupHandler := r.groupDiscoveryHandlers[gv.Group]
+		if apiGroup, remaining := groupHandler.removeVersion(gv); remaining {
+			r.groupManager.AddGroup(apiGroup)
+			continue
+		}
+		r.groupManager.RemoveGroup(gv.Group)
+		if err := r.container.Remove(groupHandler.ws); err != nil {
+			klog.ErrorDepth(5, fmt.Sprintf("failed to remove WebService %s", groupHandler.ws.RootPath()), err)
+		}
+		delete(r.groupDiscoveryHandlers, gv.Group)
+	}
+}
+
+// installResourceRoutes registers the routes serving given CRD onto target WebService.
+func (r *crdHandler) installResourceRoutes(target *restful.WebService, crd *apiextensionsv1.CustomResourceDefinition,
+	subResources *apiextensionsv1.CustomResourceSubresources) {
+	kind := crd.Spec.Names.Kind
+	resource := crd.Spec.Names.Plural
 
 	var resourcePath string
 	var namespaced string
@@ -369,7 +926,7 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 
 	// GET: Get a resource.
 	func() {
-		ws := r.newWebService()
+		ws := r.newWebService(target.RootPath())
 		route := ws.GET(resourcePath + "/{name}").
 			Doc("read the specified " + kind).
 			Param(nameParam).
@@ -378,12 +935,12 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		if len(namespaced) > 0 {
 			route.Param(namespaceParam)
 		}
-		r.ws.Route(route)
+		target.Route(route)
 	}()
 
 	// LIST: List all resources of a kind.
 	func() {
-		ws := r.newWebService()
+		ws := r.newWebService(target.RootPath())
 		route := ws.GET(resourcePath).
 			Doc("list or watch objects of kind " + kind).
 			Operation("list" + namespaced + kind).
@@ -391,7 +948,7 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		if len(namespaced) > 0 {
 			route.Param(namespaceParam)
 		}
-		r.ws.Route(route)
+		target.Route(route)
 	}()
 
 	// LIST: List resources for all namespaces
@@ -399,17 +956,17 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		if crd.Spec.Scope == apiextensionsv1.ClusterScoped {
 			return
 		}
-		ws := r.newWebService()
+		ws := r.newWebService(target.RootPath())
 		route := ws.GET(resource).
 			Doc("list or watch objects of kind " + kind + "for all namespaces").
 			Operation("list" + namespaced + kind + "ForAllNamespaces").
 			To(r.handle)
-		r.ws.Route(route)
+		target.Route(route)
 	}()
 
 	// PUT: Update a resource.
 	func() {
-		ws := r.newWebService()
+		ws := r.newWebService(target.RootPath())
 		route := ws.PUT(resourcePath + "/{name}").
 			Doc("replace the specified " + kind).
 			Param(nameParam).
@@ -418,12 +975,12 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		if len(namespaced) > 0 {
 			route.Param(namespaceParam)
 		}
-		r.ws.Route(route)
+		target.Route(route)
 	}()
 
 	// PATCH: Partially update a resource
 	func() {
-		ws := r.newWebService()
+		ws := r.newWebService(target.RootPath())
 		route := ws.PATCH(resourcePath + "/{name}").
 			Doc("partially update the specified " + kind).
 			Param(nameParam).
@@ -432,13 +989,13 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		if len(namespaced) > 0 {
 			route.Param(namespaceParam)
 		}
-		r.ws.Route(route)
+		target.Route(route)
 	}()
 
 	// POST: Create a resource
 	func() {
 		article := endpoints.GetArticleForNoun(kind, " ")
-		ws := r.newWebService()
+		ws := r.newWebService(target.RootPath())
 		route := ws.POST(resourcePath).
 			Doc("create" + article + kind).
 			Operation("create" + namespaced + kind).
@@ -446,13 +1003,13 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		if len(namespaced) > 0 {
 			route.Param(namespaceParam)
 		}
-		r.ws.Route(route)
+		target.Route(route)
 	}()
 
 	// DELETE: Delete a resource.
 	func() {
 		article := endpoints.GetArticleForNoun(kind, " ")
-		ws := r.newWebService()
+		ws := r.newWebService(target.RootPath())
 		route := ws.DELETE(resourcePath + "/{name}").
 			Doc("delete" + article + kind).
 			Operation("delete" + namespaced + kind).
@@ -460,12 +1017,12 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		if len(namespaced) > 0 {
 			route.Param(namespaceParam)
 		}
-		r.ws.Route(route)
+		target.Route(route)
 	}()
 
 	// DELETECOLLECTION
 	func() {
-		ws := r.newWebService()
+		ws := r.newWebService(target.RootPath())
 		route := ws.PATCH(resourcePath).
 			Doc("delete collection of " + kind).
 			Operation("deletecollection" + namespaced + kind).
@@ -473,7 +1030,7 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 		if len(namespaced) > 0 {
 			route.Param(namespaceParam)
 		}
-		r.ws.Route(route)
+		target.Route(route)
 	}()
 
 	// status subresource
@@ -488,7 +1045,7 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 
 		// GET: Get subresource status.
 		func() {
-			ws := r.newWebService()
+			ws := r.newWebService(target.RootPath())
 			route := ws.GET(resourcePath + "/{name}/status").
 				Doc("read status of the specified " + kind).
 				Param(nameParam).
@@ -497,12 +1054,12 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 			if len(namespaced) > 0 {
 				route.Param(namespaceParam)
 			}
-			r.ws.Route(route)
+			target.Route(route)
 		}()
 
 		// PUT: Update subresource status.
 		func() {
-			ws := r.newWebService()
+			ws := r.newWebService(target.RootPath())
 			route := ws.PUT(resourcePath + "/{name}/status").
 				Doc("replace status of the specified " + kind).
 				Param(nameParam).
@@ -511,12 +1068,12 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 			if len(namespaced) > 0 {
 				route.Param(namespaceParam)
 			}
-			r.ws.Route(route)
+			target.Route(route)
 		}()
 
 		// PATCH: Partially update subresource status
 		func() {
-			ws := r.newWebService()
+			ws := r.newWebService(target.RootPath())
 			route := ws.PATCH(resourcePath + "/{name}/status").
 				Doc("partially update status of the specified " + kind).
 				Param(nameParam).
@@ -525,15 +1082,14 @@ func (r *crdHandler) addStorage(crd *apiextensionsv1.CustomResourceDefinition) e
 			if len(namespaced) > 0 {
 				route.Param(namespaceParam)
 			}
-			r.ws.Route(route)
+			target.Route(route)
 		}()
 	}
 
-	return nil
 }
 
-// newWebService creates a new restful webservice with the api installer's prefix and version.
-func (r *crdHandler) newWebService() *restful.WebService {
+// newWebService creates a new restful webservice with given prefix.
+func (r *crdHandler) newWebService(prefix string) *restful.WebService {
 	mediaTypes, streamMediaTypes := negotiation.MediaTypesForSerializer(r.serializer)
 
 	// Backwards compatibility, we accepted objects with empty content-type at V1.
@@ -542,7 +1098,7 @@ func (r *crdHandler) newWebService() *restful.WebService {
 
 	// prefix contains "prefix/group/version"
 	ws := new(restful.WebService)
-	ws.Path(r.rootPrefix).Doc("API at " + r.rootPrefix).
+	ws.Path(prefix).Doc("API at " + prefix).
 		Consumes("*/*").
 		Produces(append(mediaTypes, streamMediaTypes...)...).
 		Param(restful.QueryParameter("pretty", "If 'true', then the output is pretty printed."))
@@ -579,10 +1135,35 @@ func (r *crdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	gvr := schema.GroupVersionResource{Group: requestInfo.APIGroup, Version: requestInfo.APIVersion, Resource: requestInfo.Resource}
+	overlay := gvr.GroupVersion() == overlayapi.SchemeGroupVersion
+	r.lock.RLock()
+	if overlay {
+		if served, ok := r.overlayResources[requestInfo.Resource]; ok {
+			gvr = served.gvr
+		}
+	}
+	tenantCRDs := r.tenantCRDs
+	r.lock.RUnlock()
+	if tenantCRDs != nil {
+		var err error
+		if gvr, err = r.tenantGroupVersionResource(ctx, gvr, overlay); err != nil {
+			responsewriters.ErrorNegotiated(err, Codecs, schema.GroupVersion{Group: requestInfo.APIGroup, Version: requestInfo.APIVersion}, w, req)
+			return
+		}
+	}
+
 	r.lock.RLock()
-	requestScope := r.requestScopes[requestInfo.Resource]
-	storage := r.storages[requestInfo.Resource]
+	requestScope := r.requestScopes[gvr]
+	storage := r.storages[gvr]
 	r.lock.RUnlock()
+	if storage == nil {
+		responsewriters.ErrorNegotiated(
+			apierrors.NewNotFound(schema.GroupResource{Group: requestInfo.APIGroup, Resource: requestInfo.Resource}, requestInfo.Name),
+			Codecs, schema.GroupVersion{Group: requestInfo.APIGroup, Version: requestInfo.APIVersion}, w, req,
+		)
+		return
+	}
 	switch requestInfo.Verb {
 	case "get":
 		handlers.GetResource(storage, requestScope).ServeHTTP(w, req)
@@ -611,17 +1192,41 @@ func (r *crdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// overlayCandidate is a CRD which could be served under overlay group by its plural
+type overlayCandidate struct {
+	gvr          schema.GroupVersionResource
+	crd          *apiextensionsv1.CustomResourceDefinition
+	subResources *apiextensionsv1.CustomResourceSubresources
+	priority     int32
+}
+
+// storageGroupVersionResource returns the group, the storage version and the plural of crd
+func storageGroupVersionResource(crd *apiextensionsv1.CustomResourceDefinition) (schema.GroupVersionResource, error) {
+	storageVersion, err := apiextensionshelpers.GetCRDStorageVersion(crd)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	return schema.GroupVersionResource{Group: crd.Spec.Group, Version: storageVersion, Resource: crd.Spec.Names.Plural}, nil
+}
+
 type versionDiscoveryHandler struct {
 	lock sync.RWMutex
 
+	serializer         runtime.NegotiatedSerializer
+	groupVersion       schema.GroupVersion
 	apiVersionHandler  *discovery.APIVersionHandler
 	nonCRDAPIResources []metav1.APIResource
+	// filter returns a function telling whether an APIResource of a CRD is visible to the requester,
+	// nil to show all
+	filter func(req *http.Request) func(metav1.APIResource) bool
 
 	crdAPIResources []metav1.APIResource
 }
 
 func newVersionDiscoveryHandler(serializer runtime.NegotiatedSerializer, groupVersion schema.GroupVersion, nonCRDAPIResources []metav1.APIResource) *versionDiscoveryHandler {
 	s := &versionDiscoveryHandler{
+		serializer:         serializer,
+		groupVersion:       groupVersion,
 		nonCRDAPIResources: nonCRDAPIResources,
 		crdAPIResources:    []metav1.APIResource{},
 	}
@@ -632,7 +1237,7 @@ func newVersionDiscoveryHandler(serializer runtime.NegotiatedSerializer, groupVe
 func (h *versionDiscoveryHandler) updateCRDAPIResource(apiResource metav1.APIResource) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	apiResource.Categories = []string{utils.Category}
+	apiResource.Categories = withOverlayCategory(apiResource.Categories)
 
 	var index *int
 	for idx, resource := range h.crdAPIResources {
@@ -648,12 +1253,13 @@ func (h *versionDiscoveryHandler) updateCRDAPIResource(apiResource metav1.APIRes
 	}
 }
 
-func (h *versionDiscoveryHandler) updateCRD(crd *apiextensionsv1.CustomResourceDefinition) {
-	var servedVersion string
+// updateCRD publishes given served version of crd
+func (h *versionDiscoveryHandler) updateCRD(crd *apiextensionsv1.CustomResourceDefinition, servedVersion string) {
+	// all served versions share the storage version, whose hash tells whether objects are stored alike
+	storageVersion, _ := apiextensionshelpers.GetCRDStorageVersion(crd)
 	var subResourceScale bool
 	for _, version := range crd.Spec.Versions {
-		if version.Storage && version.Served {
-			servedVersion = version.Name
+		if version.Name == servedVersion {
 			subResourceScale = version.Subresources != nil && version.Subresources.Scale != nil
 			break
 		}
@@ -675,12 +1281,16 @@ func (h *versionDiscoveryHandler) updateCRD(crd *apiextensionsv1.CustomResourceD
 			"watch",
 		},
 		ShortNames:         crd.Spec.Names.ShortNames,
-		StorageVersionHash: apiserverdiscovery.StorageVersionHash(crd.Spec.Group, servedVersion, crd.Spec.Names.Kind),
+		Categories:         crd.Spec.Names.Categories,
+		StorageVersionHash: apiserverdiscovery.StorageVersionHash(crd.Spec.Group, storageVersion, crd.Spec.Names.Kind),
 	}
 	h.updateCRDAPIResource(*apiResource)
 
 	// all these overlay apis are considered as templates, updating subresources, such as 'status' makes no sense.
 	// so we only handle "scale" subresource
+	if !subResourceScale {
+		h.removeCRDAPIResource(fmt.Sprintf("%s/scale", apiResource.Name))
+	}
 	if subResourceScale {
 		scaleAPIResource := apiResource.DeepCopy()
 		scaleAPIResource.Name = fmt.Sprintf("%s/scale", apiResource.Name)
@@ -689,10 +1299,22 @@ func (h *versionDiscoveryHandler) updateCRD(crd *apiextensionsv1.CustomResourceD
 		scaleAPIResource.Kind = "Scale"
 		scaleAPIResource.Verbs = []string{"get", "patch", "update"}
 		scaleAPIResource.StorageVersionHash = ""
+		scaleAPIResource.Categories = nil
 		h.updateCRDAPIResource(*scaleAPIResource)
 	}
 }
 
+func (h *versionDiscoveryHandler) removeCRDAPIResource(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for idx, resource := range h.crdAPIResources {
+		if resource.Name == name {
+			h.crdAPIResources = append(h.crdAPIResources[:idx], h.crdAPIResources[idx+1:]...)
+			return
+		}
+	}
+}
+
 func (h *versionDiscoveryHandler) removeCRD(crd *apiextensionsv1.CustomResourceDefinition) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
@@ -715,6 +1337,12 @@ func (h *versionDiscoveryHandler) handle(req *restful.Request, resp *restful.Res
 }
 
 func (h *versionDiscoveryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if visible := h.visibilityOf(req); visible != nil {
+		responsewriters.WriteObjectNegotiated(h.serializer, negotiation.DefaultEndpointRestrictions, schema.GroupVersion{}, w, req, http.StatusOK,
+			&metav1.APIResourceList{GroupVersion: h.groupVersion.String(), APIResources: h.filterAPIResources(visible)})
+		return
+	}
+
 	h.lock.RLock()
 	defer h.lock.RUnlock()
 	h.apiVersionHandler.ServeHTTP(w, req)
@@ -723,3 +1351,175 @@ func (h *versionDiscoveryHandler) ServeHTTP(w http.ResponseWriter, req *http.Req
 func (h *versionDiscoveryHandler) ListAPIResources() []metav1.APIResource {
 	return append(h.nonCRDAPIResources, h.crdAPIResources...)
 }
+
+// visibleAPIResources returns a copy of the APIResources visible to the requester of req
+func (h *versionDiscoveryHandler) visibleAPIResources(req *http.Request) []metav1.APIResource {
+	return h.filterAPIResources(h.visibilityOf(req))
+}
+
+// visibilityOf returns a function telling whether an APIResource of a CRD is visible to the requester of req,
+// nil if all are visible
+func (h *versionDiscoveryHandler) visibilityOf(req *http.Request) func(metav1.APIResource) bool {
+	if h.filter == nil {
+		return nil
+	}
+	return h.filter(req)
+}
+
+// filterAPIResources returns a copy of the APIResources, with those of CRDs filtered by visible
+func (h *versionDiscoveryHandler) filterAPIResources(visible func(metav1.APIResource) bool) []metav1.APIResource {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	apiResources := append([]metav1.APIResource{}, h.nonCRDAPIResources...)
+	for _, apiResource := range h.crdAPIResources {
+		if visible == nil || visible(apiResource) {
+			apiResources = append(apiResources, apiResource)
+		}
+	}
+	return apiResources
+}
+
+func (h *versionDiscoveryHandler) isEmpty() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.nonCRDAPIResources) == 0 && len(h.crdAPIResources) == 0
+}
+
+// groupVersionService serves overlay resources under their original group version, such as /apis/networking.istio.io/v1beta1
+type groupVersionService struct {
+	ws        *restful.WebService
+	discovery *versionDiscoveryHandler
+}
+
+// groupDiscoveryHandler serves the discovery document of an original group, such as /apis/networking.istio.io
+type groupDiscoveryHandler struct {
+	lock sync.RWMutex
+
+	serializer runtime.NegotiatedSerializer
+	ws         *restful.WebService
+
+	group           string
+	versions        []metav1.GroupVersionForDiscovery
+	apiGroupHandler *discovery.APIGroupHandler
+	// filter returns a function telling whether a version is visible to the requester, nil to show all
+	filter func(req *http.Request) func(version string) bool
+}
+
+func newGroupDiscoveryHandler(serializer runtime.NegotiatedSerializer, group string) *groupDiscoveryHandler {
+	return &groupDiscoveryHandler{
+		serializer: serializer,
+		group:      group,
+	}
+}
+
+// addVersion adds gv to the group and returns the updated APIGroup
+func (h *groupDiscoveryHandler) addVersion(gv schema.GroupVersion) metav1.APIGroup {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, v := range h.versions {
+		if v.Version == gv.Version {
+			return h.apiGroupLocked()
+		}
+	}
+	h.versions = append(h.versions, metav1.GroupVersionForDiscovery{
+		GroupVersion: gv.String(),
+		Version:      gv.Version,
+	})
+	// the preferred version comes first
+	sort.SliceStable(h.versions, func(i, j int) bool {
+		return version.CompareKubeAwareVersionStrings(h.versions[i].Version, h.versions[j].Version) > 0
+	})
+	return h.apiGroupLocked()
+}
+
+// removeVersion removes gv from the group and returns the updated APIGroup,
+// together with whether there are versions remaining.
+func (h *groupDiscoveryHandler) removeVersion(gv schema.GroupVersion) (metav1.APIGroup, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var versions []metav1.GroupVersionForDiscovery
+	for _, v := range h.versions {
+		if v.Version != gv.Version {
+			versions = append(versions, v)
+		}
+	}
+	h.versions = versions
+	return h.apiGroupLocked(), len(h.versions) > 0
+}
+
+// apiGroup returns the APIGroup with versions ordered by preference
+func (h *groupDiscoveryHandler) apiGroup() metav1.APIGroup {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.newAPIGroupLocked()
+}
+
+// visibleAPIGroup returns the APIGroup with the versions visible to the requester of req
+func (h *groupDiscoveryHandler) visibleAPIGroup(req *http.Request) metav1.APIGroup {
+	return h.filterAPIGroup(h.visibilityOf(req))
+}
+
+// visibilityOf returns a function telling whether a version is visible to the requester of req, nil if all are visible
+func (h *groupDiscoveryHandler) visibilityOf(req *http.Request) func(string) bool {
+	if h.filter == nil {
+		return nil
+	}
+	return h.filter(req)
+}
+
+// filterAPIGroup returns the APIGroup with the versions filtered by visible
+func (h *groupDiscoveryHandler) filterAPIGroup(visible func(string) bool) metav1.APIGroup {
+	apiGroup := h.apiGroup()
+	if visible == nil {
+		return apiGroup
+	}
+
+	var versions []metav1.GroupVersionForDiscovery
+	for _, v := range apiGroup.Versions {
+		if visible(v.Version) {
+			versions = append(versions, v)
+		}
+	}
+	apiGroup.Versions = versions
+	apiGroup.PreferredVersion = metav1.GroupVersionForDiscovery{}
+	if len(versions) > 0 {
+		apiGroup.PreferredVersion = versions[0]
+	}
+	return apiGroup
+}
+
+func (h *groupDiscoveryHandler) newAPIGroupLocked() metav1.APIGroup {
+	apiGroup := metav1.APIGroup{
+		Name:     h.group,
+		Versions: append([]metav1.GroupVersionForDiscovery{}, h.versions...),
+	}
+	if len(h.versions) > 0 {
+		apiGroup.PreferredVersion = h.versions[0]
+	}
+	return apiGroup
+}
+
+func (h *groupDiscoveryHandler) apiGroupLocked() metav1.APIGroup {
+	apiGroup := h.newAPIGroupLocked()
+	h.apiGroupHandler = discovery.NewAPIGroupHandler(h.serializer, apiGroup)
+	return apiGroup
+}
+
+// handle returns a handler which will return the api.GroupAndVersion of the group.
+func (h *groupDiscoveryHandler) handle(req *restful.Request, resp *restful.Response) {
+	h.ServeHTTP(resp.ResponseWriter, req.Request)
+}
+
+func (h *groupDiscoveryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if visible := h.visibilityOf(req); visible != nil {
+		apiGroup := h.filterAPIGroup(visible)
+		responsewriters.WriteObjectNegotiated(h.serializer, negotiation.DefaultEndpointRestrictions, schema.GroupVersion{}, w, req, http.StatusOK, &apiGroup)
+		return
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	h.apiGroupHandler.ServeHTTP(w, req)
+}
@@ -0,0 +1,416 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/discovery"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/tools/cache"
+	apiregistrationapis "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	apiservicelisters "k8s.io/kube-aggregator/pkg/client/listers/apiregistration/v1"
+
+	kcrd "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	overlayapi "github.com/jijiechen/external-crd/pkg/apis/overlay/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func newTestCRD(group, version, plural, kind string) *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: plural + "." + group},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:   plural,
+				Singular: strings.ToLower(kind),
+				Kind:     kind,
+			},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{Name: version, Served: true, Storage: true},
+			},
+		},
+	}
+}
+
+// newTestCRDHandler returns a crdHandler with its root WebService set, but without event handlers
+func newTestCRDHandler(apiserviceLister apiservicelisters.APIServiceLister, container *restful.Container,
+	groupManager discovery.GroupManager) *crdHandler {
+	r := NewCRDHandler(nil, nil, nil, apiserviceLister, nil, container, groupManager, nil,
+		0, 0, nil, nil, Codecs, utils.NewReservedNamespaces("kcrd-reserved", 0))
+	r.ws = r.newWebService(r.rootPrefix)
+	r.versionDiscoveryHandler = newVersionDiscoveryHandler(Codecs, overlayapi.SchemeGroupVersion, nil)
+	return r
+}
+
+func TestCRDHandlerSharedPlural(t *testing.T) {
+	newAPIService := func(group, version string, priority int32) *apiregistrationapis.APIService {
+		return &apiregistrationapis.APIService{
+			ObjectMeta: metav1.ObjectMeta{Name: version + "." + group},
+			Spec:       apiregistrationapis.APIServiceSpec{Group: group, Version: version, GroupPriorityMinimum: priority},
+		}
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = indexer.Add(newAPIService("networking.istio.io", "v1beta1", 1000))
+	_ = indexer.Add(newAPIService("gateway.networking.k8s.io", "v1beta1", 1100))
+
+	r := newTestCRDHandler(apiservicelisters.NewAPIServiceLister(indexer), restful.NewContainer(), discovery.NewRootAPIsHandler(nil, Codecs))
+
+	istio := newTestCRD("networking.istio.io", "v1beta1", "gateways", "Gateway")
+	gatewayAPI := newTestCRD("gateway.networking.k8s.io", "v1beta1", "gateways", "Gateway")
+	for _, crd := range []*apiextensionsv1.CustomResourceDefinition{istio, gatewayAPI} {
+		if err := r.addStorage(crd); err != nil {
+			t.Fatalf("addStorage() error = %v", err)
+		}
+	}
+
+	for _, crd := range []*apiextensionsv1.CustomResourceDefinition{istio, gatewayAPI} {
+		if !r.isServing(crd) {
+			t.Errorf("expect %s to be served", crd.Name)
+		}
+	}
+	overlayGroupResource := func() schema.GroupResource {
+		return r.overlayResources["gateways"].gvr.GroupResource()
+	}
+	if got, want := overlayGroupResource(), (schema.GroupResource{Group: "gateway.networking.k8s.io", Resource: "gateways"}); got != want {
+		t.Errorf("gateways in overlay group = %v, want %v", got, want)
+	}
+
+	r.removeStorage(gatewayAPI)
+	if r.isServing(gatewayAPI) {
+		t.Errorf("expect %s not to be served", gatewayAPI.Name)
+	}
+	if got, want := overlayGroupResource(), (schema.GroupResource{Group: "networking.istio.io", Resource: "gateways"}); got != want {
+		t.Errorf("gateways in overlay group = %v, want %v", got, want)
+	}
+	// get, list, list for all namespaces, replace, patch, create, delete and deletecollection
+	if got := len(r.ws.Routes()); got != 8 {
+		t.Errorf("expect 8 routes in overlay group, got %d", got)
+	}
+	if got := len(r.versionDiscoveryHandler.ListAPIResources()); got != 1 {
+		t.Errorf("expect 1 resource in overlay discovery, got %d", got)
+	}
+	if _, ok := r.groupDiscoveryHandlers["gateway.networking.k8s.io"]; ok {
+		t.Errorf("expect group gateway.networking.k8s.io to be unregistered")
+	}
+}
+
+type fakeTenantCRDs map[string][]*apiextensionsv1.CustomResourceDefinition
+
+func (f fakeTenantCRDs) ForTenant(clusterID, namespace string) []*apiextensionsv1.CustomResourceDefinition {
+	return f[utils.TenantKey(clusterID, namespace)]
+}
+
+func (f fakeTenantCRDs) List() []*apiextensionsv1.CustomResourceDefinition {
+	return nil
+}
+
+func (f fakeTenantCRDs) AddEventHandler(cache.ResourceEventHandler) {}
+
+func (f fakeTenantCRDs) HasSynced() bool {
+	return true
+}
+
+func TestCRDHandlerTenantCRDs(t *testing.T) {
+	container := restful.NewContainer()
+	groupManager := discovery.NewRootAPIsHandler(discovery.DefaultAddresses{DefaultAddress: "127.0.0.1"}, Codecs)
+	container.Add(groupManager.WebService())
+	r := newTestCRDHandler(apiservicelisters.NewAPIServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		container, groupManager)
+
+	v1alpha3 := newTestCRD("networking.istio.io", "v1alpha3", "gateways", "Gateway")
+	v1beta1 := newTestCRD("networking.istio.io", "v1beta1", "gateways", "Gateway")
+	v1beta1.Spec.Versions[0].Schema = &apiextensionsv1.CustomResourceValidation{
+		OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+			Type: "object",
+			Properties: map[string]apiextensionsv1.JSONSchemaProps{
+				"spec": {
+					Type:       "object",
+					Properties: map[string]apiextensionsv1.JSONSchemaProps{"replicas": {Type: "integer"}},
+				},
+			},
+		},
+	}
+	r.SetTenantCRDs(fakeTenantCRDs{
+		"cls-foo/ns-old": {v1alpha3},
+		"cls-foo/ns-new": {v1beta1},
+	})
+	for _, crd := range []*apiextensionsv1.CustomResourceDefinition{v1alpha3, v1beta1} {
+		if err := r.addStorage(crd); err != nil {
+			t.Fatalf("addStorage() error = %v", err)
+		}
+	}
+
+	tenantContext := func(namespace string) context.Context {
+		u := &user.DefaultInfo{Name: "system:serviceaccount:external-crd-system:biz-ab12-cls-foo-ab12-" + namespace}
+		return request.WithNamespace(request.WithUser(context.Background(), u), namespace)
+	}
+	overlayGVR := r.overlayResources["gateways"].gvr
+	for namespace, want := range map[string]string{"ns-old": "v1alpha3", "ns-new": "v1beta1"} {
+		gvr, err := r.tenantGroupVersionResource(tenantContext(namespace), overlayGVR, true)
+		if err != nil || gvr.Version != want {
+			t.Errorf("gateways in overlay group for tenant in %s = %v, %v, want version %s", namespace, gvr, err, want)
+		}
+	}
+	v1beta1GVR := schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1beta1", Resource: "gateways"}
+	if _, err := r.tenantGroupVersionResource(tenantContext("ns-old"), v1beta1GVR, false); !apierrors.IsNotFound(err) {
+		t.Errorf("expect v1beta1 gateways not to be found for tenant in ns-old, got %v", err)
+	}
+
+	discover := func(namespace, path string) *metav1.APIResourceList {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(tenantContext(namespace))
+		recorder := httptest.NewRecorder()
+		container.ServeHTTP(recorder, req)
+		list := &metav1.APIResourceList{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), list); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return list
+	}
+	if list := discover("ns-old", "/apis/networking.istio.io/v1beta1"); len(list.APIResources) != 0 {
+		t.Errorf("expect no resources in v1beta1 for tenant in ns-old, got %v", list.APIResources)
+	}
+	if list := discover("ns-new", "/apis/networking.istio.io/v1beta1"); len(list.APIResources) != 1 {
+		t.Errorf("expect gateways in v1beta1 for tenant in ns-new, got %v", list.APIResources)
+	}
+
+	storage := r.storages[v1beta1GVR]
+	invalid := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1beta1",
+		"kind":       "Gateway",
+		"metadata":   map[string]interface{}{"name": "gw"},
+		"spec":       map[string]interface{}{"replicas": "two"},
+	}}
+	if _, err := storage.validateTenantObject(tenantContext("ns-new"), "cls-foo", invalid); !apierrors.IsInvalid(err) {
+		t.Errorf("expect the object to be invalid against the schema of the tenant, got %v", err)
+	}
+	if _, err := storage.validateTenantObject(tenantContext("ns-old"), "cls-foo", invalid); !apierrors.IsNotFound(err) {
+		t.Errorf("expect v1beta1 gateways not to be found for tenant in ns-old, got %v", err)
+	}
+}
+
+func TestCRDHandlerCategoriesAndPrinterColumns(t *testing.T) {
+	r := newTestCRDHandler(apiservicelisters.NewAPIServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		restful.NewContainer(), discovery.NewRootAPIsHandler(nil, Codecs))
+
+	crd := newTestCRD("networking.istio.io", "v1beta1", "virtualservices", "VirtualService")
+	crd.Spec.Names.Categories = []string{"istio-io", "networking-istio-io"}
+	crd.Spec.Versions[0].AdditionalPrinterColumns = []apiextensionsv1.CustomResourceColumnDefinition{
+		{Name: "Gateways", Type: "string", JSONPath: ".spec.gateways"},
+		{Name: "Hosts", Type: "string", JSONPath: ".spec.hosts"},
+	}
+	if err := r.addStorage(crd); err != nil {
+		t.Fatalf("addStorage() error = %v", err)
+	}
+
+	wantCategories := []string{utils.Category, "istio-io", "networking-istio-io"}
+	apiResources := r.versionDiscoveryHandler.ListAPIResources()
+	if len(apiResources) != 1 || !reflect.DeepEqual(apiResources[0].Categories, wantCategories) {
+		t.Errorf("expect categories %v in overlay discovery, got %v", wantCategories, apiResources)
+	}
+	storage := r.storages[schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1beta1", Resource: "virtualservices"}]
+	if got := storage.Categories(); !reflect.DeepEqual(got, wantCategories) {
+		t.Errorf("Categories() = %v, want %v", got, wantCategories)
+	}
+
+	vs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1beta1",
+		"kind":       "VirtualService",
+		"metadata":   map[string]interface{}{"name": "reviews", "namespace": "ns-foo"},
+		"spec":       map[string]interface{}{"gateways": []interface{}{"gw"}, "hosts": []interface{}{"reviews"}},
+	}}
+	table, err := storage.ConvertToTable(context.Background(), vs, nil)
+	if err != nil {
+		t.Fatalf("ConvertToTable() error = %v", err)
+	}
+	var columns []string
+	for _, column := range table.ColumnDefinitions {
+		columns = append(columns, column.Name)
+	}
+	if want := []string{"Name", "Gateways", "Hosts"}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("expect columns %v, got %v", want, columns)
+	}
+	if len(table.Rows) != 1 || table.Rows[0].Cells[2] != `["reviews"]` {
+		t.Errorf("unexpected rows %v", table.Rows)
+	}
+}
+
+func TestCRDHandlerReplaceStorage(t *testing.T) {
+	r := newTestCRDHandler(apiservicelisters.NewAPIServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		restful.NewContainer(), discovery.NewRootAPIsHandler(nil, Codecs))
+
+	gvr := schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1beta1", Resource: "gateways"}
+	oldCRD := newTestCRD(gvr.Group, gvr.Version, gvr.Resource, "Gateway")
+	if err := r.addStorage(oldCRD); err != nil {
+		t.Fatalf("addStorage() error = %v", err)
+	}
+	routes := len(r.ws.Routes())
+	previous := r.storages[gvr]
+	fake := watch.NewFake()
+	w := previous.watches.track(fake)
+
+	// compatible changes swap the storage, while keeping the routes and the open watches
+	newCRD := oldCRD.DeepCopy()
+	newCRD.Spec.Names.ShortNames = []string{"gw"}
+	if err := r.replaceStorage(oldCRD, newCRD); err != nil {
+		t.Fatalf("replaceStorage() error = %v", err)
+	}
+	current := r.storages[gvr]
+	if current == previous || current.watches != previous.watches {
+		t.Errorf("expect the storage to be swapped, and to keep tracking open watches")
+	}
+	if got := len(r.ws.Routes()); got != routes {
+		t.Errorf("expect %d routes to be kept, got %d", routes, got)
+	}
+	if apiResources := r.versionDiscoveryHandler.ListAPIResources(); len(apiResources) != 1 ||
+		!reflect.DeepEqual(apiResources[0].ShortNames, []string{"gw"}) {
+		t.Errorf("expect the short names to be updated in overlay discovery, got %v", apiResources)
+	}
+	go fake.Add(&unstructured.Unstructured{})
+	if event := <-w.ResultChan(); event.Type != watch.Added {
+		t.Errorf("expect the watch to stay open, got %v", event)
+	}
+
+	// breaking changes close open watches with 410
+	clusterScoped := newCRD.DeepCopy()
+	clusterScoped.Spec.Scope = apiextensionsv1.ClusterScoped
+	if err := r.replaceStorage(newCRD, clusterScoped); err != nil {
+		t.Fatalf("replaceStorage() error = %v", err)
+	}
+	event, ok := <-w.ResultChan()
+	if !ok || event.Type != watch.Error {
+		t.Fatalf("expect an error event before the watch is closed, got %v", event)
+	}
+	if status, _ := event.Object.(*metav1.Status); status == nil || status.Code != http.StatusGone {
+		t.Errorf("expect the watch to be closed with 410, got %v", event.Object)
+	}
+	if _, ok := <-w.ResultChan(); ok {
+		t.Errorf("expect the watch to be closed")
+	}
+	if r.storages[gvr].namespaced {
+		t.Errorf("expect the storage to be cluster-scoped")
+	}
+}
+
+func TestCRDHandlerServedVersions(t *testing.T) {
+	container := restful.NewContainer()
+	groupManager := discovery.NewRootAPIsHandler(discovery.DefaultAddresses{DefaultAddress: "127.0.0.1"}, Codecs)
+	container.Add(groupManager.WebService())
+	r := newTestCRDHandler(apiservicelisters.NewAPIServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		container, groupManager)
+
+	crd := newTestCRD("networking.istio.io", "v1beta1", "gateways", "Gateway")
+	crd.Spec.Versions = append(crd.Spec.Versions,
+		apiextensionsv1.CustomResourceDefinitionVersion{Name: "v1alpha3", Served: true},
+		apiextensionsv1.CustomResourceDefinitionVersion{Name: "v1alpha1", Served: false},
+	)
+	if err := r.addStorage(crd); err != nil {
+		t.Fatalf("addStorage() error = %v", err)
+	}
+
+	get := func(path string, into interface{}) int {
+		recorder := httptest.NewRecorder()
+		container.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), into); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+		}
+		return recorder.Code
+	}
+	storageVersionHash := ""
+	for _, version := range []string{"v1beta1", "v1alpha3"} {
+		gvr := schema.GroupVersionResource{Group: "networking.istio.io", Version: version, Resource: "gateways"}
+		if storage := r.storages[gvr]; storage == nil || storage.version != version {
+			t.Errorf("expect %s to be served by the storage of its own version", gvr)
+		}
+		// get, list, list for all namespaces, replace, patch, create, delete and deletecollection
+		if got := len(r.groupVersionServices[gvr.GroupVersion()].ws.Routes()); got != 9 {
+			t.Errorf("expect 9 routes in %s including discovery, got %d", gvr.GroupVersion(), got)
+		}
+
+		list := &metav1.APIResourceList{}
+		if code := get("/apis/"+gvr.GroupVersion().String(), list); code != http.StatusOK || len(list.APIResources) != 1 {
+			t.Fatalf("expect gateways in discovery of %s, got %d %v", gvr.GroupVersion(), code, list.APIResources)
+		}
+		if len(storageVersionHash) == 0 {
+			storageVersionHash = list.APIResources[0].StorageVersionHash
+		}
+		if list.APIResources[0].StorageVersionHash != storageVersionHash {
+			t.Errorf("expect all versions to share the storage version hash, got %s", list.APIResources[0].StorageVersionHash)
+		}
+	}
+	if _, ok := r.storages[schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1alpha1", Resource: "gateways"}]; ok {
+		t.Errorf("expect v1alpha1 not to be served")
+	}
+	if code := get("/apis/networking.istio.io/v1alpha1", &metav1.APIResourceList{}); code != http.StatusNotFound {
+		t.Errorf("expect v1alpha1 not to be discovered, got %d", code)
+	}
+	group := &metav1.APIGroup{}
+	if code := get("/apis/networking.istio.io", group); code != http.StatusOK || len(group.Versions) != 2 {
+		t.Errorf("expect 2 versions of networking.istio.io, got %d %v", code, group.Versions)
+	}
+
+	// objects written with another version are converted into the version requested
+	raw, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1beta1",
+		"kind":       "Gateway",
+		"metadata":   map[string]interface{}{"name": "gw", "namespace": "ns-foo"},
+	})
+	manifest := &kcrd.KubernetesCrd{Manifest: runtime.RawExtension{Raw: raw}}
+	obj, err := r.storages[schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1alpha3", Resource: "gateways"}].convertManifest(manifest)
+	if err != nil || obj.GetAPIVersion() != "networking.istio.io/v1alpha3" {
+		t.Errorf("expect the object in networking.istio.io/v1alpha3, got %v, %v", obj, err)
+	}
+
+	// serving another set of versions is a breaking change
+	withoutAlpha := crd.DeepCopy()
+	withoutAlpha.Spec.Versions[1].Served = false
+	if reason := incompatibleChange(crd, withoutAlpha); len(reason) == 0 {
+		t.Errorf("expect changing served versions to be incompatible")
+	}
+	if err := r.replaceStorage(crd, withoutAlpha); err != nil {
+		t.Fatalf("replaceStorage() error = %v", err)
+	}
+	if code := get("/apis/networking.istio.io/v1alpha3", &metav1.APIResourceList{}); code != http.StatusNotFound {
+		t.Errorf("expect v1alpha3 to be no longer discovered, got %d", code)
+	}
+
+	r.removeStorage(withoutAlpha)
+	if len(r.storages) != 0 || len(r.groupVersionServices) != 0 {
+		t.Errorf("expect all versions to be removed, got storages %v", r.storages)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// ExposurePolicy decides which CustomResourceDefinitions in the host cluster are exposed to tenants.
+//
+// A CRD is exposed when it matches any of the Include rules (or Include is empty),
+// and matches none of the Exclude rules.
+type ExposurePolicy struct {
+	Include []ExposureRule `json:"include,omitempty"`
+	Exclude []ExposureRule `json:"exclude,omitempty"`
+}
+
+// ExposureRule matches CustomResourceDefinitions. All the specified conditions must be met for a CRD to match.
+type ExposureRule struct {
+	// Groups are glob patterns of API groups, such as "*.istio.io". Any of them matches.
+	Groups []string `json:"groups,omitempty"`
+	// Kinds are the kinds of the resources, such as "VirtualService". Any of them matches.
+	Kinds []string `json:"kinds,omitempty"`
+	// LabelSelector selects CRDs by their labels.
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	// Annotations must all be present on a CRD with the same values.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// LoadExposurePolicy reads an ExposurePolicy from a YAML or JSON file
+func LoadExposurePolicy(file string) (*ExposurePolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &ExposurePolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse CRD exposure policy %s: %v", file, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid CRD exposure policy %s: %v", file, err)
+	}
+	return policy, nil
+}
+
+// Validate checks the patterns and selectors in the policy
+func (p *ExposurePolicy) Validate() error {
+	for _, rule := range append(append([]ExposureRule{}, p.Include...), p.Exclude...) {
+		for _, pattern := range rule.Groups {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("bad group pattern %q: %v", pattern, err)
+			}
+		}
+		if rule.LabelSelector != nil {
+			if _, err := metav1.LabelSelectorAsSelector(rule.LabelSelector); err != nil {
+				return fmt.Errorf("bad label selector: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Exposes tells whether crd should be exposed to tenants.
+// CRDs of external-crd itself are never exposed.
+func (p *ExposurePolicy) Exposes(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	if strings.HasSuffix(crd.Spec.Group, kcrdGroupSuffix) {
+		return false
+	}
+	if p == nil {
+		return true
+	}
+
+	if len(p.Include) > 0 && !matchesAny(p.Include, crd) {
+		return false
+	}
+	return !matchesAny(p.Exclude, crd)
+}
+
+func matchesAny(rules []ExposureRule, crd *apiextensionsv1.CustomResourceDefinition) bool {
+	for _, rule := range rules {
+		if rule.matches(crd) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *ExposureRule) matches(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	if len(rule.Groups) > 0 {
+		var matched bool
+		for _, pattern := range rule.Groups {
+			if ok, _ := path.Match(pattern, crd.Spec.Group); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(rule.Kinds) > 0 {
+		var matched bool
+		for _, kind := range rule.Kinds {
+			if kind == crd.Spec.Names.Kind {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if rule.LabelSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(rule.LabelSelector)
+		if err != nil || !selector.Matches(labels.Set(crd.Labels)) {
+			return false
+		}
+	}
+
+	for key, value := range rule.Annotations {
+		if v, ok := crd.Annotations[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
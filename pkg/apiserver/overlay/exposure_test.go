@@ -0,0 +1,110 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExposurePolicyExposes(t *testing.T) {
+	newCRD := func(group, kind string, labels, annotations map[string]string) *apiextensionsv1.CustomResourceDefinition {
+		return &apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: annotations},
+			Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+				Group: group,
+				Names: apiextensionsv1.CustomResourceDefinitionNames{Kind: kind},
+			},
+		}
+	}
+
+	policy := &ExposurePolicy{
+		Include: []ExposureRule{
+			{Groups: []string{"*.istio.io"}},
+			{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"expose": "true"}}},
+		},
+		Exclude: []ExposureRule{
+			{Groups: []string{"install.istio.io"}},
+			{Groups: []string{"networking.istio.io"}, Kinds: []string{"EnvoyFilter"}},
+			{Annotations: map[string]string{"internal": "true"}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		policy *ExposurePolicy
+		crd    *apiextensionsv1.CustomResourceDefinition
+		want   bool
+	}{
+		{
+			name: "no policy exposes all",
+			crd:  newCRD("foo.example.com", "Foo", nil, nil),
+			want: true,
+		},
+		{
+			name: "no policy never exposes external-crd itself",
+			crd:  newCRD("k8s.jijiechen.com", "KubernetesCrd", nil, nil),
+			want: false,
+		},
+		{
+			name:   "included by group",
+			policy: policy,
+			crd:    newCRD("networking.istio.io", "VirtualService", nil, nil),
+			want:   true,
+		},
+		{
+			name:   "included by labels",
+			policy: policy,
+			crd:    newCRD("foo.example.com", "Foo", map[string]string{"expose": "true"}, nil),
+			want:   true,
+		},
+		{
+			name:   "not included",
+			policy: policy,
+			crd:    newCRD("foo.example.com", "Foo", nil, nil),
+			want:   false,
+		},
+		{
+			name:   "excluded by group",
+			policy: policy,
+			crd:    newCRD("install.istio.io", "IstioOperator", nil, nil),
+			want:   false,
+		},
+		{
+			name:   "excluded by group and kind",
+			policy: policy,
+			crd:    newCRD("networking.istio.io", "EnvoyFilter", nil, nil),
+			want:   false,
+		},
+		{
+			name:   "excluded by annotations",
+			policy: policy,
+			crd:    newCRD("security.istio.io", "PeerAuthentication", nil, map[string]string{"internal": "true"}),
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Exposes(tt.crd); got != tt.want {
+				t.Errorf("Exposes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
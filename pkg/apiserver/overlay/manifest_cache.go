@@ -0,0 +1,140 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/tools/cache"
+
+	kcrd "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+const (
+	// manifestKindIndex indexes Manifests by the tenant, the namespace, the group and the kind of the objects they store
+	manifestKindIndex = "manifest-kind"
+	// manifestNameIndex indexes Manifests by the tenant, the namespace, the group, the kind and the name of the objects
+	// they store
+	manifestNameIndex = "manifest-name"
+)
+
+// AddManifestIndexers indexes the Manifests in reservedNamespaces by the tenants, namespaces, groups, kinds and names
+// of the objects they store, which lists of tenants are served from. It should be called before the informer is started.
+func AddManifestIndexers(manifestInformer cache.SharedIndexInformer, reservedNamespaces utils.ReservedNamespaces) error {
+	return manifestInformer.AddIndexers(cache.Indexers{
+		manifestKindIndex: func(obj interface{}) ([]string, error) {
+			manifest, ok := obj.(*kcrd.KubernetesCrd)
+			if !ok || !reservedNamespaces.Has(manifest.Namespace) {
+				return nil, nil
+			}
+			return []string{manifestIndexKey(manifest.Labels[utils.ConfigClusterLabel],
+				manifest.Labels[utils.ConfigNamespaceLabel], manifest.Labels[utils.ConfigGroupLabel],
+				manifest.Labels[utils.ConfigKindLabel])}, nil
+		},
+		manifestNameIndex: func(obj interface{}) ([]string, error) {
+			manifest, ok := obj.(*kcrd.KubernetesCrd)
+			if !ok || !reservedNamespaces.Has(manifest.Namespace) {
+				return nil, nil
+			}
+			return []string{manifestIndexKey(manifest.Labels[utils.ConfigClusterLabel],
+				manifest.Labels[utils.ConfigNamespaceLabel], manifest.Labels[utils.ConfigGroupLabel],
+				manifest.Labels[utils.ConfigKindLabel], manifest.Labels[utils.ConfigNameLabel])}, nil
+		},
+	})
+}
+
+func manifestIndexKey(values ...string) string {
+	return strings.Join(values, "/")
+}
+
+// manifestCache serves the lists of tenants from the indexed Manifest informer, instead of the host cluster
+type manifestCache struct {
+	informer cache.SharedIndexInformer
+}
+
+func newManifestCache(manifestInformer cache.SharedIndexInformer) *manifestCache {
+	return &manifestCache{informer: manifestInformer}
+}
+
+// servesList tells whether a list with options can be served from the cache, following what kube-apiserver does
+// with its watch cache. Data of any age is accepted with resource version "0", and data no older than a specific
+// resource version is once the cache has caught up with it. The most recent data asked for with resource version "",
+// exact snapshots and paginated lists are left to the host cluster.
+func (c *manifestCache) servesList(options *internalversion.ListOptions) bool {
+	if options == nil || !c.informer.HasSynced() || len(options.Continue) > 0 ||
+		options.ResourceVersionMatch == metav1.ResourceVersionMatchExact {
+		return false
+	}
+	switch options.ResourceVersion {
+	case "":
+		return false
+	case "0":
+		// like kube-apiserver, the limit is ignored as the whole list is at hand
+		return true
+	}
+	if options.Limit > 0 {
+		return false
+	}
+	requested, err := strconv.ParseUint(options.ResourceVersion, 10, 64)
+	if err != nil {
+		return false
+	}
+	current, err := strconv.ParseUint(c.informer.LastSyncResourceVersion(), 10, 64)
+	return err == nil && current >= requested
+}
+
+// list returns the Manifests of kind of group in namespace of tenant clusterID matching selector, sorted by name,
+// along with the resource version they are observed at
+func (c *manifestCache) list(clusterID, namespace, group, kind string, selector labels.Selector) ([]*kcrd.KubernetesCrd, string, error) {
+	// the resource version is read first, since the cache is updated before it moves on
+	resourceVersion := c.informer.LastSyncResourceVersion()
+
+	indexName, indexKey := manifestKindIndex, manifestIndexKey(clusterID, namespace, group, kind)
+	if requirements, selectable := selector.Requirements(); selectable {
+		for _, requirement := range requirements {
+			if requirement.Key() == utils.ConfigNameLabel && requirement.Values().Len() == 1 &&
+				(requirement.Operator() == selection.Equals || requirement.Operator() == selection.DoubleEquals) {
+				indexName, indexKey = manifestNameIndex, manifestIndexKey(clusterID, namespace, group, kind, requirement.Values().List()[0])
+				break
+			}
+		}
+	}
+	items, err := c.informer.GetIndexer().ByIndex(indexName, indexKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	manifests := make([]*kcrd.KubernetesCrd, 0, len(items))
+	for _, item := range items {
+		manifest := item.(*kcrd.KubernetesCrd)
+		if selector.Matches(labels.Set(manifest.Labels)) {
+			manifests = append(manifests, manifest)
+		}
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].Name < manifests[j].Name
+	})
+	return manifests, resourceVersion, nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/tools/cache"
+
+	kcrd "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func TestManifestCacheList(t *testing.T) {
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &kcrd.KubernetesCrdList{
+				ListMeta: metav1.ListMeta{ResourceVersion: "20"},
+				Items: []kcrd.KubernetesCrd{
+					*newTestManifest("foo-2", "cls-foo", "12", map[string]string{"app": "x"}),
+					*newTestManifest("foo-1", "cls-foo", "11", nil),
+					*newTestManifest("bar-1", "cls-bar", "13", nil),
+				},
+			}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}, &kcrd.KubernetesCrd{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := AddManifestIndexers(informer, utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0)); err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		t.Fatal("informer is not synced")
+	}
+
+	manifests := newManifestCache(informer)
+	for _, test := range []struct {
+		name    string
+		options *internalversion.ListOptions
+		served  bool
+	}{
+		{name: "most recent", options: &internalversion.ListOptions{}},
+		{name: "any", options: &internalversion.ListOptions{ResourceVersion: "0", Limit: 1}, served: true},
+		{name: "not older than", options: &internalversion.ListOptions{ResourceVersion: "15"}, served: true},
+		{name: "not older than a newer one", options: &internalversion.ListOptions{ResourceVersion: "25"}},
+		{name: "paginated", options: &internalversion.ListOptions{ResourceVersion: "15", Limit: 1}},
+		{name: "exact", options: &internalversion.ListOptions{ResourceVersion: "15",
+			ResourceVersionMatch: metav1.ResourceVersionMatchExact}},
+		{name: "continued", options: &internalversion.ListOptions{ResourceVersion: "0", Continue: "foo"}},
+	} {
+		if served := manifests.servesList(test.options); served != test.served {
+			t.Errorf("%s: expect the list to be served from the cache %v, got %v", test.name, test.served, served)
+		}
+	}
+
+	storage := &REST{
+		name:               "foos",
+		namespaced:         true,
+		kind:               "Foo",
+		group:              "example.com",
+		version:            "v1",
+		reservedNamespaces: utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0),
+		manifestCache:      manifests,
+	}
+	ctx := request.WithNamespace(request.WithUser(context.Background(),
+		&user.DefaultInfo{Name: "system:serviceaccount:external-crd-system:biz-ab12-cls-foo-ab12-ns-foo"}), "ns-foo")
+	for _, test := range []struct {
+		name    string
+		options *internalversion.ListOptions
+		want    []string
+	}{
+		{name: "all", options: &internalversion.ListOptions{ResourceVersion: "0"}, want: []string{"foo-1", "foo-2"}},
+		{name: "by labels", options: &internalversion.ListOptions{ResourceVersion: "0",
+			LabelSelector: labels.SelectorFromSet(labels.Set{"app": "x"})}, want: []string{"foo-2"}},
+		{name: "by name", options: &internalversion.ListOptions{ResourceVersion: "0",
+			FieldSelector: fields.OneTermEqualSelector("metadata.name", "foo-1")}, want: []string{"foo-1"}},
+	} {
+		obj, err := storage.List(ctx, test.options)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		list := obj.(*unstructured.UnstructuredList)
+		var names []string
+		for _, item := range list.Items {
+			names = append(names, item.GetName())
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%s: expect %v, got %v", test.name, test.want, names)
+		}
+		if list.GetResourceVersion() != "20" {
+			t.Errorf("%s: expect the list at resource version 20, got %q", test.name, list.GetResourceVersion())
+		}
+	}
+}
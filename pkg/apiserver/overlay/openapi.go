@@ -0,0 +1,196 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"path"
+	"sync"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/controller/openapi/builder"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/server/mux"
+	"k8s.io/klog/v2"
+	"k8s.io/kube-openapi/pkg/handler"
+	"k8s.io/kube-openapi/pkg/handler3"
+	"k8s.io/kube-openapi/pkg/spec3"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+
+	overlayapi "github.com/jijiechen/external-crd/pkg/apis/overlay/v1alpha1"
+)
+
+// openAPIPublisher publishes the OpenAPI specs built from the schemas of served CRDs on /openapi/v2 and /openapi/v3.
+// A CRD is published both under its original group version and, when it is the one served there, under overlay group.
+type openAPIPublisher struct {
+	lock sync.Mutex
+
+	staticSpec *spec.Swagger
+	v2Service  *handler.OpenAPIService
+	v3Service  *handler3.OpenAPIService
+
+	// specs built from CRDs, keyed by the group version resource they are published with
+	v2Specs map[schema.GroupVersionResource]*spec.Swagger
+	v3Specs map[schema.GroupVersionResource]*spec3.OpenAPI
+}
+
+func newOpenAPIPublisher(pathHandler *mux.PathRecorderMux) (*openAPIPublisher, error) {
+	staticSpec := &spec.Swagger{
+		SwaggerProps: spec.SwaggerProps{
+			Swagger: "2.0",
+			Info: &spec.Info{
+				InfoProps: spec.InfoProps{
+					Title:   "external-crd",
+					Version: overlayapi.SchemeGroupVersion.Version,
+				},
+			},
+			Paths:       &spec.Paths{Paths: map[string]spec.PathItem{}},
+			Definitions: spec.Definitions{},
+		},
+	}
+
+	v2Service, err := handler.NewOpenAPIService(staticSpec)
+	if err != nil {
+		return nil, err
+	}
+	if err := v2Service.RegisterOpenAPIVersionedService("/openapi/v2", pathHandler); err != nil {
+		return nil, err
+	}
+	v3Service, err := handler3.NewOpenAPIService(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := v3Service.RegisterOpenAPIV3VersionedService("/openapi/v3", pathHandler); err != nil {
+		return nil, err
+	}
+
+	return &openAPIPublisher{
+		staticSpec: staticSpec,
+		v2Service:  v2Service,
+		v3Service:  v3Service,
+		v2Specs:    map[schema.GroupVersionResource]*spec.Swagger{},
+		v3Specs:    map[schema.GroupVersionResource]*spec3.OpenAPI{},
+	}, nil
+}
+
+// updateCRD builds and publishes the specs of crd served with gvr
+func (p *openAPIPublisher) updateCRD(gvr schema.GroupVersionResource, crd *apiextensionsv1.CustomResourceDefinition) {
+	if p == nil {
+		return
+	}
+
+	crd, version, err := crdForOpenAPI(gvr, crd)
+	if err != nil {
+		klog.Warningf("skip publishing OpenAPI specs for %s: %v", gvr.GroupResource(), err)
+		return
+	}
+	v2Spec, err := builder.BuildOpenAPIV2(crd, version, builder.Options{V2: true})
+	if err != nil {
+		klog.Warningf("failed to build OpenAPI v2 spec for %s: %v", gvr.GroupResource(), err)
+		return
+	}
+	v3Spec, err := builder.BuildOpenAPIV3(crd, version, builder.Options{})
+	if err != nil {
+		klog.Warningf("failed to build OpenAPI v3 spec for %s: %v", gvr.GroupResource(), err)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.v2Specs[gvr] = v2Spec
+	p.v3Specs[gvr] = v3Spec
+	p.publishLocked(gvr.GroupVersion())
+}
+
+// removeCRD stops publishing the specs of the CRD served with gvr
+func (p *openAPIPublisher) removeCRD(gvr schema.GroupVersionResource) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.v2Specs[gvr]; !ok {
+		return
+	}
+	delete(p.v2Specs, gvr)
+	delete(p.v3Specs, gvr)
+	p.publishLocked(gvr.GroupVersion())
+}
+
+// publishLocked merges all the v2 specs, and the v3 specs of the changed group version
+func (p *openAPIPublisher) publishLocked(changed schema.GroupVersion) {
+	var v2Specs []*spec.Swagger
+	for _, s := range p.v2Specs {
+		v2Specs = append(v2Specs, s)
+	}
+	merged, err := builder.MergeSpecs(p.staticSpec, v2Specs...)
+	if err != nil {
+		klog.Errorf("failed to merge OpenAPI v2 specs: %v", err)
+	} else if err := p.v2Service.UpdateSpec(merged); err != nil {
+		klog.Errorf("failed to update OpenAPI v2 spec: %v", err)
+	}
+
+	var v3Specs []*spec3.OpenAPI
+	for gvr, s := range p.v3Specs {
+		if gvr.GroupVersion() == changed {
+			v3Specs = append(v3Specs, s)
+		}
+	}
+	// same as the paths of the 'core' kubernetes server, such as "apis/networking.istio.io/v1beta1"
+	groupVersionPath := path.Join("apis", changed.Group, changed.Version)
+	if len(v3Specs) == 0 {
+		p.v3Service.DeleteGroupVersion(groupVersionPath)
+		return
+	}
+	mergedV3, err := builder.MergeSpecsV3(v3Specs...)
+	if err != nil {
+		klog.Errorf("failed to merge OpenAPI v3 specs for %s: %v", changed, err)
+		return
+	}
+	if err := p.v3Service.UpdateGroupVersion(groupVersionPath, mergedV3); err != nil {
+		klog.Errorf("failed to update OpenAPI v3 spec for %s: %v", changed, err)
+	}
+}
+
+// crdForOpenAPI returns the CRD, and the version of it, to build specs from.
+// For resources served under overlay group, a copy of crd is made with the group and version replaced,
+// so that the paths and the kinds in the specs match those of overlay group.
+func crdForOpenAPI(gvr schema.GroupVersionResource, crd *apiextensionsv1.CustomResourceDefinition) (*apiextensionsv1.CustomResourceDefinition, string, error) {
+	storageVersion, err := storageGroupVersionResource(crd)
+	if err != nil {
+		return nil, "", err
+	}
+	if gvr.GroupVersion() != overlayapi.SchemeGroupVersion {
+		return crd, storageVersion.Version, nil
+	}
+
+	for _, version := range crd.Spec.Versions {
+		if version.Name != storageVersion.Version {
+			continue
+		}
+
+		overlayCRD := crd.DeepCopy()
+		overlayCRD.Spec.Group = overlayapi.GroupName
+		overlayVersion := *version.DeepCopy()
+		overlayVersion.Name = overlayapi.SchemeGroupVersion.Version
+		overlayCRD.Spec.Versions = []apiextensionsv1.CustomResourceDefinitionVersion{overlayVersion}
+		return overlayCRD, overlayVersion.Name, nil
+	}
+	return nil, "", fmt.Errorf("storage version %s not found", storageVersion.Version)
+}
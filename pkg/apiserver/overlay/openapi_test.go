@@ -0,0 +1,115 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/server/mux"
+
+	overlayapi "github.com/jijiechen/external-crd/pkg/apis/overlay/v1alpha1"
+)
+
+func TestOpenAPIPublisher(t *testing.T) {
+	crd := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "gateways.networking.istio.io"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "networking.istio.io",
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:   "gateways",
+				Singular: "gateway",
+				Kind:     "Gateway",
+				ListKind: "GatewayList",
+			},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{
+					Name:    "v1beta1",
+					Served:  true,
+					Storage: true,
+					Schema: &apiextensionsv1.CustomResourceValidation{
+						OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+							Type: "object",
+							Properties: map[string]apiextensionsv1.JSONSchemaProps{
+								"spec": {
+									Type: "object",
+									Properties: map[string]apiextensionsv1.JSONSchemaProps{
+										"selector": {Type: "object", AdditionalProperties: &apiextensionsv1.JSONSchemaPropsOrBool{
+											Schema: &apiextensionsv1.JSONSchemaProps{Type: "string"},
+										}},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	pathHandler := mux.NewPathRecorderMux("test")
+	p, err := newOpenAPIPublisher(pathHandler)
+	if err != nil {
+		t.Fatalf("newOpenAPIPublisher() error = %v", err)
+	}
+
+	gvr := schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1beta1", Resource: "gateways"}
+	overlayGVR := overlayapi.SchemeGroupVersion.WithResource("gateways")
+	p.updateCRD(gvr, crd)
+	p.updateCRD(overlayGVR, crd)
+
+	getSpec := func(url string) map[string]interface{} {
+		recorder := httptest.NewRecorder()
+		pathHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", url, recorder.Code)
+		}
+		result := map[string]interface{}{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		return result
+	}
+
+	paths := getSpec("/openapi/v2")["paths"].(map[string]interface{})
+	for _, path := range []string{
+		"/apis/networking.istio.io/v1beta1/namespaces/{namespace}/gateways/{name}",
+		"/apis/overlay/v1alpha1/namespaces/{namespace}/gateways/{name}",
+	} {
+		if _, ok := paths[path]; !ok {
+			t.Errorf("expect path %s in OpenAPI v2 spec", path)
+		}
+	}
+	getSpec("/openapi/v3/apis/overlay/v1alpha1")
+	getSpec("/openapi/v3/apis/networking.istio.io/v1beta1")
+
+	p.removeCRD(overlayGVR)
+	paths = getSpec("/openapi/v2")["paths"].(map[string]interface{})
+	if _, ok := paths["/apis/overlay/v1alpha1/namespaces/{namespace}/gateways/{name}"]; ok {
+		t.Errorf("expect overlay paths to be removed from OpenAPI v2 spec")
+	}
+	if _, ok := paths["/apis/networking.istio.io/v1beta1/namespaces/{namespace}/gateways/{name}"]; !ok {
+		t.Errorf("expect original paths to be kept in OpenAPI v2 spec")
+	}
+}
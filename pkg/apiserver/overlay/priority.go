@@ -19,44 +19,22 @@ package apiserver
 
 import (
 	"strings"
-	"sync"
 
 	"k8s.io/klog/v2"
 	apiregistrationapis "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
 	apiservicelisters "k8s.io/kube-aggregator/pkg/client/listers/apiregistration/v1"
 )
 
-var (
-	priorityLock sync.Mutex
-
-	resourcePriorityMap = make(map[string]groupPriority)
-)
-
-type groupPriority struct {
-	groupVersionName     string
-	groupPriorityMinimum int32
-}
-
-func canBeAddedToStorage(group, version, resourceName string, apiserviceLister apiservicelisters.APIServiceLister) bool {
-	priorityLock.Lock()
-	defer priorityLock.Unlock()
-
+// getGroupPriorityMinimum returns the group priority of the APIService serving given group version.
+// When CRDs in different groups share the same plural, the one with the highest priority is served under overlay group.
+func getGroupPriorityMinimum(group, version string, apiserviceLister apiservicelisters.APIServiceLister) int32 {
 	apiservice, err := getAPIService(group, version, apiserviceLister)
 	if err != nil {
 		klog.Errorf("failed to get APIService %q: %v", strings.Join([]string{version, group}, "."), err)
-		// ignore the error, just add it
-		return true
-	}
-
-	if gp, ok := resourcePriorityMap[resourceName]; ok && gp.groupPriorityMinimum > apiservice.Spec.GroupPriorityMinimum {
-		return false
-	}
-
-	resourcePriorityMap[resourceName] = groupPriority{
-		groupVersionName:     apiservice.Name,
-		groupPriorityMinimum: apiservice.Spec.GroupPriorityMinimum,
+		// ignore the error, take it as the lowest priority
+		return 0
 	}
-	return true
+	return apiservice.Spec.GroupPriorityMinimum
 }
 
 func getAPIService(group, version string, apiserviceLister apiservicelisters.APIServiceLister) (*apiregistrationapis.APIService, error) {
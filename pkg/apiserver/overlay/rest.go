@@ -23,6 +23,7 @@ import (
 	sys_errors "errors"
 	"fmt"
 	"github.com/jijiechen/external-crd/pkg/utils"
+	"net/http"
 	"strings"
 	"sync"
 
@@ -39,12 +40,16 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/audit"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
 	"k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/apiserver/pkg/registry/rest"
 	clientgorest "k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 
 	kcrd "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	overlayapi "github.com/jijiechen/external-crd/pkg/apis/overlay/v1alpha1"
 	kcrdclientset "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned"
 	applisters "github.com/jijiechen/external-crd/pkg/generated/listers/kcrd/v1alpha1"
 )
@@ -63,6 +68,10 @@ type REST struct {
 	name string
 	// shortNames is a list of suggested short names of the resource.
 	shortNames []string
+	// categories is a list of the grouped resources the resource belongs to, besides utils.Category
+	categories []string
+	// tableConvertor prints the resource in tables, such as with the printer columns of the CRD
+	tableConvertor rest.TableConvertor
 	// namespaced indicates if a resource is namespaced or not.
 	namespaced bool
 	// kind is the Kind for the resource (e.g. 'Foo' is the kind for a resource 'foo')
@@ -75,16 +84,29 @@ type REST struct {
 	parameterCodec runtime.ParameterCodec
 
 	dryRunClient clientgorest.Interface
-	kcrdClient   *kcrdclientset.Clientset
+	kcrdClient   kcrdclientset.Interface
 	kcrdLister   applisters.KubernetesCrdLister
+	authorizer   authorizer.Authorizer
 
 	// deleteCollectionWorkers is the maximum number of workers in a single
 	// DeleteCollection call. Delete requests for the items in a collection
 	// are issued in parallel.
 	deleteCollectionWorkers int
 
-	// namespace where Manifests are created
-	reservedNamespace string
+	// namespaces where Manifests are created
+	reservedNamespaces utils.ReservedNamespaces
+
+	// tenantCRDs provides the CRDs of each tenant to validate objects against, nil if CRDs come from the host cluster
+	tenantCRDs TenantCRDs
+	// hostCRDs tells that tenantCRDs includes the CRDs of the host cluster, whose objects are still dry-run there
+	hostCRDs bool
+
+	// watches keeps the open watches, which are closed once the resource is no longer served as it is
+	watches *watchTracker
+	// watchCache serves watches instead of the host cluster once it is ready, nil to always watch the host cluster
+	watchCache *watchCache
+	// manifestCache serves lists that accept cached data, nil to always list from the host cluster
+	manifestCache *manifestCache
 }
 
 func getClusterNamespace(username string) (string, string, bool) {
@@ -115,38 +137,44 @@ func getClusterNamespace(username string) (string, string, bool) {
 
 // Create inserts a new item into Manifest according to the unique key from the object.
 func (r *REST) Create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (runtime.Object, error) {
-	clusterID, err := getUser(ctx)
+	clusterID, err := r.getUser(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	// dry-run
-	actualRes, err := r.dryRunCreate(ctx, obj, createValidation, options)
+	var actualRes *unstructured.Unstructured
+	switch {
+	case r.isVirtualCRDStorage():
+		actualRes, err = r.validateVirtualCRD(ctx, clusterID, obj)
+	case r.validatesAgainstSchema(ctx, clusterID):
+		// the CRD may only exist in the business cluster of the tenant, so there is nothing to dry-run against
+		actualRes, err = r.validateTenantObject(ctx, clusterID, obj)
+	default:
+		// dry-run
+		actualRes, err = r.dryRunCreate(ctx, clusterID, obj, createValidation, options)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// next we create manifest to store the actualRes
+	manifestName := r.getNormalizedManifestName(clusterID, r.tenantNamespaceOf(actualRes), actualRes.GetName())
+	manifestNamespace := r.reservedNamespaces.For(clusterID, r.tenantNamespaceOf(actualRes))
+	if r.getExistingManifestName(manifestNamespace, clusterID, r.tenantNamespaceOf(actualRes), actualRes.GetName()) != manifestName {
+		return nil, errors.NewAlreadyExists(schema.GroupResource{Group: r.group, Resource: r.name}, actualRes.GetName())
+	}
 	kcrdRes := &kcrd.KubernetesCrd{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      r.getNormalizedManifestName(clusterID, actualRes.GetNamespace(), actualRes.GetName()),
-			Namespace: r.reservedNamespace,
+			Name:      manifestName,
+			Namespace: manifestNamespace,
 			Labels:    actualRes.GetLabels(), // reuse labels from original object, which is useful for label selector
 		},
 		Manifest: runtime.RawExtension{
 			Object: actualRes,
 		},
 	}
-
-	if kcrdRes.Labels == nil {
-		kcrdRes.Labels = map[string]string{}
-	}
-	kcrdRes.Labels[utils.ConfigGroupLabel] = r.group
-	kcrdRes.Labels[utils.ConfigVersionLabel] = r.version
-	kcrdRes.Labels[utils.ConfigKindLabel] = r.kind
-	kcrdRes.Labels[utils.ConfigNameLabel] = actualRes.GetName()
-	kcrdRes.Labels[utils.ConfigClusterLabel] = clusterID
-	kcrdRes.Labels[utils.ConfigNamespaceLabel] = actualRes.GetNamespace()
+	utils.SetManifestLabels(kcrdRes, r.GroupVersionKind(schema.GroupVersion{}), clusterID,
+		r.tenantNamespaceOf(actualRes), actualRes.GetName())
 	kcrdRes, err = r.kcrdClient.KcrdV1alpha1().KubernetesCrds(kcrdRes.Namespace).Create(ctx, kcrdRes, metav1.CreateOptions{})
 	if err != nil {
 		if errors.IsAlreadyExists(err) {
@@ -154,23 +182,24 @@ func (r *REST) Create(ctx context.Context, obj runtime.Object, createValidation
 		}
 		return nil, err
 	}
-	return transformManifest(kcrdRes)
+	return r.convertManifest(kcrdRes)
 }
 
 // Get retrieves the item from Manifest.
 func (r *REST) Get(ctx context.Context, name string, options *metav1.GetOptions) (runtime.Object, error) {
-	clusterID, err := getUser(ctx)
+	clusterID, err := r.getUser(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	var manifest *kcrd.KubernetesCrd
-	if len(options.ResourceVersion) == 0 {
-		manifest, err = r.kcrdLister.KubernetesCrds(r.reservedNamespace).Get(
-			r.getNormalizedManifestName(clusterID, request.NamespaceValue(ctx), name))
+	manifestNamespace := r.getManifestNamespace(ctx, clusterID)
+	manifestName := r.getExistingManifestName(manifestNamespace, clusterID, request.NamespaceValue(ctx), name)
+	// "0" accepts data of any age, which is at hand in the cache
+	if len(options.ResourceVersion) == 0 || options.ResourceVersion == "0" {
+		manifest, err = r.kcrdLister.KubernetesCrds(manifestNamespace).Get(manifestName)
 	} else {
-		manifest, err = r.kcrdClient.KcrdV1alpha1().KubernetesCrds(r.reservedNamespace).
-			Get(ctx, r.getNormalizedManifestName(clusterID, request.NamespaceValue(ctx), name), *options)
+		manifest, err = r.kcrdClient.KcrdV1alpha1().KubernetesCrds(manifestNamespace).Get(ctx, manifestName, *options)
 	}
 	if err != nil {
 		if errors.IsNotFound(err) {
@@ -178,7 +207,7 @@ func (r *REST) Get(ctx context.Context, name string, options *metav1.GetOptions)
 		}
 		return nil, errors.NewInternalError(err)
 	}
-	return transformManifest(manifest)
+	return r.convertManifest(manifest)
 }
 
 // Update performs an atomic update and set of the object. Returns the result of the update
@@ -198,23 +227,29 @@ func (r *REST) Update(ctx context.Context, name string, objInfo rest.UpdatedObje
 		return nil, false, err
 	}
 
-	clusterID, err := getUser(ctx)
+	clusterID, err := r.getUser(ctx)
 	if err != nil {
 		return nil, false, err
 	}
-	manifest, err := r.kcrdLister.KubernetesCrds(r.reservedNamespace).Get(
-		r.getNormalizedManifestName(clusterID, request.NamespaceValue(ctx), name))
+	manifestNamespace := r.getManifestNamespace(ctx, clusterID)
+	manifest, err := r.kcrdLister.KubernetesCrds(manifestNamespace).Get(
+		r.getExistingManifestName(manifestNamespace, clusterID, request.NamespaceValue(ctx), name))
 	if err != nil {
 		if errors.IsNotFound(err) {
 			return nil, false, errors.NewNotFound(schema.GroupResource{Group: r.group, Resource: r.name}, name)
 		}
 		return nil, false, errors.NewInternalError(err)
 	}
+	if err := r.checkSyncedFromBusiness(manifest, name, "update"); err != nil {
+		return nil, false, err
+	}
 
 	oldObj := &unstructured.Unstructured{}
 	if err = json.Unmarshal(manifest.Manifest.Raw, oldObj); err != nil {
 		return nil, false, errors.NewInternalError(err)
 	}
+	// the object may have been written with another version of the CRD
+	r.convertVersion(oldObj)
 
 	newObj, err := objInfo.UpdatedObject(ctx, oldObj)
 	if err != nil {
@@ -227,6 +262,16 @@ func (r *REST) Update(ctx context.Context, name string, objInfo rest.UpdatedObje
 		}
 	}
 	result := newObj.(*unstructured.Unstructured)
+	switch {
+	case r.isVirtualCRDStorage():
+		if result, err = r.validateVirtualCRD(ctx, clusterID, result); err != nil {
+			return nil, false, err
+		}
+	case r.validatesAgainstSchema(ctx, clusterID):
+		if result, err = r.validateTenantObject(ctx, clusterID, result); err != nil {
+			return nil, false, err
+		}
+	}
 	trimResult(result)
 
 	// in case labels get changed
@@ -237,36 +282,41 @@ func (r *REST) Update(ctx context.Context, name string, objInfo rest.UpdatedObje
 	for k, v := range result.GetLabels() {
 		manifestCopy.Labels[k] = v
 	}
-	manifestCopy.Labels[utils.ConfigGroupLabel] = r.group
-	manifestCopy.Labels[utils.ConfigVersionLabel] = r.version
-	if r.kind != "Scale" {
-		manifestCopy.Labels[utils.ConfigKindLabel] = r.kind
+	gvk := r.GroupVersionKind(schema.GroupVersion{})
+	if r.kind == "Scale" {
+		gvk.Kind = manifestCopy.Labels[utils.ConfigKindLabel]
 	}
-	manifestCopy.Labels[utils.ConfigNameLabel] = result.GetName()
-	manifestCopy.Labels[utils.ConfigNamespaceLabel] = result.GetNamespace()
-	manifestCopy.Labels[utils.ConfigClusterLabel] = clusterID
+	utils.SetManifestLabels(manifestCopy, gvk, clusterID, r.tenantNamespaceOf(result), result.GetName())
 	manifestCopy.Manifest.Reset()
 	manifestCopy.Manifest.Object = result
 	// save the updates
-	manifestCopy, err = r.kcrdClient.KcrdV1alpha1().KubernetesCrds(r.reservedNamespace).Update(ctx, manifestCopy, *options)
+	manifestCopy, err = r.kcrdClient.KcrdV1alpha1().KubernetesCrds(manifestCopy.Namespace).Update(ctx, manifestCopy, *options)
 	if err != nil {
 		return nil, false, err
 	}
 
-	result, err = transformManifest(manifestCopy)
+	result, err = r.convertManifest(manifestCopy)
 	return result, err != nil, err
 }
 
 // Delete removes the item from storage.
 // options can be mutated by rest.BeforeDelete due to a graceful deletion strategy.
 func (r *REST) Delete(ctx context.Context, name string, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (runtime.Object, bool, error) {
-	clusterID, err := getUser(ctx)
+	clusterID, err := r.getUser(ctx)
 	if err != nil {
 		return nil, false, err
 	}
 
-	err = r.kcrdClient.KcrdV1alpha1().KubernetesCrds(r.reservedNamespace).
-		Delete(ctx, r.getNormalizedManifestName(clusterID, request.NamespaceValue(ctx), name), *options)
+	manifestNamespace := r.getManifestNamespace(ctx, clusterID)
+	manifestName := r.getExistingManifestName(manifestNamespace, clusterID, request.NamespaceValue(ctx), name)
+	if manifest, err := r.kcrdLister.KubernetesCrds(manifestNamespace).Get(manifestName); err == nil {
+		if err := r.checkSyncedFromBusiness(manifest, name, "delete"); err != nil {
+			return nil, false, err
+		}
+	}
+
+	err = r.kcrdClient.KcrdV1alpha1().KubernetesCrds(manifestNamespace).
+		Delete(ctx, manifestName, *options)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			err = errors.NewNotFound(schema.GroupResource{Group: r.group, Resource: r.name}, name)
@@ -370,7 +420,19 @@ func (r *REST) Watch(ctx context.Context, options *internalversion.ListOptions)
 	}
 
 	klog.V(5).Infof("%v", label)
-	watcher, err := r.kcrdClient.KcrdV1alpha1().KubernetesCrds(r.reservedNamespace).Watch(ctx, metav1.ListOptions{
+	clusterID, err := r.getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.watchCache != nil && r.watchCache.isReady() {
+		watcher, err := r.watchCache.watch(clusterID, r.group, r.kind, label, options, r.transformWatchEvent)
+		if err != nil {
+			return nil, err
+		}
+		return r.watches.track(watcher), nil
+	}
+
+	watcher, err := r.kcrdClient.KcrdV1alpha1().KubernetesCrds(r.getManifestNamespace(ctx, clusterID)).Watch(ctx, metav1.ListOptions{
 		LabelSelector:        label.String(),
 		FieldSelector:        "", // explicitly set FieldSelector to an empty string
 		Watch:                options.Watch,
@@ -381,27 +443,48 @@ func (r *REST) Watch(ctx context.Context, options *internalversion.ListOptions)
 		Limit:                options.Limit,
 		Continue:             options.Continue,
 	})
-	watchWrapper := utils.NewWatchWrapper(ctx, watcher, func(object runtime.Object) runtime.Object {
-		// transform object here
-		if _, ok := object.(*metav1.Status); ok {
-			return object
+	if err != nil {
+		if errors.IsResourceExpired(err) || errors.IsGone(err) {
+			return nil, errors.NewResourceExpired(err.Error())
 		}
+		return nil, err
+	}
+	watchWrapper := utils.NewWatchWrapper(ctx, watcher, r.transformWatchEvent, utils.DefaultWatchBufferSize)
+	go watchWrapper.Run()
+	return r.watches.track(watchWrapper), nil
+}
 
-		if manifest, ok := object.(*kcrd.KubernetesCrd); ok {
-			obj, err := transformManifest(manifest)
-			if err != nil {
-				klog.ErrorDepth(3, fmt.Sprintf("failed to transform Manifest %s: %v", klog.KObj(manifest), err))
-				return manifest
-			}
-			return obj
+// transformWatchEvent converts the Manifest in an event on Manifests into the object it stores. Bookmarks turn into
+// objects of the kind served, and expired resource versions into 410 errors about the resource served.
+func (r *REST) transformWatchEvent(event watch.Event) watch.Event {
+	if status, ok := event.Object.(*metav1.Status); ok {
+		if status.Code == http.StatusGone || status.Reason == metav1.StatusReasonExpired || status.Reason == metav1.StatusReasonGone {
+			// resource versions of the objects served are those of Manifests, which are resumed from as they are
+			expired := errors.NewResourceExpired(status.Message).Status()
+			return watch.Event{Type: watch.Error, Object: &expired}
 		}
-
-		return object
-	}, utils.DefaultWatchSize)
-	if err == nil {
-		go watchWrapper.Run()
+		return event
+	}
+	manifest, ok := event.Object.(*kcrd.KubernetesCrd)
+	if !ok {
+		return event
+	}
+	if event.Type == watch.Bookmark {
+		bookmark := &unstructured.Unstructured{}
+		bookmark.SetGroupVersionKind(r.GroupVersionKind(schema.GroupVersion{}))
+		bookmark.SetResourceVersion(manifest.ResourceVersion)
+		return watch.Event{Type: watch.Bookmark, Object: bookmark}
 	}
-	return watchWrapper, err
+	obj, err := r.convertManifest(manifest)
+	if err != nil {
+		klog.Errorf("failed to transform Manifest %s: %v", klog.KObj(manifest), err)
+		status := errors.NewInternalError(err).Status()
+		if statusErr, ok := err.(errors.APIStatus); ok {
+			status = statusErr.Status()
+		}
+		return watch.Event{Type: watch.Error, Object: &status}
+	}
+	return watch.Event{Type: event.Type, Object: obj}
 }
 
 // List returns a list of items matching labels.
@@ -411,7 +494,19 @@ func (r *REST) List(ctx context.Context, options *internalversion.ListOptions) (
 		return nil, err
 	}
 
-	manifests, err := r.kcrdClient.KcrdV1alpha1().KubernetesCrds(r.reservedNamespace).List(ctx, metav1.ListOptions{
+	clusterID, err := r.getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.manifestCache != nil && r.manifestCache.servesList(options) {
+		manifests, resourceVersion, err := r.manifestCache.list(clusterID, request.NamespaceValue(ctx), r.group, r.kind, label)
+		if err == nil {
+			return r.newList(manifests, resourceVersion, "")
+		}
+		klog.Errorf("failed to list %s from cache, listing from the host cluster: %v", r.name, err)
+	}
+
+	manifests, err := r.kcrdClient.KcrdV1alpha1().KubernetesCrds(r.getManifestNamespace(ctx, clusterID)).List(ctx, metav1.ListOptions{
 		LabelSelector:        label.String(),
 		FieldSelector:        "", // explicitly set FieldSelector to an empty string
 		Watch:                options.Watch,
@@ -426,19 +521,25 @@ func (r *REST) List(ctx context.Context, options *internalversion.ListOptions) (
 		return nil, err
 	}
 
+	items := make([]*kcrd.KubernetesCrd, 0, len(manifests.Items))
+	for i := range manifests.Items {
+		items = append(items, &manifests.Items[i])
+	}
+	return r.newList(items, manifests.ResourceVersion, manifests.Continue)
+}
+
+// newList returns the list of the objects stored in manifests
+func (r *REST) newList(manifests []*kcrd.KubernetesCrd, resourceVersion, continueToken string) (*unstructured.UnstructuredList, error) {
 	result := &unstructured.UnstructuredList{}
 	orignalGVK := r.GroupVersionKind(schema.GroupVersion{})
 	result.SetAPIVersion(orignalGVK.GroupVersion().String())
 	result.SetKind(r.getListKind())
-	result.SetResourceVersion(manifests.ResourceVersion)
-	result.SetContinue(manifests.Continue)
+	result.SetResourceVersion(resourceVersion)
+	result.SetContinue(continueToken)
 	// remainingItemCount will always be nil, since we're using non-empty label selectors.
 	// This is a limitation on Kubernetes side.
-	if len(manifests.Items) == 0 {
-		return result, nil
-	}
-	for _, manifest := range manifests.Items {
-		obj, err := transformManifest(&manifest)
+	for _, manifest := range manifests {
+		obj, err := r.convertManifest(manifest)
 		if err != nil {
 			return nil, err
 		}
@@ -457,10 +558,17 @@ func (r *REST) NewList() runtime.Object {
 }
 
 func (r *REST) ConvertToTable(ctx context.Context, object runtime.Object, tableOptions runtime.Object) (*metav1.Table, error) {
-	tableConvertor := rest.NewDefaultTableConvertor(schema.GroupResource{Group: r.group, Resource: r.name})
+	tableConvertor := r.tableConvertor
+	if tableConvertor == nil {
+		tableConvertor = rest.NewDefaultTableConvertor(schema.GroupResource{Group: r.group, Resource: r.name})
+	}
 	return tableConvertor.ConvertToTable(ctx, object, tableOptions)
 }
 
+func (r *REST) SetTableConvertor(tableConvertor rest.TableConvertor) {
+	r.tableConvertor = tableConvertor
+}
+
 func (r *REST) ShortNames() []string {
 	return r.shortNames
 }
@@ -482,7 +590,11 @@ func (r *REST) SetNamespaceScoped(namespaceScoped bool) {
 }
 
 func (r *REST) Categories() []string {
-	return []string{utils.Category}
+	return withOverlayCategory(r.categories)
+}
+
+func (r *REST) SetCategories(categories []string) {
+	r.categories = categories
 }
 
 func (r *REST) SetGroup(group string) {
@@ -493,6 +605,29 @@ func (r *REST) SetVersion(version string) {
 	r.version = version
 }
 
+func (r *REST) SetTenantCRDs(tenantCRDs TenantCRDs) {
+	r.tenantCRDs = tenantCRDs
+}
+
+func (r *REST) SetHostCRDs(hostCRDs bool) {
+	r.hostCRDs = hostCRDs
+}
+
+// SetWatchCache serves watches from the watch cache shared by all the storages
+func (r *REST) SetWatchCache(watchCache *watchCache) {
+	r.watchCache = watchCache
+}
+
+// SetManifestCache serves the lists accepting cached data from manifestCache
+func (r *REST) SetManifestCache(manifestCache *manifestCache) {
+	r.manifestCache = manifestCache
+}
+
+// inheritWatches takes over the open watches of previous, which is replaced by r for a compatible change of the CRD
+func (r *REST) inheritWatches(previous *REST) {
+	r.watches = previous.watches
+}
+
 func (r *REST) SetKind(kind string) {
 	r.kind = kind
 }
@@ -528,15 +663,25 @@ func (r *REST) normalizeRequest(req *clientgorest.Request, namespace string) *cl
 	return req
 }
 
-func getUser(ctx context.Context) (string, error) {
-	username, ok := request.UserFrom(ctx)
-	if !ok {
-		return "", errors.NewUnauthorized("No user info provided.")
+// getManifestNamespace returns the reserved namespace keeping the Manifests of the requesting tenant
+func (r *REST) getManifestNamespace(ctx context.Context, clusterID string) string {
+	return r.reservedNamespaces.For(clusterID, request.NamespaceValue(ctx))
+}
+
+// tenantNamespaceOf returns the tenant namespace that the Manifest of obj is kept for and labelled with. A Namespace
+// is kept for itself, like those mirrored from business clusters, so that it goes along with the objects in it.
+func (r *REST) tenantNamespaceOf(obj *unstructured.Unstructured) string {
+	if r.kind == "Namespace" {
+		return obj.GetName()
 	}
+	return obj.GetNamespace()
+}
 
-	// users are service accounts
-	// name: external-crd-system:${random}-<cluster-id>-${random}-<namespaces>
-	clusterID, authorizedNS, ok := getClusterNamespace(username.GetName())
+func (r *REST) getUser(ctx context.Context) (string, error) {
+	clusterID, authorizedNS, ok, err := getTenant(ctx, r.authorizer)
+	if err != nil {
+		return "", err
+	}
 	if !ok {
 		return "", errors.NewForbidden(schema.GroupResource{}, "", sys_errors.New("invalid kcrd username format"))
 	}
@@ -551,16 +696,106 @@ func getUser(ctx context.Context) (string, error) {
 	return clusterID, nil
 }
 
-// getNormalizedManifestName will converge generateLegacyNameForManifest and generateNameForManifest
+// getTenant returns the cluster id and the namespace of the tenant making the request.
+// ok is false if the requesting user is neither a tenant nor impersonating one.
+func getTenant(ctx context.Context, authz authorizer.Authorizer) (string, string, bool, error) {
+	username, ok := request.UserFrom(ctx)
+	if !ok {
+		return "", "", false, errors.NewUnauthorized("No user info provided.")
+	}
+
+	// users are service accounts
+	// name: external-crd-system:${random}-<cluster-id>-${random}-<namespaces>
+	// a tenant service account impersonated with "Impersonate-User" has already been resolved
+	// by the impersonation filter of the generic apiserver at this point.
+	if clusterID, namespace, ok := getClusterNamespace(username.GetName()); ok {
+		return clusterID, namespace, true, nil
+	}
+	// platform administrators may act as a tenant with a dedicated user extra
+	return getImpersonatedTenant(ctx, authz, username)
+}
+
+// getImpersonatedTenant returns the tenant carried in user extra utils.ImpersonateTenantExtraKey,
+// after checking that the requesting user is allowed to impersonate it.
+func getImpersonatedTenant(ctx context.Context, authz authorizer.Authorizer, u user.Info) (string, string, bool, error) {
+	values := u.GetExtra()[utils.ImpersonateTenantExtraKey]
+	if len(values) == 0 {
+		return "", "", false, nil
+	}
+	if len(values) > 1 {
+		return "", "", false, errors.NewBadRequest(fmt.Sprintf("only one tenant can be impersonated, got %q", values))
+	}
+
+	clusterID, namespace, ok := utils.ParseTenantKey(values[0])
+	if !ok {
+		return "", "", false, errors.NewBadRequest(fmt.Sprintf("invalid tenant %q to impersonate, should be <cluster-id>/<namespace>", values[0]))
+	}
+
+	if authz == nil {
+		return "", "", false, errors.NewForbidden(schema.GroupResource{Group: overlayapi.GroupName, Resource: utils.TenantResource}, values[0],
+			sys_errors.New("no authorizer configured for impersonation"))
+	}
+	// tenants are checked as a virtual resource, so that RBAC rules like
+	// {apiGroups: ["overlay"], resources: ["tenants"], verbs: ["impersonate"], resourceNames: ["<cluster-id>"]}
+	// can be used to grant impersonation
+	attributes := authorizer.AttributesRecord{
+		User:            u,
+		Verb:            "impersonate",
+		Namespace:       namespace,
+		APIGroup:        overlayapi.GroupName,
+		Resource:        utils.TenantResource,
+		Name:            clusterID,
+		ResourceRequest: true,
+	}
+	decision, reason, err := authz.Authorize(ctx, attributes)
+	if err != nil || decision != authorizer.DecisionAllow {
+		klog.V(4).Infof("user %q is not allowed to impersonate tenant %q: %s %v", u.GetName(), values[0], reason, err)
+		return "", "", false, errors.NewForbidden(schema.GroupResource{Group: overlayapi.GroupName, Resource: utils.TenantResource}, values[0],
+			sys_errors.New(fmt.Sprintf("user %q cannot impersonate tenant %q", u.GetName(), values[0])))
+	}
+
+	// the audit event already has the real user, we add the tenant being impersonated
+	audit.AddAuditAnnotation(ctx, utils.ImpersonatedTenantAuditAnnotation, values[0])
+	return clusterID, namespace, true, nil
+}
+
+// checkSyncedFromBusiness forbids tenants to modify objects mirrored from their business clusters
+func (r *REST) checkSyncedFromBusiness(manifest *kcrd.KubernetesCrd, name, verb string) error {
+	if manifest.Labels[utils.SyncedFromBusinessLabel] != "true" {
+		return nil
+	}
+	return errors.NewForbidden(schema.GroupResource{Group: r.group, Resource: r.name}, name,
+		sys_errors.New(fmt.Sprintf("can not %s objects synced from the business cluster", verb)))
+}
+
+// getNormalizedManifestName will converge generateLegacyNameForManifest and generateNameForManifest. Resources of
+// non-core groups have their groups in the names, so that those of the same plural in different groups, such as the
+// Gateways of Istio and of Gateway API, are kept apart.
 func (r *REST) getNormalizedManifestName(clusterid, namespace, name string) string {
 	resource, _ := r.getResourceName()
-	// resource is a word ("[a-z]([-a-z0-9]*[a-z0-9])?") without "."
-	// namespace is a word ("[a-z]([-a-z0-9]*[a-z0-9])?") without "."
-	// so we use "." for concatenation
-	return fmt.Sprintf("%s.%s.%s.%s", resource, clusterid, namespace, name)
+	if len(r.group) > 0 {
+		resource = resource + "." + r.group
+	}
+	return utils.GetManifestName(resource, clusterid, namespace, name)
+}
+
+// getExistingManifestName returns the name of the Manifest an object is stored in. Manifests of non-core groups used
+// to be named without the groups, and those created then are kept where they are.
+func (r *REST) getExistingManifestName(manifestNamespace, clusterID, namespace, name string) string {
+	manifestName := r.getNormalizedManifestName(clusterID, namespace, name)
+	if len(r.group) == 0 {
+		return manifestName
+	}
+	resource, _ := r.getResourceName()
+	legacyName := utils.GetManifestName(resource, clusterID, namespace, name)
+	legacy, err := r.kcrdLister.KubernetesCrds(manifestNamespace).Get(legacyName)
+	if err == nil && legacy.Labels[utils.ConfigGroupLabel] == r.group {
+		return legacyName
+	}
+	return manifestName
 }
 
-func (r *REST) dryRunCreate(ctx context.Context, obj runtime.Object, _ rest.ValidateObjectFunc, options *metav1.CreateOptions) (*unstructured.Unstructured, error) {
+func (r *REST) dryRunCreate(ctx context.Context, clusterID string, obj runtime.Object, _ rest.ValidateObjectFunc, options *metav1.CreateOptions) (*unstructured.Unstructured, error) {
 	objNamespace := request.NamespaceValue(ctx)
 
 	u, ok := obj.(*unstructured.Unstructured)
@@ -568,30 +803,16 @@ func (r *REST) dryRunCreate(ctx context.Context, obj runtime.Object, _ rest.Vali
 		return nil, errors.NewBadRequest(fmt.Sprintf("not a Unstructured object: %T", obj))
 	}
 
-	// check whether the given namespace name is valid
-	if r.namespaced || r.kind == "Namespace" {
-		fieldPath := field.NewPath("metadata", "namespace")
-		if r.kind == "Namespace" {
-			fieldPath = field.NewPath("metadata", "name")
-		}
-		if errs := apimachineryvalidation.ValidateNamespaceName(objNamespace, false); len(errs) > 0 {
-			allErrs := field.ErrorList{field.Invalid(fieldPath, objNamespace, strings.Join(errs, ","))}
-			return nil, errors.NewInvalid(r.GroupVersionKind(schema.GroupVersion{}).GroupKind(), u.GetName(), allErrs)
-		}
-	}
-
-	labels := u.GetLabels()
-	if labels == nil {
-		labels = map[string]string{}
+	if err := r.validateNamespace(u, objNamespace); err != nil {
+		return nil, err
 	}
-	labels[utils.ObjectCreatedByLabel] = utils.ExternalCrdAppName
-	u.SetLabels(labels)
+	setCreatedBy(u)
 
 	if r.kind != "Namespace" && r.namespaced {
-		u.SetNamespace(r.reservedNamespace)
+		u.SetNamespace(r.getManifestNamespace(ctx, clusterID))
 	}
 	// use reserved namespace (default to be "clusternet-reserved") to avoid error "namespaces not found"
-	dryRunNamespace := r.reservedNamespace
+	dryRunNamespace := r.getManifestNamespace(ctx, clusterID)
 	if r.kind == "Namespace" {
 		dryRunNamespace = ""
 	}
@@ -625,8 +846,34 @@ func (r *REST) dryRunCreate(ctx context.Context, obj runtime.Object, _ rest.Vali
 	return result, nil
 }
 
+// validateNamespace checks whether the given namespace name is valid
+func (r *REST) validateNamespace(u *unstructured.Unstructured, objNamespace string) error {
+	if !r.namespaced && r.kind != "Namespace" {
+		return nil
+	}
+
+	fieldPath := field.NewPath("metadata", "namespace")
+	if r.kind == "Namespace" {
+		fieldPath = field.NewPath("metadata", "name")
+	}
+	if errs := apimachineryvalidation.ValidateNamespaceName(objNamespace, false); len(errs) > 0 {
+		allErrs := field.ErrorList{field.Invalid(fieldPath, objNamespace, strings.Join(errs, ","))}
+		return errors.NewInvalid(r.GroupVersionKind(schema.GroupVersion{}).GroupKind(), u.GetName(), allErrs)
+	}
+	return nil
+}
+
+func setCreatedBy(u *unstructured.Unstructured) {
+	labels := u.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[utils.ObjectCreatedByLabel] = utils.ExternalCrdAppName
+	u.SetLabels(labels)
+}
+
 func (r *REST) convertListOptionsToLabels(ctx context.Context, options *internalversion.ListOptions) (labels.Selector, error) {
-	clusterID, err := getUser(ctx)
+	clusterID, err := r.getUser(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -638,14 +885,14 @@ func (r *REST) convertListOptionsToLabels(ctx context.Context, options *internal
 	if options != nil && options.FieldSelector != nil {
 		rqmts := options.FieldSelector.Requirements()
 		for _, rqmt := range rqmts {
-			var selectorKey string
+			var selectorKey, selectorValue string
 			switch rqmt.Field {
 			case "metadata.name":
-				selectorKey = utils.ConfigNameLabel
+				selectorKey, selectorValue = utils.ConfigNameLabel, utils.GetManifestNameLabelValue(rqmt.Value)
 			default:
 				return nil, errors.NewInternalError(fmt.Errorf("unable to recognize selector key %s", rqmt.Field))
 			}
-			requirement, err := labels.NewRequirement(selectorKey, rqmt.Operator, []string{rqmt.Value})
+			requirement, err := labels.NewRequirement(selectorKey, rqmt.Operator, []string{selectorValue})
 			if err != nil {
 				return nil, err
 			}
@@ -653,7 +900,13 @@ func (r *REST) convertListOptionsToLabels(ctx context.Context, options *internal
 		}
 	}
 
-	// apply default kind label
+	// apply default group and kind labels
+	groupRequirement, err := labels.NewRequirement(utils.ConfigGroupLabel, selection.Equals, []string{r.group})
+	if err != nil {
+		return nil, err
+	}
+	label = label.Add(*groupRequirement)
+
 	kindRequirement, err := labels.NewRequirement(utils.ConfigKindLabel, selection.Equals, []string{r.kind})
 	if err != nil {
 		return nil, err
@@ -705,6 +958,27 @@ func transformManifest(crdResource *kcrd.KubernetesCrd) (*unstructured.Unstructu
 	return result, nil
 }
 
+// convertManifest returns the object stored in crdResource in the version served by r
+func (r *REST) convertManifest(crdResource *kcrd.KubernetesCrd) (*unstructured.Unstructured, error) {
+	result, err := transformManifest(crdResource)
+	if err != nil {
+		return nil, err
+	}
+	r.convertVersion(result)
+	return result, nil
+}
+
+// convertVersion converts obj written with another version of the CRD served by r into the version served, the way
+// kube-apiserver does for CRDs with the "None" conversion strategy, where only apiVersion is changed. Objects of other
+// groups or kinds, such as those of subresources, are left as they are.
+func (r *REST) convertVersion(obj *unstructured.Unstructured) {
+	gvk := obj.GroupVersionKind()
+	if gvk.Group != r.group || gvk.Kind != r.kind || gvk.Version == r.version {
+		return
+	}
+	obj.SetAPIVersion(r.GroupVersion().String())
+}
+
 func trimResult(result *unstructured.Unstructured) {
 	// trim common metadata
 	// metadata.uid cannot be trimmed, which will be used for checking when patching.
@@ -722,14 +996,16 @@ func (r *REST) getListKind() string {
 
 // NewREST returns a RESTStorage object that will work against API services.
 func NewREST(dryRunClient clientgorest.Interface, clusternetclient *kcrdclientset.Clientset, parameterCodec runtime.ParameterCodec,
-	manifestLister applisters.KubernetesCrdLister, reservedNamespace string) *REST {
+	manifestLister applisters.KubernetesCrdLister, authorizer authorizer.Authorizer, reservedNamespaces utils.ReservedNamespaces) *REST {
 	return &REST{
 		dryRunClient:            dryRunClient,
 		kcrdClient:              clusternetclient,
 		kcrdLister:              manifestLister,
+		authorizer:              authorizer,
 		parameterCodec:          parameterCodec,
 		deleteCollectionWorkers: DefaultDeleteCollectionWorkers, // currently we only set a default value for deleteCollectionWorkers
-		reservedNamespace:       reservedNamespace,
+		reservedNamespaces:      reservedNamespaces,
+		watches:                 newWatchTracker(),
 	}
 }
 
@@ -18,10 +18,24 @@ limitations under the License.
 package apiserver
 
 import (
+	"context"
+	"encoding/json"
 	kcrd "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	kcrdfake "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned/fake"
+	kcrdlisters "github.com/jijiechen/external-crd/pkg/generated/listers/kcrd/v1alpha1"
 	"github.com/jijiechen/external-crd/pkg/utils"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/internalversion"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
 	"strings"
 	"testing"
 )
@@ -30,6 +44,7 @@ func TestRESTGenerateNameForManifest(t *testing.T) {
 	tests := []struct {
 		testCaseName string
 		resourceName string
+		group        string
 		namespace    string
 		namespaced   bool
 		name         string
@@ -41,7 +56,7 @@ func TestRESTGenerateNameForManifest(t *testing.T) {
 			namespace:    "kube-system",
 			namespaced:   true,
 			name:         "abc",
-			want:         "foos.kube-system.abc",
+			want:         "foos.abcd.kube-system.abc",
 		},
 		{
 			testCaseName: "namespace-scoped resources foos (name with '.' & '-')",
@@ -49,7 +64,7 @@ func TestRESTGenerateNameForManifest(t *testing.T) {
 			namespace:    "kube-system",
 			namespaced:   true,
 			name:         "abc.def-bar",
-			want:         "foos.kube-system.abc.def-bar",
+			want:         "foos.abcd.kube-system.abc.def-bar",
 		},
 
 		{
@@ -58,7 +73,7 @@ func TestRESTGenerateNameForManifest(t *testing.T) {
 			namespace:    "kube-system",
 			namespaced:   false,
 			name:         "abc",
-			want:         "bars.abc",
+			want:         "bars.abcd.kube-system.abc",
 		},
 		{
 			testCaseName: "cluster-scoped resources bars (name with '.' & '-')",
@@ -66,7 +81,24 @@ func TestRESTGenerateNameForManifest(t *testing.T) {
 			namespace:    "kube-system",
 			namespaced:   false,
 			name:         "abc.def-bar",
-			want:         "bars.abcd.abc.def-bar",
+			want:         "bars.abcd.kube-system.abc.def-bar",
+		},
+		{
+			testCaseName: "namespace-scoped resources foos (name too long)",
+			resourceName: "foos",
+			namespace:    "kube-system",
+			namespaced:   true,
+			name:         strings.Repeat("abc.def-", 30) + "bar",
+			want:         "foos.abcd.kube-system." + strings.Repeat("abc.def-", 27) + "abc-9cde221efb",
+		},
+		{
+			testCaseName: "namespace-scoped resources gateways of non-core group",
+			resourceName: "gateways",
+			group:        "networking.istio.io",
+			namespace:    "kube-system",
+			namespaced:   true,
+			name:         "abc",
+			want:         "gateways.networking.istio.io.abcd.kube-system.abc",
 		},
 	}
 	for _, tt := range tests {
@@ -74,6 +106,7 @@ func TestRESTGenerateNameForManifest(t *testing.T) {
 			r := &REST{
 				name:       tt.resourceName,
 				namespaced: tt.namespaced,
+				group:      tt.group,
 			}
 			if got := r.getNormalizedManifestName("abcd", tt.namespace, tt.name); got != tt.want {
 				t.Errorf("got %q, want %q", got, tt.want)
@@ -82,6 +115,159 @@ func TestRESTGenerateNameForManifest(t *testing.T) {
 	}
 }
 
+func TestRESTSamePluralInDifferentGroups(t *testing.T) {
+	kcrdClient := kcrdfake.NewSimpleClientset()
+	manifestsResource := schema.GroupVersionResource{Group: "kcrd", Version: "v1alpha1", Resource: "kubernetescrds"}
+	// Manifests come back from the host cluster serialized
+	kcrdClient.PrependReactor("create", "kubernetescrds", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		manifest := action.(clienttesting.CreateAction).GetObject().(*kcrd.KubernetesCrd).DeepCopy()
+		raw, err := json.Marshal(manifest.Manifest.Object)
+		if err != nil {
+			return true, nil, err
+		}
+		manifest.Manifest = runtime.RawExtension{Raw: raw}
+		return true, manifest, kcrdClient.Tracker().Create(manifestsResource, manifest, action.GetNamespace())
+	})
+	reservedNamespaces := utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0)
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return kcrdClient.Tracker().List(manifestsResource, kcrd.SchemeGroupVersion.WithKind("KubernetesCrd"), utils.KcrdReservedNamespace)
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}, &kcrd.KubernetesCrd{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := AddManifestIndexers(informer, reservedNamespaces); err != nil {
+		t.Fatal(err)
+	}
+
+	tenantCRDs := fakeTenantCRDs{"cls-foo/ns-foo": {
+		newTestCRD("networking.istio.io", "v1beta1", "gateways", "Gateway"),
+		newTestCRD("gateway.networking.k8s.io", "v1beta1", "gateways", "Gateway"),
+	}}
+	newStorage := func(group string) *REST {
+		return &REST{
+			name:               "gateways",
+			namespaced:         true,
+			kind:               "Gateway",
+			group:              group,
+			version:            "v1beta1",
+			kcrdClient:         kcrdClient,
+			kcrdLister:         kcrdlisters.NewKubernetesCrdLister(informer.GetIndexer()),
+			reservedNamespaces: reservedNamespaces,
+			tenantCRDs:         tenantCRDs,
+			manifestCache:      newManifestCache(informer),
+		}
+	}
+	istio, gatewayAPI := newStorage("networking.istio.io"), newStorage("gateway.networking.k8s.io")
+	ctx := request.WithNamespace(request.WithUser(context.Background(),
+		&user.DefaultInfo{Name: "system:serviceaccount:external-crd-system:biz-ab12-cls-foo-ab12-ns-foo"}), "ns-foo")
+	for _, storage := range []*REST{istio, gatewayAPI} {
+		gateway := &unstructured.Unstructured{}
+		gateway.SetAPIVersion(storage.group + "/v1beta1")
+		gateway.SetKind("Gateway")
+		gateway.SetNamespace("ns-foo")
+		gateway.SetName("ingress")
+		if _, err := storage.Create(ctx, gateway, nil, &metav1.CreateOptions{}); err != nil {
+			t.Fatalf("expect the Gateway of %s to be created, got %v", storage.group, err)
+		}
+	}
+
+	// created before Manifests were named with groups
+	if err := kcrdClient.Tracker().Create(manifestsResource, &kcrd.KubernetesCrd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "gateways.cls-foo.ns-foo.legacy",
+			Namespace: utils.KcrdReservedNamespace,
+			Labels: map[string]string{
+				utils.ConfigGroupLabel:     "networking.istio.io",
+				utils.ConfigVersionLabel:   "v1beta1",
+				utils.ConfigKindLabel:      "Gateway",
+				utils.ConfigNameLabel:      "legacy",
+				utils.ConfigClusterLabel:   "cls-foo",
+				utils.ConfigNamespaceLabel: "ns-foo",
+			},
+		},
+		Manifest: runtime.RawExtension{
+			Raw: []byte(`{"apiVersion":"networking.istio.io/v1beta1","kind":"Gateway","metadata":{"name":"legacy","namespace":"ns-foo"}}`),
+		},
+	}, utils.KcrdReservedNamespace); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		t.Fatal("informer is not synced")
+	}
+	for _, test := range []struct {
+		storage *REST
+		want    []string
+	}{
+		{storage: istio, want: []string{"legacy", "ingress"}},
+		{storage: gatewayAPI, want: []string{"ingress"}},
+	} {
+		obj, err := test.storage.List(ctx, &internalversion.ListOptions{ResourceVersion: "0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, item := range obj.(*unstructured.UnstructuredList).Items {
+			if item.GetAPIVersion() != test.storage.group+"/v1beta1" {
+				t.Errorf("expect only the Gateways of %s to be listed, got %s", test.storage.group, item.GetAPIVersion())
+			}
+			names = append(names, item.GetName())
+		}
+		if strings.Join(names, ",") != strings.Join(test.want, ",") {
+			t.Errorf("expect the Gateways %v of %s to be listed, got %v", test.want, test.storage.group, names)
+		}
+	}
+
+	if _, err := istio.Get(ctx, "legacy", &metav1.GetOptions{}); err != nil {
+		t.Errorf("expect the Gateway stored without the group to be found, got %v", err)
+	}
+	if _, err := gatewayAPI.Get(ctx, "legacy", &metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expect the Gateway stored without the group to be kept to its group, got %v", err)
+	}
+	legacy := &unstructured.Unstructured{}
+	legacy.SetAPIVersion("networking.istio.io/v1beta1")
+	legacy.SetKind("Gateway")
+	legacy.SetNamespace("ns-foo")
+	legacy.SetName("legacy")
+	if _, err := istio.Create(ctx, legacy, nil, &metav1.CreateOptions{}); !apierrors.IsAlreadyExists(err) {
+		t.Errorf("expect the Gateway stored without the group to exist, got %v", err)
+	}
+}
+
+func TestRESTTenantNamespaceOf(t *testing.T) {
+	newObject := func(kind, namespace, name string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetKind(kind)
+		obj.SetNamespace(namespace)
+		obj.SetName(name)
+		return obj
+	}
+	tests := []struct {
+		name string
+		kind string
+		obj  *unstructured.Unstructured
+		want string
+	}{
+		{name: "namespace-scoped", kind: "Foo", obj: newObject("Foo", "ns-foo", "abc"), want: "ns-foo"},
+		{name: "cluster-scoped", kind: "Bar", obj: newObject("Bar", "", "abc"), want: ""},
+		// like the Namespaces mirrored from business clusters
+		{name: "namespace", kind: "Namespace", obj: newObject("Namespace", "", "ns-foo"), want: "ns-foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &REST{kind: tt.kind}
+			if got := r.tenantNamespaceOf(tt.obj); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestTransformManifest(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -157,3 +343,96 @@ func TestTransformManifest(t *testing.T) {
 		})
 	}
 }
+
+func TestRESTTransformWatchEvent(t *testing.T) {
+	r := &REST{group: "networking.istio.io", version: "v1beta1", kind: "Gateway"}
+
+	bookmark := &kcrd.KubernetesCrd{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "42"}}
+	event := r.transformWatchEvent(watch.Event{Type: watch.Bookmark, Object: bookmark})
+	u, ok := event.Object.(*unstructured.Unstructured)
+	if event.Type != watch.Bookmark || !ok {
+		t.Fatalf("expect a bookmark of the kind served, got %s event of %T", event.Type, event.Object)
+	}
+	if u.GroupVersionKind() != r.GroupVersionKind(schema.GroupVersion{}) || u.GetResourceVersion() != "42" {
+		t.Errorf("expect the bookmark of %v at 42, got %v at %s", r.GroupVersionKind(schema.GroupVersion{}),
+			u.GroupVersionKind(), u.GetResourceVersion())
+	}
+
+	gone := apierrors.NewGone("too old resource version: 1 (42)").Status()
+	event = r.transformWatchEvent(watch.Event{Type: watch.Error, Object: &gone})
+	if status, ok := event.Object.(*metav1.Status); !ok || !apierrors.IsResourceExpired(apierrors.FromObject(status)) {
+		t.Errorf("expect expired resource versions to be 410 errors, got %v", event.Object)
+	}
+}
+
+type fakeAuthorizer struct {
+	allowed map[string]bool
+}
+
+func (f fakeAuthorizer) Authorize(_ context.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+	if a.GetVerb() == "impersonate" && a.GetResource() == utils.TenantResource && f.allowed[a.GetUser().GetName()] {
+		return authorizer.DecisionAllow, "", nil
+	}
+	return authorizer.DecisionNoOpinion, "", nil
+}
+
+func TestRESTGetUser(t *testing.T) {
+	tests := []struct {
+		name      string
+		user      user.Info
+		namespace string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "tenant service account",
+			user:      &user.DefaultInfo{Name: "system:serviceaccount:external-crd-system:biz-ab12-cls-foo-ab12-ns-bar"},
+			namespace: "ns-bar",
+			want:      "cls-foo",
+		},
+		{
+			name:      "tenant service account in other namespace",
+			user:      &user.DefaultInfo{Name: "system:serviceaccount:external-crd-system:biz-ab12-cls-foo-ab12-ns-bar"},
+			namespace: "ns-baz",
+			wantErr:   true,
+		},
+		{
+			name:      "admin impersonating tenant",
+			user:      &user.DefaultInfo{Name: "admin", Extra: map[string][]string{utils.ImpersonateTenantExtraKey: {"cls-foo/ns-bar"}}},
+			namespace: "ns-bar",
+			want:      "cls-foo",
+		},
+		{
+			name:      "unauthorized user impersonating tenant",
+			user:      &user.DefaultInfo{Name: "someone", Extra: map[string][]string{utils.ImpersonateTenantExtraKey: {"cls-foo/ns-bar"}}},
+			namespace: "ns-bar",
+			wantErr:   true,
+		},
+		{
+			name:      "admin impersonating malformed tenant",
+			user:      &user.DefaultInfo{Name: "admin", Extra: map[string][]string{utils.ImpersonateTenantExtraKey: {"cls-foo"}}},
+			namespace: "ns-bar",
+			wantErr:   true,
+		},
+		{
+			name:      "admin without impersonation",
+			user:      &user.DefaultInfo{Name: "admin"},
+			namespace: "ns-bar",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &REST{authorizer: fakeAuthorizer{allowed: map[string]bool{"admin": true}}}
+			ctx := request.WithNamespace(request.WithUser(context.Background(), tt.user), tt.namespace)
+			got, err := r.getUser(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getUser() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("getUser() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/apiextensions-apiserver/pkg/apihelpers"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiservervalidation "k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	overlayapi "github.com/jijiechen/external-crd/pkg/apis/overlay/v1alpha1"
+)
+
+// TenantCRDs provides the CRDs of each tenant, when CRDs are sourced from tenants instead of the host cluster,
+// or when tenants register virtual CRDs. Tenants may install different versions of the same CRD, such as those
+// of different Istio releases.
+type TenantCRDs interface {
+	// ForTenant returns the CRDs of a tenant
+	ForTenant(clusterID, namespace string) []*apiextensionsv1.CustomResourceDefinition
+	// List returns the CRDs of all the tenants. A CRD is listed once per storage version in use.
+	List() []*apiextensionsv1.CustomResourceDefinition
+	// AddEventHandler registers a handler notified of the changes of the CRDs returned by List
+	AddEventHandler(handler cache.ResourceEventHandler)
+	// HasSynced tells whether the CRDs of all the tenants have been loaded once
+	HasSynced() bool
+}
+
+// tenantCRD returns the CRD of group and plural among crds. When anyGroup is true, which is the case for resources
+// under overlay group, a CRD of another group with the same plural is returned if there is none of group.
+func tenantCRD(crds []*apiextensionsv1.CustomResourceDefinition, group, plural string, anyGroup bool) *apiextensionsv1.CustomResourceDefinition {
+	var found *apiextensionsv1.CustomResourceDefinition
+	for _, crd := range crds {
+		if crd.Spec.Names.Plural != plural {
+			continue
+		}
+		if crd.Spec.Group == group {
+			return crd
+		}
+		if anyGroup && (found == nil || crd.Spec.Group < found.Spec.Group) {
+			found = crd
+		}
+	}
+	return found
+}
+
+// tenantGroupVersionResource maps gvr, which is served to all the tenants, to the group version resource of the CRD
+// the requesting tenant has. Resources under overlay group are served with the storage version of the tenant,
+// while resources under their original groups are only served with it.
+func (r *crdHandler) tenantGroupVersionResource(ctx context.Context, gvr schema.GroupVersionResource, overlay bool) (schema.GroupVersionResource, error) {
+	notFound := errors.NewNotFound(schema.GroupResource{Group: gvr.Group, Resource: gvr.Resource}, "")
+	if overlay {
+		notFound = errors.NewNotFound(schema.GroupResource{Group: overlayapi.GroupName, Resource: gvr.Resource}, "")
+	}
+
+	clusterID, namespace, ok, err := getTenant(ctx, r.authorizer)
+	if err != nil {
+		return gvr, err
+	}
+	if !ok {
+		// let the storage reject the request
+		return gvr, nil
+	}
+
+	crd := tenantCRD(r.tenantCRDs.ForTenant(clusterID, namespace), gvr.Group, gvr.Resource, overlay)
+	if crd == nil {
+		return gvr, notFound
+	}
+	if !overlay {
+		// every served version of the CRD of the tenant is served by the storage of that version
+		if !apihelpers.HasServedCRDVersion(crd, gvr.Version) {
+			return gvr, notFound
+		}
+		return gvr, nil
+	}
+	tenantGVR, err := storageGroupVersionResource(crd)
+	if err != nil {
+		return gvr, errors.NewInternalError(err)
+	}
+	return tenantGVR, nil
+}
+
+// tenantResourceFilter returns a function telling whether an APIResource of a CRD under gv is visible to the tenant
+// making req. Nil is returned if all resources are visible, that is when CRDs come from the host cluster, or when
+// the requester is not a tenant, such as platform administrators.
+func (r *crdHandler) tenantResourceFilter(req *http.Request, gv schema.GroupVersion) func(metav1.APIResource) bool {
+	if r.tenantCRDs == nil {
+		return nil
+	}
+	clusterID, namespace, ok, err := getTenant(req.Context(), r.authorizer)
+	if err != nil {
+		return func(metav1.APIResource) bool { return false }
+	}
+	if !ok {
+		return nil
+	}
+
+	crds := r.tenantCRDs.ForTenant(clusterID, namespace)
+	return func(apiResource metav1.APIResource) bool {
+		plural := strings.SplitN(apiResource.Name, "/", 2)[0]
+		if gv == overlayapi.SchemeGroupVersion {
+			return tenantCRD(crds, "", plural, true) != nil
+		}
+		crd := tenantCRD(crds, gv.Group, plural, false)
+		if crd == nil {
+			return false
+		}
+		return apihelpers.HasServedCRDVersion(crd, gv.Version)
+	}
+}
+
+// tenantVersionFilter returns a function telling whether a version of group is visible to the tenant making req.
+// Nil is returned if all versions are visible.
+func (r *crdHandler) tenantVersionFilter(req *http.Request, group string) func(version string) bool {
+	if r.tenantCRDs == nil {
+		return nil
+	}
+	clusterID, namespace, ok, err := getTenant(req.Context(), r.authorizer)
+	if err != nil {
+		return func(string) bool { return false }
+	}
+	if !ok {
+		return nil
+	}
+
+	versions := map[string]bool{}
+	for _, crd := range r.tenantCRDs.ForTenant(clusterID, namespace) {
+		if crd.Spec.Group != group {
+			continue
+		}
+		for _, version := range servedVersions(crd) {
+			versions[version] = true
+		}
+	}
+	return func(version string) bool {
+		return versions[version]
+	}
+}
+
+// listCRDs returns the CRDs to be served, from tenants or the host cluster
+func (r *crdHandler) listCRDs() ([]*apiextensionsv1.CustomResourceDefinition, error) {
+	if r.tenantCRDs != nil {
+		return r.tenantCRDs.List(), nil
+	}
+	return r.crdInformer.Lister().List(labels.Everything())
+}
+
+// validateTenantObject validates obj against the schema of the CRD of the tenant, in place of a dry-run
+// against the host cluster.
+func (r *REST) validateTenantObject(ctx context.Context, clusterID string, obj runtime.Object) (*unstructured.Unstructured, error) {
+	objNamespace := request.NamespaceValue(ctx)
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errors.NewBadRequest(fmt.Sprintf("not a Unstructured object: %T", obj))
+	}
+	if err := r.validateNamespace(u, objNamespace); err != nil {
+		return nil, err
+	}
+
+	// the tenant may have the CRD without the version served
+	crd := tenantCRD(r.tenantCRDs.ForTenant(clusterID, objNamespace), r.group, r.name, false)
+	if crd == nil {
+		return nil, errors.NewNotFound(schema.GroupResource{Group: r.group, Resource: r.name}, u.GetName())
+	}
+	if !apihelpers.HasServedCRDVersion(crd, r.version) {
+		return nil, errors.NewNotFound(schema.GroupResource{Group: r.group, Resource: r.name}, u.GetName())
+	}
+	validation, err := apihelpers.GetSchemaForVersion(crd, r.version)
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	if validation != nil && validation.OpenAPIV3Schema != nil {
+		internalValidation := &apiextensions.CustomResourceValidation{}
+		if err := apiextensionsv1.Convert_v1_CustomResourceValidation_To_apiextensions_CustomResourceValidation(validation, internalValidation, nil); err != nil {
+			return nil, errors.NewInternalError(err)
+		}
+		validator, _, err := apiservervalidation.NewSchemaValidator(internalValidation)
+		if err != nil {
+			klog.Warningf("invalid schema of %s for tenant %s: %v", crd.Name, clusterID, err)
+			return nil, errors.NewInternalError(err)
+		}
+		if errs := apiservervalidation.ValidateCustomResource(nil, u.UnstructuredContent(), validator); len(errs) > 0 {
+			return nil, errors.NewInvalid(r.GroupVersionKind(schema.GroupVersion{}).GroupKind(), u.GetName(), errs)
+		}
+	}
+
+	result := u.DeepCopy()
+	setCreatedBy(result)
+	trimResult(result)
+	return result, nil
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"k8s.io/apiextensions-apiserver/pkg/apihelpers"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/validation"
+	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	kcrd "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	overlayapi "github.com/jijiechen/external-crd/pkg/apis/overlay/v1alpha1"
+	kcrdinformers "github.com/jijiechen/external-crd/pkg/generated/informers/externalversions/kcrd/v1alpha1"
+	kcrdlisters "github.com/jijiechen/external-crd/pkg/generated/listers/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+const (
+	customResourceDefinitionKind     = "CustomResourceDefinition"
+	customResourceDefinitionResource = "customresourcedefinitions"
+)
+
+// virtualCRDs provides the CRDs that tenants register in their overlay views. They are stored as Manifests like
+// any other overlay objects, and are never installed in the host cluster or the business clusters.
+type virtualCRDs struct {
+	*utils.TenantCRDSet
+
+	manifestLister kcrdlisters.KubernetesCrdLister
+	manifestSynced cache.InformerSynced
+
+	// namespaces where Manifests are created
+	reservedNamespaces utils.ReservedNamespaces
+}
+
+func newVirtualCRDs(manifestInformer kcrdinformers.KubernetesCrdInformer, reservedNamespaces utils.ReservedNamespaces) *virtualCRDs {
+	v := &virtualCRDs{
+		TenantCRDSet:       utils.NewTenantCRDSet(),
+		manifestLister:     manifestInformer.Lister(),
+		manifestSynced:     manifestInformer.Informer().HasSynced,
+		reservedNamespaces: reservedNamespaces,
+	}
+	manifestInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: isVirtualCRDManifest,
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { v.sync() },
+			UpdateFunc: func(interface{}, interface{}) { v.sync() },
+			DeleteFunc: func(interface{}) { v.sync() },
+		},
+	})
+	return v
+}
+
+// Run loads the virtual CRDs once Manifests are synced, later changes are picked up by the event handlers
+func (v *virtualCRDs) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForNamedCacheSync("virtual-crds", stopCh, v.manifestSynced) {
+		return
+	}
+	v.sync()
+}
+
+func (v *virtualCRDs) HasSynced() bool {
+	return v.manifestSynced() && v.TenantCRDSet.HasSynced()
+}
+
+func (v *virtualCRDs) sync() {
+	manifests, err := v.manifestLister.List(labels.SelectorFromSet(labels.Set{
+		utils.ConfigGroupLabel: apiextensionsv1.GroupName,
+		utils.ConfigKindLabel:  customResourceDefinitionKind,
+	}))
+	if err != nil {
+		klog.Errorf("failed to list virtual CustomResourceDefinitions: %v", err)
+		return
+	}
+
+	tenantCRDs := map[string][]*apiextensionsv1.CustomResourceDefinition{}
+	for _, manifest := range manifests {
+		if manifest.DeletionTimestamp != nil || !v.reservedNamespaces.Has(manifest.Namespace) {
+			continue
+		}
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		if err := json.Unmarshal(manifest.Manifest.Raw, crd); err != nil {
+			klog.Warningf("skip invalid virtual CustomResourceDefinition in Manifest %s: %v", klog.KObj(manifest), err)
+			continue
+		}
+		// served the same as CRDs of the host cluster, which are cluster scoped
+		crd.Namespace = ""
+		if crd.Labels == nil {
+			crd.Labels = map[string]string{}
+		}
+		crd.Labels[utils.VirtualCRDLabel] = "true"
+
+		key := utils.TenantKey(manifest.Labels[utils.ConfigClusterLabel], manifest.Labels[utils.ConfigNamespaceLabel])
+		tenantCRDs[key] = append(tenantCRDs[key], crd)
+	}
+	v.Set(tenantCRDs)
+}
+
+func isVirtualCRDManifest(obj interface{}) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	manifest, ok := obj.(*kcrd.KubernetesCrd)
+	if !ok {
+		return false
+	}
+	return manifest.Labels[utils.ConfigGroupLabel] == apiextensionsv1.GroupName &&
+		manifest.Labels[utils.ConfigKindLabel] == customResourceDefinitionKind
+}
+
+func isVirtualCRD(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	return crd.Labels[utils.VirtualCRDLabel] == "true"
+}
+
+// hostCRDs serves the CRDs of the host cluster to all the tenants, so that they can be merged with virtual CRDs
+type hostCRDs struct {
+	informer apiextensionsinformers.CustomResourceDefinitionInformer
+}
+
+func (h *hostCRDs) ForTenant(string, string) []*apiextensionsv1.CustomResourceDefinition {
+	return h.List()
+}
+
+func (h *hostCRDs) List() []*apiextensionsv1.CustomResourceDefinition {
+	crds, err := h.informer.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Errorf("failed to list CustomResourceDefinitions: %v", err)
+	}
+	return crds
+}
+
+func (h *hostCRDs) AddEventHandler(handler cache.ResourceEventHandler) {
+	h.informer.Informer().AddEventHandler(handler)
+}
+
+func (h *hostCRDs) HasSynced() bool {
+	return h.informer.Informer().HasSynced()
+}
+
+// mergedTenantCRDs serves the virtual CRDs of tenants alongside those from base. A CRD of base wins over
+// a virtual one with the same name and storage version.
+type mergedTenantCRDs struct {
+	base    TenantCRDs
+	virtual TenantCRDs
+
+	// syncLock serializes the notifications of changes
+	syncLock sync.Mutex
+	lock     sync.RWMutex
+	// CRDs of base and virtual ones, keyed by utils.CRDKey
+	crds     map[string]*apiextensionsv1.CustomResourceDefinition
+	handlers []cache.ResourceEventHandler
+}
+
+func newMergedTenantCRDs(base, virtual TenantCRDs) *mergedTenantCRDs {
+	m := &mergedTenantCRDs{
+		base:    base,
+		virtual: virtual,
+		crds:    map[string]*apiextensionsv1.CustomResourceDefinition{},
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { m.sync() },
+		UpdateFunc: func(interface{}, interface{}) { m.sync() },
+		DeleteFunc: func(interface{}) { m.sync() },
+	}
+	base.AddEventHandler(handler)
+	virtual.AddEventHandler(handler)
+	return m
+}
+
+func (m *mergedTenantCRDs) ForTenant(clusterID, namespace string) []*apiextensionsv1.CustomResourceDefinition {
+	crds := append([]*apiextensionsv1.CustomResourceDefinition{}, m.base.ForTenant(clusterID, namespace)...)
+	return append(crds, m.virtual.ForTenant(clusterID, namespace)...)
+}
+
+func (m *mergedTenantCRDs) List() []*apiextensionsv1.CustomResourceDefinition {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return utils.SortedCRDs(m.crds)
+}
+
+func (m *mergedTenantCRDs) AddEventHandler(handler cache.ResourceEventHandler) {
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+
+	m.lock.Lock()
+	m.handlers = append(m.handlers, handler)
+	m.lock.Unlock()
+
+	for _, crd := range m.List() {
+		handler.OnAdd(crd)
+	}
+}
+
+func (m *mergedTenantCRDs) HasSynced() bool {
+	return m.base.HasSynced() && m.virtual.HasSynced()
+}
+
+func (m *mergedTenantCRDs) sync() {
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+
+	crds := utils.UniqueCRDs(append(m.base.List(), m.virtual.List()...))
+	m.lock.Lock()
+	previous := m.crds
+	m.crds = crds
+	handlers := append([]cache.ResourceEventHandler{}, m.handlers...)
+	m.lock.Unlock()
+
+	utils.NotifyCRDChanges(previous, crds, handlers)
+}
+
+// isVirtualCRDStorage tells whether r serves the virtual CRDs of tenants
+func (r *REST) isVirtualCRDStorage() bool {
+	return r.group == apiextensionsv1.GroupName && r.kind == customResourceDefinitionKind
+}
+
+// validatesAgainstSchema tells whether objects are validated against the schemas of tenant CRDs, instead of being
+// dry-run against the host cluster, which is only possible for CRDs installed there.
+func (r *REST) validatesAgainstSchema(ctx context.Context, clusterID string) bool {
+	if r.tenantCRDs == nil {
+		return false
+	}
+	if !r.hostCRDs {
+		return true
+	}
+	crd := tenantCRD(r.tenantCRDs.ForTenant(clusterID, request.NamespaceValue(ctx)), r.group, r.name, false)
+	return crd != nil && isVirtualCRD(crd)
+}
+
+// validateVirtualCRD validates a CRD registered by a tenant, and returns it as served, that is defaulted and with
+// the status of an established CRD.
+func (r *REST) validateVirtualCRD(ctx context.Context, clusterID string, obj runtime.Object) (*unstructured.Unstructured, error) {
+	objNamespace := request.NamespaceValue(ctx)
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errors.NewBadRequest(fmt.Sprintf("not a Unstructured object: %T", obj))
+	}
+	if err := r.validateNamespace(u, objNamespace); err != nil {
+		return nil, err
+	}
+
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), crd); err != nil {
+		return nil, errors.NewBadRequest(fmt.Sprintf("invalid CustomResourceDefinition: %v", err))
+	}
+	// the namespace of the tenant only scopes the Manifest
+	crd.Namespace = ""
+	apiextensionsv1.SetObjectDefaults_CustomResourceDefinition(crd)
+
+	now := metav1.Now()
+	crd.Status = apiextensionsv1.CustomResourceDefinitionStatus{
+		AcceptedNames: crd.Spec.Names,
+		Conditions: []apiextensionsv1.CustomResourceDefinitionCondition{
+			{Type: apiextensionsv1.NamesAccepted, Status: apiextensionsv1.ConditionTrue, Reason: "NoConflicts", LastTransitionTime: now},
+			{Type: apiextensionsv1.Established, Status: apiextensionsv1.ConditionTrue, Reason: "InitialNamesAccepted", LastTransitionTime: now},
+		},
+	}
+	if storageVersion, err := apihelpers.GetCRDStorageVersion(crd); err == nil {
+		crd.Status.StoredVersions = []string{storageVersion}
+	}
+
+	internalCRD := &apiextensions.CustomResourceDefinition{}
+	if err := apiextensionsv1.Convert_v1_CustomResourceDefinition_To_apiextensions_CustomResourceDefinition(crd, internalCRD, nil); err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	errs := validation.ValidateCustomResourceDefinition(internalCRD)
+	errs = append(errs, r.validateVirtualCRDConflicts(crd, clusterID, objNamespace)...)
+	if len(errs) > 0 {
+		return nil, errors.NewInvalid(r.GroupVersionKind(schema.GroupVersion{}).GroupKind(), crd.Name, errs)
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(crd)
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	result := &unstructured.Unstructured{Object: content}
+	result.SetGroupVersionKind(apiextensionsv1.SchemeGroupVersion.WithKind(customResourceDefinitionKind))
+	result.SetNamespace(objNamespace)
+	setCreatedBy(result)
+	trimResult(result)
+	return result, nil
+}
+
+// validateVirtualCRDConflicts forbids a virtual CRD to take over groups reserved for Kubernetes and external-crd, or
+// groups served by CRDs not registered by the tenant. It also rejects a virtual CRD sharing the name and storage
+// version with a served CRD, but of another kind or scope, since only one of them can be served.
+func (r *REST) validateVirtualCRDConflicts(crd *apiextensionsv1.CustomResourceDefinition, clusterID, namespace string) field.ErrorList {
+	var errs field.ErrorList
+	groupPath := field.NewPath("spec", "group")
+	group := crd.Spec.Group
+	if group == overlayapi.GroupName || strings.HasSuffix(group, kcrdGroupSuffix) ||
+		strings.HasSuffix(group, ".k8s.io") || strings.HasSuffix(group, ".kubernetes.io") {
+		return append(errs, field.Forbidden(groupPath, fmt.Sprintf("group %q is reserved", group)))
+	}
+	if r.tenantCRDs == nil {
+		return errs
+	}
+
+	owned := map[*apiextensionsv1.CustomResourceDefinition]bool{}
+	for _, existing := range r.tenantCRDs.ForTenant(clusterID, namespace) {
+		if !isVirtualCRD(existing) {
+			if existing.Spec.Group == group {
+				return append(errs, field.Forbidden(groupPath, fmt.Sprintf("group %q is served by installed CustomResourceDefinitions", group)))
+			}
+			continue
+		}
+		owned[existing] = true
+	}
+
+	key, err := utils.CRDKey(crd)
+	if err != nil {
+		// reported by the validation of versions
+		return errs
+	}
+	for _, existing := range r.tenantCRDs.List() {
+		if owned[existing] {
+			continue
+		}
+		if existingKey, _ := utils.CRDKey(existing); existingKey != key {
+			continue
+		}
+		if existing.Spec.Names.Kind != crd.Spec.Names.Kind || existing.Spec.Scope != crd.Spec.Scope {
+			errs = append(errs, field.Invalid(field.NewPath("spec", "names", "kind"), crd.Spec.Names.Kind,
+				fmt.Sprintf("conflicts with a served CustomResourceDefinition %s of kind %s and scope %s",
+					existing.Name, existing.Spec.Names.Kind, existing.Spec.Scope)))
+		}
+	}
+	return errs
+}
+
+// newVirtualCRDREST returns the storage of the virtual CRDs of tenants, served under overlay group in the namespace
+// of each tenant
+func (ols *OverlayAPIServer) newVirtualCRDREST() *REST {
+	resourceRest := NewREST(ols.kubeRESTClient, ols.kcrdClient, ParameterCodec, ols.kcrdLister, ols.GenericAPIServer.Authorizer, ols.reservedNamespaces)
+	resourceRest.SetNamespaceScoped(true)
+	resourceRest.SetName(customResourceDefinitionResource)
+	resourceRest.SetShortNames([]string{"crd", "crds"})
+	resourceRest.SetKind(customResourceDefinitionKind)
+	resourceRest.SetGroup(apiextensionsv1.GroupName)
+	resourceRest.SetVersion(apiextensionsv1.SchemeGroupVersion.Version)
+	resourceRest.SetTenantCRDs(ols.tenantCRDs)
+	resourceRest.SetHostCRDs(ols.crdHandler.hostCRDs)
+	resourceRest.SetWatchCache(ols.watchCache)
+	resourceRest.SetManifestCache(ols.manifestCache)
+	return resourceRest
+}
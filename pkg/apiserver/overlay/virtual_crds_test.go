@@ -0,0 +1,131 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/tools/cache"
+
+	kcrd "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	kcrdlisters "github.com/jijiechen/external-crd/pkg/generated/listers/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func TestVirtualCRDs(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	virtual := &virtualCRDs{
+		TenantCRDSet:       utils.NewTenantCRDSet(),
+		manifestLister:     kcrdlisters.NewKubernetesCrdLister(indexer),
+		manifestSynced:     func() bool { return true },
+		reservedNamespaces: utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0),
+	}
+	base := fakeTenantCRDs{
+		"cls-foo/ns-foo": {newTestCRD("networking.istio.io", "v1beta1", "gateways", "Gateway")},
+	}
+	merged := newMergedTenantCRDs(base, virtual)
+	storage := &REST{
+		name:               customResourceDefinitionResource,
+		namespaced:         true,
+		kind:               customResourceDefinitionKind,
+		group:              apiextensionsv1.GroupName,
+		version:            "v1",
+		tenantCRDs:         merged,
+		reservedNamespaces: utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0),
+	}
+	ctx := request.WithNamespace(request.WithUser(context.Background(),
+		&user.DefaultInfo{Name: "system:serviceaccount:external-crd-system:biz-ab12-cls-foo-ab12-ns-foo"}), "ns-foo")
+
+	newCRD := func(group string) *unstructured.Unstructured {
+		crd := newTestCRD(group, "v1", "widgets", "Widget")
+		crd.Spec.Versions[0].Schema = &apiextensionsv1.CustomResourceValidation{
+			OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{Type: "object"},
+		}
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(crd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := &unstructured.Unstructured{Object: content}
+		u.SetGroupVersionKind(apiextensionsv1.SchemeGroupVersion.WithKind(customResourceDefinitionKind))
+		return u
+	}
+	for _, group := range []string{"apps.k8s.io", "networking.istio.io"} {
+		if _, err := storage.validateVirtualCRD(ctx, "cls-foo", newCRD(group)); !apierrors.IsInvalid(err) {
+			t.Errorf("expect a virtual CRD of group %s to be rejected, got %v", group, err)
+		}
+	}
+
+	result, err := storage.validateVirtualCRD(ctx, "cls-foo", newCRD("example.com"))
+	if err != nil {
+		t.Fatalf("validateVirtualCRD() error = %v", err)
+	}
+	if result.GetNamespace() != "ns-foo" {
+		t.Errorf("expect the virtual CRD in the namespace of the tenant, got %q", result.GetNamespace())
+	}
+	if storedVersions, _, _ := unstructured.NestedStringSlice(result.Object, "status", "storedVersions"); len(storedVersions) != 1 {
+		t.Errorf("expect the virtual CRD to have the storage version stored, got %v", storedVersions)
+	}
+
+	body, err := result.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.Add(&kcrd.KubernetesCrd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "widgets.example.com",
+			Namespace: utils.KcrdReservedNamespace,
+			Labels: map[string]string{
+				utils.ConfigGroupLabel:     apiextensionsv1.GroupName,
+				utils.ConfigKindLabel:      customResourceDefinitionKind,
+				utils.ConfigClusterLabel:   "cls-foo",
+				utils.ConfigNamespaceLabel: "ns-foo",
+			},
+		},
+		Manifest: runtime.RawExtension{Raw: body},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	virtual.sync()
+
+	if crds := merged.List(); len(crds) != 1 || !isVirtualCRD(crds[0]) {
+		t.Errorf("expect the virtual CRD to be served, got %v", crds)
+	}
+	if crd := tenantCRD(merged.ForTenant("cls-foo", "ns-foo"), "example.com", "widgets", false); crd == nil {
+		t.Errorf("expect the virtual CRD to be visible to its tenant")
+	}
+	if crd := tenantCRD(merged.ForTenant("cls-foo", "ns-bar"), "example.com", "widgets", false); crd != nil {
+		t.Errorf("expect the virtual CRD to be invisible to other tenants")
+	}
+
+	widgets := &REST{name: "widgets", group: "example.com", version: "v1", tenantCRDs: merged, hostCRDs: true}
+	if !widgets.validatesAgainstSchema(ctx, "cls-foo") {
+		t.Errorf("expect objects of virtual CRDs to be validated against their schemas")
+	}
+	gateways := &REST{name: "gateways", group: "networking.istio.io", version: "v1beta1", tenantCRDs: merged, hostCRDs: true}
+	if gateways.validatesAgainstSchema(ctx, "cls-foo") {
+		t.Errorf("expect objects of host CRDs to be dry-run against the host cluster")
+	}
+}
@@ -0,0 +1,468 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	kcrd "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+const (
+	// watchCacheBookmarkInterval is how often watchers allowing bookmarks are told the latest resource version
+	watchCacheBookmarkInterval = time.Minute
+)
+
+// watchCache serves the watches of all the tenants from the shared Manifest informer, instead of opening a watch
+// on the host cluster for each of them. It keeps the Manifests in the reserved namespaces indexed by tenant and kind,
+// along with their recent events, from which watches are resumed by resource version.
+type watchCache struct {
+	informer cache.SharedIndexInformer
+
+	// namespaces where Manifests are created
+	reservedNamespaces utils.ReservedNamespaces
+
+	lock sync.RWMutex
+	// ready is closed once all the Manifests listed by the informer are observed
+	ready chan struct{}
+	// objects are the Manifests by namespace and name, and keys the namespaced names of them by tenant and kind
+	objects map[string]*kcrd.KubernetesCrd
+	keys    map[string]sets.String
+	// events is a ring of the recent events, starting from events[start]
+	events []watchCacheEvent
+	start  int
+	size   int
+	// resourceVersion is the latest resource version observed, and oldest the earliest one to resume watches from
+	resourceVersion uint64
+	oldest          uint64
+	watchers        map[string]map[*cacheWatcher]struct{}
+}
+
+type watchCacheEvent struct {
+	eventType       watch.EventType
+	object          *kcrd.KubernetesCrd
+	prevObject      *kcrd.KubernetesCrd
+	resourceVersion uint64
+}
+
+// newWatchCache returns a watchCache keeping the latest capacity events
+func newWatchCache(manifestInformer cache.SharedIndexInformer, reservedNamespaces utils.ReservedNamespaces, capacity int) *watchCache {
+	c := &watchCache{
+		informer:           manifestInformer,
+		reservedNamespaces: reservedNamespaces,
+		ready:              make(chan struct{}),
+		objects:            map[string]*kcrd.KubernetesCrd{},
+		keys:               map[string]sets.String{},
+		events:             make([]watchCacheEvent, capacity),
+		watchers:           map[string]map[*cacheWatcher]struct{}{},
+	}
+	c.informer.AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			manifest, ok := obj.(*kcrd.KubernetesCrd)
+			return ok && reservedNamespaces.Has(manifest.Namespace)
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.process(watch.Added, obj.(*kcrd.KubernetesCrd), false)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				// periodic resyncs change nothing
+				if oldObj.(*kcrd.KubernetesCrd).ResourceVersion != newObj.(*kcrd.KubernetesCrd).ResourceVersion {
+					c.process(watch.Modified, newObj.(*kcrd.KubernetesCrd), false)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					c.process(watch.Deleted, tombstone.Obj.(*kcrd.KubernetesCrd), true)
+					return
+				}
+				c.process(watch.Deleted, obj.(*kcrd.KubernetesCrd), false)
+			},
+		},
+	})
+	return c
+}
+
+// Run makes the cache ready once the informer is synced, and sends bookmarks until stopCh is closed
+func (c *watchCache) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForNamedCacheSync("watch-cache", stopCh, c.informer.HasSynced) {
+		return
+	}
+	// the notifications of the initial list may still be on their way
+	if err := wait.PollImmediateUntil(100*time.Millisecond, func() (bool, error) {
+		return c.hasObservedAll(), nil
+	}, stopCh); err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	c.oldest = c.resourceVersion
+	close(c.ready)
+	c.lock.Unlock()
+	klog.Infof("watch cache is ready at resource version %d", c.oldest)
+
+	wait.Until(c.sendBookmarks, watchCacheBookmarkInterval, stopCh)
+}
+
+// isReady tells whether watches can be served from the cache
+func (c *watchCache) isReady() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *watchCache) hasObservedAll() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, namespace := range c.reservedNamespaces.All() {
+		items, err := c.informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+		if err != nil {
+			return false
+		}
+		for _, item := range items {
+			if _, ok := c.objects[objectKey(item.(*kcrd.KubernetesCrd))]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// watch serves the events of the Manifests of kind of group of tenant clusterID matching selector, and converts them
+// with transform before they are sent
+func (c *watchCache) watch(clusterID, group, kind string, selector labels.Selector, options *internalversion.ListOptions,
+	transform func(watch.Event) watch.Event) (watch.Interface, error) {
+	var resourceVersion string
+	var allowBookmarks bool
+	if options != nil {
+		resourceVersion = options.ResourceVersion
+		allowBookmarks = options.AllowWatchBookmarks
+	}
+	// like the watch cache of kube-apiserver, "" and "0" both start with the current objects
+	initial := len(resourceVersion) == 0 || resourceVersion == "0"
+	var from uint64
+	if !initial {
+		var err error
+		if from, err = strconv.ParseUint(resourceVersion, 10, 64); err != nil {
+			return nil, errors.NewBadRequest(fmt.Sprintf("invalid resource version %q: %v", resourceVersion, err))
+		}
+	}
+
+	key := watchCacheKey(clusterID, group, kind)
+	w := &cacheWatcher{
+		cache:          c,
+		key:            key,
+		selector:       selector,
+		allowBookmarks: allowBookmarks,
+		from:           from,
+		transform:      transform,
+		input:          make(chan watch.Event, utils.DefaultWatchBufferSize),
+		result:         make(chan watch.Event, utils.DefaultWatchSize),
+		done:           make(chan struct{}),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if initial {
+		for _, name := range c.keys[key].List() {
+			if object := c.objects[name]; selector.Matches(labels.Set(object.Labels)) {
+				w.initial = append(w.initial, watch.Event{Type: watch.Added, Object: object})
+			}
+		}
+	} else {
+		if from < c.oldest {
+			return nil, errors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", from, c.oldest))
+		}
+		for i := 0; i < c.size; i++ {
+			event := c.events[(c.start+i)%len(c.events)]
+			if watchEvent, ok := w.filter(&event); ok {
+				w.initial = append(w.initial, watchEvent)
+			}
+		}
+	}
+	// watches may be resumed from the resource versions of the host cluster the cache has not caught up with
+	w.resourceVersion = c.resourceVersion
+	if from > w.resourceVersion {
+		w.resourceVersion = from
+	}
+
+	if c.watchers[key] == nil {
+		c.watchers[key] = map[*cacheWatcher]struct{}{}
+	}
+	c.watchers[key][w] = struct{}{}
+	go w.run()
+	return w, nil
+}
+
+// process updates the cache with an event observed by the informer. unknown tells that the deletion is observed
+// after re-listing, when the events in between are lost.
+func (c *watchCache) process(eventType watch.EventType, object *kcrd.KubernetesCrd, unknown bool) {
+	resourceVersion, err := strconv.ParseUint(object.ResourceVersion, 10, 64)
+	if err != nil {
+		klog.Errorf("invalid resource version of Manifest %s: %v", klog.KObj(object), err)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	name := objectKey(object)
+	prevObject := c.objects[name]
+	if prevObject != nil {
+		prevKey := manifestWatchCacheKey(prevObject)
+		if c.keys[prevKey].Delete(name).Len() == 0 {
+			delete(c.keys, prevKey)
+		}
+	}
+	if eventType == watch.Deleted {
+		delete(c.objects, name)
+	} else {
+		c.objects[name] = object
+		key := manifestWatchCacheKey(object)
+		if c.keys[key] == nil {
+			c.keys[key] = sets.NewString()
+		}
+		c.keys[key].Insert(name)
+	}
+
+	if !c.isReady() {
+		// no history is kept until the cache is ready, nor is any watcher served
+		if resourceVersion > c.resourceVersion {
+			c.resourceVersion = resourceVersion
+		}
+		return
+	}
+
+	event := watchCacheEvent{eventType: eventType, object: object, prevObject: prevObject, resourceVersion: resourceVersion}
+	if unknown || resourceVersion <= c.resourceVersion {
+		// the events in between are lost, so are the chances for watches to resume where they are
+		klog.Warningf("watch cache has lost events before resource version %d, terminating all the watchers", resourceVersion)
+		if resourceVersion > c.resourceVersion {
+			c.resourceVersion = resourceVersion
+		}
+		c.start, c.size = 0, 0
+		c.oldest = c.resourceVersion + 1
+		for _, watchers := range c.watchers {
+			for w := range watchers {
+				c.terminateLocked(w)
+			}
+		}
+		return
+	}
+
+	if len(c.events) > 0 {
+		if c.size == len(c.events) {
+			c.oldest = c.events[c.start].resourceVersion
+			c.start = (c.start + 1) % len(c.events)
+			c.size--
+		}
+		c.events[(c.start+c.size)%len(c.events)] = event
+		c.size++
+	} else {
+		c.oldest = resourceVersion
+	}
+	c.resourceVersion = resourceVersion
+
+	keys := sets.NewString(manifestWatchCacheKey(object))
+	if prevObject != nil {
+		keys.Insert(manifestWatchCacheKey(prevObject))
+	}
+	for key := range keys {
+		for w := range c.watchers[key] {
+			if watchEvent, ok := w.filter(&event); ok {
+				c.sendLocked(w, watchEvent)
+			}
+		}
+	}
+}
+
+// sendBookmarks tells the watchers allowing bookmarks the latest resource version observed
+func (c *watchCache) sendBookmarks() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	bookmark := &kcrd.KubernetesCrd{}
+	bookmark.ResourceVersion = strconv.FormatUint(c.resourceVersion, 10)
+	for _, watchers := range c.watchers {
+		for w := range watchers {
+			if !w.allowBookmarks || w.resourceVersion >= c.resourceVersion {
+				continue
+			}
+			// bookmarks are optional, which are never worth terminating a watcher for
+			select {
+			case w.input <- watch.Event{Type: watch.Bookmark, Object: bookmark}:
+				w.resourceVersion = c.resourceVersion
+			default:
+			}
+		}
+	}
+}
+
+func (c *watchCache) sendLocked(w *cacheWatcher, event watch.Event) {
+	select {
+	case w.input <- event:
+		w.resourceVersion = c.resourceVersion
+	default:
+		klog.V(2).Infof("terminating watcher of %s, which falls behind by %d events", w.key, len(w.input))
+		c.terminateLocked(w)
+	}
+}
+
+// terminateLocked removes w, and closes its input so that it ends after the events sent
+func (c *watchCache) terminateLocked(w *cacheWatcher) {
+	watchers := c.watchers[w.key]
+	if _, ok := watchers[w]; !ok {
+		return
+	}
+	delete(watchers, w)
+	if len(watchers) == 0 {
+		delete(c.watchers, w.key)
+	}
+	close(w.input)
+}
+
+func (c *watchCache) stopWatcher(w *cacheWatcher) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.terminateLocked(w)
+}
+
+func watchCacheKey(clusterID, group, kind string) string {
+	return clusterID + "/" + group + "/" + kind
+}
+
+func manifestWatchCacheKey(manifest *kcrd.KubernetesCrd) string {
+	return watchCacheKey(manifest.Labels[utils.ConfigClusterLabel], manifest.Labels[utils.ConfigGroupLabel],
+		manifest.Labels[utils.ConfigKindLabel])
+}
+
+// objectKey keys Manifests by namespace and name, as a Manifest being migrated lives in two reserved namespaces
+func objectKey(manifest *kcrd.KubernetesCrd) string {
+	return manifest.Namespace + "/" + manifest.Name
+}
+
+// cacheWatcher is a watch served from watchCache
+type cacheWatcher struct {
+	cache          *watchCache
+	key            string
+	selector       labels.Selector
+	allowBookmarks bool
+	// from is the resource version the watch starts from, at and before which no events are sent, even if the
+	// cache has not caught up with it yet
+	from      uint64
+	transform func(watch.Event) watch.Event
+	// resourceVersion is the latest resource version the watcher is up to, guarded by the lock of cache
+	resourceVersion uint64
+
+	// initial events are sent before those from input
+	initial []watch.Event
+	input   chan watch.Event
+	result  chan watch.Event
+	done    chan struct{}
+	once    sync.Once
+}
+
+// filter tells what event the watcher gets from the event of the cache, which turns into an addition or a deletion
+// if the Manifest starts or stops matching the watcher
+func (w *cacheWatcher) filter(event *watchCacheEvent) (watch.Event, bool) {
+	if event.resourceVersion <= w.from {
+		return watch.Event{}, false
+	}
+	matches := func(object *kcrd.KubernetesCrd) bool {
+		return object != nil && manifestWatchCacheKey(object) == w.key && w.selector.Matches(labels.Set(object.Labels))
+	}
+	if event.eventType == watch.Deleted {
+		return watch.Event{Type: watch.Deleted, Object: event.object}, matches(event.object)
+	}
+	current, previous := matches(event.object), matches(event.prevObject)
+	switch {
+	case current && previous:
+		return watch.Event{Type: watch.Modified, Object: event.object}, true
+	case current:
+		return watch.Event{Type: watch.Added, Object: event.object}, true
+	case previous:
+		// the watcher last saw the previous Manifest, which is gone at the resource version of the event
+		object := event.prevObject.DeepCopy()
+		object.ResourceVersion = event.object.ResourceVersion
+		return watch.Event{Type: watch.Deleted, Object: object}, true
+	default:
+		return watch.Event{}, false
+	}
+}
+
+func (w *cacheWatcher) run() {
+	defer close(w.result)
+	for _, event := range w.initial {
+		if !w.send(event) {
+			return
+		}
+	}
+	w.initial = nil
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.input:
+			if !ok || !w.send(event) {
+				return
+			}
+		}
+	}
+}
+
+func (w *cacheWatcher) send(event watch.Event) bool {
+	if w.transform != nil {
+		event = w.transform(event)
+	}
+	select {
+	case w.result <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *cacheWatcher) Stop() {
+	w.once.Do(func() {
+		close(w.done)
+		w.cache.stopWatcher(w)
+	})
+}
+
+func (w *cacheWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+var _ watch.Interface = &cacheWatcher{}
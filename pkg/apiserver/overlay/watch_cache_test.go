@@ -0,0 +1,177 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	kcrd "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func newTestManifest(name, clusterID, resourceVersion string, extraLabels map[string]string) *kcrd.KubernetesCrd {
+	manifest := &kcrd.KubernetesCrd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       utils.KcrdReservedNamespace,
+			ResourceVersion: resourceVersion,
+			Labels: map[string]string{
+				utils.ConfigGroupLabel:     "example.com",
+				utils.ConfigKindLabel:      "Foo",
+				utils.ConfigNameLabel:      name,
+				utils.ConfigNamespaceLabel: "ns-foo",
+				utils.ConfigClusterLabel:   clusterID,
+			},
+		},
+		Manifest: runtime.RawExtension{
+			Raw: []byte(fmt.Sprintf(`{"apiVersion":"example.com/v1","kind":"Foo","metadata":{"name":%q,"namespace":"ns-foo"}}`, name)),
+		},
+	}
+	for k, v := range extraLabels {
+		manifest.Labels[k] = v
+	}
+	return manifest
+}
+
+func expectWatchEvent(t *testing.T, w watch.Interface, eventType watch.EventType, name, resourceVersion string) {
+	t.Helper()
+	select {
+	case event, ok := <-w.ResultChan():
+		if !ok {
+			t.Fatalf("expect %s event of %q, got the watch closed", eventType, name)
+		}
+		manifest := event.Object.(*kcrd.KubernetesCrd)
+		if event.Type != eventType || manifest.Name != name || manifest.ResourceVersion != resourceVersion {
+			t.Fatalf("expect %s event of %q at %s, got %s event of %q at %s", eventType, name, resourceVersion,
+				event.Type, manifest.Name, manifest.ResourceVersion)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("expect %s event of %q, got nothing", eventType, name)
+	}
+}
+
+func TestWatchCache(t *testing.T) {
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &kcrd.KubernetesCrdList{
+				ListMeta: metav1.ListMeta{ResourceVersion: "11"},
+				Items: []kcrd.KubernetesCrd{
+					*newTestManifest("foo-1", "cls-foo", "10", nil),
+					*newTestManifest("bar-1", "cls-bar", "11", nil),
+				},
+			}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}, &kcrd.KubernetesCrd{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	c := newWatchCache(informer, utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0), 2)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	go c.Run(stopCh)
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return c.isReady(), nil
+	}); err != nil {
+		t.Fatal("watch cache is not ready")
+	}
+
+	// watches start with the current objects of the tenant and kind
+	all, err := c.watch("cls-foo", "example.com", "Foo", labels.Everything(), &internalversion.ListOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Stop()
+	expectWatchEvent(t, all, watch.Added, "foo-1", "10")
+
+	c.process(watch.Added, newTestManifest("bar-2", "cls-bar", "12", nil), false)
+	c.process(watch.Added, newTestManifest("foo-2", "cls-foo", "13", map[string]string{"app": "x"}), false)
+	expectWatchEvent(t, all, watch.Added, "foo-2", "13")
+
+	// watches resume from the recent events
+	selected, err := c.watch("cls-foo", "example.com", "Foo", labels.SelectorFromSet(labels.Set{"app": "x"}),
+		&internalversion.ListOptions{ResourceVersion: "12", AllowWatchBookmarks: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer selected.Stop()
+	expectWatchEvent(t, selected, watch.Added, "foo-2", "13")
+
+	// objects no longer matching are deleted from the watches
+	c.process(watch.Modified, newTestManifest("foo-2", "cls-foo", "14", nil), false)
+	expectWatchEvent(t, all, watch.Modified, "foo-2", "14")
+	expectWatchEvent(t, selected, watch.Deleted, "foo-2", "14")
+
+	c.process(watch.Added, newTestManifest("bar-3", "cls-bar", "15", nil), false)
+	c.sendBookmarks()
+	select {
+	case event := <-selected.ResultChan():
+		if event.Type != watch.Bookmark || event.Object.(*kcrd.KubernetesCrd).ResourceVersion != "15" {
+			t.Errorf("expect a bookmark at 15, got %s event %v", event.Type, event.Object)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("expect a bookmark")
+	}
+	select {
+	case event := <-all.ResultChan():
+		t.Errorf("expect no bookmark for the watch not allowing bookmarks, got %s event", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// watches resumed from resource versions the cache has not caught up with skip the events up to them
+	ahead, err := c.watch("cls-foo", "example.com", "Foo", labels.Everything(), &internalversion.ListOptions{ResourceVersion: "17"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ahead.Stop()
+	c.process(watch.Added, newTestManifest("foo-3", "cls-foo", "16", nil), false)
+	c.process(watch.Added, newTestManifest("foo-4", "cls-foo", "18", nil), false)
+	expectWatchEvent(t, ahead, watch.Added, "foo-4", "18")
+	expectWatchEvent(t, all, watch.Added, "foo-3", "16")
+	expectWatchEvent(t, all, watch.Added, "foo-4", "18")
+
+	// events older than those kept can no longer be resumed from
+	if _, err := c.watch("cls-foo", "example.com", "Foo", labels.Everything(), &internalversion.ListOptions{ResourceVersion: "12"}, nil); !apierrors.IsResourceExpired(err) {
+		t.Errorf("expect resuming from an evicted resource version to be expired, got %v", err)
+	}
+
+	// watchers are terminated once events are lost
+	c.process(watch.Deleted, newTestManifest("foo-1", "cls-foo", "10", nil), true)
+	select {
+	case _, ok := <-all.ResultChan():
+		if ok {
+			t.Errorf("expect the watch to be closed")
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("expect the watch to be closed")
+	}
+	if _, err := c.watch("cls-foo", "example.com", "Foo", labels.Everything(), &internalversion.ListOptions{ResourceVersion: "15"}, nil); !apierrors.IsResourceExpired(err) {
+		t.Errorf("expect resuming from before the lost events to be expired, got %v", err)
+	}
+}
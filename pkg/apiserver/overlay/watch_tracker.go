@@ -0,0 +1,136 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// watchTracker keeps the open watches of a storage, so that they can be closed with an error once the CRD is
+// changed incompatibly or no longer served. Storages rebuilt for compatible changes share the tracker.
+type watchTracker struct {
+	lock    sync.Mutex
+	watches map[*trackedWatch]struct{}
+}
+
+func newWatchTracker() *watchTracker {
+	return &watchTracker{watches: map[*trackedWatch]struct{}{}}
+}
+
+// track relays the events of w until it is stopped, or closed by closeAll
+func (t *watchTracker) track(w watch.Interface) watch.Interface {
+	if t == nil {
+		return w
+	}
+	tw := &trackedWatch{
+		upstream: w,
+		tracker:  t,
+		result:   make(chan watch.Event, utils.DefaultWatchSize),
+		done:     make(chan struct{}),
+	}
+	t.lock.Lock()
+	t.watches[tw] = struct{}{}
+	t.lock.Unlock()
+
+	go tw.run()
+	return tw
+}
+
+// closeAll closes all the open watches, and tells the watchers why with err, such as a 410 to make them re-list
+func (t *watchTracker) closeAll(err *apierrors.StatusError) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	watches := t.watches
+	t.watches = map[*trackedWatch]struct{}{}
+	t.lock.Unlock()
+
+	for tw := range watches {
+		tw.close(err)
+	}
+}
+
+func (t *watchTracker) untrack(tw *trackedWatch) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.watches, tw)
+}
+
+type trackedWatch struct {
+	upstream watch.Interface
+	tracker  *watchTracker
+
+	result chan watch.Event
+	done   chan struct{}
+	once   sync.Once
+	// err is sent to the watcher before the result channel is closed
+	err *apierrors.StatusError
+}
+
+func (tw *trackedWatch) run() {
+	defer close(tw.result)
+
+	upstream := tw.upstream.ResultChan()
+	for {
+		select {
+		case <-tw.done:
+			if tw.err != nil {
+				// best effort, the watcher re-lists anyway once the result channel is closed
+				select {
+				case tw.result <- watch.Event{Type: watch.Error, Object: &tw.err.ErrStatus}:
+				default:
+				}
+			}
+			return
+		case event, ok := <-upstream:
+			if !ok {
+				return
+			}
+			select {
+			case tw.result <- event:
+			case <-tw.done:
+			}
+		}
+	}
+}
+
+func (tw *trackedWatch) close(err *apierrors.StatusError) {
+	tw.once.Do(func() {
+		tw.err = err
+		close(tw.done)
+		// the upstream may block stopping until its stream ends
+		go tw.upstream.Stop()
+	})
+}
+
+func (tw *trackedWatch) Stop() {
+	tw.tracker.untrack(tw)
+	tw.close(nil)
+}
+
+func (tw *trackedWatch) ResultChan() <-chan watch.Event {
+	return tw.result
+}
+
+var _ watch.Interface = &trackedWatch{}
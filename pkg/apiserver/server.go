@@ -19,12 +19,18 @@ package apiserver
 
 import (
 	"context"
+	"os"
+
+	"github.com/jijiechen/external-crd/pkg/controllers/tenant"
 	"github.com/jijiechen/external-crd/pkg/utils"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/controller-manager/pkg/clientbuilder"
 	"k8s.io/klog/v2"
 	aggregatorclient "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
@@ -41,6 +47,7 @@ type OverlayServer struct {
 
 	kcrdInformerFactory       informers.SharedInformerFactory
 	kubeInformerFactory       kubeinformers.SharedInformerFactory
+	systemInformerFactory     kubeinformers.SharedInformerFactory
 	aggregatorInformerFactory aggregatorinformers.SharedInformerFactory
 
 	kubeClient    *kubernetes.Clientset
@@ -66,6 +73,9 @@ func NewOverlayServer(opts *OverlayServerOptions) (*OverlayServer, error) {
 
 	// creates the informer factory
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, utils.DefaultResync)
+	// only watches objects in the system namespace, such as tenant registrations
+	systemInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, utils.DefaultResync,
+		kubeinformers.WithNamespace(utils.KcrdSystemNamespace))
 	kcrdInformerFactory := informers.NewSharedInformerFactory(kcrdClient, utils.DefaultResync)
 	aggregatorInformerFactory := aggregatorinformers.NewSharedInformerFactory(aggregatorclient.
 		NewForConfigOrDie(rootClientBuilder.ConfigOrDie("kcrd-server-kube-client")), utils.DefaultResync)
@@ -77,6 +87,7 @@ func NewOverlayServer(opts *OverlayServerOptions) (*OverlayServer, error) {
 		clientBuilder:             rootClientBuilder,
 		kcrdInformerFactory:       kcrdInformerFactory,
 		kubeInformerFactory:       kubeInformerFactory,
+		systemInformerFactory:     systemInformerFactory,
 		aggregatorInformerFactory: aggregatorInformerFactory,
 	}
 	return server, nil
@@ -90,35 +101,91 @@ func (s *OverlayServer) Run(ctx context.Context) error {
 		return err
 	}
 
+	var crdCatalog *tenant.CRDCatalog
+	if s.options.CRDSource == utils.CRDSourceTenant {
+		crdCatalog = tenant.NewCRDCatalog(s.systemInformerFactory.Core().V1().ConfigMaps(),
+			s.systemInformerFactory.Core().V1().Secrets(),
+			s.options.TenantCRDBundleDir, s.options.TenantCRDSyncPeriod)
+		config.ExtraConfig.TenantCRDs = crdCatalog
+	}
+
+	reservedNamespaces := utils.NewReservedNamespaces(s.options.ReservedNamespace, s.options.ReservedNamespaceShards)
+	if err := tenant.EnsureReservedNamespaces(ctx, s.kubeClient, reservedNamespaces); err != nil {
+		return err
+	}
+
 	server, err := config.Complete().New(
 		s.kubeClient,
 		s.kcrdClient,
 		s.kcrdInformerFactory,
 		s.aggregatorInformerFactory,
 		s.clientBuilder,
-		s.options.ReservedNamespace)
+		reservedNamespaces)
 	if err != nil {
 		return err
 	}
 
+	tenantLifecycleController := tenant.NewLifecycleController(s.kcrdClient,
+		s.systemInformerFactory.Core().V1().ServiceAccounts(),
+		s.kcrdInformerFactory.Kcrd().V1alpha1().KubernetesCrds(),
+		s.options.TenantGCGracePeriod, s.options.TenantArchiveDir, reservedNamespaces)
+
+	tenantTokenController := tenant.NewTokenController(s.kubeClient,
+		s.systemInformerFactory.Core().V1().ServiceAccounts(),
+		s.options.TenantTokenAudiences, s.options.TenantTokenExpiration, s.options.ProxyDeployment)
+
+	var certificateController *tenant.CertificateController
+	if len(s.options.ProxyBaseHost) > 0 {
+		certificateController = tenant.NewCertificateController(s.kubeClient,
+			s.systemInformerFactory.Core().V1().ConfigMaps(),
+			s.systemInformerFactory.Core().V1().Secrets(),
+			s.options.ProxyBaseHost, s.options.ProxyWildcardServingCert, s.options.ProxyServingCertValidity)
+	}
+
+	var namespaceSyncController *tenant.NamespaceSyncController
+	if s.options.NamespaceSyncPeriod > 0 {
+		namespaceSyncController = tenant.NewNamespaceSyncController(s.kcrdClient,
+			s.systemInformerFactory.Core().V1().ConfigMaps(),
+			s.systemInformerFactory.Core().V1().Secrets(),
+			s.kcrdInformerFactory.Kcrd().V1alpha1().KubernetesCrds(),
+			s.options.NamespaceSyncPeriod, reservedNamespaces)
+	}
+
 	server.GenericAPIServer.AddPostStartHookOrDie("start-shared-informers-controllers",
 		func(context genericapiserver.PostStartHookContext) error {
 			klog.Infof("starting external-crd informers ...")
 			// Start the informer factories to begin populating the informer caches
 			// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
 			s.kubeInformerFactory.Start(context.StopCh)
+			s.systemInformerFactory.Start(context.StopCh)
 			s.kcrdInformerFactory.Start(context.StopCh)
 			s.aggregatorInformerFactory.Start(context.StopCh)
 			config.GenericConfig.SharedInformerFactory.Start(context.StopCh)
 
 			// waits for all started informers' cache got synced
 			s.kubeInformerFactory.WaitForCacheSync(context.StopCh)
+			s.systemInformerFactory.WaitForCacheSync(context.StopCh)
 			s.kcrdInformerFactory.WaitForCacheSync(context.StopCh)
 			s.aggregatorInformerFactory.WaitForCacheSync(context.StopCh)
 			// TODO: uncomment this when module "k8s.io/apiserver" gets bumped to a higher version.
 			// 		supports k8s.io/apiserver version skew (kcrd/kcrd#137)
 			// config.GenericConfig.SharedInformerFactory.WaitForCacheSync(context.StopCh)
 
+			if crdCatalog != nil {
+				go crdCatalog.Run(context.StopCh)
+			}
+			// controllers writing to the host cluster are only run by the leader among all the replicas
+			go s.runLeading(context.StopCh, func(stopCh <-chan struct{}) {
+				go tenantLifecycleController.Run(1, stopCh)
+				go tenantTokenController.Run(1, stopCh)
+				if certificateController != nil {
+					go certificateController.Run(stopCh)
+				}
+				if namespaceSyncController != nil {
+					go namespaceSyncController.Run(stopCh)
+				}
+			})
+
 			select {
 			case <-context.StopCh:
 			}
@@ -129,3 +196,58 @@ func (s *OverlayServer) Run(ctx context.Context) error {
 
 	return server.GenericAPIServer.PrepareRun().Run(ctx.Done())
 }
+
+// runLeading calls run once this replica is elected as the leader, or right away if leader election is disabled.
+// Controllers cannot be restarted once stopped, so the process exits when the leadership is lost, leaving other
+// replicas to take over.
+func (s *OverlayServer) runLeading(stopCh <-chan struct{}, run func(stopCh <-chan struct{})) {
+	if !s.options.LeaderElection.LeaderElect {
+		run(stopCh)
+		return
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("failed to get hostname: %v", err)
+	}
+	// add a uniquifier so that two processes on the same host don't accidentally both become active
+	identity := hostname + "_" + string(uuid.NewUUID())
+	lock, err := resourcelock.New(s.options.LeaderElection.ResourceLock,
+		s.options.LeaderElection.ResourceNamespace,
+		s.options.LeaderElection.ResourceName,
+		s.kubeClient.CoreV1(),
+		s.kubeClient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		klog.Fatalf("failed to create the resource lock for leader election: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   s.options.LeaderElection.LeaseDuration.Duration,
+		RenewDeadline:   s.options.LeaderElection.RenewDeadline.Duration,
+		RetryPeriod:     s.options.LeaderElection.RetryPeriod.Duration,
+		ReleaseOnCancel: true,
+		Name:            s.options.LeaderElection.ResourceName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("started leading as %s", identity)
+				run(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				select {
+				case <-stopCh:
+					klog.Info("stopped leading on shutdown")
+				default:
+					klog.Fatalf("leader election lost")
+				}
+			},
+		},
+	})
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package business
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// WildcardCertLabel is the label of the wildcard serving certificate for "*.<base>".
+// It never collides with the tenant labels, which are DNS labels.
+const WildcardCertLabel = "_wildcard"
+
+// wildcardCertSecretSuffix names the Secret of the wildcard serving certificate, which never collides with those of
+// tenants, as host labels always contain a "-"
+const wildcardCertSecretSuffix = "wildcard"
+
+// ServingCertSecretName returns the name of the Secret holding the serving certificate of a label, which is either
+// the host label of a tenant or WildcardCertLabel
+func ServingCertSecretName(label string) string {
+	return utils.ProxyServingCertSecretName + "-" + servingCertSecretSuffix(label)
+}
+
+func servingCertSecretSuffix(label string) string {
+	if label == WildcardCertLabel {
+		return wildcardCertSecretSuffix
+	}
+	return label
+}
+
+// NewServingCertSecret returns the Secret in namespace holding cert of label
+func NewServingCertSecret(namespace, label string, cert ServingCertificate) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ServingCertSecretName(label),
+			Namespace: namespace,
+			Labels: map[string]string{
+				utils.ProxyServingCertLabel: servingCertSecretSuffix(label),
+				utils.ObjectCreatedByLabel:  utils.ExternalCrdAppName,
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       cert.Cert,
+			corev1.TLSPrivateKeyKey: cert.Key,
+		},
+	}
+}
+
+// IsServingCertSecret tells whether secret holds a serving certificate of the apiserver proxy
+func IsServingCertSecret(secret metav1.Object) bool {
+	_, ok := secret.GetLabels()[utils.ProxyServingCertLabel]
+	return ok
+}
+
+// ServingCertificateOf returns the label and the serving certificate held in secret, false if it holds none
+func ServingCertificateOf(secret *corev1.Secret) (string, ServingCertificate, bool) {
+	suffix, ok := secret.Labels[utils.ProxyServingCertLabel]
+	if !ok || secret.Name != utils.ProxyServingCertSecretName+"-"+suffix {
+		return "", ServingCertificate{}, false
+	}
+	cert := ServingCertificate{Cert: secret.Data[corev1.TLSCertKey], Key: secret.Data[corev1.TLSPrivateKeyKey]}
+	if len(cert.Cert) == 0 || len(cert.Key) == 0 {
+		return "", ServingCertificate{}, false
+	}
+	if suffix == wildcardCertSecretSuffix {
+		return WildcardCertLabel, cert, true
+	}
+	return suffix, cert, true
+}
+
+// ListServingCertSecrets returns the Secrets in namespace holding the serving certificates of the apiserver proxy
+func ListServingCertSecrets(lister corelisters.SecretLister, namespace string) ([]*corev1.Secret, error) {
+	requirement, err := labels.NewRequirement(utils.ProxyServingCertLabel, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	return lister.Secrets(namespace).List(labels.NewSelector().Add(*requirement))
+}
+
+// ListServingCertificates returns the serving certificates of the apiserver proxy in namespace, keyed by labels
+func ListServingCertificates(lister corelisters.SecretLister, namespace string) (map[string]ServingCertificate, error) {
+	secrets, err := ListServingCertSecrets(lister, namespace)
+	if err != nil {
+		return nil, err
+	}
+	certs := map[string]ServingCertificate{}
+	for _, secret := range secrets {
+		if label, cert, ok := ServingCertificateOf(secret); ok {
+			certs[label] = cert
+		}
+	}
+	return certs, nil
+}
+
+// LegacyServingCertKeys returns the keys for the certificate and the private key of a label in the single Secret
+// utils.ProxyServingCertSecretName, where earlier versions kept all the serving certificates
+func LegacyServingCertKeys(label string) (string, string) {
+	return label + ".crt", label + ".key"
+}
+
+// LegacyServingCertificates returns the PEM encoded certificates and private keys in the single Secret
+// utils.ProxyServingCertSecretName of earlier versions, keyed by labels
+func LegacyServingCertificates(secret *corev1.Secret) map[string]ServingCertificate {
+	certs := map[string]ServingCertificate{}
+	for key, cert := range secret.Data {
+		if !strings.HasSuffix(key, ".crt") {
+			continue
+		}
+		label := strings.TrimSuffix(key, ".crt")
+		_, keyKey := LegacyServingCertKeys(label)
+		if len(cert) == 0 || len(secret.Data[keyKey]) == 0 {
+			continue
+		}
+		certs[label] = ServingCertificate{Cert: cert, Key: secret.Data[keyKey]}
+	}
+	return certs
+}
+
+// ServingCertificate is a PEM encoded serving certificate of the apiserver proxy and its private key
+type ServingCertificate struct {
+	Cert []byte
+	Key  []byte
+}
+
+// TLSCertificate parses the serving certificate
+func (c ServingCertificate) TLSCertificate() (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// ServingCertLabel returns the label of the serving certificate for serverName, which is either the host label of
+// a tenant or WildcardCertLabel, and false if serverName is not under baseHost
+func ServingCertLabel(serverName, baseHost string) (string, bool) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	label := strings.TrimSuffix(serverName, "."+strings.ToLower(baseHost))
+	if len(label) == 0 || label == serverName || strings.Contains(label, ".") {
+		return "", false
+	}
+	return label, true
+}
+
+// GetProxyCA returns the PEM encoded CA certificate that issues serving certificates for the apiserver proxy,
+// nil if it is not generated yet
+func GetProxyCA(ctx context.Context, kubeClient kubernetes.Interface, systemNamespace string) ([]byte, error) {
+	secret, err := kubeClient.CoreV1().Secrets(systemNamespace).Get(ctx, utils.ProxyCASecretName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get the CA of the apiserver proxy: %v", err)
+	}
+	return secret.Data[corev1.TLSCertKey], nil
+}
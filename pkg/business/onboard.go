@@ -0,0 +1,386 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package business
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+const (
+	// the ClusterRole bound to all the tenant identities
+	tenantClusterRole = "external-crd"
+	// name prefix of the tenant service accounts, see getClusterNamespace in the overlay apiserver
+	tenantServiceAccountPrefix = "biz-"
+)
+
+// Onboarder creates, deletes and lists tenants in the cluster where external-crd runs
+type Onboarder struct {
+	kubeClient      kubernetes.Interface
+	systemNamespace string
+}
+
+// NewOnboarder returns a new Onboarder
+func NewOnboarder(kubeClient kubernetes.Interface, systemNamespace string) *Onboarder {
+	return &Onboarder{
+		kubeClient:      kubeClient,
+		systemNamespace: systemNamespace,
+	}
+}
+
+// Tenant is an onboarded tenant
+type Tenant struct {
+	ClusterID      string
+	Namespace      string
+	ServiceAccount string
+	// Registered indicates whether the tenant is found in the business config of the proxy
+	Registered bool
+}
+
+// Create onboards a tenant whose business cluster is accessed with given kubeconfig.
+// The business apiserver is verified with the CA bundle in the kubeconfig, unless insecureSkipTLSVerify is set.
+// The tenant identity and its binding are reused if they exist.
+func (o *Onboarder) Create(ctx context.Context, clusterID, namespace string, businessConfig *clientcmdapi.Config,
+	insecureSkipTLSVerify bool) (*Registration, error) {
+	if err := ValidateTenant(clusterID, namespace); err != nil {
+		return nil, err
+	}
+	apiserver, err := ParseBusinessKubeConfig(businessConfig)
+	if err != nil {
+		return nil, err
+	}
+	if insecureSkipTLSVerify {
+		apiserver.InsecureSkipTLSVerify = true
+	}
+	if err := apiserver.ValidateTLS(); err != nil {
+		return nil, err
+	}
+
+	if _, err := o.ensureIdentity(ctx, clusterID, namespace); err != nil {
+		return nil, err
+	}
+
+	// the token of the tenant identity is minted and rotated by the token controller in external-crd
+	registration := &Registration{
+		ClusterID: clusterID,
+		Namespace: namespace,
+		APIServer: *apiserver,
+	}
+	if err := SaveRegistration(ctx, o.kubeClient, o.systemNamespace, registration); err != nil {
+		return nil, fmt.Errorf("failed to update business config: %v", err)
+	}
+	return registration, nil
+}
+
+// Delete offboards a tenant by removing its identity, binding and business config
+func (o *Onboarder) Delete(ctx context.Context, clusterID, namespace string) error {
+	if err := RemoveRegistration(ctx, o.kubeClient, o.systemNamespace, clusterID, namespace); err != nil {
+		return fmt.Errorf("failed to update business config: %v", err)
+	}
+
+	err := o.kubeClient.RbacV1().ClusterRoleBindings().Delete(ctx, clusterRoleBindingName(clusterID, namespace), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	sas, err := o.listIdentities(ctx, clusterID, namespace)
+	if err != nil {
+		return err
+	}
+	for _, sa := range sas {
+		err := o.kubeClient.CoreV1().ServiceAccounts(o.systemNamespace).Delete(ctx, sa.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		klog.V(2).Infof("deleted service account %s/%s", o.systemNamespace, sa.Name)
+	}
+	return nil
+}
+
+// List returns all the tenants known by their identities or business config
+func (o *Onboarder) List(ctx context.Context) ([]Tenant, error) {
+	sas, err := o.kubeClient.CoreV1().ServiceAccounts(o.systemNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: utils.TenantClusterLabel,
+	})
+	if err != nil {
+		return nil, err
+	}
+	registrations, err := GetRegistrations(ctx, o.kubeClient, o.systemNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := map[string]bool{}
+	for _, registration := range registrations {
+		registered[utils.TenantKey(registration.ClusterID, registration.Namespace)] = true
+	}
+
+	var tenants []Tenant
+	for _, sa := range sas.Items {
+		clusterID := sa.Labels[utils.TenantClusterLabel]
+		namespace := sa.Labels[utils.TenantNamespaceLabel]
+		key := utils.TenantKey(clusterID, namespace)
+		tenants = append(tenants, Tenant{
+			ClusterID:      clusterID,
+			Namespace:      namespace,
+			ServiceAccount: sa.Name,
+			Registered:     registered[key],
+		})
+		delete(registered, key)
+	}
+	// registrations without identities
+	for _, registration := range registrations {
+		if registered[utils.TenantKey(registration.ClusterID, registration.Namespace)] {
+			tenants = append(tenants, Tenant{
+				ClusterID:  registration.ClusterID,
+				Namespace:  registration.Namespace,
+				Registered: true,
+			})
+		}
+	}
+	return tenants, nil
+}
+
+// Get returns the registration of a tenant
+func (o *Onboarder) Get(ctx context.Context, clusterID, namespace string) (*Registration, error) {
+	registrations, err := GetRegistrations(ctx, o.kubeClient, o.systemNamespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, registration := range registrations {
+		if registration.ClusterID == clusterID && registration.Namespace == namespace {
+			return registration, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(corev1.Resource("tenant"), utils.TenantKey(clusterID, namespace))
+}
+
+func (o *Onboarder) ensureIdentity(ctx context.Context, clusterID, namespace string) (string, error) {
+	sas, err := o.listIdentities(ctx, clusterID, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	crbName := clusterRoleBindingName(clusterID, namespace)
+	crb, err := o.kubeClient.RbacV1().ClusterRoleBindings().Get(ctx, crbName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "", err
+	}
+	if err == nil {
+		for _, subject := range crb.Subjects {
+			for _, sa := range sas {
+				if subject.Kind == rbacv1.ServiceAccountKind && subject.Namespace == o.systemNamespace && subject.Name == sa.Name {
+					klog.Infof("reusing existing service account %s", sa.Name)
+					return sa.Name, nil
+				}
+			}
+		}
+		// service account missing... delete the cluster role binding and let it be created later
+		if err := o.kubeClient.RbacV1().ClusterRoleBindings().Delete(ctx, crbName, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return "", err
+		}
+	}
+
+	var saName string
+	if len(sas) > 0 {
+		saName = sas[0].Name
+	} else {
+		random := utilrand.String(utils.UsernameRandomDelimiterLength)
+		saName = fmt.Sprintf("%s%s-%s-%s-%s", tenantServiceAccountPrefix, random, clusterID, random, namespace)
+		sa := &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      saName,
+				Namespace: o.systemNamespace,
+				Labels: map[string]string{
+					utils.TenantClusterLabel:   clusterID,
+					utils.TenantNamespaceLabel: namespace,
+				},
+			},
+		}
+		if _, err := o.kubeClient.CoreV1().ServiceAccounts(o.systemNamespace).Create(ctx, sa, metav1.CreateOptions{}); err != nil {
+			return "", err
+		}
+		klog.Infof("created service account %s/%s", o.systemNamespace, saName)
+	}
+
+	crb = &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: crbName,
+			Labels: map[string]string{
+				utils.TenantClusterLabel:   clusterID,
+				utils.TenantNamespaceLabel: namespace,
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     tenantClusterRole,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      saName,
+				Namespace: o.systemNamespace,
+			},
+		},
+	}
+	if _, err := o.kubeClient.RbacV1().ClusterRoleBindings().Create(ctx, crb, metav1.CreateOptions{}); err != nil {
+		return "", err
+	}
+	return saName, nil
+}
+
+func (o *Onboarder) listIdentities(ctx context.Context, clusterID, namespace string) ([]corev1.ServiceAccount, error) {
+	sas, err := o.kubeClient.CoreV1().ServiceAccounts(o.systemNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			utils.TenantClusterLabel:   clusterID,
+			utils.TenantNamespaceLabel: namespace,
+		}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sas.Items, nil
+}
+
+// ParseBusinessKubeConfig reads the address, the CA bundle and the credentials of a business apiserver
+// from the current context of a kubeconfig. Both token and client certificate are supported.
+func ParseBusinessKubeConfig(config *clientcmdapi.Config) (*APIServer, error) {
+	if err := clientcmdapi.FlattenConfig(config); err != nil {
+		return nil, err
+	}
+	context, ok := config.Contexts[config.CurrentContext]
+	if !ok {
+		return nil, fmt.Errorf("current context %q not found in business kubeconfig", config.CurrentContext)
+	}
+	cluster, ok := config.Clusters[context.Cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %q not found in business kubeconfig", context.Cluster)
+	}
+	authInfo, ok := config.AuthInfos[context.AuthInfo]
+	if !ok {
+		return nil, fmt.Errorf("user %q not found in business kubeconfig", context.AuthInfo)
+	}
+
+	host, port, err := splitServer(cluster.Server)
+	if err != nil {
+		return nil, err
+	}
+	apiserver := &APIServer{
+		Host:                     host,
+		HTTPSPort:                port,
+		CertificateAuthorityData: cluster.CertificateAuthorityData,
+		TLSServerName:            cluster.TLSServerName,
+		InsecureSkipTLSVerify:    cluster.InsecureSkipTLSVerify,
+	}
+	switch {
+	case len(authInfo.Token) > 0:
+		apiserver.Token = authInfo.Token
+	case len(authInfo.ClientCertificateData) > 0 && len(authInfo.ClientKeyData) > 0:
+		apiserver.ClientCertificateData = authInfo.ClientCertificateData
+		apiserver.ClientKeyData = authInfo.ClientKeyData
+	default:
+		return nil, fmt.Errorf("only token or client certificate is supported to access business apiserver")
+	}
+	return apiserver, nil
+}
+
+// ProxyCA returns the CA that issues serving certificates for the apiserver proxy, nil if it is not generated yet
+func (o *Onboarder) ProxyCA(ctx context.Context) ([]byte, error) {
+	return GetProxyCA(ctx, o.kubeClient, o.systemNamespace)
+}
+
+// KubeConfigFor generates the kubeconfig for a tenant to access its business cluster through the proxy.
+// The credentials of the business cluster are reused, since the proxy swaps them for the external-crd ones.
+func KubeConfigFor(registration *Registration, baseHost string, proxyCA []byte) *clientcmdapi.Config {
+	serverURL := "https://" + Hostname(registration.ClusterID, registration.Namespace, baseHost)
+
+	var config *clientcmdapi.Config
+	if len(registration.APIServer.Token) > 0 {
+		config = utils.CreateKubeConfigWithToken(serverURL, registration.APIServer.Token, proxyCA)
+	} else {
+		config = utils.CreateKubeConfigWithClientCert(serverURL, registration.APIServer.ClientCertificateData,
+			registration.APIServer.ClientKeyData, proxyCA)
+	}
+	for _, context := range config.Contexts {
+		context.Namespace = registration.Namespace
+	}
+	return config
+}
+
+// LoadBusinessKubeConfig loads a kubeconfig of a business cluster from file
+func LoadBusinessKubeConfig(path string) (*clientcmdapi.Config, error) {
+	config, err := clientcmd.LoadFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading kubeconfig from file %v: %v", path, err)
+	}
+	return config, nil
+}
+
+// ValidateTenant checks whether a cluster id and a namespace can be used in tenant hostnames and names
+func ValidateTenant(clusterID, namespace string) error {
+	if errs := validation.IsDNS1123Label(clusterID); len(errs) > 0 {
+		return fmt.Errorf("invalid cluster id %q: %s", clusterID, strings.Join(errs, ","))
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %s", namespace, strings.Join(errs, ","))
+	}
+	return nil
+}
+
+func clusterRoleBindingName(clusterID, namespace string) string {
+	return fmt.Sprintf("external-crd-biz-%s-%s", clusterID, namespace)
+}
+
+func splitServer(server string) (string, int, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid business apiserver %q: %v", server, err)
+	}
+	if u.Scheme != "https" {
+		return "", 0, fmt.Errorf("only support original kube api server of https scheme, got %q", server)
+	}
+
+	host, port := u.Host, 443
+	if h, p, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid port of business apiserver %q: %v", server, err)
+		}
+	}
+	return host, port, nil
+}
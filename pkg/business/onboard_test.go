@@ -0,0 +1,87 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package business
+
+import (
+	"reflect"
+	"testing"
+
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestParseBusinessKubeConfig(t *testing.T) {
+	newConfig := func(server string, authInfo *clientcmdapi.AuthInfo) *clientcmdapi.Config {
+		return &clientcmdapi.Config{
+			Clusters:       map[string]*clientcmdapi.Cluster{"biz": {Server: server}},
+			AuthInfos:      map[string]*clientcmdapi.AuthInfo{"admin": authInfo},
+			Contexts:       map[string]*clientcmdapi.Context{"biz": {Cluster: "biz", AuthInfo: "admin"}},
+			CurrentContext: "biz",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		config  *clientcmdapi.Config
+		want    *APIServer
+		wantErr bool
+	}{
+		{
+			name:   "token with port",
+			config: newConfig("https://192.168.1.71:6443", &clientcmdapi.AuthInfo{Token: "my-cool-token"}),
+			want:   &APIServer{Host: "192.168.1.71", HTTPSPort: 6443, Token: "my-cool-token"},
+		},
+		{
+			name:   "client certificate without port",
+			config: newConfig("https://api.example.com", &clientcmdapi.AuthInfo{ClientCertificateData: []byte("cert"), ClientKeyData: []byte("key")}),
+			want:   &APIServer{Host: "api.example.com", HTTPSPort: 443, ClientCertificateData: []byte("cert"), ClientKeyData: []byte("key")},
+		},
+		{
+			name: "CA bundle and server name",
+			config: func() *clientcmdapi.Config {
+				config := newConfig("https://192.168.1.71:6443", &clientcmdapi.AuthInfo{Token: "my-cool-token"})
+				config.Clusters["biz"].CertificateAuthorityData = []byte("ca")
+				config.Clusters["biz"].TLSServerName = "kubernetes.default.svc"
+				return config
+			}(),
+			want: &APIServer{Host: "192.168.1.71", HTTPSPort: 6443, Token: "my-cool-token",
+				CertificateAuthorityData: []byte("ca"), TLSServerName: "kubernetes.default.svc"},
+		},
+		{
+			name:    "http scheme",
+			config:  newConfig("http://192.168.1.71:8080", &clientcmdapi.AuthInfo{Token: "my-cool-token"}),
+			wantErr: true,
+		},
+		{
+			name:    "no credentials",
+			config:  newConfig("https://192.168.1.71:6443", &clientcmdapi.AuthInfo{Username: "admin", Password: "admin"}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBusinessKubeConfig(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseBusinessKubeConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseBusinessKubeConfig() got = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,461 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// Registration is the business config of a tenant consumed by the apiserver proxy.
+// It is stored as "<namespace>-<cluster>.json" in ConfigMap utils.BusinessConfigMapName, except for the credentials
+// to the business apiserver, which are kept in Secret utils.BusinessTokenSecretName.
+type Registration struct {
+	ClusterID string    `json:"clusterId"`
+	Namespace string    `json:"namespace"`
+	APIServer APIServer `json:"apiserver"`
+	// ExternalCrdSAToken is the legacy long-lived token of the tenant identity in external-crd.
+	// Deprecated: tokens are minted by external-crd and stored in Secret utils.BusinessTokenSecretName.
+	ExternalCrdSAToken string `json:"externalCrdSAToken,omitempty"`
+}
+
+// APIServer describes how to reach the apiserver of a business cluster
+type APIServer struct {
+	Host      string `json:"host"`
+	HTTPSPort int    `json:"httpsPort"`
+
+	// either token or client certificate is used to authenticate to the business apiserver.
+	// They are stored in Secret utils.BusinessTokenSecretName, earlier versions kept them in the business config.
+	Token                 string `json:"token,omitempty"`
+	ClientCertificateData []byte `json:"clientCertificateData,omitempty"`
+	ClientKeyData         []byte `json:"clientKeyData,omitempty"`
+
+	// CertificateAuthorityData is the PEM encoded CA bundle to verify the business apiserver with
+	CertificateAuthorityData []byte `json:"certificateAuthorityData,omitempty"`
+	// TLSServerName is the name to verify the serving certificate with, and to send as SNI, defaults to Host
+	TLSServerName string `json:"tlsServerName,omitempty"`
+	// InsecureSkipTLSVerify skips verifying the business apiserver, which must be set explicitly without a CA bundle
+	InsecureSkipTLSVerify bool `json:"insecureSkipTLSVerify,omitempty"`
+}
+
+// Key returns the key of this registration in the business config
+func (r *Registration) Key() string {
+	return ConfigKey(r.ClusterID, r.Namespace)
+}
+
+// Server returns the URL of the business apiserver
+func (a *APIServer) Server() string {
+	return fmt.Sprintf("https://%s", net.JoinHostPort(a.Host, strconv.Itoa(a.HTTPSPort)))
+}
+
+// RESTConfig returns the config to access the business apiserver with the credentials of a tenant
+func (a *APIServer) RESTConfig() *rest.Config {
+	config := &rest.Config{
+		Host:        a.Server(),
+		BearerToken: a.Token,
+		TLSClientConfig: rest.TLSClientConfig{
+			ServerName: a.TLSServerName,
+			CertData:   a.ClientCertificateData,
+			KeyData:    a.ClientKeyData,
+		},
+	}
+	if a.InsecureSkipTLSVerify {
+		config.TLSClientConfig.Insecure = true
+		config.TLSClientConfig.ServerName = ""
+	} else {
+		config.TLSClientConfig.CAData = a.CertificateAuthorityData
+	}
+	return config
+}
+
+// ValidateTLS makes sure the business apiserver is either verified with a CA bundle,
+// or explicitly registered to skip verification
+func (a *APIServer) ValidateTLS() error {
+	if a.InsecureSkipTLSVerify || len(a.CertificateAuthorityData) > 0 {
+		return nil
+	}
+	return fmt.Errorf("no CA bundle is registered to verify business apiserver %s, "+
+		"please register one, or skip verification explicitly with insecureSkipTLSVerify", a.Server())
+}
+
+// ConfigKey returns the key in the business config for a tenant
+func ConfigKey(clusterID, namespace string) string {
+	return fmt.Sprintf("%s-%s.json", namespace, clusterID)
+}
+
+// TokenKey returns the key in the business token Secret for a tenant
+func TokenKey(clusterID, namespace string) string {
+	return fmt.Sprintf("%s-%s.token", namespace, clusterID)
+}
+
+// CRDToken returns the token of the tenant identity in external-crd for registration, looked up in tokens, the data
+// of the business token Secret. Tokens minted and rotated by external-crd take precedence over the legacy ones.
+func CRDToken(registration *Registration, tokens map[string][]byte) string {
+	if token := tokens[TokenKey(registration.ClusterID, registration.Namespace)]; len(token) > 0 {
+		return string(token)
+	}
+	return registration.ExternalCrdSAToken
+}
+
+// businessTokenKey returns the key in the business token Secret for the token to the business apiserver of a tenant
+func businessTokenKey(clusterID, namespace string) string {
+	return fmt.Sprintf("%s-%s.business-token", namespace, clusterID)
+}
+
+// businessClientCertKey returns the key in the business token Secret for the client certificate to the business
+// apiserver of a tenant
+func businessClientCertKey(clusterID, namespace string) string {
+	return fmt.Sprintf("%s-%s.business-client.crt", namespace, clusterID)
+}
+
+// businessClientKeyKey returns the key in the business token Secret for the client key to the business apiserver
+// of a tenant
+func businessClientKeyKey(clusterID, namespace string) string {
+	return fmt.Sprintf("%s-%s.business-client.key", namespace, clusterID)
+}
+
+// credentialKeys returns the keys in the business token Secret for the credentials to the business apiserver of a tenant
+func credentialKeys(clusterID, namespace string) []string {
+	return []string{
+		businessTokenKey(clusterID, namespace),
+		businessClientCertKey(clusterID, namespace),
+		businessClientKeyKey(clusterID, namespace),
+	}
+}
+
+// LoadCredentials fills in the credentials to the business apiserver with those in tokens, the data of the business
+// token Secret. Credentials of registrations saved by earlier versions are kept in the business config, they are
+// used as is until saved again.
+func (r *Registration) LoadCredentials(tokens map[string][]byte) {
+	for _, key := range credentialKeys(r.ClusterID, r.Namespace) {
+		if _, ok := tokens[key]; ok {
+			r.APIServer.Token = string(tokens[businessTokenKey(r.ClusterID, r.Namespace)])
+			r.APIServer.ClientCertificateData = tokens[businessClientCertKey(r.ClusterID, r.Namespace)]
+			r.APIServer.ClientKeyData = tokens[businessClientKeyKey(r.ClusterID, r.Namespace)]
+			return
+		}
+	}
+}
+
+// hasCredentials tells whether any credentials to the business apiserver are set
+func (a *APIServer) hasCredentials() bool {
+	return len(a.Token) > 0 || len(a.ClientCertificateData) > 0 || len(a.ClientKeyData) > 0
+}
+
+// tokenExpirationKey returns the key in the business token Secret for the expiration of a tenant token
+func tokenExpirationKey(clusterID, namespace string) string {
+	return fmt.Sprintf("%s-%s.expiration", namespace, clusterID)
+}
+
+// tokenIssuedAtKey returns the key in the business token Secret for when a tenant token is issued
+func tokenIssuedAtKey(clusterID, namespace string) string {
+	return fmt.Sprintf("%s-%s.issued-at", namespace, clusterID)
+}
+
+// Hostname returns the hostname of the proxy for a tenant, which is "<namespace>-<cluster>.<base-host>"
+func Hostname(clusterID, namespace, baseHost string) string {
+	return fmt.Sprintf("%s.%s", HostLabel(clusterID, namespace), baseHost)
+}
+
+// HostLabel returns the leading label of the proxy hostname for a tenant, which is "<namespace>-<cluster>"
+func HostLabel(clusterID, namespace string) string {
+	return fmt.Sprintf("%s-%s", namespace, clusterID)
+}
+
+// GetRegistrations reads all the registrations from the business config, along with their credentials
+func GetRegistrations(ctx context.Context, kubeClient kubernetes.Interface, systemNamespace string) ([]*Registration, error) {
+	cm, err := kubeClient.CoreV1().ConfigMaps(systemNamespace).Get(ctx, utils.BusinessConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	registrations, err := ParseRegistrations(cm)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := kubeClient.CoreV1().Secrets(systemNamespace).Get(ctx, utils.BusinessTokenSecretName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return registrations, nil
+		}
+		return nil, err
+	}
+	for _, registration := range registrations {
+		registration.LoadCredentials(secret.Data)
+	}
+	return registrations, nil
+}
+
+// ListRegistrations reads all the registrations from the business config in the listers, along with their credentials
+func ListRegistrations(configMapLister corelisters.ConfigMapLister, secretLister corelisters.SecretLister,
+	systemNamespace string) ([]*Registration, error) {
+	cm, err := configMapLister.ConfigMaps(systemNamespace).Get(utils.BusinessConfigMapName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	registrations, err := ParseRegistrations(cm)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := secretLister.Secrets(systemNamespace).Get(utils.BusinessTokenSecretName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return registrations, nil
+		}
+		return nil, err
+	}
+	for _, registration := range registrations {
+		registration.LoadCredentials(secret.Data)
+	}
+	return registrations, nil
+}
+
+// ParseRegistrations parses the registrations in a business config, without the credentials kept in the business
+// token Secret, see LoadCredentials
+func ParseRegistrations(cm *corev1.ConfigMap) ([]*Registration, error) {
+	var keys []string
+	for key := range cm.Data {
+		if strings.HasSuffix(key, ".json") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var registrations []*Registration
+	for _, key := range keys {
+		registration := &Registration{}
+		if err := json.Unmarshal([]byte(cm.Data[key]), registration); err != nil {
+			return nil, fmt.Errorf("invalid business config %q: %v", key, err)
+		}
+		registrations = append(registrations, registration)
+	}
+	return registrations, nil
+}
+
+// SaveRegistration creates or updates a registration in the business config, with its credentials in the business
+// token Secret. Credentials are saved first, so that the registration is never found without them.
+func SaveRegistration(ctx context.Context, kubeClient kubernetes.Interface, systemNamespace string, registration *Registration) error {
+	clusterID, namespace := registration.ClusterID, registration.Namespace
+	credentials := map[string][]byte{}
+	for key, value := range map[string][]byte{
+		businessTokenKey(clusterID, namespace):      []byte(registration.APIServer.Token),
+		businessClientCertKey(clusterID, namespace): registration.APIServer.ClientCertificateData,
+		businessClientKeyKey(clusterID, namespace):  registration.APIServer.ClientKeyData,
+	} {
+		if len(value) > 0 {
+			credentials[key] = value
+		}
+	}
+	if err := updateTokenSecret(ctx, kubeClient, systemNamespace, credentials, credentialKeys(clusterID, namespace)); err != nil {
+		return err
+	}
+
+	withoutCredentials := *registration
+	withoutCredentials.APIServer.Token = ""
+	withoutCredentials.APIServer.ClientCertificateData = nil
+	withoutCredentials.APIServer.ClientKeyData = nil
+	data, err := json.Marshal(&withoutCredentials)
+	if err != nil {
+		return err
+	}
+
+	cm, err := kubeClient.CoreV1().ConfigMaps(systemNamespace).Get(ctx, utils.BusinessConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      utils.BusinessConfigMapName,
+				Namespace: systemNamespace,
+			},
+			Data: map[string]string{
+				registration.Key(): string(data),
+			},
+		}
+		_, err = kubeClient.CoreV1().ConfigMaps(systemNamespace).Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	cm = cm.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[registration.Key()] = string(data)
+	_, err = kubeClient.CoreV1().ConfigMaps(systemNamespace).Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// RemoveRegistration removes the registration of a tenant from the business config, and then its credentials from
+// the business token Secret
+func RemoveRegistration(ctx context.Context, kubeClient kubernetes.Interface, systemNamespace, clusterID, namespace string) error {
+	cm, err := kubeClient.CoreV1().ConfigMaps(systemNamespace).Get(ctx, utils.BusinessConfigMapName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && len(cm.Data[ConfigKey(clusterID, namespace)]) > 0 {
+		cm = cm.DeepCopy()
+		delete(cm.Data, ConfigKey(clusterID, namespace))
+		if _, err := kubeClient.CoreV1().ConfigMaps(systemNamespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	return updateTokenSecret(ctx, kubeClient, systemNamespace, nil, credentialKeys(clusterID, namespace))
+}
+
+// updateTokenSecret removes the keys in remove from the business token Secret and then sets the data in set,
+// the Secret is created if there is anything to set
+func updateTokenSecret(ctx context.Context, kubeClient kubernetes.Interface, systemNamespace string, set map[string][]byte, remove []string) error {
+	secret, err := kubeClient.CoreV1().Secrets(systemNamespace).Get(ctx, utils.BusinessTokenSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if len(set) == 0 {
+			return nil
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      utils.BusinessTokenSecretName,
+				Namespace: systemNamespace,
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: set,
+		}
+		_, err = kubeClient.CoreV1().Secrets(systemNamespace).Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	data := map[string][]byte{}
+	for key, value := range secret.Data {
+		data[key] = value
+	}
+	for _, key := range remove {
+		delete(data, key)
+	}
+	for key, value := range set {
+		data[key] = value
+	}
+	if reflect.DeepEqual(data, secret.Data) {
+		return nil
+	}
+	secret = secret.DeepCopy()
+	secret.Data = data
+	_, err = kubeClient.CoreV1().Secrets(systemNamespace).Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+// SaveToken creates or updates the token of a tenant identity in the business token Secret, along with when it is
+// issued and when it expires
+func SaveToken(ctx context.Context, kubeClient kubernetes.Interface, systemNamespace, clusterID, namespace, token string,
+	issuedAt, expiration time.Time) error {
+	return updateTokenSecret(ctx, kubeClient, systemNamespace, map[string][]byte{
+		TokenKey(clusterID, namespace):           []byte(token),
+		tokenIssuedAtKey(clusterID, namespace):   []byte(issuedAt.Format(time.RFC3339)),
+		tokenExpirationKey(clusterID, namespace): []byte(expiration.Format(time.RFC3339)),
+	}, nil)
+}
+
+// GetTokenExpiration returns when the stored token of a tenant identity is issued and when it expires.
+// The issue time is zero for the tokens stored without one.
+func GetTokenExpiration(ctx context.Context, kubeClient kubernetes.Interface, systemNamespace, clusterID, namespace string) (time.Time, time.Time, bool, error) {
+	secret, err := kubeClient.CoreV1().Secrets(systemNamespace).Get(ctx, utils.BusinessTokenSecretName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return time.Time{}, time.Time{}, false, nil
+		}
+		return time.Time{}, time.Time{}, false, err
+	}
+	if len(secret.Data[TokenKey(clusterID, namespace)]) == 0 {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	expiration, err := time.Parse(time.RFC3339, string(secret.Data[tokenExpirationKey(clusterID, namespace)]))
+	if err != nil {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	issuedAt, err := time.Parse(time.RFC3339, string(secret.Data[tokenIssuedAtKey(clusterID, namespace)]))
+	if err != nil {
+		issuedAt = time.Time{}
+	}
+	return issuedAt, expiration, true, nil
+}
+
+// RemoveToken removes the token of a tenant identity from the business token Secret
+func RemoveToken(ctx context.Context, kubeClient kubernetes.Interface, systemNamespace, clusterID, namespace string) error {
+	return updateTokenSecret(ctx, kubeClient, systemNamespace, nil, []string{
+		TokenKey(clusterID, namespace),
+		tokenIssuedAtKey(clusterID, namespace),
+		tokenExpirationKey(clusterID, namespace),
+	})
+}
+
+// RemoveLegacyCredentials drops the plain text token of a tenant identity from the business config, and moves the
+// credentials to the business apiserver saved there by earlier versions into the business token Secret
+func RemoveLegacyCredentials(ctx context.Context, kubeClient kubernetes.Interface, systemNamespace, clusterID, namespace string) error {
+	cm, err := kubeClient.CoreV1().ConfigMaps(systemNamespace).Get(ctx, utils.BusinessConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	registrations, err := ParseRegistrations(cm)
+	if err != nil {
+		return err
+	}
+	for _, registration := range registrations {
+		if registration.ClusterID != clusterID || registration.Namespace != namespace {
+			continue
+		}
+		if len(registration.ExternalCrdSAToken) == 0 && !registration.APIServer.hasCredentials() {
+			return nil
+		}
+		// credentials already in the Secret take precedence over those left in the business config
+		secret, err := kubeClient.CoreV1().Secrets(systemNamespace).Get(ctx, utils.BusinessTokenSecretName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err == nil {
+			registration.LoadCredentials(secret.Data)
+		}
+		registration.ExternalCrdSAToken = ""
+		return SaveRegistration(ctx, kubeClient, systemNamespace, registration)
+	}
+	return nil
+}
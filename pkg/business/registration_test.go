@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func TestSaveRegistration(t *testing.T) {
+	ctx := context.TODO()
+	kubeClient := kubefake.NewSimpleClientset()
+	registration := &Registration{
+		ClusterID: "cls-foo",
+		Namespace: "ns-foo",
+		APIServer: APIServer{Host: "192.168.1.71", HTTPSPort: 6443, ClientCertificateData: []byte("cert"),
+			ClientKeyData: []byte("key"), CertificateAuthorityData: []byte("ca")},
+	}
+	if err := SaveRegistration(ctx, kubeClient, utils.KcrdSystemNamespace, registration); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := kubeClient.CoreV1().ConfigMaps(utils.KcrdSystemNamespace).Get(ctx, utils.BusinessConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := &Registration{}
+	if err := json.Unmarshal([]byte(cm.Data[registration.Key()]), saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.APIServer.hasCredentials() {
+		t.Errorf("expect no credentials in the business config, got %s", cm.Data[registration.Key()])
+	}
+	if string(saved.APIServer.CertificateAuthorityData) != "ca" || saved.APIServer.Host != "192.168.1.71" {
+		t.Errorf("expect the endpoint and CA in the business config, got %s", cm.Data[registration.Key()])
+	}
+
+	registrations, err := GetRegistrations(ctx, kubeClient, utils.KcrdSystemNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registrations) != 1 || !reflect.DeepEqual(registrations[0], registration) {
+		t.Fatalf("expect the registration read with its credentials, got %#v", registrations)
+	}
+
+	// switching to a token drops the client certificate
+	registration.APIServer.Token = "business-token"
+	registration.APIServer.ClientCertificateData = nil
+	registration.APIServer.ClientKeyData = nil
+	if err := SaveRegistration(ctx, kubeClient, utils.KcrdSystemNamespace, registration); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Get(ctx, utils.BusinessTokenSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Data) != 1 || string(secret.Data[businessTokenKey("cls-foo", "ns-foo")]) != "business-token" {
+		t.Errorf("expect only the business token in the Secret, got %v", secret.Data)
+	}
+
+	if err := RemoveRegistration(ctx, kubeClient, utils.KcrdSystemNamespace, "cls-foo", "ns-foo"); err != nil {
+		t.Fatal(err)
+	}
+	secret, err = kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Get(ctx, utils.BusinessTokenSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Data) > 0 {
+		t.Errorf("expect the credentials removed along with the registration, got %v", secret.Data)
+	}
+}
+
+func TestRemoveLegacyCredentials(t *testing.T) {
+	ctx := context.TODO()
+	legacy := `{"clusterId":"cls-foo","namespace":"ns-foo","externalCrdSAToken":"crd-token",` +
+		`"apiserver":{"host":"192.168.1.71","httpsPort":6443,"token":"business-token","insecureSkipTLSVerify":true}}`
+	kubeClient := kubefake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.BusinessConfigMapName, Namespace: utils.KcrdSystemNamespace},
+		Data:       map[string]string{ConfigKey("cls-foo", "ns-foo"): legacy},
+	})
+
+	// registrations saved by earlier versions keep working
+	registrations, err := GetRegistrations(ctx, kubeClient, utils.KcrdSystemNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registrations) != 1 || registrations[0].APIServer.Token != "business-token" {
+		t.Fatalf("expect the legacy business token, got %#v", registrations)
+	}
+
+	if err := RemoveLegacyCredentials(ctx, kubeClient, utils.KcrdSystemNamespace, "cls-foo", "ns-foo"); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := kubeClient.CoreV1().ConfigMaps(utils.KcrdSystemNamespace).Get(ctx, utils.BusinessConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := cm.Data[ConfigKey("cls-foo", "ns-foo")]; strings.Contains(data, "token") {
+		t.Errorf("expect no tokens left in the business config, got %s", data)
+	}
+	registrations, err = GetRegistrations(ctx, kubeClient, utils.KcrdSystemNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registrations) != 1 || registrations[0].APIServer.Token != "business-token" || !registrations[0].APIServer.InsecureSkipTLSVerify {
+		t.Errorf("expect the business token moved into the Secret, got %#v", registrations)
+	}
+}
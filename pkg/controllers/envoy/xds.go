@@ -0,0 +1,674 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package envoy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	crdinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions/apiextensions/v1"
+	crdlisters "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	overlayapi "github.com/jijiechen/external-crd/pkg/apis/overlay/v1alpha1"
+	overlayapiserver "github.com/jijiechen/external-crd/pkg/apiserver/overlay"
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+const (
+	// the Envoy clusters of the apiserver where external-crd runs, and of external-crd itself
+	hostClusterName    = "external-crd-builtin.apiserver"
+	overlayClusterName = "external-crd-builtin.crdserver"
+	routeConfigName    = "local_route"
+	listenerName       = "listener_0"
+	listenerPort       = 443
+
+	// the files read by the path-based dynamic_resources of Envoy
+	cdsFileName = "cds.yaml"
+	rdsFileName = "rds.yaml"
+	ldsFileName = "lds.yaml"
+	// the directory under the output directory keeping the serving certificates and private keys referred to by LDS
+	certsDirName = "certs"
+
+	// the fallback serving certificate generated by the init container, for hostnames without one issued by external-crd
+	fallbackCertFile = "/etc/envoy/server.pem"
+	fallbackKeyFile  = "/etc/envoy/server.key"
+
+	// the only queue key, since all the files are generated at once
+	generateKey = "xds"
+
+	exposurePolicyReloadPeriod = 30 * time.Second
+)
+
+// Upstream is an address Envoy proxies to
+type Upstream struct {
+	Host string
+	Port int
+}
+
+// XDSGenerator generates the dynamic CDS, RDS and LDS files of the Envoy apiserver proxy from the tenant registrations,
+// the CRDs exposed and the serving certificates issued by external-crd, replacing the files atomically,
+// so that Envoy picks up changes without restarts.
+type XDSGenerator struct {
+	systemNamespace string
+	outputDir       string
+	// tenants are served at "<namespace>-<cluster>.<base>"
+	baseHost string
+
+	// the apiserver where external-crd runs, which serves the root discovery documents
+	hostAPIServer Upstream
+	// external-crd, which serves the API groups of the CRDs exposed
+	overlay Upstream
+
+	configMapLister corelisters.ConfigMapLister
+	secretLister    corelisters.SecretLister
+	crdLister       crdlisters.CustomResourceDefinitionLister
+	synced          []cache.InformerSynced
+
+	queue workqueue.RateLimitingInterface
+
+	exposurePolicyFile string
+	policyLock         sync.RWMutex
+	exposurePolicy     *overlayapiserver.ExposurePolicy
+
+	// contents last written, keyed by file name
+	written map[string][]byte
+	// the certificate files referred to by the LDS files written last time and the time before, which are kept
+	// until Envoy is done with them
+	certFiles, previousCertFiles sets.String
+}
+
+// NewXDSGenerator returns a new XDSGenerator writing to outputDir
+func NewXDSGenerator(configMapInformer coreinformers.ConfigMapInformer, secretInformer coreinformers.SecretInformer,
+	crdInformer crdinformers.CustomResourceDefinitionInformer, systemNamespace, outputDir, exposurePolicyFile, baseHost string,
+	hostAPIServer, overlay Upstream) (*XDSGenerator, error) {
+	g := &XDSGenerator{
+		systemNamespace:    systemNamespace,
+		outputDir:          outputDir,
+		baseHost:           baseHost,
+		hostAPIServer:      hostAPIServer,
+		overlay:            overlay,
+		configMapLister:    configMapInformer.Lister(),
+		secretLister:       secretInformer.Lister(),
+		crdLister:          crdInformer.Lister(),
+		synced:             []cache.InformerSynced{configMapInformer.Informer().HasSynced, secretInformer.Informer().HasSynced, crdInformer.Informer().HasSynced},
+		queue:              workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "envoy-xds"),
+		exposurePolicyFile: exposurePolicyFile,
+		written:            map[string][]byte{},
+		certFiles:          sets.NewString(),
+		previousCertFiles:  sets.NewString(),
+	}
+	if len(exposurePolicyFile) > 0 {
+		policy, err := overlayapiserver.LoadExposurePolicy(exposurePolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		g.exposurePolicy = policy
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: g.enqueue,
+		UpdateFunc: func(old, cur interface{}) {
+			g.enqueue(cur)
+		},
+		DeleteFunc: g.enqueue,
+	}
+	configMapInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: g.isBusinessConfig,
+		Handler:    handler,
+	})
+	secretInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: g.isBusinessConfig,
+		Handler:    handler,
+	})
+	crdInformer.Informer().AddEventHandler(handler)
+	return g, nil
+}
+
+// isBusinessConfig tells whether obj is the business config, the business token Secret or a serving certificate Secret
+func (g *XDSGenerator) isBusinessConfig(obj interface{}) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	switch o := obj.(type) {
+	case *corev1.ConfigMap:
+		return o.Namespace == g.systemNamespace && o.Name == utils.BusinessConfigMapName
+	case *corev1.Secret:
+		return o.Namespace == g.systemNamespace && (o.Name == utils.BusinessTokenSecretName || business.IsServingCertSecret(o))
+	}
+	return false
+}
+
+func (g *XDSGenerator) enqueue(interface{}) {
+	g.queue.Add(generateKey)
+}
+
+// Run generates the files on changes and blocks until stopCh is closed
+func (g *XDSGenerator) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer g.queue.ShutDown()
+
+	klog.Info("starting envoy xds generator")
+	defer klog.Info("shutting down envoy xds generator")
+
+	if !cache.WaitForNamedCacheSync("envoy-xds", stopCh, g.synced...) {
+		return
+	}
+	if len(g.exposurePolicyFile) > 0 {
+		go wait.Until(g.reloadExposurePolicy, exposurePolicyReloadPeriod, stopCh)
+	}
+
+	g.queue.Add(generateKey)
+	go wait.Until(g.runWorker, time.Second, stopCh)
+	<-stopCh
+}
+
+// reloadExposurePolicy re-reads the exposure policy file, and regenerates the files if it has changed
+func (g *XDSGenerator) reloadExposurePolicy() {
+	policy, err := overlayapiserver.LoadExposurePolicy(g.exposurePolicyFile)
+	if err != nil {
+		klog.Errorf("failed to reload CRD exposure policy, keep using the current one: %v", err)
+		return
+	}
+
+	g.policyLock.Lock()
+	defer g.policyLock.Unlock()
+	if reflect.DeepEqual(policy, g.exposurePolicy) {
+		return
+	}
+	g.exposurePolicy = policy
+	g.queue.Add(generateKey)
+}
+
+func (g *XDSGenerator) runWorker() {
+	for g.processNextItem() {
+	}
+}
+
+func (g *XDSGenerator) processNextItem() bool {
+	key, quit := g.queue.Get()
+	if quit {
+		return false
+	}
+	defer g.queue.Done(key)
+
+	if err := g.generate(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to generate envoy xds files: %v", err))
+		g.queue.AddRateLimited(key)
+		return true
+	}
+	g.queue.Forget(key)
+	return true
+}
+
+// generate writes the CDS, RDS and LDS files if their contents have changed
+func (g *XDSGenerator) generate() error {
+	tenants, err := g.listTenants()
+	if err != nil {
+		return err
+	}
+	groups, err := g.exposedGroups()
+	if err != nil {
+		return err
+	}
+
+	cds, err := renderFile(g.clusters(tenants))
+	if err != nil {
+		return err
+	}
+	rds, err := renderFile(g.routeConfigurations(tenants, groups))
+	if err != nil {
+		return err
+	}
+	listeners, certFiles, err := g.listeners()
+	if err != nil {
+		return err
+	}
+	lds, err := renderFile(listeners)
+	if err != nil {
+		return err
+	}
+	if err := g.writeCertFiles(certFiles); err != nil {
+		return err
+	}
+	// clusters are written before the routes referring to them. All the files are only readable to the owner,
+	// as the routes carry the tokens of tenants
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{{cdsFileName, cds}, {rdsFileName, rds}, {ldsFileName, lds}} {
+		if bytes.Equal(g.written[file.name], file.data) {
+			continue
+		}
+		if err := utils.WriteFileAtomically(filepath.Join(g.outputDir, file.name), file.data, 0600); err != nil {
+			return err
+		}
+		g.written[file.name] = file.data
+		klog.Infof("generated %s for %d tenants", file.name, len(tenants))
+	}
+	g.pruneCertFiles(certFiles)
+	return nil
+}
+
+// writeCertFiles writes the serving certificates and private keys referred to by LDS, only readable to the owner.
+// Files are named after the digests of their contents, so existing ones are never rewritten, and rotated certificates
+// change LDS for Envoy to reload them.
+func (g *XDSGenerator) writeCertFiles(files map[string][]byte) error {
+	dir := filepath.Join(g.outputDir, certsDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			continue
+		}
+		if err := utils.WriteFileAtomically(filepath.Join(dir, name), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneCertFiles removes the certificate files referred to by neither the LDS file just written nor the last one,
+// which Envoy may still be loading
+func (g *XDSGenerator) pruneCertFiles(files map[string][]byte) {
+	current := sets.StringKeySet(files)
+	if !current.Equal(g.certFiles) {
+		g.previousCertFiles, g.certFiles = g.certFiles, current
+	}
+	dir := filepath.Join(g.outputDir, certsDirName)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		klog.Errorf("failed to list certificate files in %s: %v", dir, err)
+		return
+	}
+	for _, entry := range entries {
+		if g.certFiles.Has(entry.Name()) || g.previousCertFiles.Has(entry.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("failed to remove certificate file %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// xdsTenant is a registration ready to be proxied by Envoy
+type xdsTenant struct {
+	*business.Registration
+	crdToken string
+}
+
+// clusterName returns the name of the Envoy cluster of the business apiserver of t
+func (t *xdsTenant) clusterName() string {
+	return fmt.Sprintf("%s-%s", t.ClusterID, t.Namespace)
+}
+
+func (g *XDSGenerator) listTenants() ([]*xdsTenant, error) {
+	cm, err := g.configMapLister.ConfigMaps(g.systemNamespace).Get(utils.BusinessConfigMapName)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	registrations, err := business.ParseRegistrations(cm)
+	if err != nil {
+		return nil, err
+	}
+	tokens := map[string][]byte{}
+	secret, err := g.secretLister.Secrets(g.systemNamespace).Get(utils.BusinessTokenSecretName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if secret != nil {
+		tokens = secret.Data
+	}
+
+	var tenants []*xdsTenant
+	for _, registration := range registrations {
+		key := utils.TenantKey(registration.ClusterID, registration.Namespace)
+		registration.LoadCredentials(tokens)
+		crdToken := business.CRDToken(registration, tokens)
+		if len(crdToken) == 0 {
+			klog.Warningf("no token found for tenant %s, skipping", key)
+			continue
+		}
+		// Envoy matches tenants by their tokens before swapping them
+		if len(registration.APIServer.Token) == 0 {
+			klog.Warningf("tenant %s is registered with a client certificate, which is not supported by envoy, skipping", key)
+			continue
+		}
+		if err := registration.APIServer.ValidateTLS(); err != nil {
+			klog.Warningf("tenant %s is skipped: %v", key, err)
+			continue
+		}
+		tenants = append(tenants, &xdsTenant{Registration: registration, crdToken: crdToken})
+	}
+	return tenants, nil
+}
+
+// exposedGroups returns the API groups served by external-crd, which are those of the CRDs exposed and the overlay group
+func (g *XDSGenerator) exposedGroups() ([]string, error) {
+	crds, err := g.crdLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	g.policyLock.RLock()
+	defer g.policyLock.RUnlock()
+	groups := sets.NewString(overlayapi.GroupName)
+	for _, crd := range crds {
+		if crd.DeletionTimestamp == nil && g.exposurePolicy.Exposes(crd) && servesAnyVersion(crd) {
+			groups.Insert(crd.Spec.Group)
+		}
+	}
+	return groups.List(), nil
+}
+
+func servesAnyVersion(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	for _, version := range crd.Spec.Versions {
+		if version.Served {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *XDSGenerator) clusters(tenants []*xdsTenant) []interface{} {
+	clusters := []interface{}{
+		cluster(hostClusterName, g.hostAPIServer, acceptUntrusted()),
+		cluster(overlayClusterName, g.overlay, acceptUntrusted()),
+	}
+	for _, t := range tenants {
+		clusters = append(clusters, cluster(t.clusterName(), Upstream{Host: t.APIServer.Host, Port: t.APIServer.HTTPSPort},
+			upstreamTLSContext(&t.APIServer)))
+	}
+	return clusters
+}
+
+// upstreamTLSContext verifies a business apiserver with its CA bundle and server name,
+// unless it is registered to skip verification
+func upstreamTLSContext(apiserver *business.APIServer) map[string]interface{} {
+	if apiserver.InsecureSkipTLSVerify {
+		return acceptUntrusted()
+	}
+	serverName := apiserver.TLSServerName
+	if len(serverName) == 0 {
+		serverName = apiserver.Host
+	}
+	return map[string]interface{}{
+		"@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext",
+		"sni":   serverName,
+		"common_tls_context": map[string]interface{}{
+			"validation_context": map[string]interface{}{
+				"trusted_ca": map[string]interface{}{
+					"inline_string": string(apiserver.CertificateAuthorityData),
+				},
+				"match_subject_alt_names": []interface{}{
+					map[string]interface{}{"exact": serverName},
+				},
+			},
+		},
+	}
+}
+
+func acceptUntrusted() map[string]interface{} {
+	return map[string]interface{}{
+		"@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext",
+		"common_tls_context": map[string]interface{}{
+			"validation_context": map[string]interface{}{
+				"trust_chain_verification": "ACCEPT_UNTRUSTED",
+			},
+		},
+	}
+}
+
+func cluster(name string, upstream Upstream, tlsContext map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"@type":           "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+		"name":            name,
+		"connect_timeout": "3s",
+		"type":            "LOGICAL_DNS",
+		"lb_policy":       "ROUND_ROBIN",
+		"load_assignment": map[string]interface{}{
+			"cluster_name": name,
+			"endpoints": []interface{}{
+				map[string]interface{}{
+					"lb_endpoints": []interface{}{
+						map[string]interface{}{
+							"endpoint": map[string]interface{}{
+								"address": map[string]interface{}{
+									"socket_address": map[string]interface{}{
+										"address":    upstream.Host,
+										"port_value": upstream.Port,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		"transport_socket": map[string]interface{}{
+			"name":         "envoy.transport_sockets.tls",
+			"typed_config": tlsContext,
+		},
+	}
+}
+
+func (g *XDSGenerator) routeConfigurations(tenants []*xdsTenant, groups []string) []interface{} {
+	virtualHosts := []interface{}{}
+	for _, t := range tenants {
+		name := t.clusterName()
+		virtualHosts = append(virtualHosts, map[string]interface{}{
+			"name": name,
+			// the hostname of a tenant is "<namespace>-<cluster>.<base>"
+			"domains": []string{business.HostLabel(t.ClusterID, t.Namespace) + ".*"},
+			"routes": []interface{}{
+				// the root discovery documents, which list the overlay group as well. Unlike the Go proxy,
+				// Envoy cannot merge them with those of the business clusters
+				swapRoute(name+"-apis", `^/apis?/?(\?.*)?$`, t, hostClusterName),
+				swapRoute(name+"-external-crd", groupsRegex(groups), t, overlayClusterName),
+				map[string]interface{}{
+					"name":  name + "-biz",
+					"match": map[string]interface{}{"prefix": "/"},
+					"route": map[string]interface{}{"timeout": "0s", "cluster": name},
+				},
+			},
+		})
+	}
+	return []interface{}{
+		map[string]interface{}{
+			"@type":         "type.googleapis.com/envoy.config.route.v3.RouteConfiguration",
+			"name":          routeConfigName,
+			"virtual_hosts": virtualHosts,
+		},
+	}
+}
+
+// swapRoute routes the requests matching regex and carrying the business token of t to cluster,
+// with the business token swapped for the token of the tenant identity in external-crd
+func swapRoute(name, regex string, t *xdsTenant, cluster string) map[string]interface{} {
+	return map[string]interface{}{
+		"name": name,
+		"match": map[string]interface{}{
+			"safe_regex": map[string]interface{}{
+				"google_re2": map[string]interface{}{},
+				"regex":      regex,
+			},
+			"headers": []interface{}{
+				map[string]interface{}{
+					"name":        "authorization",
+					"exact_match": "Bearer " + t.APIServer.Token,
+				},
+			},
+		},
+		"request_headers_to_add": []interface{}{
+			map[string]interface{}{
+				"append": false,
+				"header": map[string]interface{}{
+					"key":   "authorization",
+					"value": "Bearer " + t.crdToken,
+				},
+			},
+		},
+		"route": map[string]interface{}{"timeout": "0s", "cluster": cluster},
+	}
+}
+
+// groupsRegex matches the paths under any of groups, such as "/apis/networking.istio.io/v1beta1/gateways"
+func groupsRegex(groups []string) string {
+	quoted := make([]string, 0, len(groups))
+	for _, group := range groups {
+		quoted = append(quoted, regexp.QuoteMeta(group))
+	}
+	return fmt.Sprintf(`^/apis/(%s)([/?].*)?$`, strings.Join(quoted, "|"))
+}
+
+// listeners returns the listener serving tenants, with a filter chain for each serving certificate issued by
+// external-crd, matched by the hostnames the clients ask for, and a fallback one with the certificate of the init
+// container. Certificates and private keys are referred to by the files returned along, keyed by their names in
+// the certificate directory, so that private keys are never written into LDS.
+func (g *XDSGenerator) listeners() ([]interface{}, map[string][]byte, error) {
+	certs, err := business.ListServingCertificates(g.secretLister, g.systemNamespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	certLabels := make([]string, 0, len(certs))
+	for label := range certs {
+		certLabels = append(certLabels, label)
+	}
+	sort.Strings(certLabels)
+
+	certFiles := map[string][]byte{}
+	filterChains := []interface{}{}
+	for _, label := range certLabels {
+		serverName := fmt.Sprintf("%s.%s", label, g.baseHost)
+		if label == business.WildcardCertLabel {
+			serverName = "*." + g.baseHost
+		}
+		digest := sha256.Sum256(append(append([]byte{}, certs[label].Cert...), certs[label].Key...))
+		certFile := fmt.Sprintf("%s-%s.crt", label, hex.EncodeToString(digest[:8]))
+		keyFile := fmt.Sprintf("%s-%s.key", label, hex.EncodeToString(digest[:8]))
+		certFiles[certFile], certFiles[keyFile] = certs[label].Cert, certs[label].Key
+		chain := g.filterChain(map[string]interface{}{
+			"certificate_chain": map[string]interface{}{"filename": filepath.Join(g.outputDir, certsDirName, certFile)},
+			"private_key":       map[string]interface{}{"filename": filepath.Join(g.outputDir, certsDirName, keyFile)},
+		})
+		chain["name"] = label
+		chain["filter_chain_match"] = map[string]interface{}{"server_names": []string{serverName}}
+		filterChains = append(filterChains, chain)
+	}
+	filterChains = append(filterChains, g.filterChain(map[string]interface{}{
+		"certificate_chain": map[string]interface{}{"filename": fallbackCertFile},
+		"private_key":       map[string]interface{}{"filename": fallbackKeyFile},
+	}))
+
+	return []interface{}{
+		map[string]interface{}{
+			"@type": "type.googleapis.com/envoy.config.listener.v3.Listener",
+			"name":  listenerName,
+			"address": map[string]interface{}{
+				"socket_address": map[string]interface{}{
+					"address":    "0.0.0.0",
+					"port_value": listenerPort,
+				},
+			},
+			"listener_filters": []interface{}{
+				map[string]interface{}{"name": "envoy.filters.listener.tls_inspector"},
+			},
+			"filter_chains": filterChains,
+		},
+	}, certFiles, nil
+}
+
+// filterChain returns a filter chain terminating TLS with certificate, and routing with the RDS file
+func (g *XDSGenerator) filterChain(certificate map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"filters": []interface{}{
+			map[string]interface{}{
+				"name": "envoy.filters.network.http_connection_manager",
+				"typed_config": map[string]interface{}{
+					"@type":               "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+					"stat_prefix":         "ingress_https",
+					"codec_type":          "AUTO",
+					"server_name":         "default",
+					"stream_idle_timeout": "600s",
+					"rds": map[string]interface{}{
+						"route_config_name": routeConfigName,
+						"config_source": map[string]interface{}{
+							"path":                 filepath.Join(g.outputDir, rdsFileName),
+							"resource_api_version": "V3",
+						},
+					},
+					"http_filters": []interface{}{
+						map[string]interface{}{"name": "envoy.filters.http.router"},
+					},
+				},
+			},
+		},
+		"transport_socket": map[string]interface{}{
+			"name": "envoy.transport_sockets.tls",
+			"typed_config": map[string]interface{}{
+				"@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext",
+				"common_tls_context": map[string]interface{}{
+					"tls_certificates": []interface{}{certificate},
+				},
+			},
+		},
+	}
+}
+
+// renderFile renders resources into a file of Envoy's path-based dynamic_resources,
+// versioned with the digest of the resources
+func renderFile(resources []interface{}) ([]byte, error) {
+	data, err := json.Marshal(resources)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	return yaml.Marshal(map[string]interface{}{
+		"version_info": hex.EncodeToString(digest[:8]),
+		"resources":    resources,
+	})
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package envoy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	crdfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	crdinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func TestXDSGenerator(t *testing.T) {
+	registration, _ := json.Marshal(&business.Registration{
+		ClusterID: "cls-foo",
+		Namespace: "ns-bar",
+		APIServer: business.APIServer{Host: "192.168.1.71", HTTPSPort: 6443, Token: "business-token",
+			CertificateAuthorityData: []byte("business-ca"), TLSServerName: "kubernetes.default.svc"},
+	})
+	kubeClient := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: utils.BusinessConfigMapName, Namespace: utils.KcrdSystemNamespace},
+			Data:       map[string]string{business.ConfigKey("cls-foo", "ns-bar"): string(registration)},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: utils.BusinessTokenSecretName, Namespace: utils.KcrdSystemNamespace},
+			Data:       map[string][]byte{business.TokenKey("cls-foo", "ns-bar"): []byte("crd-token")},
+		},
+		business.NewServingCertSecret(utils.KcrdSystemNamespace, "ns-bar-cls-foo",
+			business.ServingCertificate{Cert: []byte("serving-cert"), Key: []byte("serving-key")}))
+	crdClient := crdfake.NewSimpleClientset(&apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "gateways.networking.istio.io"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group:    "networking.istio.io",
+			Names:    apiextensionsv1.CustomResourceDefinitionNames{Plural: "gateways", Kind: "Gateway"},
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{Name: "v1beta1", Served: true, Storage: true}},
+		},
+	})
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	crdInformerFactory := crdinformers.NewSharedInformerFactory(crdClient, 0)
+
+	outputDir := t.TempDir()
+	g, err := NewXDSGenerator(informerFactory.Core().V1().ConfigMaps(), informerFactory.Core().V1().Secrets(),
+		crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions(), utils.KcrdSystemNamespace, outputDir, "", utils.DefaultProxyBaseHost,
+		Upstream{Host: "10.0.0.1", Port: 443}, Upstream{Host: "external-crd.external-crd-system.svc", Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	crdInformerFactory.Start(stopCh)
+	informerFactory.WaitForCacheSync(stopCh)
+	crdInformerFactory.WaitForCacheSync(stopCh)
+
+	if err := g.generate(); err != nil {
+		t.Fatalf("generate() error = %v", err)
+	}
+	cds, err := ioutil.ReadFile(filepath.Join(outputDir, cdsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cluster := range []string{hostClusterName, overlayClusterName, "cls-foo-ns-bar", "192.168.1.71", "business-ca", "kubernetes.default.svc"} {
+		if !strings.Contains(string(cds), cluster) {
+			t.Errorf("expect %s in %s", cluster, cdsFileName)
+		}
+	}
+	rds, err := ioutil.ReadFile(filepath.Join(outputDir, rdsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ns-bar-cls-foo.*", "Bearer business-token", "Bearer crd-token", `networking\.istio\.io`} {
+		if !strings.Contains(string(rds), want) {
+			t.Errorf("expect %s in %s", want, rdsFileName)
+		}
+	}
+	lds, err := ioutil.ReadFile(filepath.Join(outputDir, ldsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ns-bar-cls-foo." + utils.DefaultProxyBaseHost, fallbackCertFile,
+		filepath.Join(outputDir, rdsFileName), filepath.Join(outputDir, certsDirName)} {
+		if !strings.Contains(string(lds), want) {
+			t.Errorf("expect %s in %s", want, ldsFileName)
+		}
+	}
+	for _, unwanted := range []string{"serving-cert", "serving-key"} {
+		if strings.Contains(string(lds), unwanted) {
+			t.Errorf("expect no %s in %s", unwanted, ldsFileName)
+		}
+	}
+	if len(g.certFiles) != 2 {
+		t.Fatalf("expect a certificate and a key file, got %v", g.certFiles.List())
+	}
+	for _, name := range g.certFiles.List() {
+		data, err := ioutil.ReadFile(filepath.Join(outputDir, certsDirName, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "serving-cert"
+		if strings.HasSuffix(name, ".key") {
+			want = "serving-key"
+		}
+		if string(data) != want {
+			t.Errorf("expect %s in %s, got %s", want, name, data)
+		}
+	}
+
+	names := []string{cdsFileName, rdsFileName, ldsFileName}
+	for _, name := range g.certFiles.List() {
+		names = append(names, filepath.Join(certsDirName, name))
+	}
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("expect %s to be only readable to the owner, got %v", name, mode)
+		}
+	}
+
+	regex := regexp.MustCompile(groupsRegex([]string{"networking.istio.io", "security.istio.io"}))
+	for path, want := range map[string]bool{
+		"/apis/networking.istio.io":                                true,
+		"/apis/networking.istio.io/v1beta1/gateways?watch=1":       true,
+		"/apis/security.istio.io/v1beta1/peerauthentications":      true,
+		"/apis/networking.istio.iox/v1beta1/gateways":              false,
+		"/apis/networking-istio-io/v1beta1/gateways":               false,
+		"/apis/apps/v1/namespaces/ns-bar/deployments":              false,
+		"/api/v1/namespaces/ns-bar/configmaps/networking.istio.io": false,
+	} {
+		if got := regex.MatchString(path); got != want {
+			t.Errorf("expect %s to be matched: %t, got %t", path, want, got)
+		}
+	}
+}
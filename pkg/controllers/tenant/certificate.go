@@ -0,0 +1,409 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// the only queue key, since all the serving certificates are synced at once
+const servingCertsKey = "serving-certs"
+
+// CertificateController issues serving certificates for the hostnames of the apiserver proxy, either one for each
+// tenant ("<namespace>-<cluster>.<base>") or a wildcard one ("*.<base>"), signed by a CA it generates and keeps in
+// Secret utils.ProxyCASecretName. Each certificate is stored in a Secret of its own labeled with
+// utils.ProxyServingCertLabel, where the proxies pick them up, so that the number of tenants is not bounded by the size
+// of a Secret. They are reissued before they expire.
+type CertificateController struct {
+	kubeClient kubernetes.Interface
+
+	configMapLister corelisters.ConfigMapLister
+	secretLister    corelisters.SecretLister
+	synced          []cache.InformerSynced
+
+	queue workqueue.RateLimitingInterface
+
+	baseHost string
+	wildcard bool
+	validity time.Duration
+}
+
+// NewCertificateController returns a new CertificateController
+func NewCertificateController(kubeClient kubernetes.Interface, configMapInformer coreinformers.ConfigMapInformer,
+	secretInformer coreinformers.SecretInformer, baseHost string, wildcard bool, validity time.Duration) *CertificateController {
+	c := &CertificateController{
+		kubeClient:      kubeClient,
+		configMapLister: configMapInformer.Lister(),
+		secretLister:    secretInformer.Lister(),
+		synced:          []cache.InformerSynced{configMapInformer.Informer().HasSynced, secretInformer.Informer().HasSynced},
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "tenant-certificate"),
+		baseHost:        baseHost,
+		wildcard:        wildcard,
+		validity:        validity,
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(old, cur interface{}) {
+			c.enqueue(cur)
+		},
+		DeleteFunc: c.enqueue,
+	}
+	configMapInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			return isSystemObject(obj, utils.BusinessConfigMapName)
+		},
+		Handler: handler,
+	})
+	secretInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			return isSystemObject(obj, utils.ProxyCASecretName) || isSystemObject(obj, utils.ProxyServingCertSecretName) ||
+				isServingCertSecret(obj)
+		},
+		Handler: handler,
+	})
+	return c
+}
+
+// isSystemObject tells whether obj is the object with name in the system namespace
+func isSystemObject(obj interface{}, name string) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	accessor, ok := obj.(metav1.Object)
+	return ok && accessor.GetNamespace() == utils.KcrdSystemNamespace && accessor.GetName() == name
+}
+
+// isServingCertSecret tells whether obj is a Secret of a serving certificate in the system namespace
+func isServingCertSecret(obj interface{}) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	accessor, ok := obj.(metav1.Object)
+	return ok && accessor.GetNamespace() == utils.KcrdSystemNamespace && business.IsServingCertSecret(accessor)
+}
+
+func (c *CertificateController) enqueue(interface{}) {
+	c.queue.Add(servingCertsKey)
+}
+
+// Run starts the worker and blocks until stopCh is closed
+func (c *CertificateController) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	klog.Info("starting tenant certificate controller")
+	defer klog.Info("shutting down tenant certificate controller")
+
+	if !cache.WaitForNamedCacheSync("tenant-certificate", stopCh, c.synced...) {
+		return
+	}
+
+	c.queue.Add(servingCertsKey)
+	go wait.Until(c.runWorker, time.Second, stopCh)
+	<-stopCh
+}
+
+func (c *CertificateController) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *CertificateController) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to sync serving certificates of the apiserver proxy: %v", err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// sync issues the missing serving certificates, reissues those about to expire, and drops those of offboarded tenants.
+// Certificates kept in the single Secret of earlier versions are moved into Secrets of their own.
+func (c *CertificateController) sync() error {
+	ca, err := c.ensureCA()
+	if err != nil {
+		return err
+	}
+	hostnames, err := c.desiredHostnames()
+	if err != nil {
+		return err
+	}
+
+	secrets, err := business.ListServingCertSecrets(c.secretLister, utils.KcrdSystemNamespace)
+	if err != nil {
+		return err
+	}
+	legacy, err := c.secretLister.Secrets(utils.KcrdSystemNamespace).Get(utils.ProxyServingCertSecretName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	current := map[string]business.ServingCertificate{}
+	if legacy != nil {
+		current = business.LegacyServingCertificates(legacy)
+	}
+	existing := map[string]*corev1.Secret{}
+	for _, secret := range secrets {
+		existing[secret.Name] = secret
+		if label, cert, ok := business.ServingCertificateOf(secret); ok {
+			current[label] = cert
+		}
+	}
+
+	var errs []error
+	nextRefresh := time.Now().Add(c.validity)
+	for label, names := range hostnames {
+		cert, ok := current[label]
+		refreshAt, valid := c.refreshTime(cert, ca, names)
+		if !ok || !valid || !time.Now().Before(refreshAt) {
+			cert, err = ca.issue(names, c.validity)
+			if err != nil {
+				return err
+			}
+			refreshAt = time.Now().Add(c.validity * 4 / 5)
+			klog.V(4).Infof("issued serving certificate for %v, refreshing at %s", names, refreshAt)
+		}
+		if refreshAt.Before(nextRefresh) {
+			nextRefresh = refreshAt
+		}
+
+		desired := business.NewServingCertSecret(utils.KcrdSystemNamespace, label, cert)
+		secret := existing[desired.Name]
+		delete(existing, desired.Name)
+		switch {
+		case secret == nil:
+			_, err = c.kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Create(context.TODO(), desired, metav1.CreateOptions{})
+		case !reflect.DeepEqual(secret.Data, desired.Data) || !reflect.DeepEqual(secret.Labels, desired.Labels):
+			secret = secret.DeepCopy()
+			secret.Labels, secret.Data = desired.Labels, desired.Data
+			_, err = c.kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
+		default:
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.queue.AddAfter(servingCertsKey, time.Until(nextRefresh))
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	// the certificates of offboarded tenants, and the Secret of earlier versions once all are moved
+	for name := range existing {
+		if err := c.kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+	if legacy != nil {
+		err := c.kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Delete(context.TODO(), legacy.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, err)
+		} else {
+			klog.Infof("moved the serving certificates in Secret %s/%s into Secrets of their own", legacy.Namespace, legacy.Name)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// desiredHostnames returns the hostnames to issue serving certificates for, keyed by their labels in the Secret
+func (c *CertificateController) desiredHostnames() (map[string][]string, error) {
+	if c.wildcard {
+		return map[string][]string{business.WildcardCertLabel: {"*." + c.baseHost, c.baseHost}}, nil
+	}
+
+	cm, err := c.configMapLister.ConfigMaps(utils.KcrdSystemNamespace).Get(utils.BusinessConfigMapName)
+	if apierrors.IsNotFound(err) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	registrations, err := business.ParseRegistrations(cm)
+	if err != nil {
+		return nil, err
+	}
+	hostnames := map[string][]string{}
+	for _, registration := range registrations {
+		hostnames[business.HostLabel(registration.ClusterID, registration.Namespace)] =
+			[]string{business.Hostname(registration.ClusterID, registration.Namespace, c.baseHost)}
+	}
+	return hostnames, nil
+}
+
+// refreshTime returns when cert should be reissued, which is at 80% of its lifetime,
+// and false if it is not a valid certificate for names issued by ca
+func (c *CertificateController) refreshTime(cert business.ServingCertificate, ca *certificateAuthority, names []string) (time.Time, bool) {
+	if len(cert.Cert) == 0 {
+		return time.Time{}, false
+	}
+	if _, err := cert.TLSCertificate(); err != nil {
+		return time.Time{}, false
+	}
+	certs, err := certutil.ParseCertsPEM(cert.Cert)
+	if err != nil || len(certs) == 0 {
+		return time.Time{}, false
+	}
+	leaf := certs[0]
+	if !reflect.DeepEqual(leaf.DNSNames, names) || leaf.CheckSignatureFrom(ca.cert) != nil {
+		return time.Time{}, false
+	}
+	return leaf.NotAfter.Add(-leaf.NotAfter.Sub(leaf.NotBefore) / 5), true
+}
+
+// certificateAuthority issues serving certificates for the apiserver proxy
+type certificateAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// ensureCA loads the CA, generating it on the first run
+func (c *CertificateController) ensureCA() (*certificateAuthority, error) {
+	secret, err := c.secretLister.Secrets(utils.KcrdSystemNamespace).Get(utils.ProxyCASecretName)
+	if err == nil {
+		return parseCA(secret)
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := certutil.NewSelfSignedCACert(certutil.Config{CommonName: "external-crd-proxy-ca"}, key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := keyutil.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		return nil, err
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      utils.ProxyCASecretName,
+			Namespace: utils.KcrdSystemNamespace,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: certutil.CertificateBlockType, Bytes: cert.Raw}),
+			corev1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+	// another replica may have generated it, the serving certificates are issued after the Secret is observed
+	if _, err := c.kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
+		return nil, err
+	}
+	klog.Infof("generated the CA of the apiserver proxy in Secret %s/%s", utils.KcrdSystemNamespace, utils.ProxyCASecretName)
+	return &certificateAuthority{cert: cert, key: key}, nil
+}
+
+func parseCA(secret *corev1.Secret) (*certificateAuthority, error) {
+	certs, err := certutil.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA in Secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	key, err := keyutil.ParsePrivateKeyPEM(secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA key in Secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("invalid CA key in Secret %s/%s: not a signer", secret.Namespace, secret.Name)
+	}
+	return &certificateAuthority{cert: certs[0], key: signer}, nil
+}
+
+// issue signs a serving certificate for names, valid for validity
+func (ca *certificateAuthority) issue(names []string, validity time.Duration) (business.ServingCertificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return business.ServingCertificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	if err != nil {
+		return business.ServingCertificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		// tolerate clock skews between the proxies and their clients
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return business.ServingCertificate{}, err
+	}
+	keyPEM, err := keyutil.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		return business.ServingCertificate{}, err
+	}
+
+	// the chain ends with the CA, which is also embedded in the kubeconfigs of tenants
+	var certPEM bytes.Buffer
+	for _, raw := range [][]byte{der, ca.cert.Raw} {
+		if err := pem.Encode(&certPEM, &pem.Block{Type: certutil.CertificateBlockType, Bytes: raw}); err != nil {
+			return business.ServingCertificate{}, err
+		}
+	}
+	return business.ServingCertificate{Cert: certPEM.Bytes(), Key: keyPEM}, nil
+}
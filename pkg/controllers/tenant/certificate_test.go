@@ -0,0 +1,127 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	certutil "k8s.io/client-go/util/cert"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func TestCertificateController(t *testing.T) {
+	registration, _ := json.Marshal(&business.Registration{ClusterID: "cls-foo", Namespace: "ns-bar"})
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.BusinessConfigMapName, Namespace: utils.KcrdSystemNamespace},
+		Data:       map[string]string{business.ConfigKey("cls-foo", "ns-bar"): string(registration)},
+	}
+	kubeClient := kubefake.NewSimpleClientset(cm)
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0, informers.WithNamespace(utils.KcrdSystemNamespace))
+	c := NewCertificateController(kubeClient, informerFactory.Core().V1().ConfigMaps(), informerFactory.Core().V1().Secrets(),
+		utils.DefaultProxyBaseHost, false, time.Hour)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	informerFactory.WaitForCacheSync(stopCh)
+
+	// syncs until the serving certificates observed satisfy done
+	syncUntil := func(done func(map[string]business.ServingCertificate) bool) map[string]business.ServingCertificate {
+		var certs map[string]business.ServingCertificate
+		if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			if err := c.sync(); err != nil {
+				return false, nil
+			}
+			var err error
+			if certs, err = business.ListServingCertificates(c.secretLister, utils.KcrdSystemNamespace); err != nil {
+				return false, nil
+			}
+			return done(certs), nil
+		}); err != nil {
+			t.Fatalf("serving certificates are not synced, got %d", len(certs))
+		}
+		return certs
+	}
+
+	label := business.HostLabel("cls-foo", "ns-bar")
+	certs := syncUntil(func(certs map[string]business.ServingCertificate) bool { return len(certs) == 1 })
+	ca, err := business.GetProxyCA(context.TODO(), kubeClient, utils.KcrdSystemNamespace)
+	if err != nil || len(ca) == 0 {
+		t.Fatalf("expect the CA to be generated, got %v", err)
+	}
+	pool, _ := certutil.NewPoolFromBytes(ca)
+	leafs, err := certutil.ParseCertsPEM(certs[label].Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leafs[0].Verify(x509.VerifyOptions{
+		DNSName: business.Hostname("cls-foo", "ns-bar", utils.DefaultProxyBaseHost),
+		Roots:   pool,
+	}); err != nil {
+		t.Errorf("expect the serving certificate to be verified with the CA: %v", err)
+	}
+
+	// certificates are kept until they are about to expire
+	if err := c.sync(); err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Get(context.TODO(), business.ServingCertSecretName(label), metav1.GetOptions{})
+	if secret == nil || !bytes.Equal(secret.Data[corev1.TLSCertKey], certs[label].Cert) {
+		t.Errorf("expect the valid serving certificate not to be reissued")
+	}
+
+	// certificates kept in the single Secret of earlier versions are moved into Secrets of their own
+	certKey, keyKey := business.LegacyServingCertKeys(label)
+	legacy := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.ProxyServingCertSecretName, Namespace: utils.KcrdSystemNamespace},
+		Data:       map[string][]byte{certKey: certs[label].Cert, keyKey: certs[label].Key},
+	}
+	if _, err := kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Create(context.TODO(), legacy, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Delete(context.TODO(), business.ServingCertSecretName(label), metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	moved := syncUntil(func(certs map[string]business.ServingCertificate) bool {
+		_, err := c.secretLister.Secrets(utils.KcrdSystemNamespace).Get(utils.ProxyServingCertSecretName)
+		return len(certs) == 1 && apierrors.IsNotFound(err)
+	})
+	if !bytes.Equal(moved[label].Cert, certs[label].Cert) {
+		t.Errorf("expect the serving certificate to be moved without being reissued")
+	}
+
+	// certificates of offboarded tenants are dropped
+	cm = cm.DeepCopy()
+	cm.Data = map[string]string{}
+	if _, err := kubeClient.CoreV1().ConfigMaps(utils.KcrdSystemNamespace).Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	syncUntil(func(certs map[string]business.ServingCertificate) bool { return len(certs) == 0 })
+}
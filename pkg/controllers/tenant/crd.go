@@ -0,0 +1,166 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// CRDCatalog keeps the CRDs of each tenant, so that tenants running different versions of the same CRDs can be
+// served. The CRDs of a tenant are read from its bundle "<namespace>-<cluster>.yaml" in the bundle directory
+// if there is one, or from its business cluster otherwise.
+type CRDCatalog struct {
+	configMapLister corelisters.ConfigMapLister
+	configMapSynced cache.InformerSynced
+	secretLister    corelisters.SecretLister
+	secretSynced    cache.InformerSynced
+
+	// newBusinessClient creates a client for a business apiserver
+	newBusinessClient func(*business.Registration) (apiextensionsclientset.Interface, error)
+
+	bundleDir string
+	period    time.Duration
+
+	*utils.TenantCRDSet
+}
+
+// NewCRDCatalog returns a new CRDCatalog
+func NewCRDCatalog(configMapInformer coreinformers.ConfigMapInformer, secretInformer coreinformers.SecretInformer,
+	bundleDir string, period time.Duration) *CRDCatalog {
+	return &CRDCatalog{
+		configMapLister: configMapInformer.Lister(),
+		configMapSynced: configMapInformer.Informer().HasSynced,
+		secretLister:    secretInformer.Lister(),
+		secretSynced:    secretInformer.Informer().HasSynced,
+		newBusinessClient: func(registration *business.Registration) (apiextensionsclientset.Interface, error) {
+			if err := registration.APIServer.ValidateTLS(); err != nil {
+				return nil, err
+			}
+			return apiextensionsclientset.NewForConfig(registration.APIServer.RESTConfig())
+		},
+		bundleDir:    bundleDir,
+		period:       period,
+		TenantCRDSet: utils.NewTenantCRDSet(),
+	}
+}
+
+// Run loads the CRDs of tenants periodically and blocks until stopCh is closed
+func (c *CRDCatalog) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	klog.Info("starting tenant CRD catalog")
+	defer klog.Info("shutting down tenant CRD catalog")
+
+	if !cache.WaitForNamedCacheSync("tenant-crd-catalog", stopCh, c.configMapSynced, c.secretSynced) {
+		return
+	}
+
+	wait.Until(c.syncAll, c.period, stopCh)
+}
+
+func (c *CRDCatalog) syncAll() {
+	registrations, err := business.ListRegistrations(c.configMapLister, c.secretLister, utils.KcrdSystemNamespace)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	tenantCRDs := map[string][]*apiextensionsv1.CustomResourceDefinition{}
+	for _, registration := range registrations {
+		key := utils.TenantKey(registration.ClusterID, registration.Namespace)
+		crds, err := c.load(registration)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to load CRDs of tenant %s, keep using the loaded ones: %v", key, err))
+			crds = c.ForTenant(registration.ClusterID, registration.Namespace)
+		}
+		tenantCRDs[key] = crds
+	}
+	c.Set(tenantCRDs)
+}
+
+// load reads the CRDs of a tenant from its bundle, or from its business cluster if there is no bundle
+func (c *CRDCatalog) load(registration *business.Registration) ([]*apiextensionsv1.CustomResourceDefinition, error) {
+	if len(c.bundleDir) > 0 {
+		bundle := filepath.Join(c.bundleDir, fmt.Sprintf("%s-%s.yaml", registration.Namespace, registration.ClusterID))
+		crds, err := readCRDBundle(bundle)
+		if err == nil || !os.IsNotExist(err) {
+			return crds, err
+		}
+	}
+
+	client, err := c.newBusinessClient(registration)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.period)
+	defer cancel()
+	crdList, err := client.ApiextensionsV1().CustomResourceDefinitions().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var crds []*apiextensionsv1.CustomResourceDefinition
+	for i := range crdList.Items {
+		crds = append(crds, &crdList.Items[i])
+	}
+	return crds, nil
+}
+
+// readCRDBundle reads the CRDs in a YAML file of multiple documents, documents of other kinds are ignored
+func readCRDBundle(file string) ([]*apiextensionsv1.CustomResourceDefinition, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var crds []*apiextensionsv1.CustomResourceDefinition
+	decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		if err := decoder.Decode(crd); err != nil {
+			if err == io.EOF {
+				return crds, nil
+			}
+			return nil, fmt.Errorf("invalid CRD bundle %s: %v", file, err)
+		}
+		if crd.Kind != "CustomResourceDefinition" {
+			continue
+		}
+		crds = append(crds, crd)
+	}
+}
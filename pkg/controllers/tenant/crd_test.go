@@ -0,0 +1,138 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+const gatewayBundle = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: not-a-crd
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: gateways.networking.istio.io
+spec:
+  group: networking.istio.io
+  names:
+    kind: Gateway
+    plural: gateways
+  scope: Namespaced
+  versions:
+  - name: v1alpha3
+    served: true
+    storage: true
+`
+
+func TestCRDCatalog(t *testing.T) {
+	newRegistration := func(clusterID, namespace string) string {
+		data, _ := json.Marshal(&business.Registration{ClusterID: clusterID, Namespace: namespace})
+		return string(data)
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.BusinessConfigMapName, Namespace: utils.KcrdSystemNamespace},
+		Data: map[string]string{
+			business.ConfigKey("cls-foo", "ns-bar"): newRegistration("cls-foo", "ns-bar"),
+			business.ConfigKey("cls-foo", "ns-baz"): newRegistration("cls-foo", "ns-baz"),
+		},
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(cm); err != nil {
+		t.Fatal(err)
+	}
+
+	// ns-bar has a bundle, while ns-baz has its CRDs in the business cluster
+	bundleDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundleDir, "ns-bar-cls-foo.yaml"), []byte(gatewayBundle), 0644); err != nil {
+		t.Fatal(err)
+	}
+	businessClient := apiextensionsfake.NewSimpleClientset(&apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "gateways.networking.istio.io"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "networking.istio.io",
+			Names: apiextensionsv1.CustomResourceDefinitionNames{Kind: "Gateway", Plural: "gateways"},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{Name: "v1alpha3", Served: true},
+				{Name: "v1beta1", Served: true, Storage: true},
+			},
+		},
+	})
+
+	c := &CRDCatalog{
+		configMapLister: corelisters.NewConfigMapLister(indexer),
+		secretLister:    corelisters.NewSecretLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		newBusinessClient: func(*business.Registration) (apiextensionsclientset.Interface, error) {
+			return businessClient, nil
+		},
+		bundleDir:    bundleDir,
+		period:       time.Minute,
+		TenantCRDSet: utils.NewTenantCRDSet(),
+	}
+	var added, deleted []string
+	c.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			added = append(added, obj.(*apiextensionsv1.CustomResourceDefinition).Spec.Versions[0].Name)
+		},
+		DeleteFunc: func(obj interface{}) {
+			deleted = append(deleted, obj.(*apiextensionsv1.CustomResourceDefinition).Spec.Versions[0].Name)
+		},
+	})
+
+	c.syncAll()
+	if !c.HasSynced() {
+		t.Fatalf("expect the catalog to be synced")
+	}
+	if crds := c.ForTenant("cls-foo", "ns-bar"); len(crds) != 1 || crds[0].Spec.Versions[0].Name != "v1alpha3" {
+		t.Errorf("unexpected CRDs of tenant cls-foo/ns-bar: %v", crds)
+	}
+	if crds := c.ForTenant("cls-foo", "ns-baz"); len(crds) != 1 || len(crds[0].Spec.Versions) != 2 {
+		t.Errorf("unexpected CRDs of tenant cls-foo/ns-baz: %v", crds)
+	}
+	// the same CRD is listed once per storage version
+	if crds := c.List(); len(crds) != 2 || len(added) != 2 {
+		t.Errorf("expect 2 CRDs listed and added, got %d listed and %v added", len(crds), added)
+	}
+
+	delete(cm.Data, business.ConfigKey("cls-foo", "ns-bar"))
+	c.syncAll()
+	if len(deleted) != 1 || deleted[0] != "v1alpha3" {
+		t.Errorf("expect the CRD of the offboarded tenant to be deleted, got %v", deleted)
+	}
+	if crds := c.ForTenant("cls-foo", "ns-bar"); len(crds) != 0 {
+		t.Errorf("expect no CRDs for the offboarded tenant, got %v", crds)
+	}
+}
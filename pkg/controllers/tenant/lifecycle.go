@@ -0,0 +1,350 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	kcrdapi "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	kcrdclientset "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned"
+	kcrdinformers "github.com/jijiechen/external-crd/pkg/generated/informers/externalversions/kcrd/v1alpha1"
+	kcrdlisters "github.com/jijiechen/external-crd/pkg/generated/listers/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// LifecycleController garbage-collects the manifests of offboarded tenants.
+// A tenant is registered by a service account labelled with utils.TenantClusterLabel and utils.TenantNamespaceLabel,
+// once all of its service accounts are gone and the grace period has elapsed, all the manifests
+// carrying its utils.ConfigClusterLabel and utils.ConfigNamespaceLabel are (optionally archived and) deleted.
+// Manifests of cluster-scoped objects carry no namespace, and are collected once no tenant of the cluster is left.
+type LifecycleController struct {
+	kcrdClient kcrdclientset.Interface
+
+	saLister       corelisters.ServiceAccountLister
+	saSynced       cache.InformerSynced
+	manifestLister kcrdlisters.KubernetesCrdLister
+	manifestSynced cache.InformerSynced
+
+	queue workqueue.RateLimitingInterface
+
+	// gracePeriod is how long the manifests of a tenant are kept after its registration disappears
+	gracePeriod time.Duration
+	// archiveDir is where the manifests are saved to before deletion, empty means no archive.
+	// It is on the local filesystem, so it needs to be backed by a PersistentVolume for archives to outlive the pod.
+	archiveDir string
+
+	// namespaces where Manifests are created
+	reservedNamespaces utils.ReservedNamespaces
+}
+
+// clusterKey is the queue key to collect the manifests of the cluster-scoped objects of a cluster, which is the
+// cluster ID
+type clusterKey string
+
+// NewLifecycleController returns a new LifecycleController
+func NewLifecycleController(kcrdClient kcrdclientset.Interface, saInformer coreinformers.ServiceAccountInformer,
+	manifestInformer kcrdinformers.KubernetesCrdInformer, gracePeriod time.Duration, archiveDir string,
+	reservedNamespaces utils.ReservedNamespaces) *LifecycleController {
+	c := &LifecycleController{
+		kcrdClient:         kcrdClient,
+		saLister:           saInformer.Lister(),
+		saSynced:           saInformer.Informer().HasSynced,
+		manifestLister:     manifestInformer.Lister(),
+		manifestSynced:     manifestInformer.Informer().HasSynced,
+		queue:              workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "tenant-lifecycle"),
+		gracePeriod:        gracePeriod,
+		archiveDir:         archiveDir,
+		reservedNamespaces: reservedNamespaces,
+	}
+
+	saInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: c.deleteServiceAccount,
+	})
+	return c
+}
+
+func (c *LifecycleController) deleteServiceAccount(obj interface{}) {
+	sa, ok := obj.(*corev1.ServiceAccount)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("couldn't get object from tombstone %#v", obj))
+			return
+		}
+		sa, ok = tombstone.Obj.(*corev1.ServiceAccount)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("tombstone contained object that is not a ServiceAccount %#v", obj))
+			return
+		}
+	}
+
+	clusterID, namespace, ok := tenantOf(sa)
+	if !ok {
+		return
+	}
+	klog.V(4).Infof("registration %s of tenant %s is deleted, manifests will be collected after %s",
+		klog.KObj(sa), utils.TenantKey(clusterID, namespace), c.gracePeriod)
+	c.queue.AddAfter(utils.TenantKey(clusterID, namespace), c.gracePeriod)
+}
+
+// Run starts the workers and blocks until stopCh is closed
+func (c *LifecycleController) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	klog.Info("starting tenant lifecycle controller")
+	defer klog.Info("shutting down tenant lifecycle controller")
+
+	if !cache.WaitForNamedCacheSync("tenant-lifecycle", stopCh, c.saSynced, c.manifestSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+	// tenants may be offboarded while we are not running,
+	// so we look for manifests without a registration periodically
+	go wait.Until(c.enqueueOrphanTenants, utils.DefaultTenantScanPeriod, stopCh)
+
+	<-stopCh
+}
+
+func (c *LifecycleController) enqueueOrphanTenants() {
+	manifests, err := c.manifestLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	tenants, clusters := sets.NewString(), sets.NewString()
+	for _, manifest := range manifests {
+		if !c.reservedNamespaces.Has(manifest.Namespace) {
+			continue
+		}
+		clusterID, namespace, ok := tenantOfManifest(manifest)
+		if ok {
+			tenants.Insert(utils.TenantKey(clusterID, namespace))
+		} else if clusterID := manifest.Labels[utils.ConfigClusterLabel]; len(clusterID) > 0 {
+			clusters.Insert(clusterID)
+		}
+	}
+	for _, key := range tenants.List() {
+		clusterID, namespace, _ := utils.ParseTenantKey(key)
+		registered, err := c.isRegistered(clusterID, namespace)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		if !registered {
+			c.queue.AddAfter(key, c.gracePeriod)
+		}
+	}
+	for _, clusterID := range clusters.List() {
+		registered, err := c.isRegistered(clusterID, "")
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		if !registered {
+			c.queue.AddAfter(clusterKey(clusterID), c.gracePeriod)
+		}
+	}
+}
+
+func (c *LifecycleController) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *LifecycleController) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	var err error
+	if clusterID, ok := key.(clusterKey); ok {
+		err = c.collectManifests(string(clusterID), "")
+	} else {
+		err = c.collect(key.(string))
+	}
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to collect manifests of tenant %q: %v", key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// collect archives and deletes all the manifests of an offboarded tenant
+func (c *LifecycleController) collect(key string) error {
+	clusterID, namespace, ok := utils.ParseTenantKey(key)
+	if !ok {
+		return nil
+	}
+	return c.collectManifests(clusterID, namespace)
+}
+
+// collectManifests archives and deletes the manifests of the objects in namespace of cluster clusterID, or those of
+// the cluster-scoped objects if namespace is empty, unless the tenant, or any tenant of the cluster, is registered
+func (c *LifecycleController) collectManifests(clusterID, namespace string) error {
+	owner := "cluster " + clusterID
+	if len(namespace) > 0 {
+		owner = "tenant " + utils.TenantKey(clusterID, namespace)
+	}
+
+	// the tenant may be onboarded again during the grace period
+	registered, err := c.isRegistered(clusterID, namespace)
+	if err != nil {
+		return err
+	}
+	if registered {
+		klog.V(4).Infof("%s is registered again, skip collecting its manifests", owner)
+		return nil
+	}
+
+	manifests, err := tenantManifests(c.manifestLister, c.reservedNamespaces, clusterID, namespace)
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		return nil
+	}
+
+	if len(c.archiveDir) > 0 {
+		if err := c.archive(clusterID, namespace, manifests); err != nil {
+			return err
+		}
+	}
+
+	klog.Infof("deleting %d manifests of offboarded %s", len(manifests), owner)
+	return deleteManifests(c.kcrdClient, manifests)
+}
+
+// isRegistered tells whether the tenant in namespace of cluster clusterID is registered, or any tenant of the cluster
+// if namespace is empty
+func (c *LifecycleController) isRegistered(clusterID, namespace string) (bool, error) {
+	set := labels.Set{utils.TenantClusterLabel: clusterID}
+	if len(namespace) > 0 {
+		set[utils.TenantNamespaceLabel] = namespace
+	}
+	sas, err := c.saLister.ServiceAccounts(utils.KcrdSystemNamespace).List(labels.SelectorFromSet(set))
+	if err != nil {
+		return false, err
+	}
+	return len(sas) > 0, nil
+}
+
+func (c *LifecycleController) archive(clusterID, namespace string, manifests []*kcrdapi.KubernetesCrd) error {
+	list := &kcrdapi.KubernetesCrdList{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: kcrdapi.SchemeGroupVersion.String(),
+			Kind:       "KubernetesCrdList",
+		},
+	}
+	for _, manifest := range manifests {
+		list.Items = append(list.Items, *manifest.DeepCopy())
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.archiveDir, 0700); err != nil {
+		return err
+	}
+	name := clusterID
+	if len(namespace) > 0 {
+		name += "." + namespace
+	}
+	file := filepath.Join(c.archiveDir, fmt.Sprintf("%s.%d.json", name, time.Now().Unix()))
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	klog.Infof("archived %d manifests of %s to %s", len(manifests), name, file)
+	return nil
+}
+
+// tenantManifests returns all the manifests of a tenant, or those of the cluster-scoped objects of cluster clusterID
+// if namespace is empty
+func tenantManifests(manifestLister kcrdlisters.KubernetesCrdLister, reservedNamespaces utils.ReservedNamespaces,
+	clusterID, namespace string) ([]*kcrdapi.KubernetesCrd, error) {
+	all, err := manifestLister.KubernetesCrds(reservedNamespaces.For(clusterID, namespace)).List(labels.SelectorFromSet(labels.Set{
+		utils.ConfigClusterLabel: clusterID,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []*kcrdapi.KubernetesCrd
+	for _, manifest := range all {
+		if manifest.Labels[utils.ConfigNamespaceLabel] == namespace {
+			manifests = append(manifests, manifest)
+		}
+	}
+	return manifests, nil
+}
+
+func deleteManifests(kcrdClient kcrdclientset.Interface, manifests []*kcrdapi.KubernetesCrd) error {
+	for _, manifest := range manifests {
+		err := kcrdClient.KcrdV1alpha1().KubernetesCrds(manifest.Namespace).Delete(context.TODO(), manifest.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func tenantOf(sa *corev1.ServiceAccount) (string, string, bool) {
+	clusterID := sa.Labels[utils.TenantClusterLabel]
+	namespace := sa.Labels[utils.TenantNamespaceLabel]
+	if len(clusterID) == 0 || len(namespace) == 0 {
+		return "", "", false
+	}
+	return clusterID, namespace, true
+}
+
+func tenantOfManifest(manifest *kcrdapi.KubernetesCrd) (string, string, bool) {
+	clusterID := manifest.Labels[utils.ConfigClusterLabel]
+	namespace := manifest.Labels[utils.ConfigNamespaceLabel]
+	if len(clusterID) == 0 || len(namespace) == 0 {
+		return "", "", false
+	}
+	return clusterID, namespace, true
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	kcrdapi "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	kcrdfake "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned/fake"
+	kcrdlisters "github.com/jijiechen/external-crd/pkg/generated/listers/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func newRegistration(clusterID, namespace string) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%s", namespace, clusterID),
+			Namespace: utils.KcrdSystemNamespace,
+			Labels: map[string]string{
+				utils.TenantClusterLabel:   clusterID,
+				utils.TenantNamespaceLabel: namespace,
+			},
+		},
+	}
+}
+
+func tenantManifest(name, clusterID, namespace string) *kcrdapi.KubernetesCrd {
+	return newManifest(name, map[string]string{
+		utils.ConfigKindLabel:      "ConfigMap",
+		utils.ConfigNameLabel:      name,
+		utils.ConfigClusterLabel:   clusterID,
+		utils.ConfigNamespaceLabel: namespace,
+	})
+}
+
+// clusterManifest returns the Manifest of a cluster-scoped object, which carries no namespace
+func clusterManifest(name, clusterID string) *kcrdapi.KubernetesCrd {
+	return newManifest(name, map[string]string{
+		utils.ConfigKindLabel:    "ClusterRole",
+		utils.ConfigNameLabel:    name,
+		utils.ConfigClusterLabel: clusterID,
+	})
+}
+
+// namespaceManifest returns the Manifest of a Namespace, which is cluster-scoped and kept for itself
+func namespaceManifest(clusterID, namespace string) *kcrdapi.KubernetesCrd {
+	return newManifest(utils.GetManifestName("namespaces", clusterID, namespace, namespace), map[string]string{
+		utils.ConfigKindLabel:      "Namespace",
+		utils.ConfigNameLabel:      namespace,
+		utils.ConfigClusterLabel:   clusterID,
+		utils.ConfigNamespaceLabel: namespace,
+	})
+}
+
+func newTestLifecycleController(t *testing.T, archiveDir string, registrations []*corev1.ServiceAccount,
+	manifests []*kcrdapi.KubernetesCrd) (*LifecycleController, *kcrdfake.Clientset, *recordingQueue, cache.Indexer) {
+	saIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, sa := range registrations {
+		if err := saIndexer.Add(sa); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifestIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	objects := make([]runtime.Object, 0, len(manifests))
+	for _, manifest := range manifests {
+		if err := manifestIndexer.Add(manifest); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, manifest)
+	}
+
+	queue := &recordingQueue{
+		RateLimitingInterface: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		delays:                map[interface{}]time.Duration{},
+	}
+	kcrdClient := kcrdfake.NewSimpleClientset(objects...)
+	return &LifecycleController{
+		kcrdClient:         kcrdClient,
+		saLister:           corelisters.NewServiceAccountLister(saIndexer),
+		manifestLister:     kcrdlisters.NewKubernetesCrdLister(manifestIndexer),
+		queue:              queue,
+		gracePeriod:        time.Hour,
+		archiveDir:         archiveDir,
+		reservedNamespaces: utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0),
+	}, kcrdClient, queue, saIndexer
+}
+
+func deletedManifests(kcrdClient *kcrdfake.Clientset) []string {
+	var deleted []string
+	for _, action := range kcrdClient.Actions() {
+		if deleteAction, ok := action.(clienttesting.DeleteAction); ok {
+			deleted = append(deleted, deleteAction.GetName())
+		}
+	}
+	return deleted
+}
+
+func TestLifecycleReRegistration(t *testing.T) {
+	sa := newRegistration("cls-foo", "ns-foo")
+	c, kcrdClient, queue, saIndexer := newTestLifecycleController(t, "", nil,
+		[]*kcrdapi.KubernetesCrd{tenantManifest("foo", "cls-foo", "ns-foo")})
+
+	c.deleteServiceAccount(cache.DeletedFinalStateUnknown{Key: "external-crd-system/ns-foo-cls-foo", Obj: sa})
+	key := utils.TenantKey("cls-foo", "ns-foo")
+	if got, ok := queue.delays[key]; !ok || got != c.gracePeriod {
+		t.Fatalf("expect tenant %s to be collected after the grace period, got %v", key, got)
+	}
+
+	// the tenant is onboarded again before the grace period elapses
+	if err := saIndexer.Add(sa); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.collect(key); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := deletedManifests(kcrdClient); len(deleted) > 0 {
+		t.Errorf("expect no Manifests of a registered tenant to be deleted, got %v", deleted)
+	}
+}
+
+func TestLifecycleOrphanTenants(t *testing.T) {
+	outside := tenantManifest("outside", "cls-baz", "ns-baz")
+	outside.Namespace = "default"
+	c, kcrdClient, queue, _ := newTestLifecycleController(t, "",
+		[]*corev1.ServiceAccount{newRegistration("cls-foo", "ns-foo")},
+		[]*kcrdapi.KubernetesCrd{
+			tenantManifest("foo", "cls-foo", "ns-foo"),
+			clusterManifest("cluster-foo", "cls-foo"),
+			tenantManifest("bar", "cls-bar", "ns-bar"),
+			clusterManifest("cluster-bar", "cls-bar"),
+			namespaceManifest("cls-qux", "ns-qux"),
+			newManifest("unlabelled", nil),
+			outside,
+		})
+
+	c.enqueueOrphanTenants()
+	want := map[interface{}]time.Duration{
+		utils.TenantKey("cls-bar", "ns-bar"): c.gracePeriod,
+		clusterKey("cls-bar"):                c.gracePeriod,
+		utils.TenantKey("cls-qux", "ns-qux"): c.gracePeriod,
+	}
+	if len(queue.delays) != len(want) {
+		t.Fatalf("expect orphan tenants %v to be enqueued, got %v", want, queue.delays)
+	}
+	for key, delay := range want {
+		if got, ok := queue.delays[key]; !ok || got != delay {
+			t.Errorf("expect tenant %s to be enqueued after %v, got %v", key, delay, got)
+		}
+	}
+
+	// Manifests of cluster-scoped objects are kept as long as any tenant of the cluster is registered
+	if err := c.collectManifests("cls-foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.collectManifests("cls-bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := deletedManifests(kcrdClient); len(deleted) != 1 || deleted[0] != "cluster-bar" {
+		t.Errorf("expect only the Manifests of the cluster-scoped objects of cls-bar deleted, got %v", deleted)
+	}
+}
+
+func TestLifecycleCollect(t *testing.T) {
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	c, kcrdClient, _, _ := newTestLifecycleController(t, archiveDir, nil,
+		[]*kcrdapi.KubernetesCrd{
+			tenantManifest("foo", "cls-foo", "ns-foo"),
+			namespaceManifest("cls-foo", "ns-foo"),
+			tenantManifest("other-namespace", "cls-foo", "ns-bar"),
+			namespaceManifest("cls-foo", "ns-bar"),
+			tenantManifest("other-cluster", "cls-bar", "ns-foo"),
+		})
+	// manifests are only deleted once they are archived
+	kcrdClient.PrependReactor("delete", "kubernetescrds", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		files, err := ioutil.ReadDir(archiveDir)
+		if err != nil || len(files) != 1 {
+			t.Errorf("expect Manifest %s to be archived before deletion, got %d archives, %v",
+				action.(clienttesting.DeleteAction).GetName(), len(files), err)
+		}
+		return false, nil, nil
+	})
+
+	if err := c.collect(utils.TenantKey("cls-foo", "ns-foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{"foo": true, utils.GetManifestName("namespaces", "cls-foo", "ns-foo", "ns-foo"): true}
+	deleted := deletedManifests(kcrdClient)
+	if len(deleted) != len(want) {
+		t.Fatalf("expect Manifests %v to be deleted, got %v", want, deleted)
+	}
+	for _, name := range deleted {
+		if !want[name] {
+			t.Errorf("expect Manifest %s to be kept", name)
+		}
+	}
+
+	files, err := ioutil.ReadDir(archiveDir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expect an archive, got %d, %v", len(files), err)
+	}
+	if mode := files[0].Mode().Perm(); mode != 0600 {
+		t.Errorf("expect the archive to be only readable to the owner, got %v", mode)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(archiveDir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := &kcrdapi.KubernetesCrdList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != len(want) {
+		t.Fatalf("expect %d Manifests archived, got %d", len(want), len(list.Items))
+	}
+	for _, manifest := range list.Items {
+		if !want[manifest.Name] {
+			t.Errorf("expect Manifest %s not to be archived", manifest.Name)
+		}
+	}
+}
+
+func TestLifecycleCollectArchiveFailure(t *testing.T) {
+	// the archive directory cannot be created under a file
+	archiveFile := filepath.Join(t.TempDir(), "archive")
+	if err := ioutil.WriteFile(archiveFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, kcrdClient, _, _ := newTestLifecycleController(t, filepath.Join(archiveFile, "dir"), nil,
+		[]*kcrdapi.KubernetesCrd{tenantManifest("foo", "cls-foo", "ns-foo")})
+
+	if err := c.collect(utils.TenantKey("cls-foo", "ns-foo")); err == nil {
+		t.Fatal("expect collecting to fail when manifests cannot be archived")
+	}
+	if deleted := deletedManifests(kcrdClient); len(deleted) > 0 {
+		t.Errorf("expect no Manifests to be deleted without an archive, got %v", deleted)
+	}
+}
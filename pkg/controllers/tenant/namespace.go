@@ -0,0 +1,296 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	kcrdapi "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/business"
+	kcrdclientset "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned"
+	kcrdinformers "github.com/jijiechen/external-crd/pkg/generated/informers/externalversions/kcrd/v1alpha1"
+	kcrdlisters "github.com/jijiechen/external-crd/pkg/generated/listers/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// NamespaceSyncController mirrors the namespace of each tenant from its business cluster into the overlay,
+// with the business apiserver credentials registered for the tenant.
+// The mirrored Namespace objects are read-only for tenants. When the namespace is deleted in the business
+// cluster, all the overlay objects in it are deleted as well.
+type NamespaceSyncController struct {
+	kcrdClient kcrdclientset.Interface
+
+	configMapLister corelisters.ConfigMapLister
+	configMapSynced cache.InformerSynced
+	secretLister    corelisters.SecretLister
+	secretSynced    cache.InformerSynced
+	manifestLister  kcrdlisters.KubernetesCrdLister
+	manifestSynced  cache.InformerSynced
+
+	// newBusinessClient creates a client for a business apiserver
+	newBusinessClient func(*business.Registration) (kubernetes.Interface, error)
+	// businessClients caches the clients of the registered tenants by registration key, only used by syncAll
+	businessClients map[string]*businessClient
+
+	period time.Duration
+
+	// namespaces where Manifests are created
+	reservedNamespaces utils.ReservedNamespaces
+}
+
+// businessClient is a client for a business apiserver, along with the apiserver it is created for
+type businessClient struct {
+	apiServer business.APIServer
+	client    kubernetes.Interface
+}
+
+// NewNamespaceSyncController returns a new NamespaceSyncController
+func NewNamespaceSyncController(kcrdClient kcrdclientset.Interface, configMapInformer coreinformers.ConfigMapInformer,
+	secretInformer coreinformers.SecretInformer, manifestInformer kcrdinformers.KubernetesCrdInformer, period time.Duration, reservedNamespaces utils.ReservedNamespaces) *NamespaceSyncController {
+	return &NamespaceSyncController{
+		kcrdClient:      kcrdClient,
+		configMapLister: configMapInformer.Lister(),
+		configMapSynced: configMapInformer.Informer().HasSynced,
+		secretLister:    secretInformer.Lister(),
+		secretSynced:    secretInformer.Informer().HasSynced,
+		manifestLister:  manifestInformer.Lister(),
+		manifestSynced:  manifestInformer.Informer().HasSynced,
+		newBusinessClient: func(registration *business.Registration) (kubernetes.Interface, error) {
+			if err := registration.APIServer.ValidateTLS(); err != nil {
+				return nil, err
+			}
+			return kubernetes.NewForConfig(registration.APIServer.RESTConfig())
+		},
+		businessClients:    map[string]*businessClient{},
+		period:             period,
+		reservedNamespaces: reservedNamespaces,
+	}
+}
+
+// Run syncs namespaces periodically and blocks until stopCh is closed
+func (c *NamespaceSyncController) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	klog.Info("starting tenant namespace sync controller")
+	defer klog.Info("shutting down tenant namespace sync controller")
+
+	if !cache.WaitForNamedCacheSync("tenant-namespace-sync", stopCh, c.configMapSynced, c.secretSynced, c.manifestSynced) {
+		return
+	}
+
+	wait.Until(c.syncAll, c.period, stopCh)
+}
+
+func (c *NamespaceSyncController) syncAll() {
+	registrations, err := business.ListRegistrations(c.configMapLister, c.secretLister, utils.KcrdSystemNamespace)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	registered := make(map[string]bool, len(registrations))
+	for _, registration := range registrations {
+		registered[registration.Key()] = true
+		if err := c.sync(registration); err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to sync namespace of tenant %s: %v",
+				utils.TenantKey(registration.ClusterID, registration.Namespace), err))
+		}
+	}
+	for key := range c.businessClients {
+		if !registered[key] {
+			delete(c.businessClients, key)
+		}
+	}
+}
+
+// getBusinessClient returns the client for the business apiserver of a registration, which is created again only
+// once the apiserver or the credentials of the registration change
+func (c *NamespaceSyncController) getBusinessClient(registration *business.Registration) (kubernetes.Interface, error) {
+	if cached, ok := c.businessClients[registration.Key()]; ok && reflect.DeepEqual(cached.apiServer, registration.APIServer) {
+		return cached.client, nil
+	}
+	client, err := c.newBusinessClient(registration)
+	if err != nil {
+		delete(c.businessClients, registration.Key())
+		return nil, err
+	}
+	if c.businessClients == nil {
+		c.businessClients = map[string]*businessClient{}
+	}
+	c.businessClients[registration.Key()] = &businessClient{apiServer: registration.APIServer, client: client}
+	return client, nil
+}
+
+func (c *NamespaceSyncController) sync(registration *business.Registration) error {
+	client, err := c.getBusinessClient(registration)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.period)
+	defer cancel()
+	ns, err := client.CoreV1().Namespaces().Get(ctx, registration.Namespace, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return c.cascadeDelete(registration.ClusterID, registration.Namespace)
+	}
+	if err != nil {
+		return err
+	}
+	return c.mirror(registration.ClusterID, ns)
+}
+
+// mirror creates or updates the Namespace object in the overlay
+func (c *NamespaceSyncController) mirror(clusterID string, ns *corev1.Namespace) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ns)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{Object: obj}
+	u.SetAPIVersion(corev1.SchemeGroupVersion.String())
+	u.SetKind("Namespace")
+	trimNamespace(u)
+
+	name := utils.GetManifestName("namespaces", clusterID, ns.Name, ns.Name)
+	reservedNamespace := c.reservedNamespaces.For(clusterID, ns.Name)
+	manifest, err := c.manifestLister.KubernetesCrds(reservedNamespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		manifest = &kcrdapi.KubernetesCrd{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: reservedNamespace,
+			},
+			Manifest: runtime.RawExtension{Object: u},
+		}
+		setMirroredLabels(manifest, clusterID, ns)
+		_, err = c.kcrdClient.KcrdV1alpha1().KubernetesCrds(reservedNamespace).Create(context.TODO(), manifest, metav1.CreateOptions{})
+		if err == nil {
+			klog.V(4).Infof("mirrored namespace %s of cluster %s", ns.Name, clusterID)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	current := &unstructured.Unstructured{}
+	if err := current.UnmarshalJSON(manifest.Manifest.Raw); err != nil {
+		return err
+	}
+	updated := manifest.DeepCopy()
+	setMirroredLabels(updated, clusterID, ns)
+	if !namespaceChanged(current, u) && reflect.DeepEqual(updated.Labels, manifest.Labels) &&
+		reflect.DeepEqual(updated.Annotations, manifest.Annotations) {
+		return nil
+	}
+
+	updated.Manifest = runtime.RawExtension{Object: u}
+	_, err = c.kcrdClient.KcrdV1alpha1().KubernetesCrds(reservedNamespace).Update(context.TODO(), updated, metav1.UpdateOptions{})
+	return err
+}
+
+// setMirroredLabels labels the Manifest of a mirrored namespace like the overlay apiserver does, with the labels of
+// the namespace in place of the ones it has
+func setMirroredLabels(manifest *kcrdapi.KubernetesCrd, clusterID string, ns *corev1.Namespace) {
+	labels := map[string]string{}
+	for k, v := range ns.Labels {
+		labels[k] = v
+	}
+	manifest.Labels = labels
+	utils.SetManifestLabels(manifest, corev1.SchemeGroupVersion.WithKind("Namespace"), clusterID, ns.Name, ns.Name)
+	manifest.Labels[utils.SyncedFromBusinessLabel] = "true"
+}
+
+// cascadeDelete deletes the mirrored Namespace and all the overlay objects in it,
+// once a namespace that has been mirrored is deleted in the business cluster
+func (c *NamespaceSyncController) cascadeDelete(clusterID, namespace string) error {
+	name := utils.GetManifestName("namespaces", clusterID, namespace, namespace)
+	if _, err := c.manifestLister.KubernetesCrds(c.reservedNamespaces.For(clusterID, namespace)).Get(name); err != nil {
+		if apierrors.IsNotFound(err) {
+			// never mirrored, the namespace may not be created in the business cluster yet
+			return nil
+		}
+		return err
+	}
+
+	manifests, err := tenantManifests(c.manifestLister, c.reservedNamespaces, clusterID, namespace)
+	if err != nil {
+		return err
+	}
+	klog.Infof("namespace %s of cluster %s is deleted, deleting %d overlay objects in it", namespace, clusterID, len(manifests))
+	// delete the Namespace itself at last, so that we retry on failures
+	var namespaceManifest *kcrdapi.KubernetesCrd
+	var objects []*kcrdapi.KubernetesCrd
+	for _, manifest := range manifests {
+		if manifest.Name == name {
+			namespaceManifest = manifest
+			continue
+		}
+		objects = append(objects, manifest)
+	}
+	if err := deleteManifests(c.kcrdClient, objects); err != nil {
+		return err
+	}
+	if namespaceManifest == nil {
+		return nil
+	}
+	return deleteManifests(c.kcrdClient, []*kcrdapi.KubernetesCrd{namespaceManifest})
+}
+
+// mirroredNamespaceFields are the fields of namespaces that are mirrored, those of the metadata maintained by the
+// business cluster, such as the managed fields, changing alone are not worth an update
+var mirroredNamespaceFields = [][]string{
+	{"metadata", "labels"},
+	{"metadata", "annotations"},
+	{"spec"},
+	{"status", "phase"},
+}
+
+// namespaceChanged tells whether the mirrored fields of a namespace differ from those mirrored before
+func namespaceChanged(mirrored, ns *unstructured.Unstructured) bool {
+	for _, fields := range mirroredNamespaceFields {
+		before, _, _ := unstructured.NestedFieldNoCopy(mirrored.Object, fields...)
+		after, _, _ := unstructured.NestedFieldNoCopy(ns.Object, fields...)
+		if !reflect.DeepEqual(before, after) {
+			return true
+		}
+	}
+	return false
+}
+
+func trimNamespace(u *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(u.Object, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(u.Object, "metadata", "managedFields")
+	unstructured.RemoveNestedField(u.Object, "metadata", "resourceVersion")
+	unstructured.RemoveNestedField(u.Object, "metadata", "uid")
+}
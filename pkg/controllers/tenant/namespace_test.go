@@ -0,0 +1,247 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	kcrdapi "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/business"
+	kcrdfake "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned/fake"
+	kcrdlisters "github.com/jijiechen/external-crd/pkg/generated/listers/kcrd/v1alpha1"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func newManifest(name string, labels map[string]string) *kcrdapi.KubernetesCrd {
+	return &kcrdapi.KubernetesCrd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: utils.KcrdReservedNamespace,
+			Labels:    labels,
+		},
+	}
+}
+
+func TestNamespaceSyncCascadeDelete(t *testing.T) {
+	registration := &business.Registration{ClusterID: "cls-foo", Namespace: "ns-bar"}
+	nsManifestName := utils.GetManifestName("namespaces", "cls-foo", "ns-bar", "ns-bar")
+
+	tests := []struct {
+		name          string
+		manifests     []*kcrdapi.KubernetesCrd
+		businessObjs  []*corev1.Namespace
+		wantRemaining []string
+	}{
+		{
+			name: "namespace deleted in business cluster",
+			manifests: []*kcrdapi.KubernetesCrd{
+				newManifest(nsManifestName, map[string]string{
+					utils.ConfigClusterLabel: "cls-foo", utils.ConfigNamespaceLabel: "ns-bar", utils.ConfigKindLabel: "Namespace",
+					utils.SyncedFromBusinessLabel: "true",
+				}),
+				newManifest("gateways.cls-foo.ns-bar.gw", map[string]string{
+					utils.ConfigClusterLabel: "cls-foo", utils.ConfigNamespaceLabel: "ns-bar", utils.ConfigKindLabel: "Gateway",
+				}),
+				newManifest("gateways.cls-foo.ns-baz.gw", map[string]string{
+					utils.ConfigClusterLabel: "cls-foo", utils.ConfigNamespaceLabel: "ns-baz", utils.ConfigKindLabel: "Gateway",
+				}),
+			},
+			wantRemaining: []string{"gateways.cls-foo.ns-baz.gw"},
+		},
+		{
+			name: "namespace never mirrored",
+			manifests: []*kcrdapi.KubernetesCrd{
+				newManifest("gateways.cls-foo.ns-bar.gw", map[string]string{
+					utils.ConfigClusterLabel: "cls-foo", utils.ConfigNamespaceLabel: "ns-bar", utils.ConfigKindLabel: "Gateway",
+				}),
+			},
+			wantRemaining: []string{"gateways.cls-foo.ns-bar.gw"},
+		},
+		{
+			name: "namespace exists in business cluster",
+			manifests: []*kcrdapi.KubernetesCrd{
+				newManifest("gateways.cls-foo.ns-bar.gw", map[string]string{
+					utils.ConfigClusterLabel: "cls-foo", utils.ConfigNamespaceLabel: "ns-bar", utils.ConfigKindLabel: "Gateway",
+				}),
+			},
+			businessObjs:  []*corev1.Namespace{{ObjectMeta: metav1.ObjectMeta{Name: "ns-bar"}}},
+			wantRemaining: []string{"gateways.cls-foo.ns-bar.gw", nsManifestName},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kcrdClient := kcrdfake.NewSimpleClientset()
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			for _, manifest := range tt.manifests {
+				if _, err := kcrdClient.KcrdV1alpha1().KubernetesCrds(manifest.Namespace).Create(context.TODO(), manifest, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				indexer.Add(manifest)
+			}
+			businessClient := kubefake.NewSimpleClientset()
+			for _, ns := range tt.businessObjs {
+				businessClient.Tracker().Add(ns)
+			}
+
+			c := &NamespaceSyncController{
+				kcrdClient:     kcrdClient,
+				manifestLister: kcrdlisters.NewKubernetesCrdLister(indexer),
+				newBusinessClient: func(*business.Registration) (kubernetes.Interface, error) {
+					return businessClient, nil
+				},
+				period:             time.Minute,
+				reservedNamespaces: utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0),
+			}
+			if err := c.sync(registration); err != nil {
+				t.Fatalf("sync() error = %v", err)
+			}
+
+			got := map[string]bool{}
+			for _, action := range kcrdClient.Actions() {
+				switch a := action.(type) {
+				case clienttesting.CreateAction:
+					got[a.GetObject().(*kcrdapi.KubernetesCrd).Name] = true
+				case clienttesting.DeleteAction:
+					delete(got, a.GetName())
+				}
+			}
+			if len(got) != len(tt.wantRemaining) {
+				t.Errorf("got remaining manifests %v, want %v", got, tt.wantRemaining)
+			}
+			for _, name := range tt.wantRemaining {
+				if !got[name] {
+					t.Errorf("manifest %s is missing, got %v", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNamespaceSyncBusinessClients(t *testing.T) {
+	created := 0
+	c := &NamespaceSyncController{
+		configMapLister: corelisters.NewConfigMapLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		secretLister:    corelisters.NewSecretLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		newBusinessClient: func(*business.Registration) (kubernetes.Interface, error) {
+			created++
+			return kubefake.NewSimpleClientset(), nil
+		},
+	}
+	registration := &business.Registration{ClusterID: "cls-foo", Namespace: "ns-bar",
+		APIServer: business.APIServer{Host: "10.0.0.1", HTTPSPort: 6443, Token: "foo"}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.getBusinessClient(registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("expect the client of a registration reused, got %d clients created", created)
+	}
+
+	rotated := *registration
+	rotated.APIServer.Token = "bar"
+	if _, err := c.getBusinessClient(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	if created != 2 {
+		t.Errorf("expect the client created again with the new credentials, got %d clients created", created)
+	}
+
+	// no tenant is registered any longer
+	c.syncAll()
+	if len(c.businessClients) != 0 {
+		t.Errorf("expect the clients of unregistered tenants dropped, got %v", c.businessClients)
+	}
+}
+
+func TestNamespaceSyncMirror(t *testing.T) {
+	kcrdClient := kcrdfake.NewSimpleClientset()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	c := &NamespaceSyncController{
+		kcrdClient:         kcrdClient,
+		manifestLister:     kcrdlisters.NewKubernetesCrdLister(indexer),
+		reservedNamespaces: utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0),
+	}
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "ns-bar",
+			Labels:          map[string]string{"istio-injection": "enabled"},
+			ResourceVersion: "10",
+		},
+		Status: corev1.NamespaceStatus{Phase: corev1.NamespaceActive},
+	}
+	if err := c.mirror("cls-foo", ns); err != nil {
+		t.Fatal(err)
+	}
+	actions := kcrdClient.Actions()
+	if len(actions) != 1 || actions[0].GetVerb() != "create" {
+		t.Fatalf("expect the namespace mirrored, got %v", actions)
+	}
+	manifest := actions[0].(clienttesting.CreateAction).GetObject().(*kcrdapi.KubernetesCrd).DeepCopy()
+	if manifest.Labels[utils.ConfigNameLabel] != "ns-bar" || manifest.Annotations[utils.ConfigNameAnnotation] != "ns-bar" ||
+		manifest.Labels[utils.ConfigNamespaceLabel] != "ns-bar" || manifest.Labels["istio-injection"] != "enabled" {
+		t.Errorf("expect the manifest labelled like the overlay apiserver does, got %v %v", manifest.Labels, manifest.Annotations)
+	}
+	raw, err := json.Marshal(manifest.Manifest.Object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Manifest = runtime.RawExtension{Raw: raw}
+	if err := indexer.Add(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		mutate  func(*corev1.Namespace)
+		updated bool
+	}{
+		{name: "resource version", mutate: func(ns *corev1.Namespace) { ns.ResourceVersion = "11" }},
+		{name: "managed fields", mutate: func(ns *corev1.Namespace) {
+			ns.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kubectl", Operation: metav1.ManagedFieldsOperationUpdate}}
+		}},
+		{name: "status conditions", mutate: func(ns *corev1.Namespace) {
+			ns.Status.Conditions = []corev1.NamespaceCondition{{Type: corev1.NamespaceDeletionDiscoveryFailure, Status: corev1.ConditionFalse}}
+		}},
+		{name: "labels", mutate: func(ns *corev1.Namespace) { ns.Labels["istio-injection"] = "disabled" }, updated: true},
+		{name: "phase", mutate: func(ns *corev1.Namespace) { ns.Status.Phase = corev1.NamespaceTerminating }, updated: true},
+	} {
+		changed := ns.DeepCopy()
+		test.mutate(changed)
+		kcrdClient.ClearActions()
+		if err := c.mirror("cls-foo", changed); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if updated := len(kcrdClient.Actions()) > 0; updated != test.updated {
+			t.Errorf("%s: expect the mirrored namespace updated %v, got %v", test.name, test.updated, kcrdClient.Actions())
+		}
+	}
+}
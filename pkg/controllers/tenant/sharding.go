@@ -0,0 +1,150 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	kcrdapi "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	kcrdclientset "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// EnsureReservedNamespaces creates the reserved namespaces that do not exist yet
+func EnsureReservedNamespaces(ctx context.Context, kubeClient kubernetes.Interface, reservedNamespaces utils.ReservedNamespaces) error {
+	for _, name := range reservedNamespaces.All() {
+		ns := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					utils.ObjectCreatedByLabel: utils.ExternalCrdAppName,
+				},
+			},
+		}
+		_, err := kubeClient.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{})
+		if err == nil {
+			klog.Infof("created reserved namespace %s", name)
+			continue
+		}
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateManifests moves the Manifests kept in the reserved namespaces from to where they belong in the reserved
+// namespaces to, and returns the number of Manifests moved, or to be moved if dryRun is set. Each Manifest is copied
+// before the original is deleted, so an interrupted migration can simply be run again. Manifests with owner references
+// are refused, as owners are looked up in the namespaces of their dependents. It is meant to run while external-crd
+// is stopped, as Manifests written in between may be left behind.
+func MigrateManifests(ctx context.Context, kcrdClient kcrdclientset.Interface, from, to utils.ReservedNamespaces, dryRun bool) (int, error) {
+	moved := 0
+	for _, namespace := range from.All() {
+		manifests, err := kcrdClient.KcrdV1alpha1().KubernetesCrds(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return moved, err
+		}
+
+		for i := range manifests.Items {
+			manifest := &manifests.Items[i]
+			clusterID, tenantNamespace, ok := tenantOfManifest(manifest)
+			if !ok {
+				klog.Warningf("skip migrating Manifest %s not belonging to any tenant", klog.KObj(manifest))
+				continue
+			}
+			target := to.For(clusterID, tenantNamespace)
+			if target == manifest.Namespace {
+				continue
+			}
+			if len(manifest.OwnerReferences) > 0 {
+				// owners are looked up in the namespace of their dependents, so the copy would be collected
+				return moved, fmt.Errorf("cannot move Manifest %s with owner references, please remove them first", klog.KObj(manifest))
+			}
+			moved++
+			if dryRun {
+				klog.Infof("would move Manifest %s to namespace %s", klog.KObj(manifest), target)
+				continue
+			}
+			if err := moveManifest(ctx, kcrdClient, manifest, target); err != nil {
+				return moved - 1, err
+			}
+			klog.V(4).Infof("moved Manifest %s to namespace %s", klog.KObj(manifest), target)
+		}
+	}
+	return moved, nil
+}
+
+// moveManifest copies manifest into namespace, and deletes the original once the copy is in place. A copy left by an
+// interrupted migration is taken only if it stores the same object with the same labels.
+func moveManifest(ctx context.Context, kcrdClient kcrdclientset.Interface, manifest *kcrdapi.KubernetesCrd, namespace string) error {
+	copied := &kcrdapi.KubernetesCrd{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        manifest.Name,
+			Namespace:   namespace,
+			Labels:      manifest.Labels,
+			Annotations: manifest.Annotations,
+			Finalizers:  manifest.Finalizers,
+		},
+		Manifest: manifest.Manifest,
+	}
+	_, err := kcrdClient.KcrdV1alpha1().KubernetesCrds(namespace).Create(ctx, copied, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		existing, getErr := kcrdClient.KcrdV1alpha1().KubernetesCrds(namespace).Get(ctx, manifest.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if !bytes.Equal(existing.Manifest.Raw, manifest.Manifest.Raw) || !reflect.DeepEqual(existing.Labels, manifest.Labels) {
+			return fmt.Errorf("the Manifest %s differs from %s already in place, please resolve the conflict before migrating again",
+				klog.KObj(manifest), klog.KObj(existing))
+		}
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the finalizers are carried over to the copy, so the original would otherwise never go away
+	if len(manifest.Finalizers) > 0 {
+		original := manifest.DeepCopy()
+		original.Finalizers = nil
+		if manifest, err = kcrdClient.KcrdV1alpha1().KubernetesCrds(original.Namespace).Update(ctx, original, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	err = kcrdClient.KcrdV1alpha1().KubernetesCrds(manifest.Namespace).Delete(ctx, manifest.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &manifest.UID},
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
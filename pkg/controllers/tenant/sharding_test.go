@@ -0,0 +1,209 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	kcrdapi "github.com/jijiechen/external-crd/pkg/apis/kcrd/v1alpha1"
+	kcrdfake "github.com/jijiechen/external-crd/pkg/generated/clientset/versioned/fake"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+func TestMigrateManifests(t *testing.T) {
+	from := utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0)
+	to := utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 3)
+
+	tenantLabels := func(clusterID, namespace string) map[string]string {
+		return map[string]string{
+			utils.ConfigClusterLabel:   clusterID,
+			utils.ConfigNamespaceLabel: namespace,
+		}
+	}
+	kcrdClient := kcrdfake.NewSimpleClientset()
+	// the generated fake lists with a group other than the one the list kind is registered with
+	kcrdClient.PrependReactor("list", "kubernetescrds", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		obj, err := kcrdClient.Tracker().List(action.GetResource(),
+			kcrdapi.SchemeGroupVersion.WithKind("KubernetesCrd"), action.GetNamespace())
+		return true, obj, err
+	})
+	// objects are created through the fake, so that they are tracked under the group it lists with
+	for _, manifest := range []*kcrdapi.KubernetesCrd{
+		newManifest("foo", tenantLabels("cls-foo", "ns-foo")),
+		newManifest("bar", tenantLabels("cls-bar", "ns-bar")),
+		newManifest("orphan", nil),
+	} {
+		if _, err := kcrdClient.KcrdV1alpha1().KubernetesCrds(manifest.Namespace).Create(context.TODO(), manifest, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kubeClient := kubefake.NewSimpleClientset()
+	if err := EnsureReservedNamespaces(context.TODO(), kubeClient, to); err != nil {
+		t.Fatal(err)
+	}
+	for _, namespace := range to.All() {
+		if _, err := kubeClient.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{}); err != nil {
+			t.Errorf("expect reserved namespace %s created, got %v", namespace, err)
+		}
+	}
+
+	moved, err := MigrateManifests(context.TODO(), kcrdClient, from, to, true)
+	if err != nil || moved != 2 {
+		t.Fatalf("expect 2 Manifests to be moved, got %d, %v", moved, err)
+	}
+	if manifests, _ := kcrdClient.KcrdV1alpha1().KubernetesCrds(utils.KcrdReservedNamespace).List(context.TODO(), metav1.ListOptions{}); len(manifests.Items) != 3 {
+		t.Fatalf("expect nothing moved in a dry run, got %d Manifests left", len(manifests.Items))
+	}
+
+	moved, err = MigrateManifests(context.TODO(), kcrdClient, from, to, false)
+	if err != nil || moved != 2 {
+		t.Fatalf("expect 2 Manifests moved, got %d, %v", moved, err)
+	}
+	for name, namespace := range map[string]string{
+		"foo":    to.For("cls-foo", "ns-foo"),
+		"bar":    to.For("cls-bar", "ns-bar"),
+		"orphan": utils.KcrdReservedNamespace,
+	} {
+		if _, err := kcrdClient.KcrdV1alpha1().KubernetesCrds(namespace).Get(context.TODO(), name, metav1.GetOptions{}); err != nil {
+			t.Errorf("expect Manifest %s in %s, got %v", name, namespace, err)
+		}
+	}
+	if manifests, _ := kcrdClient.KcrdV1alpha1().KubernetesCrds(utils.KcrdReservedNamespace).List(context.TODO(), metav1.ListOptions{}); len(manifests.Items) != 1 {
+		t.Errorf("expect only the orphan Manifest left, got %d Manifests", len(manifests.Items))
+	}
+
+	// migrating again moves nothing
+	if moved, err := MigrateManifests(context.TODO(), kcrdClient, to, to, false); err != nil || moved != 0 {
+		t.Errorf("expect nothing moved again, got %d, %v", moved, err)
+	}
+}
+
+func TestMoveManifest(t *testing.T) {
+	const target = "kcrd-reserved-1"
+	newManifestWith := func(namespace, raw string, mutate func(*kcrdapi.KubernetesCrd)) *kcrdapi.KubernetesCrd {
+		manifest := newManifest("foo", map[string]string{utils.ConfigClusterLabel: "cls-foo"})
+		manifest.Namespace = namespace
+		manifest.Manifest = runtime.RawExtension{Raw: []byte(raw)}
+		if mutate != nil {
+			mutate(manifest)
+		}
+		return manifest
+	}
+
+	tests := []struct {
+		name           string
+		manifest       *kcrdapi.KubernetesCrd
+		existing       *kcrdapi.KubernetesCrd
+		wantErr        bool
+		wantFinalizers []string
+	}{
+		{
+			name:     "moved",
+			manifest: newManifestWith(utils.KcrdReservedNamespace, `{"a":1}`, nil),
+		},
+		{
+			name:     "identical copy left by an interrupted migration",
+			manifest: newManifestWith(utils.KcrdReservedNamespace, `{"a":1}`, nil),
+			existing: newManifestWith(target, `{"a":1}`, nil),
+		},
+		{
+			name:     "conflicting copy",
+			manifest: newManifestWith(utils.KcrdReservedNamespace, `{"a":1}`, nil),
+			existing: newManifestWith(target, `{"a":2}`, nil),
+			wantErr:  true,
+		},
+		{
+			name:     "copy with other labels",
+			manifest: newManifestWith(utils.KcrdReservedNamespace, `{"a":1}`, nil),
+			existing: newManifestWith(target, `{"a":1}`, func(m *kcrdapi.KubernetesCrd) {
+				m.Labels = map[string]string{utils.ConfigClusterLabel: "cls-bar"}
+			}),
+			wantErr: true,
+		},
+		{
+			name: "finalizers carried over",
+			manifest: newManifestWith(utils.KcrdReservedNamespace, `{"a":1}`, func(m *kcrdapi.KubernetesCrd) {
+				m.Finalizers = []string{"example.com/cleanup"}
+			}),
+			wantFinalizers: []string{"example.com/cleanup"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kcrdClient := kcrdfake.NewSimpleClientset()
+			for _, manifest := range []*kcrdapi.KubernetesCrd{tt.manifest, tt.existing} {
+				if manifest == nil {
+					continue
+				}
+				if _, err := kcrdClient.KcrdV1alpha1().KubernetesCrds(manifest.Namespace).Create(context.TODO(), manifest, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := moveManifest(context.TODO(), kcrdClient, tt.manifest, target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("moveManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, originalErr := kcrdClient.KcrdV1alpha1().KubernetesCrds(tt.manifest.Namespace).Get(context.TODO(), "foo", metav1.GetOptions{})
+			if tt.wantErr {
+				if originalErr != nil {
+					t.Errorf("expect the original to be kept on conflicts, got %v", originalErr)
+				}
+				return
+			}
+			if originalErr == nil {
+				t.Errorf("expect the original to be deleted")
+			}
+			copied, err := kcrdClient.KcrdV1alpha1().KubernetesCrds(target).Get(context.TODO(), "foo", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("expect the copy in %s, got %v", target, err)
+			}
+			if !reflect.DeepEqual(copied.Finalizers, tt.wantFinalizers) {
+				t.Errorf("expect finalizers %v on the copy, got %v", tt.wantFinalizers, copied.Finalizers)
+			}
+		})
+	}
+}
+
+func TestMigrateManifestsWithOwners(t *testing.T) {
+	from := utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 0)
+	to := utils.NewReservedNamespaces(utils.KcrdReservedNamespace, 3)
+
+	kcrdClient := kcrdfake.NewSimpleClientset()
+	kcrdClient.PrependReactor("list", "kubernetescrds", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		obj, err := kcrdClient.Tracker().List(action.GetResource(),
+			kcrdapi.SchemeGroupVersion.WithKind("KubernetesCrd"), action.GetNamespace())
+		return true, obj, err
+	})
+	owned := newManifest("owned", map[string]string{utils.ConfigClusterLabel: "cls-foo", utils.ConfigNamespaceLabel: "ns-foo"})
+	owned.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "owner", UID: "owner-uid"}}
+	if _, err := kcrdClient.KcrdV1alpha1().KubernetesCrds(owned.Namespace).Create(context.TODO(), owned, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MigrateManifests(context.TODO(), kcrdClient, from, to, true); err == nil {
+		t.Errorf("expect Manifests with owner references to be refused")
+	}
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+const (
+	// the queue key to reload the apiserver proxy after tokens get rotated
+	proxyReloadKey = "\x00proxy"
+	// tokens rotated within this period are reloaded by the apiserver proxy at once
+	proxyReloadDelay = 10 * time.Second
+	// minTokenRefreshDelay is the least time to wait before a token is checked again, in case its lifetime is
+	// too short to refresh it in time
+	minTokenRefreshDelay = time.Minute
+)
+
+// tokenRemovalKey is the queue key to remove the token of a tenant whose identity is deleted, which is the tenant key
+type tokenRemovalKey string
+
+// tokenLifetime is when a minted token is issued and when it expires
+type tokenLifetime struct {
+	issuedAt   time.Time
+	expiration time.Time
+}
+
+// TokenController mints audience-bound tokens for tenant identities with the TokenRequest API,
+// refreshes them before they expire and stores them in Secret utils.BusinessTokenSecretName for the apiserver proxy.
+type TokenController struct {
+	kubeClient kubernetes.Interface
+
+	saLister corelisters.ServiceAccountLister
+	saSynced cache.InformerSynced
+
+	queue workqueue.RateLimitingInterface
+
+	// lifetimes of the minted tokens, keyed by service account name
+	lock      sync.Mutex
+	lifetimes map[string]tokenLifetime
+
+	audiences []string
+	// expiration is the lifetime requested for tokens, which the apiserver may cap
+	expiration time.Duration
+	// name of the apiserver proxy Deployment to restart after tokens are rotated, empty to disable.
+	// Only the Envoy proxy configured once by its init container needs restarting, as the other proxies
+	// reload tokens on the fly.
+	proxyDeployment string
+}
+
+// NewTokenController returns a new TokenController
+func NewTokenController(kubeClient kubernetes.Interface, saInformer coreinformers.ServiceAccountInformer,
+	audiences []string, expiration time.Duration, proxyDeployment string) *TokenController {
+	c := &TokenController{
+		kubeClient:      kubeClient,
+		saLister:        saInformer.Lister(),
+		saSynced:        saInformer.Informer().HasSynced,
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "tenant-token"),
+		lifetimes:       map[string]tokenLifetime{},
+		audiences:       audiences,
+		expiration:      expiration,
+		proxyDeployment: proxyDeployment,
+	}
+
+	saInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(old, cur interface{}) {
+			c.enqueue(cur)
+		},
+		DeleteFunc: c.deleteServiceAccount,
+	})
+	return c
+}
+
+func (c *TokenController) enqueue(obj interface{}) {
+	sa := obj.(*corev1.ServiceAccount)
+	if _, _, ok := tenantOf(sa); !ok {
+		return
+	}
+	c.queue.Add(sa.Name)
+}
+
+func (c *TokenController) deleteServiceAccount(obj interface{}) {
+	sa, ok := obj.(*corev1.ServiceAccount)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("couldn't get object from tombstone %#v", obj))
+			return
+		}
+		sa, ok = tombstone.Obj.(*corev1.ServiceAccount)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("tombstone contained object that is not a ServiceAccount %#v", obj))
+			return
+		}
+	}
+
+	clusterID, namespace, ok := tenantOf(sa)
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	delete(c.lifetimes, sa.Name)
+	c.lock.Unlock()
+	c.queue.Add(tokenRemovalKey(utils.TenantKey(clusterID, namespace)))
+}
+
+// Run starts the workers and blocks until stopCh is closed
+func (c *TokenController) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	klog.Info("starting tenant token controller")
+	defer klog.Info("shutting down tenant token controller")
+
+	if !cache.WaitForNamedCacheSync("tenant-token", stopCh, c.saSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+func (c *TokenController) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *TokenController) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	var err error
+	if tenantKey, ok := key.(tokenRemovalKey); ok {
+		err = c.removeToken(string(tenantKey))
+	} else if key.(string) == proxyReloadKey {
+		err = c.reloadProxy()
+	} else {
+		err = c.sync(key.(string))
+	}
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to sync tenant token %q: %v", key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// sync mints a new token for a tenant identity if its current one is about to expire
+func (c *TokenController) sync(name string) error {
+	sa, err := c.saLister.ServiceAccounts(utils.KcrdSystemNamespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	clusterID, namespace, ok := tenantOf(sa)
+	if !ok {
+		return nil
+	}
+
+	c.lock.Lock()
+	lifetime, minted := c.lifetimes[name]
+	c.lock.Unlock()
+	if !minted {
+		// tokens minted before a restart are still valid
+		lifetime.issuedAt, lifetime.expiration, minted, err = business.GetTokenExpiration(context.TODO(), c.kubeClient,
+			sa.Namespace, clusterID, namespace)
+		if err != nil {
+			return err
+		}
+		if minted {
+			c.lock.Lock()
+			c.lifetimes[name] = lifetime
+			c.lock.Unlock()
+		}
+	}
+	if minted {
+		if refreshAt := c.refreshTime(lifetime); time.Now().Before(refreshAt) {
+			c.queue.AddAfter(name, refreshDelay(refreshAt))
+			return nil
+		}
+	}
+
+	// the token is issued no earlier than now
+	issuedAt := time.Now()
+	expirationSeconds := int64(c.expiration.Seconds())
+	tokenRequest, err := c.kubeClient.CoreV1().ServiceAccounts(sa.Namespace).CreateToken(context.TODO(), sa.Name,
+		&authenticationv1.TokenRequest{
+			Spec: authenticationv1.TokenRequestSpec{
+				Audiences:         c.audiences,
+				ExpirationSeconds: &expirationSeconds,
+			},
+		}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	lifetime = tokenLifetime{issuedAt: issuedAt, expiration: tokenRequest.Status.ExpirationTimestamp.Time}
+	if err := business.SaveToken(context.TODO(), c.kubeClient, sa.Namespace, clusterID, namespace,
+		tokenRequest.Status.Token, lifetime.issuedAt, lifetime.expiration); err != nil {
+		return err
+	}
+	// neither tokens nor business credentials sit in the business config in plain text
+	if err := business.RemoveLegacyCredentials(context.TODO(), c.kubeClient, sa.Namespace, clusterID, namespace); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.lifetimes[name] = lifetime
+	c.lock.Unlock()
+	klog.V(4).Infof("minted token for tenant %s, expiring at %s", utils.TenantKey(clusterID, namespace), lifetime.expiration)
+
+	c.queue.AddAfter(name, refreshDelay(c.refreshTime(lifetime)))
+	if len(c.proxyDeployment) > 0 {
+		c.queue.AddAfter(proxyReloadKey, proxyReloadDelay)
+	}
+	return nil
+}
+
+// removeToken removes the token of a tenant whose identity is deleted, unless the tenant has got another one since
+func (c *TokenController) removeToken(tenantKey string) error {
+	clusterID, namespace, ok := utils.ParseTenantKey(tenantKey)
+	if !ok {
+		return nil
+	}
+	sas, err := c.saLister.ServiceAccounts(utils.KcrdSystemNamespace).List(labels.SelectorFromSet(labels.Set{
+		utils.TenantClusterLabel:   clusterID,
+		utils.TenantNamespaceLabel: namespace,
+	}))
+	if err != nil {
+		return err
+	}
+	if len(sas) > 0 {
+		return nil
+	}
+	return business.RemoveToken(context.TODO(), c.kubeClient, utils.KcrdSystemNamespace, clusterID, namespace)
+}
+
+// refreshTime returns when a token should be refreshed, which is at 80% of the lifetime it is issued with.
+// The apiserver may issue tokens with a shorter lifetime than requested, such as with
+// "--service-account-max-token-expiration".
+func (c *TokenController) refreshTime(lifetime tokenLifetime) time.Time {
+	issuedAt := lifetime.issuedAt
+	if issuedAt.IsZero() || !issuedAt.Before(lifetime.expiration) {
+		// tokens stored without the issue time are taken as issued with the lifetime requested
+		issuedAt = lifetime.expiration.Add(-c.expiration)
+	}
+	return issuedAt.Add(lifetime.expiration.Sub(issuedAt) * 4 / 5)
+}
+
+// refreshDelay returns how long to wait until refreshAt, which is at least minTokenRefreshDelay
+func refreshDelay(refreshAt time.Time) time.Duration {
+	if delay := time.Until(refreshAt); delay > minTokenRefreshDelay {
+		return delay
+	}
+	return minTokenRefreshDelay
+}
+
+// reloadProxy restarts the apiserver proxy configured once by its init container, which reads the tokens on startup
+func (c *TokenController) reloadProxy() error {
+	if len(c.proxyDeployment) == 0 {
+		return nil
+	}
+
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+		utils.TokensRotatedAtAnnotation, time.Now().Format(time.RFC3339))
+	_, err := c.kubeClient.AppsV1().Deployments(utils.KcrdSystemNamespace).Patch(context.TODO(), c.proxyDeployment,
+		types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	if apierrors.IsNotFound(err) {
+		klog.V(4).Infof("apiserver proxy %s/%s not found, skip reloading", utils.KcrdSystemNamespace, c.proxyDeployment)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// recordingQueue records the delays items are added after
+type recordingQueue struct {
+	workqueue.RateLimitingInterface
+	delays map[interface{}]time.Duration
+}
+
+func (q *recordingQueue) AddAfter(item interface{}, duration time.Duration) {
+	q.delays[item] = duration
+}
+
+func newTestTokenController(t *testing.T, lifetime time.Duration, objects ...runtime.Object) (*TokenController, *kubefake.Clientset, *recordingQueue) {
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tenant-foo",
+			Namespace: utils.KcrdSystemNamespace,
+			Labels: map[string]string{
+				utils.TenantClusterLabel:   "cls-foo",
+				utils.TenantNamespaceLabel: "ns-foo",
+			},
+		},
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(sa); err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient := kubefake.NewSimpleClientset(append(objects, sa)...)
+	// the apiserver issues tokens with lifetime regardless of what is requested
+	kubeClient.PrependReactor("create", "serviceaccounts", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		return true, &authenticationv1.TokenRequest{
+			Status: authenticationv1.TokenRequestStatus{
+				Token:               "minted",
+				ExpirationTimestamp: metav1.NewTime(time.Now().Add(lifetime)),
+			},
+		}, nil
+	})
+
+	queue := &recordingQueue{
+		RateLimitingInterface: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		delays:                map[interface{}]time.Duration{},
+	}
+	return &TokenController{
+		kubeClient: kubeClient,
+		saLister:   corelisters.NewServiceAccountLister(indexer),
+		queue:      queue,
+		lifetimes:  map[string]tokenLifetime{},
+		expiration: 24 * time.Hour,
+	}, kubeClient, queue
+}
+
+func countTokenRequests(kubeClient *kubefake.Clientset) int {
+	count := 0
+	for _, action := range kubeClient.Actions() {
+		if action.GetVerb() == "create" && action.GetSubresource() == "token" {
+			count++
+		}
+	}
+	return count
+}
+
+func newTokenSecret(issuedAt, expiration time.Time) *corev1.Secret {
+	data := map[string][]byte{
+		business.TokenKey("cls-foo", "ns-foo"): []byte("stored"),
+		"ns-foo-cls-foo.expiration":            []byte(expiration.Format(time.RFC3339)),
+	}
+	if !issuedAt.IsZero() {
+		data["ns-foo-cls-foo.issued-at"] = []byte(issuedAt.Format(time.RFC3339))
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.BusinessTokenSecretName, Namespace: utils.KcrdSystemNamespace},
+		Data:       data,
+	}
+}
+
+func expectDelay(t *testing.T, queue *recordingQueue, want time.Duration) {
+	t.Helper()
+	got, ok := queue.delays["tenant-foo"]
+	if !ok {
+		t.Fatalf("expect the token to be checked again")
+	}
+	// the tests take a moment, and timestamps are stored in seconds
+	if got < want-5*time.Second || got > want+time.Second {
+		t.Errorf("expect the token to be checked again in %s, got %s", want, got)
+	}
+}
+
+func TestTokenControllerMint(t *testing.T) {
+	c, kubeClient, queue := newTestTokenController(t, 24*time.Hour)
+	if err := c.sync("tenant-foo"); err != nil {
+		t.Fatal(err)
+	}
+	if countTokenRequests(kubeClient) != 1 {
+		t.Fatalf("expect a token minted")
+	}
+	secret, err := kubeClient.CoreV1().Secrets(utils.KcrdSystemNamespace).Get(context.TODO(), utils.BusinessTokenSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := string(secret.Data[business.TokenKey("cls-foo", "ns-foo")]); token != "minted" {
+		t.Errorf("expect the minted token saved, got %q", token)
+	}
+	expectDelay(t, queue, 24*time.Hour*4/5)
+	if _, ok := queue.delays[proxyReloadKey]; ok {
+		t.Errorf("expect the apiserver proxy not restarted unless asked to")
+	}
+
+	// the token is not minted again until it is to be refreshed
+	if err := c.sync("tenant-foo"); err != nil {
+		t.Fatal(err)
+	}
+	if countTokenRequests(kubeClient) != 1 {
+		t.Errorf("expect no token minted before it is to be refreshed")
+	}
+}
+
+func TestTokenControllerCappedExpiration(t *testing.T) {
+	// 24h is requested, but only 1h is issued
+	c, kubeClient, queue := newTestTokenController(t, time.Hour)
+	if err := c.sync("tenant-foo"); err != nil {
+		t.Fatal(err)
+	}
+	expectDelay(t, queue, 48*time.Minute)
+
+	if err := c.sync("tenant-foo"); err != nil {
+		t.Fatal(err)
+	}
+	if countTokenRequests(kubeClient) != 1 {
+		t.Errorf("expect no token minted again with a capped expiration, got %d tokens minted", countTokenRequests(kubeClient))
+	}
+
+	// tokens shorter than the least delay are checked again after the least delay
+	c, _, queue = newTestTokenController(t, 10*time.Second)
+	if err := c.sync("tenant-foo"); err != nil {
+		t.Fatal(err)
+	}
+	expectDelay(t, queue, minTokenRefreshDelay)
+}
+
+func TestTokenControllerRefresh(t *testing.T) {
+	now := time.Now()
+	c, kubeClient, queue := newTestTokenController(t, time.Hour, newTokenSecret(now.Add(-50*time.Minute), now.Add(10*time.Minute)))
+	if err := c.sync("tenant-foo"); err != nil {
+		t.Fatal(err)
+	}
+	if countTokenRequests(kubeClient) != 1 {
+		t.Fatalf("expect the token past 80%% of its lifetime refreshed")
+	}
+	expectDelay(t, queue, 48*time.Minute)
+}
+
+func TestTokenControllerRestart(t *testing.T) {
+	now := time.Now()
+	// tokens minted before a restart are kept until they are to be refreshed
+	c, kubeClient, queue := newTestTokenController(t, time.Hour, newTokenSecret(now.Add(-10*time.Minute), now.Add(50*time.Minute)))
+	if err := c.sync("tenant-foo"); err != nil {
+		t.Fatal(err)
+	}
+	if countTokenRequests(kubeClient) != 0 {
+		t.Errorf("expect the stored token kept")
+	}
+	expectDelay(t, queue, 38*time.Minute)
+
+	// tokens stored without the issue time are taken as issued with the lifetime requested
+	c, kubeClient, queue = newTestTokenController(t, time.Hour, newTokenSecret(time.Time{}, now.Add(12*time.Hour)))
+	if err := c.sync("tenant-foo"); err != nil {
+		t.Fatal(err)
+	}
+	if countTokenRequests(kubeClient) != 0 {
+		t.Errorf("expect the stored token kept")
+	}
+	expectDelay(t, queue, 12*time.Hour-24*time.Hour/5)
+}
+
+func TestTokenControllerRemove(t *testing.T) {
+	now := time.Now()
+	c, kubeClient, queue := newTestTokenController(t, time.Hour, newTokenSecret(now, now.Add(time.Hour)))
+	sa, err := c.saLister.ServiceAccounts(utils.KcrdSystemNamespace).Get("tenant-foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deletions are seen by every replica, while only the leader writes
+	kubeClient.ClearActions()
+	c.deleteServiceAccount(sa)
+	if len(kubeClient.Actions()) != 0 {
+		t.Errorf("expect the token removed by the workers, got %v", kubeClient.Actions())
+	}
+	if queue.Len() != 1 {
+		t.Fatalf("expect the tenant to be queued, got %d items", queue.Len())
+	}
+	key, _ := queue.Get()
+	queue.Done(key)
+	if key != tokenRemovalKey("cls-foo/ns-foo") {
+		t.Fatalf("expect the tenant to be queued, got %v", key)
+	}
+
+	// the tenant has got another identity since
+	if err := c.removeToken("cls-foo/ns-foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, minted, err := business.GetTokenExpiration(context.TODO(), kubeClient, utils.KcrdSystemNamespace, "cls-foo", "ns-foo"); err != nil || !minted {
+		t.Errorf("expect the token of the tenant kept, got %v", err)
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	c.saLister = corelisters.NewServiceAccountLister(indexer)
+	if err := c.removeToken("cls-foo/ns-foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, minted, err := business.GetTokenExpiration(context.TODO(), kubeClient, utils.KcrdSystemNamespace, "cls-foo", "ns-foo"); err != nil || minted {
+		t.Errorf("expect the token of the tenant removed, got %v", err)
+	}
+}
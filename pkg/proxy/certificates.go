@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+)
+
+// servingCertificates picks the serving certificates issued by external-crd for the hostnames of tenants,
+// which are reloaded whenever they get rotated
+type servingCertificates struct {
+	systemNamespace string
+	baseHost        string
+	lister          corelisters.SecretLister
+
+	// the parsed certificates keyed by labels, and the Secrets they are parsed from keyed by names
+	lock         sync.Mutex
+	secrets      map[string]*corev1.Secret
+	certificates map[string]*tls.Certificate
+}
+
+// get returns the certificate for serverName, either issued for the tenant or the wildcard one, nil if none is issued
+func (s *servingCertificates) get(serverName string) *tls.Certificate {
+	label, ok := business.ServingCertLabel(serverName, s.baseHost)
+	if !ok {
+		return nil
+	}
+	certificates := s.load()
+	if cert := certificates[label]; cert != nil {
+		return cert
+	}
+	return certificates[business.WildcardCertLabel]
+}
+
+// load parses the certificates in the Secrets if any of them has changed
+func (s *servingCertificates) load() map[string]*tls.Certificate {
+	secrets, err := business.ListServingCertSecrets(s.lister, s.systemNamespace)
+	if err != nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// the informer replaces the cached Secrets on changes
+	if len(secrets) == len(s.secrets) {
+		unchanged := true
+		for _, secret := range secrets {
+			if s.secrets[secret.Name] != secret {
+				unchanged = false
+				break
+			}
+		}
+		if unchanged {
+			return s.certificates
+		}
+	}
+	parsedSecrets := make(map[string]*corev1.Secret, len(secrets))
+	certificates := map[string]*tls.Certificate{}
+	for _, secret := range secrets {
+		parsedSecrets[secret.Name] = secret
+		label, cert, ok := business.ServingCertificateOf(secret)
+		if !ok {
+			continue
+		}
+		parsed, err := cert.TLSCertificate()
+		if err != nil {
+			klog.Errorf("invalid serving certificate in Secret %s/%s: %v", secret.Namespace, secret.Name, err)
+			continue
+		}
+		certificates[label] = parsed
+	}
+	s.secrets, s.certificates = parsedSecrets, certificates
+	return certificates
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// serveMergedGroups serves "/apis" for t, which lists the API groups of the business cluster, with the versions served
+// by external-crd for t merged in, so that clients find the kinds external-crd serves under their original groups.
+// The documents of groups served by both are served as merged here, while the others are routed to where the groups
+// are listed from.
+func (p *Proxy) serveMergedGroups(w http.ResponseWriter, req *http.Request, t *tenant) {
+	type result struct {
+		groups *metav1.APIGroupList
+		err    error
+	}
+	overlayResult := make(chan result, 1)
+	go func() {
+		groups, err := fetchGroups(req.Context(), p.overlay, t.crdToken)
+		overlayResult <- result{groups, err}
+	}()
+	businessGroups, err := fetchGroups(req.Context(), t.business, t.registration.APIServer.Token)
+	if err != nil {
+		klog.Errorf("failed to discover the API groups of the business cluster of tenant %s: %v", t.key(), err)
+		writeStatus(w, apierrors.NewServiceUnavailable(err.Error()))
+		return
+	}
+	overlay := <-overlayResult
+	if overlay.err != nil {
+		// partial documents would make clients forget the kinds external-crd serves until they invalidate their caches
+		klog.Errorf("failed to discover the API groups served for tenant %s: %v", t.key(), overlay.err)
+		writeStatus(w, apierrors.NewServiceUnavailable(overlay.err.Error()))
+		return
+	}
+
+	merged := mergeGroups(businessGroups, overlay.groups)
+	// keep routing consistent with what the tenant has just discovered
+	t.setOverlayGroups(overlay.groups)
+	t.setMergedGroups(sharedGroups(businessGroups, merged))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(merged); err != nil {
+		klog.Errorf("failed to write response: %v", err)
+	}
+}
+
+// mergeGroups lists the groups of business in their order, with the versions of those of overlay merged into the
+// groups with the same names, followed by the others of overlay. Versions served by both are served by overlay,
+// which are preferred to the others of business.
+func mergeGroups(business, overlay *metav1.APIGroupList) *metav1.APIGroupList {
+	overlayGroups := map[string]metav1.APIGroup{}
+	for _, group := range overlay.Groups {
+		overlayGroups[group.Name] = group
+	}
+
+	merged := &metav1.APIGroupList{
+		TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+		Groups:   make([]metav1.APIGroup, 0, len(business.Groups)+len(overlay.Groups)),
+	}
+	listed := sets.NewString()
+	for _, group := range business.Groups {
+		if overlayGroup, ok := overlayGroups[group.Name]; ok {
+			group = mergeVersions(group, overlayGroup)
+		}
+		merged.Groups = append(merged.Groups, group)
+		listed.Insert(group.Name)
+	}
+	for _, group := range overlay.Groups {
+		if !listed.Has(group.Name) {
+			merged.Groups = append(merged.Groups, group)
+			listed.Insert(group.Name)
+		}
+	}
+	// the addresses of upstreams are never reachable to tenants
+	for i := range merged.Groups {
+		merged.Groups[i].ServerAddressByClientCIDRs = nil
+	}
+	return merged
+}
+
+// mergeVersions returns the group with the versions of overlay, followed by those only served by business
+func mergeVersions(business, overlay metav1.APIGroup) metav1.APIGroup {
+	merged := *overlay.DeepCopy()
+	versions := sets.NewString()
+	for _, version := range overlay.Versions {
+		versions.Insert(version.Version)
+	}
+	for _, version := range business.Versions {
+		if !versions.Has(version.Version) {
+			merged.Versions = append(merged.Versions, version)
+		}
+	}
+	if len(merged.PreferredVersion.Version) == 0 {
+		merged.PreferredVersion = business.PreferredVersion
+	}
+	return merged
+}
+
+// sharedGroups returns the groups in merged which are served by business as well, keyed by their names
+func sharedGroups(business, merged *metav1.APIGroupList) map[string]metav1.APIGroup {
+	businessGroups := sets.NewString()
+	for _, group := range business.Groups {
+		businessGroups.Insert(group.Name)
+	}
+	shared := map[string]metav1.APIGroup{}
+	for _, group := range merged.Groups {
+		if businessGroups.Has(group.Name) && len(group.Name) > 0 {
+			shared[group.Name] = group
+		}
+	}
+	return shared
+}
+
+// serveMergedGroup serves "/apis/<group>" of a group served by both external-crd and the business cluster for t,
+// as merged when the tenant discovered "/apis". False is returned if group is not served by both.
+func serveMergedGroup(w http.ResponseWriter, t *tenant, group string) bool {
+	apiGroup, ok := t.mergedGroup(group)
+	if !ok {
+		return false
+	}
+	apiGroup.TypeMeta = metav1.TypeMeta{Kind: "APIGroup", APIVersion: "v1"}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&apiGroup); err != nil {
+		klog.Errorf("failed to write response: %v", err)
+	}
+	return true
+}
+
+// fetchGroups gets "/apis" from target, authenticated with token if not empty
+func fetchGroups(ctx context.Context, target *upstream, token string) (*metav1.APIGroupList, error) {
+	location := *target.url
+	location.Path = strings.TrimSuffix(location.Path, "/") + "/apis"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := target.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, location.String())
+	}
+	groups := &metav1.APIGroupList{}
+	if err := json.NewDecoder(resp.Body).Decode(groups); err != nil {
+		return nil, fmt.Errorf("invalid discovery document from %s: %v", location.String(), err)
+	}
+	return groups, nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/spf13/pflag"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// Options contains the settings of the tenant front proxy
+type Options struct {
+	// path to a kubeconfig file pointing at the cluster where external-crd runs, empty for in-cluster config
+	Kubeconfig string
+	// the namespace holding the tenant registrations and tokens
+	SystemNamespace string
+
+	// tenants are served at "<namespace>-<cluster>.<base>"
+	BaseHost    string
+	BindAddress net.IP
+	SecurePort  int
+	// fallback serving certificate and key for hostnames without certificates issued by external-crd,
+	// a self-signed certificate for "*.<base>" is generated if not specified
+	TLSCertFile       string
+	TLSPrivateKeyFile string
+
+	// URL of external-crd, where the API groups it serves are routed to
+	OverlayServer string
+	// CA bundle to verify external-crd with, empty to skip verification
+	OverlayCAFile string
+	// interval to refresh the API groups served by external-crd for each tenant
+	DiscoveryRefreshPeriod time.Duration
+}
+
+// NewOptions returns the default Options
+func NewOptions() *Options {
+	return &Options{
+		SystemNamespace:        utils.KcrdSystemNamespace,
+		BaseHost:               utils.DefaultProxyBaseHost,
+		BindAddress:            net.ParseIP("0.0.0.0"),
+		SecurePort:             443,
+		OverlayServer:          fmt.Sprintf("https://%s.%s.svc:443", utils.ExternalCrdAppName, utils.KcrdSystemNamespace),
+		DiscoveryRefreshPeriod: utils.DefaultProxyDiscoveryRefreshPeriod,
+	}
+}
+
+// AddFlags adds flags for the proxy to the specified FlagSet
+func (o *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Kubeconfig, "kubeconfig", o.Kubeconfig, "Path to a kubeconfig file pointing at the cluster where external-crd runs. Only required if out-of-cluster.")
+	fs.StringVar(&o.SystemNamespace, "system-namespace", o.SystemNamespace, "The namespace holding the tenant registrations and tokens")
+	fs.StringVar(&o.BaseHost, "proxy-base-host", o.BaseHost, "The base domain of the proxy, tenants are served at <namespace>-<cluster>.<base>")
+	fs.IPVar(&o.BindAddress, "bind-address", o.BindAddress, "The IP address on which to listen for the --secure-port port")
+	fs.IntVar(&o.SecurePort, "secure-port", o.SecurePort, "The port on which to serve HTTPS")
+	fs.StringVar(&o.TLSCertFile, "tls-cert-file", o.TLSCertFile, "File containing the fallback serving certificate for hostnames without certificates issued by external-crd, a self-signed one for *.<base> is generated if not specified")
+	fs.StringVar(&o.TLSPrivateKeyFile, "tls-private-key-file", o.TLSPrivateKeyFile, "File containing the private key matching --tls-cert-file")
+	fs.StringVar(&o.OverlayServer, "overlay-server", o.OverlayServer, "The URL of external-crd, where the API groups it serves are routed to")
+	fs.StringVar(&o.OverlayCAFile, "overlay-ca-file", o.OverlayCAFile, "Path to the CA bundle to verify external-crd with, empty to skip verification")
+	fs.DurationVar(&o.DiscoveryRefreshPeriod, "discovery-refresh-period", o.DiscoveryRefreshPeriod, "The interval to refresh the API groups served by external-crd for each tenant")
+}
+
+// Validate validates Options
+func (o *Options) Validate() error {
+	errors := []error{}
+	if len(o.BaseHost) == 0 {
+		errors = append(errors, fmt.Errorf("--proxy-base-host must be specified"))
+	}
+	if o.SecurePort <= 0 || o.SecurePort > 65535 {
+		errors = append(errors, fmt.Errorf("--secure-port %d must be between 1 and 65535", o.SecurePort))
+	}
+	if (len(o.TLSCertFile) == 0) != (len(o.TLSPrivateKeyFile) == 0) {
+		errors = append(errors, fmt.Errorf("--tls-cert-file and --tls-private-key-file must be specified together"))
+	}
+	if u, err := url.Parse(o.OverlayServer); err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+		errors = append(errors, fmt.Errorf("--overlay-server %q must be an https URL", o.OverlayServer))
+	}
+	if o.DiscoveryRefreshPeriod <= 0 {
+		errors = append(errors, fmt.Errorf("--discovery-refresh-period must be positive"))
+	}
+	return utilerrors.NewAggregate(errors)
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	utilproxy "k8s.io/apimachinery/pkg/util/proxy"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	certutil "k8s.io/client-go/util/cert"
+	componentbaseconfig "k8s.io/component-base/config"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// Proxy is the front proxy of tenants. Each tenant is served at "<namespace>-<cluster>.<base>", authenticated with
+// the credentials of its business cluster. Requests to the API groups external-crd serves for the tenant are sent to
+// external-crd with the token of the tenant identity, while the others are sent to the business apiserver.
+// The API groups discovered by tenants are merged from both.
+type Proxy struct {
+	baseHost string
+	tenants  *tenantTable
+
+	// external-crd, serving the overlay group and the original groups of the CRDs exposed
+	overlay       *upstream
+	overlayConfig *rest.Config
+
+	informerFactory        informers.SharedInformerFactory
+	discoveryRefreshPeriod time.Duration
+
+	address string
+	// serving certificates issued by external-crd for the hostnames of tenants
+	servingCertificates *servingCertificates
+	// the fallback serving certificate, for hostnames without one issued
+	certificate tls.Certificate
+}
+
+// NewProxy returns a Proxy configured with opts
+func NewProxy(opts *Options) (*Proxy, error) {
+	hostConfig, err := utils.LoadsKubeConfig(&componentbaseconfig.ClientConnectionConfiguration{Kubeconfig: opts.Kubeconfig})
+	if err != nil {
+		return nil, err
+	}
+	kubeClient, err := kubernetes.NewForConfig(hostConfig)
+	if err != nil {
+		return nil, err
+	}
+	overlayConfig := &rest.Config{
+		Host: opts.OverlayServer,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure: len(opts.OverlayCAFile) == 0,
+			CAFile:   opts.OverlayCAFile,
+		},
+	}
+	overlay, err := newUpstream(overlayConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := loadServingCertificate(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(kubeClient, utils.DefaultResync,
+		informers.WithNamespace(opts.SystemNamespace))
+	p := &Proxy{
+		baseHost: opts.BaseHost,
+		tenants: newTenantTable(opts.SystemNamespace, informerFactory.Core().V1().ConfigMaps(),
+			informerFactory.Core().V1().Secrets()),
+		overlay:                overlay,
+		overlayConfig:          overlayConfig,
+		informerFactory:        informerFactory,
+		discoveryRefreshPeriod: opts.DiscoveryRefreshPeriod,
+		address:                net.JoinHostPort(opts.BindAddress.String(), strconv.Itoa(opts.SecurePort)),
+		servingCertificates: &servingCertificates{
+			systemNamespace: opts.SystemNamespace,
+			baseHost:        opts.BaseHost,
+			lister:          informerFactory.Core().V1().Secrets().Lister(),
+		},
+		certificate: certificate,
+	}
+	p.tenants.onChange = func(tenants []*tenant) {
+		for _, t := range tenants {
+			go p.refreshOverlayGroups(t)
+		}
+	}
+	return p, nil
+}
+
+func loadServingCertificate(opts *Options) (tls.Certificate, error) {
+	if len(opts.TLSCertFile) > 0 {
+		return tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSPrivateKeyFile)
+	}
+	klog.Warningf("no serving certificate specified, generating a self-signed one for *.%s", opts.BaseHost)
+	wildcard := "*." + opts.BaseHost
+	cert, key, err := certutil.GenerateSelfSignedCertKey(wildcard, nil, []string{wildcard})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(cert, key)
+}
+
+// Run serves tenants until ctx is done
+func (p *Proxy) Run(ctx context.Context) error {
+	p.informerFactory.Start(ctx.Done())
+	if !cache.WaitForNamedCacheSync("tenant-proxy", ctx.Done(), p.tenants.synced...) {
+		return fmt.Errorf("failed to wait for tenant registrations to be synced")
+	}
+	p.tenants.reload()
+	go wait.UntilWithContext(ctx, func(context.Context) {
+		for _, t := range p.tenants.list() {
+			p.refreshOverlayGroups(t)
+		}
+	}, p.discoveryRefreshPeriod)
+
+	server := &http.Server{
+		Addr:    p.address,
+		Handler: p,
+		TLSConfig: &tls.Config{
+			GetCertificate: p.getCertificate,
+			// tenants registered with client certificates present them to us, which are matched against the registrations
+			ClientAuth: tls.RequestClientCert,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			klog.Errorf("failed to shut down proxy: %v", err)
+		}
+	}()
+
+	klog.Infof("serving tenants at *.%s on %s", p.baseHost, p.address)
+	if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// getCertificate serves the certificate issued for the hostname the client asks for, falling back to the one configured
+func (p *Proxy) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := p.servingCertificates.get(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return &p.certificate, nil
+}
+
+// refreshOverlayGroups discovers the API groups external-crd serves for t, with the token of its identity
+func (p *Proxy) refreshOverlayGroups(t *tenant) {
+	config := rest.CopyConfig(p.overlayConfig)
+	config.BearerToken = t.crdToken
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	groupList, err := client.ServerGroups()
+	if err != nil {
+		// keep routing with the groups known
+		klog.Errorf("failed to discover the API groups served for tenant %s: %v", t.key(), err)
+		return
+	}
+
+	t.setOverlayGroups(groupList)
+	if klog.V(5).Enabled() {
+		var groupVersions []string
+		for _, group := range groupList.Groups {
+			groupVersions = append(groupVersions, group.PreferredVersion.GroupVersion)
+		}
+		klog.Infof("API groups served by external-crd for tenant %s: %v", t.key(), groupVersions)
+	}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	t := p.tenantFor(req)
+	if t == nil {
+		writeStatus(w, apierrors.NewNotFound(schema.GroupResource{Resource: utils.TenantResource}, req.Host))
+		return
+	}
+	if !t.authenticate(req) {
+		writeStatus(w, apierrors.NewUnauthorized("Unauthorized"))
+		return
+	}
+
+	if req.Method == http.MethodGet && strings.TrimSuffix(req.URL.Path, "/") == "/apis" {
+		p.serveMergedGroups(w, req, t)
+		return
+	}
+	if group, version := apiGroupVersionOf(req.URL.Path); req.Method == http.MethodGet && len(group) > 0 && len(version) == 0 &&
+		serveMergedGroup(w, t, group) {
+		return
+	}
+
+	target, token := p.route(t, req.URL.Path)
+	location := *target.url
+	location.Path = strings.TrimSuffix(location.Path, "/") + req.URL.Path
+	location.RawQuery = req.URL.RawQuery
+
+	upstreamReq := req.WithContext(req.Context())
+	upstreamReq.Header = utilnet.CloneHeader(req.Header)
+	// swap the credentials of the business cluster for those of the upstream
+	upstreamReq.Header.Del("Authorization")
+	if len(token) > 0 {
+		upstreamReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	handler := utilproxy.NewUpgradeAwareHandler(&location, target.transport, false, false, &responder{tenant: t.key()})
+	handler.UseLocationHost = true
+	handler.ServeHTTP(w, upstreamReq)
+}
+
+// tenantFor returns the tenant served at the host of req, falling back to the server name the client asked for
+func (p *Proxy) tenantFor(req *http.Request) *tenant {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t := p.tenants.get(strings.SplitN(host, ".", 2)[0]); t != nil {
+		return t
+	}
+	if req.TLS != nil && len(req.TLS.ServerName) > 0 {
+		return p.tenants.get(strings.SplitN(req.TLS.ServerName, ".", 2)[0])
+	}
+	return nil
+}
+
+// route returns where a request of t to requestPath goes, and the token to authenticate with. Group versions served
+// by external-crd go there, as well as the documents of groups only served by external-crd.
+func (p *Proxy) route(t *tenant, requestPath string) (*upstream, string) {
+	group, version := apiGroupVersionOf(requestPath)
+	switch {
+	case len(group) == 0:
+	case len(version) > 0 && t.servesOverlayGroupVersion(group+"/"+version),
+		len(version) == 0 && t.servesOverlayGroup(group):
+		return p.overlay, t.crdToken
+	}
+	// the business upstream authenticates with client certificates itself, if registered with them
+	return t.business, t.registration.APIServer.Token
+}
+
+// apiGroupVersionOf returns the API group and version in a path like "/apis/<group>/<version>/...", empty for the
+// others. The version is empty for the documents of groups.
+func apiGroupVersionOf(requestPath string) (string, string) {
+	if !strings.HasPrefix(requestPath, "/apis/") {
+		return "", ""
+	}
+	segments := strings.SplitN(strings.Trim(strings.TrimPrefix(requestPath, "/apis/"), "/"), "/", 3)
+	if len(segments) == 1 {
+		return segments[0], ""
+	}
+	return segments[0], segments[1]
+}
+
+type responder struct {
+	tenant string
+}
+
+func (r *responder) Error(w http.ResponseWriter, req *http.Request, err error) {
+	klog.Errorf("failed to proxy %s %s for tenant %s: %v", req.Method, req.URL.Path, r.tenant, err)
+	writeStatus(w, apierrors.NewServiceUnavailable(err.Error()))
+}
+
+func writeStatus(w http.ResponseWriter, err *apierrors.StatusError) {
+	status := err.Status()
+	status.Kind, status.APIVersion = "Status", "v1"
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	if err := json.NewEncoder(w).Encode(&status); err != nil {
+		klog.Errorf("failed to write response: %v", err)
+	}
+}
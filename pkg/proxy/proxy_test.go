@@ -0,0 +1,246 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	certutil "k8s.io/client-go/util/cert"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// newTestUpstream returns a TLS server answering with its name and the token it received,
+// which lists groups in "/apis" to the requests with token
+func newTestUpstream(t *testing.T, name, token string, groups ...metav1.APIGroup) (*httptest.Server, *upstream) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api" {
+			http.NotFound(w, req)
+			return
+		}
+		if req.URL.Path == "/apis" {
+			if req.Header.Get("Authorization") != "Bearer "+token {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(&metav1.APIGroupList{
+				TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+				Groups:   groups,
+			})
+			return
+		}
+		w.Header().Set("X-Upstream", name)
+		w.Header().Set("X-Authorization", req.Header.Get("Authorization"))
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := newUpstream(&rest.Config{Host: server.URL, TLSClientConfig: rest.TLSClientConfig{Insecure: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, u
+}
+
+func TestProxy(t *testing.T) {
+	istio := func(version string) metav1.APIGroup {
+		groupVersion := metav1.GroupVersionForDiscovery{GroupVersion: "networking.istio.io/" + version, Version: version}
+		return metav1.APIGroup{Name: "networking.istio.io", Versions: []metav1.GroupVersionForDiscovery{groupVersion}, PreferredVersion: groupVersion}
+	}
+	overlayVersion := metav1.GroupVersionForDiscovery{GroupVersion: "overlay.k8s.jijiechen.com/v1alpha1", Version: "v1alpha1"}
+	overlayServer, overlay := newTestUpstream(t, "overlay", "crd-token", metav1.APIGroup{Name: "overlay.k8s.jijiechen.com",
+		Versions: []metav1.GroupVersionForDiscovery{overlayVersion}, PreferredVersion: overlayVersion}, istio("v1beta1"))
+	businessServer, _ := newTestUpstream(t, "business", "business-token", metav1.APIGroup{Name: "apps"}, istio("v1alpha3"),
+		metav1.APIGroup{Name: "batch"})
+
+	businessHost, businessPort, _ := net.SplitHostPort(businessServer.Listener.Addr().String())
+	port, _ := strconv.Atoi(businessPort)
+	registration, _ := json.Marshal(&business.Registration{
+		ClusterID: "cls-foo",
+		Namespace: "ns-bar",
+		APIServer: business.APIServer{Host: businessHost, HTTPSPort: port, Token: "business-token",
+			CertificateAuthorityData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: businessServer.Certificate().Raw})},
+	})
+	// business apiservers are verified, unless registered to skip verification explicitly
+	unverified, _ := json.Marshal(&business.Registration{
+		ClusterID: "cls-foo",
+		Namespace: "ns-baz",
+		APIServer: business.APIServer{Host: businessHost, HTTPSPort: port, Token: "business-token"},
+	})
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.BusinessConfigMapName, Namespace: utils.KcrdSystemNamespace},
+		Data: map[string]string{
+			business.ConfigKey("cls-foo", "ns-bar"): string(registration),
+			business.ConfigKey("cls-foo", "ns-baz"): string(unverified),
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.BusinessTokenSecretName, Namespace: utils.KcrdSystemNamespace},
+		Data: map[string][]byte{
+			business.TokenKey("cls-foo", "ns-bar"): []byte("crd-token"),
+			business.TokenKey("cls-foo", "ns-baz"): []byte("crd-token"),
+		},
+	}
+	tenantHostname := business.Hostname("cls-foo", "ns-bar", utils.DefaultProxyBaseHost)
+	servingCert, servingKey, _ := certutil.GenerateSelfSignedCertKey(tenantHostname, nil, nil)
+	servingCerts := business.NewServingCertSecret(utils.KcrdSystemNamespace, business.HostLabel("cls-foo", "ns-bar"),
+		business.ServingCertificate{Cert: servingCert, Key: servingKey})
+	kubeClient := fake.NewSimpleClientset(cm, secret, servingCerts)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	p := &Proxy{
+		baseHost: utils.DefaultProxyBaseHost,
+		tenants: newTenantTable(utils.KcrdSystemNamespace, informerFactory.Core().V1().ConfigMaps(),
+			informerFactory.Core().V1().Secrets()),
+		overlay:       overlay,
+		overlayConfig: &rest.Config{Host: overlayServer.URL, TLSClientConfig: rest.TLSClientConfig{Insecure: true}},
+		servingCertificates: &servingCertificates{
+			systemNamespace: utils.KcrdSystemNamespace,
+			baseHost:        utils.DefaultProxyBaseHost,
+			lister:          informerFactory.Core().V1().Secrets().Lister(),
+		},
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	informerFactory.WaitForCacheSync(stopCh)
+	p.tenants.reload()
+
+	tenantHost := tenantHostname + ":443"
+	p.refreshOverlayGroups(p.tenants.get(business.HostLabel("cls-foo", "ns-bar")))
+
+	// tenants are served with the certificates issued for them, the others with the fallback one
+	for serverName, issued := range map[string]bool{
+		tenantHostname: true,
+		"ns-baz-cls-foo." + utils.DefaultProxyBaseHost: false,
+		"localhost": false,
+	} {
+		cert, err := p.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cert != &p.certificate; got != issued {
+			t.Errorf("%s: expect the certificate issued to be served: %t, got %t", serverName, issued, got)
+		}
+	}
+
+	serve := func(host, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	if code := serve("ns-baz-cls-foo."+utils.DefaultProxyBaseHost, "/api/v1/pods", "business-token").Code; code != http.StatusNotFound {
+		t.Errorf("expect tenants without CA bundles of their business apiservers to get 404, got %d", code)
+	}
+	if code := serve(tenantHost, "/api/v1/pods", "crd-token").Code; code != http.StatusUnauthorized {
+		t.Errorf("expect requests without the business credentials to get 401, got %d", code)
+	}
+
+	tests := []struct {
+		path          string
+		upstream      string
+		authorization string
+	}{
+		{path: "/apis/networking.istio.io/v1beta1/namespaces/ns-bar/gateways", upstream: "overlay", authorization: "Bearer crd-token"},
+		{path: "/apis/networking.istio.io/v1alpha3/namespaces/ns-bar/gateways", upstream: "business", authorization: "Bearer business-token"},
+		{path: "/apis/overlay.k8s.jijiechen.com", upstream: "overlay", authorization: "Bearer crd-token"},
+		{path: "/apis/apps/v1/namespaces/ns-bar/deployments", upstream: "business", authorization: "Bearer business-token"},
+		{path: "/api/v1/namespaces/ns-bar/pods", upstream: "business", authorization: "Bearer business-token"},
+	}
+	for _, tt := range tests {
+		recorder := serve(tenantHost, tt.path, "business-token")
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: got %d: %s", tt.path, recorder.Code, recorder.Body.String())
+			continue
+		}
+		if got := recorder.Header().Get("X-Upstream"); got != tt.upstream {
+			t.Errorf("%s: expect to be routed to %s, got %s", tt.path, tt.upstream, got)
+		}
+		if got := recorder.Header().Get("X-Authorization"); got != tt.authorization {
+			t.Errorf("%s: expect to be authenticated with %q, got %q", tt.path, tt.authorization, got)
+		}
+	}
+
+	// the API groups of the business cluster are listed with those served by external-crd taking their places
+	recorder := serve(tenantHost, "/apis", "business-token")
+	groupList := &metav1.APIGroupList{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), groupList); err != nil {
+		t.Fatalf("invalid discovery document %s: %v", recorder.Body.String(), err)
+	}
+	var groups []string
+	for _, group := range groupList.Groups {
+		groups = append(groups, group.Name+"/"+group.PreferredVersion.Version)
+	}
+	if want := []string{"apps/", "networking.istio.io/v1beta1", "batch/", "overlay.k8s.jijiechen.com/v1alpha1"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("expect API groups %v, got %v", want, groups)
+	}
+
+	// versions of groups served by both are merged, in "/apis" as well as in the documents of the groups
+	wantVersions := []string{"v1beta1", "v1alpha3"}
+	versionsOf := func(group metav1.APIGroup) []string {
+		var versions []string
+		for _, version := range group.Versions {
+			versions = append(versions, version.Version)
+		}
+		return versions
+	}
+	if got := versionsOf(groupList.Groups[1]); !reflect.DeepEqual(got, wantVersions) {
+		t.Errorf("expect versions %v of networking.istio.io in /apis, got %v", wantVersions, got)
+	}
+	recorder = serve(tenantHost, "/apis/networking.istio.io", "business-token")
+	apiGroup := metav1.APIGroup{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &apiGroup); err != nil {
+		t.Fatalf("invalid group document %s: %v", recorder.Body.String(), err)
+	}
+	if got := versionsOf(apiGroup); apiGroup.Kind != "APIGroup" || !reflect.DeepEqual(got, wantVersions) {
+		t.Errorf("expect versions %v of networking.istio.io in its document, got %v", wantVersions, recorder.Body.String())
+	}
+
+	// tenants are offboarded without restarts
+	cm = cm.DeepCopy()
+	cm.Data = map[string]string{}
+	if _, err := kubeClient.CoreV1().ConfigMaps(utils.KcrdSystemNamespace).Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return serve(tenantHost, "/api/v1/pods", "business-token").Code == http.StatusNotFound, nil
+	}); err != nil {
+		t.Errorf("expect the offboarded tenant to be no longer served")
+	}
+}
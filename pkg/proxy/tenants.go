@@ -0,0 +1,340 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/jijiechen/external-crd/pkg/business"
+	"github.com/jijiechen/external-crd/pkg/utils"
+)
+
+// upstream is where requests are proxied to
+type upstream struct {
+	url       *url.URL
+	transport http.RoundTripper
+}
+
+// newUpstream builds an upstream from config, whose credentials other than client certificates are ignored
+func newUpstream(config *rest.Config) (*upstream, error) {
+	u, err := url.Parse(config.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid upstream %q", config.Host)
+	}
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+	return &upstream{
+		url:       u,
+		transport: utilnet.SetTransportDefaults(&http.Transport{TLSClientConfig: tlsConfig}),
+	}, nil
+}
+
+// tenant is a registration ready to be proxied
+type tenant struct {
+	registration *business.Registration
+	// the token of the tenant identity in external-crd
+	crdToken string
+
+	// the business apiserver, authenticated with the credentials of the registration
+	business *upstream
+	// DER of the client certificate registered, if any
+	clientCert []byte
+
+	lock sync.RWMutex
+	// API group versions served by external-crd for this tenant, such as "networking.istio.io/v1beta1"
+	overlayGroupVersions sets.String
+	// API groups served by both external-crd and the business cluster, with their versions merged
+	mergedGroups map[string]metav1.APIGroup
+}
+
+func newTenant(registration *business.Registration, crdToken string) (*tenant, error) {
+	if err := registration.APIServer.ValidateTLS(); err != nil {
+		return nil, err
+	}
+	config := registration.APIServer.RESTConfig()
+	config.BearerToken = ""
+	businessUpstream, err := newUpstream(config)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tenant{
+		registration:         registration,
+		crdToken:             crdToken,
+		business:             businessUpstream,
+		overlayGroupVersions: sets.NewString(),
+		mergedGroups:         map[string]metav1.APIGroup{},
+	}
+	if data := registration.APIServer.ClientCertificateData; len(data) > 0 {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid client certificate")
+		}
+		t.clientCert = block.Bytes
+	}
+	return t, nil
+}
+
+// authenticate tells whether req carries the credentials of the business cluster registered by the tenant
+func (t *tenant) authenticate(req *http.Request) bool {
+	if token := t.registration.APIServer.Token; len(token) > 0 {
+		if presented, ok := bearerToken(req); ok && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+			return true
+		}
+	}
+	if len(t.clientCert) > 0 && req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return bytes.Equal(req.TLS.PeerCertificates[0].Raw, t.clientCert)
+	}
+	return false
+}
+
+// servesOverlayGroupVersion tells whether external-crd serves groupVersion for t
+func (t *tenant) servesOverlayGroupVersion(groupVersion string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.overlayGroupVersions.Has(groupVersion)
+}
+
+// servesOverlayGroup tells whether external-crd serves any version of group for t
+func (t *tenant) servesOverlayGroup(group string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for groupVersion := range t.overlayGroupVersions {
+		if strings.HasPrefix(groupVersion, group+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mergedGroup returns group with the versions of both external-crd and the business cluster, if served by both
+func (t *tenant) mergedGroup(group string) (metav1.APIGroup, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	apiGroup, ok := t.mergedGroups[group]
+	return apiGroup, ok
+}
+
+// setOverlayGroups records the group versions external-crd serves for t from groups
+func (t *tenant) setOverlayGroups(groups *metav1.APIGroupList) {
+	groupVersions := sets.NewString()
+	for _, group := range groups.Groups {
+		if len(group.Name) == 0 {
+			continue
+		}
+		for _, version := range group.Versions {
+			groupVersions.Insert(version.GroupVersion)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.overlayGroupVersions = groupVersions
+}
+
+func (t *tenant) setMergedGroups(groups map[string]metav1.APIGroup) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.mergedGroups = groups
+}
+
+func (t *tenant) key() string {
+	return utils.TenantKey(t.registration.ClusterID, t.registration.Namespace)
+}
+
+func bearerToken(req *http.Request) (string, bool) {
+	parts := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") || len(parts[1]) == 0 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// tenantTable keeps the tenants to proxy up to date with the registrations in ConfigMap utils.BusinessConfigMapName
+// and the tokens in Secret utils.BusinessTokenSecretName, so that tenants are added or removed without restarts.
+type tenantTable struct {
+	systemNamespace string
+
+	configMapLister corelisters.ConfigMapLister
+	secretLister    corelisters.SecretLister
+	synced          []cache.InformerSynced
+
+	lock sync.RWMutex
+	// keyed by the leading label of the hostname, which is "<namespace>-<cluster>"
+	tenants map[string]*tenant
+	// called with the tenants added or whose credentials have changed
+	onChange func([]*tenant)
+}
+
+func newTenantTable(systemNamespace string, configMapInformer coreinformers.ConfigMapInformer,
+	secretInformer coreinformers.SecretInformer) *tenantTable {
+	tt := &tenantTable{
+		systemNamespace: systemNamespace,
+		configMapLister: configMapInformer.Lister(),
+		secretLister:    secretInformer.Lister(),
+		synced:          []cache.InformerSynced{configMapInformer.Informer().HasSynced, secretInformer.Informer().HasSynced},
+		tenants:         map[string]*tenant{},
+	}
+
+	handler := cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			switch o := obj.(type) {
+			case *corev1.ConfigMap:
+				return o.Namespace == systemNamespace && o.Name == utils.BusinessConfigMapName
+			case *corev1.Secret:
+				return o.Namespace == systemNamespace && o.Name == utils.BusinessTokenSecretName
+			}
+			return false
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: func(interface{}) { tt.reload() },
+			UpdateFunc: func(interface{}, interface{}) {
+				tt.reload()
+			},
+			DeleteFunc: func(interface{}) { tt.reload() },
+		},
+	}
+	configMapInformer.Informer().AddEventHandler(handler)
+	secretInformer.Informer().AddEventHandler(handler)
+	return tt
+}
+
+// get returns the tenant served at the hostname whose leading label is label
+func (tt *tenantTable) get(label string) *tenant {
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	return tt.tenants[label]
+}
+
+func (tt *tenantTable) list() []*tenant {
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	tenants := make([]*tenant, 0, len(tt.tenants))
+	for _, t := range tt.tenants {
+		tenants = append(tenants, t)
+	}
+	return tenants
+}
+
+func (tt *tenantTable) reload() {
+	var registrations []*business.Registration
+	cm, err := tt.configMapLister.ConfigMaps(tt.systemNamespace).Get(utils.BusinessConfigMapName)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		klog.Errorf("failed to get tenant registrations: %v", err)
+		return
+	default:
+		registrations, err = business.ParseRegistrations(cm)
+		if err != nil {
+			// keep serving current tenants
+			klog.Errorf("failed to parse tenant registrations: %v", err)
+			return
+		}
+	}
+	tokens := map[string][]byte{}
+	secret, err := tt.secretLister.Secrets(tt.systemNamespace).Get(utils.BusinessTokenSecretName)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		klog.Errorf("failed to get tenant tokens: %v", err)
+		return
+	default:
+		tokens = secret.Data
+	}
+
+	tt.lock.Lock()
+	var changed []*tenant
+	tenants := map[string]*tenant{}
+	for _, registration := range registrations {
+		key := utils.TenantKey(registration.ClusterID, registration.Namespace)
+		registration.LoadCredentials(tokens)
+		crdToken := business.CRDToken(registration, tokens)
+		if len(crdToken) == 0 {
+			klog.Warningf("no token found for tenant %s, skipping", key)
+			continue
+		}
+
+		label := business.HostLabel(registration.ClusterID, registration.Namespace)
+		if existing, ok := tenants[label]; ok {
+			klog.Warningf("tenant %s is served at the same hostname as tenant %s, skipping", key, existing.key())
+			continue
+		}
+		if previous, ok := tt.tenants[label]; ok && previous.crdToken == crdToken &&
+			reflect.DeepEqual(previous.registration, registration) {
+			tenants[label] = previous
+			continue
+		}
+		t, err := newTenant(registration, crdToken)
+		if err != nil {
+			klog.Errorf("failed to load tenant %s: %v", key, err)
+			continue
+		}
+		if previous, ok := tt.tenants[label]; ok {
+			// keep routing with the groups known, until they are refreshed with the new credentials
+			previous.lock.RLock()
+			t.overlayGroupVersions = previous.overlayGroupVersions
+			t.mergedGroups = previous.mergedGroups
+			previous.lock.RUnlock()
+		}
+		tenants[label] = t
+		changed = append(changed, t)
+	}
+	for label, previous := range tt.tenants {
+		if _, ok := tenants[label]; !ok {
+			klog.Infof("tenant %s is no longer served", previous.key())
+		}
+	}
+	tt.tenants = tenants
+	onChange := tt.onChange
+	tt.lock.Unlock()
+
+	for _, t := range changed {
+		klog.Infof("tenant %s is loaded", t.key())
+	}
+	if onChange != nil && len(changed) > 0 {
+		onChange(changed)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"sort"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/version"
 	"k8s.io/client-go/restmapper"
 )
@@ -69,3 +70,27 @@ func NormalizeAPIGroupResources(apiGroupResource *restmapper.APIGroupResources)
 	}
 	return normalizedVersionResources
 }
+
+// SelectAPIResources returns the resources of groupResources, such as "configmaps" or "leases.coordination.k8s.io",
+// with preferred version or highest semantic version, and the ones not found in apiGroupResources.
+// Resources are returned in the order of groupResources.
+func SelectAPIResources(apiGroupResources []*restmapper.APIGroupResources, groupResources []string) ([]metav1.APIResource, []string) {
+	found := map[schema.GroupResource]metav1.APIResource{}
+	for _, apiGroupResource := range apiGroupResources {
+		for _, apiResource := range NormalizeAPIGroupResources(apiGroupResource) {
+			found[schema.GroupResource{Group: apiResource.Group, Resource: apiResource.Name}] = apiResource
+		}
+	}
+
+	var selected []metav1.APIResource
+	var missing []string
+	for _, groupResource := range groupResources {
+		apiResource, ok := found[schema.ParseGroupResource(groupResource)]
+		if !ok {
+			missing = append(missing, groupResource)
+			continue
+		}
+		selected = append(selected, apiResource)
+	}
+	return selected, missing
+}
@@ -251,3 +251,41 @@ func TestNormalizeAPIGroupResources(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectAPIResources(t *testing.T) {
+	apiGroupResources := []*restmapper.APIGroupResources{
+		{
+			Group: metav1.APIGroup{
+				PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "v1", Version: "v1"},
+			},
+			VersionedResources: map[string][]metav1.APIResource{
+				"v1": {
+					{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"},
+					{Name: "events", Namespaced: true, Kind: "Event"},
+				},
+			},
+		},
+		{
+			Group: metav1.APIGroup{
+				Name:             "coordination.k8s.io",
+				PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "coordination.k8s.io/v1", Version: "v1"},
+			},
+			VersionedResources: map[string][]metav1.APIResource{
+				"v1":      {{Name: "leases", Namespaced: true, Kind: "Lease"}},
+				"v1beta1": {{Name: "leases", Namespaced: true, Kind: "Lease"}},
+			},
+		},
+	}
+
+	selected, missing := SelectAPIResources(apiGroupResources, []string{"leases.coordination.k8s.io", "configmaps", "leases", "secrets"})
+	want := []metav1.APIResource{
+		{Name: "leases", Namespaced: true, Group: "coordination.k8s.io", Version: "v1", Kind: "Lease"},
+		{Name: "configmaps", Namespaced: true, Group: "", Version: "v1", Kind: "ConfigMap"},
+	}
+	if !reflect.DeepEqual(selected, want) {
+		t.Errorf("SelectAPIResources() selected = %#v, want %#v", selected, want)
+	}
+	if !reflect.DeepEqual(missing, []string{"leases", "secrets"}) {
+		t.Errorf("SelectAPIResources() missing = %v, want [leases secrets]", missing)
+	}
+}
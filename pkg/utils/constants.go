@@ -32,6 +32,28 @@ const (
 	// DefaultResync means the default resync time
 	DefaultResync = time.Hour * 12
 
+	// DefaultTenantGCGracePeriod is how long the manifests of an offboarded tenant are kept
+	DefaultTenantGCGracePeriod = time.Hour * 24
+	// DefaultTenantTokenExpiration is the default lifetime of the tokens minted for tenant identities
+	DefaultTenantTokenExpiration = time.Hour * 24
+	// DefaultTenantScanPeriod is the interval to look for manifests of tenants without registrations
+	DefaultTenantScanPeriod = time.Hour
+	// DefaultTenantCRDSyncPeriod is the default interval to reload the CRDs of tenants
+	DefaultTenantCRDSyncPeriod = time.Minute
+	// DefaultProxyServingCertValidity is the default lifetime of the serving certificates issued for the apiserver proxy
+	DefaultProxyServingCertValidity = time.Hour * 24 * 30
+	// ProxyCAValidity is the lifetime of the CA issuing serving certificates for the apiserver proxy
+	ProxyCAValidity = time.Hour * 24 * 365 * 10
+	// DefaultProxyDiscoveryRefreshPeriod is the default interval for the proxy to refresh the API groups served to tenants
+	DefaultProxyDiscoveryRefreshPeriod = time.Minute
+	// DefaultWatchCacheSize is the default number of the recent Manifest events kept for tenant watches to resume from
+	DefaultWatchCacheSize = 1000
+
+	// CRDSourceHost serves the CRDs installed in the host cluster to all the tenants
+	CRDSourceHost = "host"
+	// CRDSourceTenant serves each tenant with the CRDs from its bundle or its business cluster
+	CRDSourceTenant = "tenant"
+
 	Category = "external-crd"
 
 	ObjectCreatedByLabel = "k8s.jijiechen.com/created-by"
@@ -43,6 +65,44 @@ const (
 	ConfigNameLabel      = "k8s.jijiechen.com/config.name"
 	ConfigNamespaceLabel = "k8s.jijiechen.com/config.namespace"
 	ConfigClusterLabel   = "k8s.jijiechen.com/config.cluster"
+	// ConfigNameAnnotation keeps the full name of the object, as ConfigNameLabel is shortened for long names
+	ConfigNameAnnotation = "k8s.jijiechen.com/config.name"
+
+	// SyncedFromBusinessLabel marks the objects mirrored from business clusters, which are read-only for tenants
+	SyncedFromBusinessLabel = "k8s.jijiechen.com/synced-from-business"
+	// VirtualCRDLabel marks the CRDs registered by tenants in their overlay views, which are not installed in any cluster
+	VirtualCRDLabel = "k8s.jijiechen.com/virtual-crd"
 
 	ExternalCrdAppName = "external-crd"
+
+	// labels on the service accounts that register a tenant (a namespace in a business cluster)
+	TenantClusterLabel   = "k8s.jijiechen.com/cluster"
+	TenantNamespaceLabel = "k8s.jijiechen.com/namespace"
+
+	// BusinessConfigMapName is the ConfigMap in the system namespace holding the tenant registrations for the apiserver proxy
+	BusinessConfigMapName = "apiserver-proxy-business-config"
+	// BusinessTokenSecretName is the Secret in the system namespace holding the tokens of tenant identities for the apiserver proxy
+	BusinessTokenSecretName = "apiserver-proxy-business-tokens"
+	// ProxyCASecretName is the Secret in the system namespace holding the CA that issues serving certificates for the apiserver proxy
+	ProxyCASecretName = "apiserver-proxy-ca"
+	// ProxyServingCertSecretName prefixes the Secrets in the system namespace holding the serving certificates of the
+	// apiserver proxy, one for each tenant. Earlier versions kept all of them in the Secret with this name.
+	ProxyServingCertSecretName = "apiserver-proxy-serving-certs"
+	// ProxyServingCertLabel is set on the Secrets holding the serving certificates of the apiserver proxy
+	ProxyServingCertLabel = "k8s.jijiechen.com/proxy-serving-cert"
+	// ProxyDeploymentName is the default name of the apiserver proxy Deployment
+	ProxyDeploymentName = "apiserver-proxy"
+	// TokensRotatedAtAnnotation is set on the pod template of the apiserver proxy to reload rotated tokens
+	TokensRotatedAtAnnotation = "k8s.jijiechen.com/tokens-rotated-at"
+	// DefaultProxyBaseHost is the default base domain of the apiserver proxy, tenants are served at "<namespace>-<cluster>.<base>"
+	DefaultProxyBaseHost = "kube-api-server.external-crd.com"
+
+	// ImpersonateTenantExtraKey is the user extra key that platform administrators set (e.g. with
+	// "kubectl --as=<admin> --as-user-extra=k8s.jijiechen.com/impersonate-tenant=<cluster>/<namespace>")
+	// to act as a tenant. The value is "<cluster-id>/<namespace>".
+	ImpersonateTenantExtraKey = "k8s.jijiechen.com/impersonate-tenant"
+	// ImpersonatedTenantAuditAnnotation records the impersonated tenant alongside the real user in audit events
+	ImpersonatedTenantAuditAnnotation = "k8s.jijiechen.com/impersonated-tenant"
+	// TenantResource is the virtual resource checked with verb "impersonate" before a tenant can be impersonated
+	TenantResource = "tenants"
 )
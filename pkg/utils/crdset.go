@@ -0,0 +1,238 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	apiextensionshelpers "k8s.io/apiextensions-apiserver/pkg/apihelpers"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// TenantCRDSet keeps the CRDs of each tenant, and notifies handlers of the changes of the CRDs of all the tenants,
+// where a CRD is listed once per storage version in use.
+type TenantCRDSet struct {
+	lock sync.RWMutex
+	// CRDs of each tenant, keyed by tenant key
+	tenantCRDs map[string][]*apiextensionsv1.CustomResourceDefinition
+	// CRDs of all the tenants, keyed by CRDKey
+	crds     map[string]*apiextensionsv1.CustomResourceDefinition
+	handlers []cache.ResourceEventHandler
+	synced   bool
+}
+
+// NewTenantCRDSet returns an empty TenantCRDSet
+func NewTenantCRDSet() *TenantCRDSet {
+	return &TenantCRDSet{
+		tenantCRDs: map[string][]*apiextensionsv1.CustomResourceDefinition{},
+		crds:       map[string]*apiextensionsv1.CustomResourceDefinition{},
+	}
+}
+
+// ForTenant returns the CRDs of a tenant
+func (s *TenantCRDSet) ForTenant(clusterID, namespace string) []*apiextensionsv1.CustomResourceDefinition {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tenantCRDs[TenantKey(clusterID, namespace)]
+}
+
+// List returns the CRDs of all the tenants
+func (s *TenantCRDSet) List() []*apiextensionsv1.CustomResourceDefinition {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return SortedCRDs(s.crds)
+}
+
+// AddEventHandler registers a handler notified of the changes of the CRDs returned by List.
+// The handler is notified of the current CRDs at once.
+func (s *TenantCRDSet) AddEventHandler(handler cache.ResourceEventHandler) {
+	s.lock.Lock()
+	s.handlers = append(s.handlers, handler)
+	s.lock.Unlock()
+
+	for _, crd := range s.List() {
+		handler.OnAdd(crd)
+	}
+}
+
+// HasSynced tells whether the CRDs have been set once
+func (s *TenantCRDSet) HasSynced() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.synced
+}
+
+// Set replaces the CRDs of all the tenants, which are keyed by tenant key, and notifies the handlers of the changes.
+// A resource is served to all the tenants by the same storage, so a CRD conflicting with that of another tenant
+// serving the same resource, such as with another scope, is left out with a warning.
+func (s *TenantCRDSet) Set(tenantCRDs map[string][]*apiextensionsv1.CustomResourceDefinition) {
+	// tenants are visited in order, so that the same CRD is always taken from the same tenant
+	var tenants []string
+	for key := range tenantCRDs {
+		tenants = append(tenants, key)
+	}
+	sort.Strings(tenants)
+	accepted := make(map[string][]*apiextensionsv1.CustomResourceDefinition, len(tenantCRDs))
+	// the CRDs taken for each served resource, keyed by "<group>/<version>/<plural>"
+	served := map[string]*apiextensionsv1.CustomResourceDefinition{}
+	var all []*apiextensionsv1.CustomResourceDefinition
+	for _, key := range tenants {
+		accepted[key] = []*apiextensionsv1.CustomResourceDefinition{}
+		for _, crd := range tenantCRDs[key] {
+			if reason := conflictingCRD(served, crd); len(reason) > 0 {
+				klog.Warningf("skip CRD %s of tenant %s: %s", crd.Name, key, reason)
+				continue
+			}
+			for _, version := range crd.Spec.Versions {
+				if version.Served {
+					served[servedResourceKey(crd, version.Name)] = crd
+				}
+			}
+			accepted[key] = append(accepted[key], crd)
+			all = append(all, crd)
+		}
+	}
+	crds := UniqueCRDs(all)
+
+	s.lock.Lock()
+	previous := s.crds
+	s.tenantCRDs = accepted
+	s.crds = crds
+	s.synced = true
+	handlers := append([]cache.ResourceEventHandler{}, s.handlers...)
+	s.lock.Unlock()
+
+	NotifyCRDChanges(previous, crds, handlers)
+}
+
+func servedResourceKey(crd *apiextensionsv1.CustomResourceDefinition, version string) string {
+	return crd.Spec.Group + "/" + version + "/" + crd.Spec.Names.Plural
+}
+
+// conflictingCRD tells why crd cannot be served by the storages of the CRDs already taken for the resources it
+// serves, which are keyed by servedResourceKey, an empty string if it can. Schemas may differ, as objects are
+// validated against the CRD of their own tenant.
+func conflictingCRD(served map[string]*apiextensionsv1.CustomResourceDefinition, crd *apiextensionsv1.CustomResourceDefinition) string {
+	for _, version := range crd.Spec.Versions {
+		if !version.Served {
+			continue
+		}
+		taken, ok := served[servedResourceKey(crd, version.Name)]
+		if !ok {
+			continue
+		}
+		switch {
+		case taken.Spec.Scope != crd.Spec.Scope:
+			return fmt.Sprintf("%s is served as %s already", version.Name, taken.Spec.Scope)
+		case taken.Spec.Names.Kind != crd.Spec.Names.Kind:
+			return fmt.Sprintf("%s is served with kind %s already", version.Name, taken.Spec.Names.Kind)
+		}
+		takenSubresources, _ := apiextensionshelpers.GetSubresourcesForVersion(taken, version.Name)
+		subresources, _ := apiextensionshelpers.GetSubresourcesForVersion(crd, version.Name)
+		if !reflect.DeepEqual(takenSubresources, subresources) {
+			return fmt.Sprintf("%s is served with other subresources already", version.Name)
+		}
+		takenColumns := printerColumns(taken, version.Name)
+		if (len(takenColumns) > 0 || len(version.AdditionalPrinterColumns) > 0) &&
+			!reflect.DeepEqual(takenColumns, version.AdditionalPrinterColumns) {
+			return fmt.Sprintf("%s is served with other printer columns already", version.Name)
+		}
+	}
+	return ""
+}
+
+func printerColumns(crd *apiextensionsv1.CustomResourceDefinition, version string) []apiextensionsv1.CustomResourceColumnDefinition {
+	for _, v := range crd.Spec.Versions {
+		if v.Name == version {
+			return v.AdditionalPrinterColumns
+		}
+	}
+	return nil
+}
+
+// CRDKey returns the key identifying a CRD with its storage version, which is "<name>/<storage-version>"
+func CRDKey(crd *apiextensionsv1.CustomResourceDefinition) (string, error) {
+	storageVersion, err := apiextensionshelpers.GetCRDStorageVersion(crd)
+	if err != nil {
+		return "", err
+	}
+	return crd.Name + "/" + storageVersion, nil
+}
+
+// UniqueCRDs returns crds keyed by CRDKey, where the first one wins among those of the same key
+func UniqueCRDs(crds []*apiextensionsv1.CustomResourceDefinition) map[string]*apiextensionsv1.CustomResourceDefinition {
+	unique := map[string]*apiextensionsv1.CustomResourceDefinition{}
+	for _, crd := range crds {
+		key, err := CRDKey(crd)
+		if err != nil {
+			klog.Warningf("skip CRD %s: %v", crd.Name, err)
+			continue
+		}
+		if _, ok := unique[key]; !ok {
+			unique[key] = crd
+		}
+	}
+	return unique
+}
+
+// SortedCRDs returns the CRDs in crds ordered by key
+func SortedCRDs(crds map[string]*apiextensionsv1.CustomResourceDefinition) []*apiextensionsv1.CustomResourceDefinition {
+	var keys []string
+	for key := range crds {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sorted []*apiextensionsv1.CustomResourceDefinition
+	for _, key := range keys {
+		sorted = append(sorted, crds[key])
+	}
+	return sorted
+}
+
+// NotifyCRDChanges notifies handlers of the changes from previous to current CRDs, both keyed by CRDKey
+func NotifyCRDChanges(previous, current map[string]*apiextensionsv1.CustomResourceDefinition, handlers []cache.ResourceEventHandler) {
+	for _, crd := range SortedCRDs(previous) {
+		key, _ := CRDKey(crd)
+		if _, ok := current[key]; ok {
+			continue
+		}
+		for _, handler := range handlers {
+			handler.OnDelete(crd)
+		}
+	}
+	for _, crd := range SortedCRDs(current) {
+		key, _ := CRDKey(crd)
+		old, ok := previous[key]
+		switch {
+		case !ok:
+			for _, handler := range handlers {
+				handler.OnAdd(crd)
+			}
+		case !reflect.DeepEqual(old.Spec, crd.Spec):
+			for _, handler := range handlers {
+				handler.OnUpdate(old, crd)
+			}
+		}
+	}
+}
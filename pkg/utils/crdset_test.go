@@ -0,0 +1,68 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestCRD(version string, scope apiextensionsv1.ResourceScope) *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "gateways.networking.istio.io"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "networking.istio.io",
+			Names: apiextensionsv1.CustomResourceDefinitionNames{Plural: "gateways", Kind: "Gateway"},
+			Scope: scope,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{Name: version, Served: true, Storage: true},
+			},
+		},
+	}
+}
+
+func TestTenantCRDSetConflicts(t *testing.T) {
+	s := NewTenantCRDSet()
+	s.Set(map[string][]*apiextensionsv1.CustomResourceDefinition{
+		"cls-foo/ns-bar": {newTestCRD("v1beta1", apiextensionsv1.NamespaceScoped)},
+		"cls-foo/ns-baz": {newTestCRD("v1beta1", apiextensionsv1.ClusterScoped)},
+		// another version is served by another storage
+		"cls-foo/ns-qux": {newTestCRD("v1alpha3", apiextensionsv1.ClusterScoped)},
+	})
+
+	if crds := s.ForTenant("cls-foo", "ns-bar"); len(crds) != 1 || crds[0].Spec.Scope != apiextensionsv1.NamespaceScoped {
+		t.Errorf("expect the CRD of the first tenant kept, got %v", crds)
+	}
+	if crds := s.ForTenant("cls-foo", "ns-baz"); len(crds) != 0 {
+		t.Errorf("expect the CRD of another scope left out, got %v", crds)
+	}
+	if crds := s.ForTenant("cls-foo", "ns-qux"); len(crds) != 1 {
+		t.Errorf("expect the CRD serving another version kept, got %v", crds)
+	}
+	crds := s.List()
+	if len(crds) != 2 {
+		t.Fatalf("expect a CRD served per storage version, got %d", len(crds))
+	}
+	for _, crd := range crds {
+		if crd.Spec.Versions[0].Name == "v1beta1" && crd.Spec.Scope != apiextensionsv1.NamespaceScoped {
+			t.Errorf("expect v1beta1 served as %s, got %s", apiextensionsv1.NamespaceScoped, crd.Spec.Scope)
+		}
+	}
+}
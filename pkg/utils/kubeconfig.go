@@ -66,6 +66,18 @@ func CreateKubeConfigWithToken(serverURL, token string, caCert []byte) *clientcm
 	return config
 }
 
+// CreateKubeConfigWithClientCert creates a KubeConfig object with access to the API server with a client certificate
+func CreateKubeConfigWithClientCert(serverURL string, clientCert, clientKey []byte, caCert []byte) *clientcmdapi.Config {
+	userName := "external-crd"
+	clusterName := "external-crd-cluster"
+	config := createBasicKubeConfig(serverURL, clusterName, userName, caCert)
+	config.AuthInfos[userName] = &clientcmdapi.AuthInfo{
+		ClientCertificateData: clientCert,
+		ClientKeyData:         clientKey,
+	}
+	return config
+}
+
 // LoadsKubeConfig tries to load kubeconfig from specified kubeconfig file or in-cluster config
 func LoadsKubeConfig(clientConnectionCfg *componentbaseconfig.ClientConnectionConfiguration) (*rest.Config, error) {
 	if clientConnectionCfg == nil {
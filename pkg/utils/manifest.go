@@ -0,0 +1,88 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// shortenedHashLength is the number of the hex digits of the hash that shortened names end with
+const shortenedHashLength = 10
+
+// GetManifestName returns the name of the Manifest storing an object of a tenant. It is
+// "<resource>.<cluster>.<namespace>.<name>" as long as that fits in a name, otherwise the readable beginning of it
+// followed by a hash of the whole, as long names of tenants would exceed the limit of the host cluster. The resource
+// is followed by its group for non-core groups, such as "gateways.networking.istio.io".
+// Names that fit are never changed, so existing Manifests are kept where they are.
+func GetManifestName(resource, clusterID, namespace, name string) string {
+	// resource is a word ("[a-z]([-a-z0-9]*[a-z0-9])?") without ".", or one followed by the group
+	// namespace is a word ("[a-z]([-a-z0-9]*[a-z0-9])?") without "."
+	// so we use "." for concatenation
+	return shortenWithHash(fmt.Sprintf("%s.%s.%s.%s", resource, clusterID, namespace, name),
+		validation.DNS1123SubdomainMaxLength)
+}
+
+// GetManifestNameLabelValue returns the value of ConfigNameLabel for an object named name, which is shortened like
+// the names of Manifests if it is longer than label values are allowed to be. The full name is kept in
+// ConfigNameAnnotation.
+func GetManifestNameLabelValue(name string) string {
+	return shortenWithHash(name, validation.LabelValueMaxLength)
+}
+
+// SetManifestLabels labels a Manifest with the group, version and kind of the object it stores, along with the tenant
+// clusterID, the namespace and the name of the object, and annotates it with the full name, which the label may have
+// shortened. Other labels and annotations are kept.
+func SetManifestLabels(manifest metav1.Object, gvk schema.GroupVersionKind, clusterID, namespace, name string) {
+	labels := manifest.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[ConfigGroupLabel] = gvk.Group
+	labels[ConfigVersionLabel] = gvk.Version
+	labels[ConfigKindLabel] = gvk.Kind
+	labels[ConfigNameLabel] = GetManifestNameLabelValue(name)
+	labels[ConfigClusterLabel] = clusterID
+	labels[ConfigNamespaceLabel] = namespace
+	manifest.SetLabels(labels)
+
+	annotations := manifest.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ConfigNameAnnotation] = name
+	manifest.SetAnnotations(annotations)
+}
+
+// shortenWithHash returns s if it is no longer than maxLength, otherwise the beginning of s and a hash of the whole
+// in maxLength characters
+func shortenWithHash(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	sum := sha256.Sum256([]byte(s))
+	// both names and label values have to end with an alphanumeric character before "-" is appended
+	prefix := strings.TrimRight(s[:maxLength-shortenedHashLength-1], "-_.")
+	return prefix + "-" + hex.EncodeToString(sum[:])[:shortenedHashLength]
+}
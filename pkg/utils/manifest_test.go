@@ -0,0 +1,87 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestGetManifestName(t *testing.T) {
+	if got := GetManifestName("foos", "cls-foo", "ns-foo", "abc.def-bar"); got != "foos.cls-foo.ns-foo.abc.def-bar" {
+		t.Errorf("expect names that fit kept as they were, got %q", got)
+	}
+
+	long := strings.Repeat("a", 200)
+	names := map[string]bool{}
+	for _, name := range []string{long + "-1", long + "-2", long + ".b"} {
+		manifestName := GetManifestName("virtualservices", strings.Repeat("c", 50), "ns-foo", name)
+		if errs := validation.IsDNS1123Subdomain(manifestName); len(errs) > 0 {
+			t.Errorf("expect a valid name for %q, got %q: %v", name, manifestName, errs)
+		}
+		if !strings.HasPrefix(manifestName, "virtualservices."+strings.Repeat("c", 50)+".ns-foo.aaa") {
+			t.Errorf("expect the readable beginning kept, got %q", manifestName)
+		}
+		if again := GetManifestName("virtualservices", strings.Repeat("c", 50), "ns-foo", name); again != manifestName {
+			t.Errorf("expect a stable name, got %q and %q", manifestName, again)
+		}
+		names[manifestName] = true
+	}
+	if len(names) != 3 {
+		t.Errorf("expect different names for objects sharing a long prefix, got %v", names)
+	}
+}
+
+func TestGetManifestNameLabelValue(t *testing.T) {
+	if got := GetManifestNameLabelValue("abc.def-bar"); got != "abc.def-bar" {
+		t.Errorf("expect short names kept as they were, got %q", got)
+	}
+	for _, name := range []string{strings.Repeat("a", 63) + ".b", strings.Repeat("a.", 40)} {
+		value := GetManifestNameLabelValue(name)
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			t.Errorf("expect a valid label value for %q, got %q: %v", name, value, errs)
+		}
+	}
+}
+
+func TestSetManifestLabels(t *testing.T) {
+	manifest := &metav1.ObjectMeta{Labels: map[string]string{"app": "x"}}
+	name := strings.Repeat("a", 70)
+	SetManifestLabels(manifest, schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Foo"}, "cls-foo", "ns-foo", name)
+
+	want := map[string]string{
+		"app":                "x",
+		ConfigGroupLabel:     "example.com",
+		ConfigVersionLabel:   "v1",
+		ConfigKindLabel:      "Foo",
+		ConfigNameLabel:      GetManifestNameLabelValue(name),
+		ConfigClusterLabel:   "cls-foo",
+		ConfigNamespaceLabel: "ns-foo",
+	}
+	if !reflect.DeepEqual(manifest.Labels, want) {
+		t.Errorf("expect labels %v, got %v", want, manifest.Labels)
+	}
+	if manifest.Annotations[ConfigNameAnnotation] != name {
+		t.Errorf("expect the full name annotated, got %q", manifest.Annotations[ConfigNameAnnotation])
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// ReservedNamespaces are where the Manifests of tenants are stored. Manifests are kept in the base namespace, or
+// sharded across "<base>-<shard>" by the hashes of tenants, so that no namespace grows too big to list or watch.
+type ReservedNamespaces struct {
+	// Base is the single reserved namespace, and the prefix of the shards
+	Base string
+	// Shards is the number of the namespaces Manifests are sharded across, 0 to keep them all in Base
+	Shards int
+}
+
+// NewReservedNamespaces returns the reserved namespaces sharding Manifests across shards namespaces
+func NewReservedNamespaces(base string, shards int) ReservedNamespaces {
+	return ReservedNamespaces{Base: base, Shards: shards}
+}
+
+// For returns the namespace keeping the Manifests of tenant namespace in cluster clusterID
+func (r ReservedNamespaces) For(clusterID, namespace string) string {
+	if r.Shards <= 0 {
+		return r.Base
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clusterID + "/" + namespace))
+	return r.shard(int(h.Sum32() % uint32(r.Shards)))
+}
+
+// All returns all the namespaces keeping Manifests
+func (r ReservedNamespaces) All() []string {
+	if r.Shards <= 0 {
+		return []string{r.Base}
+	}
+	namespaces := make([]string, 0, r.Shards)
+	for i := 0; i < r.Shards; i++ {
+		namespaces = append(namespaces, r.shard(i))
+	}
+	return namespaces
+}
+
+// Has tells whether Manifests are kept in namespace
+func (r ReservedNamespaces) Has(namespace string) bool {
+	if r.Shards <= 0 {
+		return namespace == r.Base
+	}
+	if !strings.HasPrefix(namespace, r.Base+"-") {
+		return false
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(namespace, r.Base+"-"))
+	return err == nil && i >= 0 && i < r.Shards && r.shard(i) == namespace
+}
+
+func (r ReservedNamespaces) shard(i int) string {
+	return fmt.Sprintf("%s-%d", r.Base, i)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+)
+
+func TestReservedNamespaces(t *testing.T) {
+	single := NewReservedNamespaces("kcrd-reserved", 0)
+	if got := single.For("cls-foo", "ns-foo"); got != "kcrd-reserved" {
+		t.Errorf("expect Manifests kept in the base namespace without shards, got %q", got)
+	}
+	if !single.Has("kcrd-reserved") || single.Has("kcrd-reserved-0") {
+		t.Errorf("expect only the base namespace reserved without shards")
+	}
+
+	sharded := NewReservedNamespaces("kcrd-reserved", 4)
+	all := sharded.All()
+	if len(all) != 4 || all[0] != "kcrd-reserved-0" || all[3] != "kcrd-reserved-3" {
+		t.Errorf("expect 4 shards, got %v", all)
+	}
+	for _, namespace := range []string{"kcrd-reserved", "kcrd-reserved-4", "kcrd-reserved-01", "kcrd-reserved--1", "kcrd-reserved-x"} {
+		if sharded.Has(namespace) {
+			t.Errorf("expect %q not reserved", namespace)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, tenant := range [][2]string{{"cls-foo", "ns-foo"}, {"cls-foo", "ns-bar"}, {"cls-bar", "ns-foo"}, {"cls-bar", "ns-bar"}, {"cls-baz", "ns-baz"}} {
+		shard := sharded.For(tenant[0], tenant[1])
+		if !sharded.Has(shard) {
+			t.Errorf("expect tenant %v kept in a shard, got %q", tenant, shard)
+		}
+		if again := sharded.For(tenant[0], tenant[1]); again != shard {
+			t.Errorf("expect tenant %v always kept in %q, got %q", tenant, shard, again)
+		}
+		seen[shard] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("expect tenants spread across shards, got %v", seen)
+	}
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TenantKey returns the key of a tenant, which is "<cluster-id>/<namespace>"
+func TenantKey(clusterID, namespace string) string {
+	return fmt.Sprintf("%s/%s", clusterID, namespace)
+}
+
+// ParseTenantKey splits a tenant key "<cluster-id>/<namespace>" into cluster id and namespace
+func ParseTenantKey(key string) (string, string, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
@@ -21,75 +21,87 @@ import (
 	"context"
 	"sync"
 
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog/v2"
 )
 
 const (
+	// DefaultWatchSize is the size of the result channels of watches
 	DefaultWatchSize = 5
+	// DefaultWatchBufferSize is how many events a watcher may fall behind before it gets terminated
+	DefaultWatchBufferSize = 100
 )
 
-type FixupFunc func(runtime.Object) runtime.Object
+// FixupFunc corrects an event before it is sent to the serializer, such as converting the object it carries
+type FixupFunc func(watch.Event) watch.Event
 
+// WatchWrapper relays the events of an upstream watch, corrected by fixup. Events are buffered for slow watchers,
+// which are terminated instead of stalling the upstream once they fall behind by more than the buffer.
 type WatchWrapper struct {
 	// watch and report changes
 	watcher watch.Interface
-	// used to correct the object before we send it to the serializer
+	// used to correct the event before we send it to the serializer
 	fixup FixupFunc
 
 	ctx context.Context
 
 	result chan watch.Event
-	sync.Mutex
+	done   chan struct{}
+	once   sync.Once
 }
 
+// Stop stops relaying events, without waiting for the upstream to end
 func (w *WatchWrapper) Stop() {
-	w.Lock()
-	defer w.Unlock()
-
-	w.watcher.Stop()
+	w.once.Do(func() {
+		close(w.done)
+		// the upstream may block stopping until its stream ends
+		go w.watcher.Stop()
+	})
 }
 
 func (w *WatchWrapper) ResultChan() <-chan watch.Event {
 	return w.result
 }
 
+// Run relays events until the upstream ends, the watcher stops or falls behind, or ctx is done
 func (w *WatchWrapper) Run() {
-	w.Lock()
-	defer w.Unlock()
+	defer close(w.result)
+	defer w.Stop()
 
 	ch := w.watcher.ResultChan()
-	done := w.ctx.Done()
-
 	for {
 		select {
-		case <-done:
+		case <-w.ctx.Done():
+			return
+		case <-w.done:
 			return
 		case event, ok := <-ch:
 			if !ok {
 				// End of results.
 				return
 			}
-
-			if w.fixup == nil {
-				w.result <- event
-			} else {
-				obj := w.fixup(event.Object)
-				w.result <- watch.Event{
-					Type:   event.Type,
-					Object: obj,
-				}
+			if w.fixup != nil {
+				event = w.fixup(event)
+			}
+			select {
+			case w.result <- event:
+			default:
+				// the watcher resumes from the last event it gets once the result channel is closed
+				klog.V(2).Infof("terminating a watcher which falls behind by %d events", cap(w.result))
+				return
 			}
 		}
 	}
 }
 
+// NewWatchWrapper returns a WatchWrapper buffering size events for the watcher
 func NewWatchWrapper(ctx context.Context, watcher watch.Interface, fixup FixupFunc, size int) *WatchWrapper {
 	return &WatchWrapper{
 		ctx:     ctx,
 		watcher: watcher,
 		fixup:   fixup,
 		result:  make(chan watch.Event, size),
+		done:    make(chan struct{}),
 	}
 }
 
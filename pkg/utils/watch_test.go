@@ -0,0 +1,99 @@
+/*
+Copyright 2022 Jijie Chen.
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// blockingWatch blocks stopping until unblocked
+type blockingWatch struct {
+	*watch.FakeWatcher
+	unblock chan struct{}
+}
+
+func (b *blockingWatch) Stop() {
+	<-b.unblock
+	b.FakeWatcher.Stop()
+}
+
+func expectClosed(t *testing.T, ch <-chan watch.Event) int {
+	t.Helper()
+	var events int
+	timeout := time.After(wait.ForeverTestTimeout)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return events
+			}
+			events++
+		case <-timeout:
+			t.Fatal("expect the result channel to be closed")
+		}
+	}
+}
+
+func TestWatchWrapperStop(t *testing.T) {
+	upstream := &blockingWatch{FakeWatcher: watch.NewFake(), unblock: make(chan struct{})}
+	defer close(upstream.unblock)
+	w := NewWatchWrapper(context.TODO(), upstream, func(event watch.Event) watch.Event {
+		event.Object.(*metav1.PartialObjectMetadata).SetResourceVersion("2")
+		return event
+	}, DefaultWatchBufferSize)
+	go w.Run()
+
+	upstream.Add(&metav1.PartialObjectMetadata{})
+	event := <-w.ResultChan()
+	if accessor, _ := meta.Accessor(event.Object); accessor.GetResourceVersion() != "2" {
+		t.Errorf("expect events to be fixed up")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("expect Stop not to wait for the upstream")
+	}
+	expectClosed(t, w.ResultChan())
+}
+
+func TestWatchWrapperSlowWatcher(t *testing.T) {
+	upstream := watch.NewFake()
+	w := NewWatchWrapper(context.TODO(), upstream, nil, 2)
+	go w.Run()
+
+	// nothing is read until the buffer overflows
+	for i := 0; i < 3; i++ {
+		upstream.Add(&metav1.PartialObjectMetadata{})
+	}
+	if events := expectClosed(t, w.ResultChan()); events != 2 {
+		t.Errorf("expect the buffered events before the watcher is terminated, got %d", events)
+	}
+}